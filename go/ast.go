@@ -0,0 +1,169 @@
+package nunchucks
+
+// node is a parsed template element. Nodes are rendered in source order.
+type node interface {
+	position() nodePos
+}
+
+// nodePos is the 1-based line and column a node starts at.
+type nodePos struct {
+	line int
+	col  int
+}
+
+func (p nodePos) position() nodePos { return p }
+
+type textNode struct {
+	nodePos
+	text string
+}
+
+type outputNode struct {
+	nodePos
+	expr *compiledExpr
+}
+
+type ifBranch struct {
+	cond *compiledExpr
+	body []node
+}
+
+type ifNode struct {
+	nodePos
+	branches []ifBranch
+	elseBody []node
+}
+
+// forNode is a for loop. cond, when set, filters the items before the loop
+// starts; elseBody renders when no item is left.
+type forNode struct {
+	nodePos
+	targets   []string
+	iter      *compiledExpr
+	cond      *compiledExpr
+	recursive bool
+	body      []node
+	elseBody  []node
+}
+
+// loopControlNode is {% break %} or {% continue %}.
+type loopControlNode struct {
+	nodePos
+	brk bool
+}
+
+type setAssign struct {
+	name string
+	expr *compiledExpr
+}
+
+// setNode assigns expr to targets, unpacking it when there are several.
+// A block set instead assigns its rendered body, passed through filters.
+// Targets are names or ns.attr attributes of a namespace.
+type setNode struct {
+	nodePos
+	targets []string
+	expr    *compiledExpr
+	block   bool
+	body    []node
+	filters []filterCall
+}
+
+// withNode renders body in a scope of its own, starting with assigns.
+type withNode struct {
+	nodePos
+	assigns []setAssign
+	body    []node
+}
+
+type blockNode struct {
+	nodePos
+	name string
+	body []node
+	// required blocks must be overridden by a template extending this one.
+	required bool
+}
+
+// The targets of extends, include and import are expressions naming a
+// template, or a list of names to try in order.
+type extendsNode struct {
+	nodePos
+	target *compiledExpr
+}
+
+type includeNode struct {
+	nodePos
+	target        *compiledExpr
+	ignoreMissing bool
+	withContext   bool
+}
+
+type importNode struct {
+	nodePos
+	target      *compiledExpr
+	alias       string
+	withContext bool
+}
+
+type fromImportNode struct {
+	nodePos
+	target      *compiledExpr
+	names       [][2]string
+	withContext bool
+}
+
+type macroNode struct {
+	nodePos
+	def MacroDef
+}
+
+type callNode struct {
+	nodePos
+	call *callExpr
+	// params are the parameters of caller, as in {% call(item) list(items) %}.
+	params []MacroParam
+	body   []node
+}
+
+type filterBlockNode struct {
+	nodePos
+	filters []filterCall
+	body    []node
+}
+
+type autoescapeNode struct {
+	nodePos
+	enabled bool
+	body    []node
+}
+
+type rawNode struct {
+	nodePos
+	text string
+}
+
+// extensionNode is a tag handled by an Extension.
+type extensionNode struct {
+	nodePos
+	tag     string
+	args    []exprNode
+	kwargs  []kwargExpr
+	body    []node
+	hasBody bool
+	// ext is the extension that parsed the tag, which also renders it.
+	ext Extension
+}
+
+type clientEventNode struct {
+	nodePos
+	event string
+	expr  string
+}
+
+// parsedTemplate is the node tree for one template source.
+type parsedTemplate struct {
+	name   string
+	raw    string
+	root   []node
+	blocks map[string]*blockNode
+}
@@ -15,6 +15,12 @@ type renderMapRequest struct {
 	Context  map[string]any    `json:"context"`
 }
 
+type renderCompiledRequest struct {
+	Template string            `json:"template"`
+	Programs []json.RawMessage `json:"programs"`
+	Context  map[string]any    `json:"context"`
+}
+
 type renderStringRequest struct {
 	Source  string         `json:"source"`
 	Context map[string]any `json:"context"`
@@ -56,6 +62,33 @@ func renderFromMap(_ js.Value, args []js.Value) any {
 	return toResponse(wasmResponse{OK: true, Output: out})
 }
 
+func renderCompiled(_ js.Value, args []js.Value) any {
+	if len(args) < 1 {
+		return toResponse(wasmResponse{OK: false, Error: "missing request json"})
+	}
+
+	var req renderCompiledRequest
+	if err := json.Unmarshal([]byte(args[0].String()), &req); err != nil {
+		return toResponse(wasmResponse{OK: false, Error: err.Error()})
+	}
+	if req.Context == nil {
+		req.Context = map[string]any{}
+	}
+
+	env := nunchucks.Configure(nunchucks.ConfigOptions{Loader: nunchucks.MemoryLoader(nil)})
+	for _, prog := range req.Programs {
+		if _, err := env.LoadIR(prog); err != nil {
+			return toResponse(wasmResponse{OK: false, Error: err.Error()})
+		}
+	}
+	out, err := env.Render(req.Template, req.Context)
+	if err != nil {
+		return toResponse(wasmResponse{OK: false, Error: err.Error()})
+	}
+
+	return toResponse(wasmResponse{OK: true, Output: out})
+}
+
 func renderString(_ js.Value, args []js.Value) any {
 	if len(args) < 1 {
 		return toResponse(wasmResponse{OK: false, Error: "missing request json"})
@@ -81,6 +114,7 @@ func renderString(_ js.Value, args []js.Value) any {
 func main() {
 	api := js.Global().Get("Object").New()
 	api.Set("renderFromMap", js.FuncOf(renderFromMap))
+	api.Set("renderCompiled", js.FuncOf(renderCompiled))
 	api.Set("renderString", js.FuncOf(renderString))
 	js.Global().Set("NunchucksWasm", api)
 
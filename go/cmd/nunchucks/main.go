@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -67,13 +68,17 @@ func printRenderUsage() {
 	fmt.Fprintln(os.Stderr, "Options:")
 	fmt.Fprintln(os.Stderr, "  -views string        templates directory (default \"views\")")
 	fmt.Fprintln(os.Stderr, "  -template string     template path relative to views (required)")
+	fmt.Fprintln(os.Stderr, "  -block string        render only this block of the template")
 	fmt.Fprintln(os.Stderr, "  -data string         JSON context object (default \"{}\")")
 	fmt.Fprintln(os.Stderr, "  -global value        global template, repeatable")
 	fmt.Fprintln(os.Stderr, "  -global-head value   global head template, repeatable")
 	fmt.Fprintln(os.Stderr, "  -global-foot value   global foot template, repeatable")
+	fmt.Fprintln(os.Stderr, "  -undefined string    undefined values: lenient, strict or debug (default \"lenient\")")
+	fmt.Fprintln(os.Stderr, "  -trace               log each executed VM instruction to stderr")
 	fmt.Fprintln(os.Stderr)
 	fmt.Fprintln(os.Stderr, "Example:")
 	fmt.Fprintf(os.Stderr, "  %s render -views ./views -template index.njk -data '{\"user\":{\"name\":\"sam\"}}'\n", name)
+	fmt.Fprintf(os.Stderr, "  %s render -views ./views -template search.njk -block results -data '{\"q\":\"go\"}'\n", name)
 }
 
 func printPrecompileUsage() {
@@ -85,16 +90,19 @@ func printPrecompileUsage() {
 	fmt.Fprintln(os.Stderr, "  -views string        templates directory (default \"views\")")
 	fmt.Fprintln(os.Stderr, "  -out string          output directory (default \"public\")")
 	fmt.Fprintln(os.Stderr, "  -out-format string   output naming: preserve or html (default \"preserve\")")
+	fmt.Fprintln(os.Stderr, "  -ir                  write compiled templates (<name>.ir.json) instead of rendered output")
 	fmt.Fprintln(os.Stderr, "  -watch               rerender when template files change")
 	fmt.Fprintln(os.Stderr, "  -interval duration   polling interval for watch mode (default 1s)")
 	fmt.Fprintln(os.Stderr, "  -data string         JSON context object (default \"{}\")")
 	fmt.Fprintln(os.Stderr, "  -global value        global template, repeatable")
 	fmt.Fprintln(os.Stderr, "  -global-head value   global head template, repeatable")
 	fmt.Fprintln(os.Stderr, "  -global-foot value   global foot template, repeatable")
+	fmt.Fprintln(os.Stderr, "  -undefined string    undefined values: lenient, strict or debug (default \"lenient\")")
 	fmt.Fprintln(os.Stderr)
 	fmt.Fprintln(os.Stderr, "Example:")
 	fmt.Fprintf(os.Stderr, "  %s precompile -views ./views -out ./public -data '{\"title\":\"Hello\"}'\n", name)
 	fmt.Fprintf(os.Stderr, "  %s precompile -views ./views -out ./public -out-format html\n", name)
+	fmt.Fprintf(os.Stderr, "  %s precompile -views ./views -out ./compiled -ir\n", name)
 	fmt.Fprintf(os.Stderr, "  %s precompile -views ./views -out ./public --watch -interval 750ms\n", name)
 }
 
@@ -140,8 +148,15 @@ func errorText(msg string) string {
 	return ansiRed + msg + ansiReset
 }
 
+// printError prints err, and for a template error the snippet and stack
+// that TemplateError.Detail adds to its message.
 func printError(err error) {
-	fmt.Fprintln(os.Stderr, errorText("error: "+err.Error()))
+	detail := ""
+	var te *nunchucks.TemplateError
+	if errors.As(err, &te) {
+		detail = strings.TrimPrefix(te.Detail(), te.Error())
+	}
+	fmt.Fprintln(os.Stderr, errorText("error: "+err.Error())+detail)
 }
 
 func parseData(raw string) (map[string]any, error) {
@@ -155,6 +170,14 @@ func parseData(raw string) (map[string]any, error) {
 	return out, nil
 }
 
+func parseUndefined(raw string) (nunchucks.UndefinedMode, error) {
+	switch mode := nunchucks.UndefinedMode(raw); mode {
+	case nunchucks.UndefinedLenient, nunchucks.UndefinedStrict, nunchucks.UndefinedDebug:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid -undefined %q: want lenient, strict or debug", raw)
+}
+
 type fileState struct {
 	modTime time.Time
 	size    int64
@@ -228,6 +251,9 @@ func removeDeletedOutputs(outDir string, previous, current map[string]fileState,
 }
 
 func nunchucksOutputPath(rel string, opts nunchucks.PrecompileOptions) string {
+	if opts.IR {
+		return rel + ".ir.json"
+	}
 	if strings.EqualFold(strings.TrimSpace(opts.OutputFormat), "html") && strings.EqualFold(filepath.Ext(rel), ".njk") {
 		return strings.TrimSuffix(rel, filepath.Ext(rel)) + ".html"
 	}
@@ -301,6 +327,7 @@ func runRender(args []string) error {
 
 	views := fs.String("views", "views", "templates directory")
 	template := fs.String("template", "", "template path relative to views")
+	block := fs.String("block", "", "render only this block of the template")
 	data := fs.String("data", "{}", "JSON context object")
 	var globalTemplates stringListFlag
 	var globalHeadTemplates stringListFlag
@@ -308,28 +335,42 @@ func runRender(args []string) error {
 	fs.Var(&globalTemplates, "global", "global template (repeatable)")
 	fs.Var(&globalHeadTemplates, "global-head", "global head template (repeatable)")
 	fs.Var(&globalFootTemplates, "global-foot", "global foot template (repeatable)")
+	undefined := fs.String("undefined", "lenient", "undefined values: lenient, strict or debug")
+	trace := fs.Bool("trace", false, "log each executed VM instruction to stderr")
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
 	if *template == "" {
 		return fmt.Errorf("-template is required")
 	}
+	mode, err := parseUndefined(*undefined)
+	if err != nil {
+		return err
+	}
 	ctx, err := parseData(*data)
 	if err != nil {
 		return fmt.Errorf("invalid -data JSON: %w", err)
 	}
-	env := nunchucks.Configure(nunchucks.ConfigOptions{
+	opts := nunchucks.ConfigOptions{
 		Path:                *views,
 		GlobalTemplates:     []string(globalTemplates),
 		GlobalHeadTemplates: []string(globalHeadTemplates),
 		GlobalFootTemplates: []string(globalFootTemplates),
-	})
-	out, err := env.Render(*template, ctx)
-	if err != nil {
+		Undefined:           mode,
+	}
+	if *trace {
+		opts.Trace = os.Stderr
+	}
+	env := nunchucks.Configure(opts)
+	if *block != "" {
+		out, err := env.RenderBlock(*template, *block, ctx)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprint(os.Stdout, out)
 		return err
 	}
-	_, err = fmt.Fprint(os.Stdout, out)
-	return err
+	return env.RenderTo(os.Stdout, *template, ctx)
 }
 
 func runPrecompile(args []string) error {
@@ -342,6 +383,7 @@ func runPrecompile(args []string) error {
 	outFormat := fs.String("out-format", "preserve", "output naming: preserve or html")
 	watch := fs.Bool("watch", false, "rerender when template files change")
 	interval := fs.Duration("interval", time.Second, "polling interval for watch mode")
+	emitIR := fs.Bool("ir", false, "write compiled templates instead of rendered output")
 	data := fs.String("data", "{}", "JSON context object")
 	var globalTemplates stringListFlag
 	var globalHeadTemplates stringListFlag
@@ -349,6 +391,7 @@ func runPrecompile(args []string) error {
 	fs.Var(&globalTemplates, "global", "global template (repeatable)")
 	fs.Var(&globalHeadTemplates, "global-head", "global head template (repeatable)")
 	fs.Var(&globalFootTemplates, "global-foot", "global foot template (repeatable)")
+	undefined := fs.String("undefined", "lenient", "undefined values: lenient, strict or debug")
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
@@ -356,14 +399,20 @@ func runPrecompile(args []string) error {
 	if err != nil {
 		return fmt.Errorf("invalid -data JSON: %w", err)
 	}
+	mode, err := parseUndefined(*undefined)
+	if err != nil {
+		return err
+	}
 	env := nunchucks.Configure(nunchucks.ConfigOptions{
 		Path:                *views,
 		GlobalTemplates:     []string(globalTemplates),
 		GlobalHeadTemplates: []string(globalHeadTemplates),
 		GlobalFootTemplates: []string(globalFootTemplates),
+		Undefined:           mode,
 	})
 	precompileOpts := nunchucks.PrecompileOptions{
 		OutputFormat: *outFormat,
+		IR:           *emitIR,
 	}
 	if *watch {
 		return watchPrecompile(env, *views, *outDir, ctx, *interval, precompileOpts)
@@ -52,7 +52,7 @@ func TestPrintHelpRender(t *testing.T) {
 	if !strings.Contains(output, "render [options]") {
 		t.Fatalf("expected render command usage, got %q", output)
 	}
-	if !strings.Contains(output, "-template string") {
+	if !strings.Contains(output, "-template string") || !strings.Contains(output, "-block string") {
 		t.Fatalf("expected render flags, got %q", output)
 	}
 }
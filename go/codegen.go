@@ -0,0 +1,419 @@
+package nunchucks
+
+import (
+	"fmt"
+	"strings"
+)
+
+// codegen lowers a parsed template into a program.
+type codegen struct {
+	prog       *program
+	autoescape bool
+	// contextual selects escaping by HTML context; html tracks that
+	// context through the literal text in source order.
+	contextual bool
+	html       htmlContext
+	// loops holds the for loops enclosing the code being generated.
+	loops []*loopLabels
+}
+
+// loopLabels tracks the jumps of a for loop while its body is generated.
+type loopLabels struct {
+	// top is the pc of the loop's NEXT, where continue jumps.
+	top int
+	// breaks are the jumps to patch to the loop's exit.
+	breaks []int
+	// frames counts the scopes entered inside the body, which break and
+	// continue leave along with the iteration's own.
+	frames int
+}
+
+// compileProgram compiles a parsed template and its contract into IR.
+// With autoescape, {{ }} output is HTML-escaped unless it is a SafeString;
+// contextual additionally picks the encoder from where the output sits.
+func compileProgram(tpl *parsedTemplate, autoescape, contextual bool) (*program, error) {
+	contract, err := ParseTemplateContract(tpl.raw)
+	if err != nil {
+		return nil, err
+	}
+	g := &codegen{prog: &program{
+		Version:    irVersion,
+		Name:       tpl.name,
+		Blocks:     map[string]int{},
+		Contract:   contract,
+		Newline:    strings.HasSuffix(tpl.raw, "\n"),
+		Autoescape: autoescape,
+		source:     tpl.raw,
+	}, autoescape: autoescape, contextual: contextual}
+	g.newUnit("", nil)
+	if err := g.nodes(0, tpl.root); err != nil {
+		return nil, err
+	}
+	return g.prog, nil
+}
+
+func (g *codegen) newUnit(name string, params []MacroParam) int {
+	g.prog.Units = append(g.prog.Units, unit{Name: name, Params: params, Code: []instr{}})
+	return len(g.prog.Units) - 1
+}
+
+func (g *codegen) emit(u int, at nodePos, in instr) int {
+	in.Line, in.Col = at.line, at.col
+	code := &g.prog.Units[u].Code
+	*code = append(*code, in)
+	return len(*code) - 1
+}
+
+func (g *codegen) pc(u int) int {
+	return len(g.prog.Units[u].Code)
+}
+
+// patch points the jump at index at to the next instruction.
+func (g *codegen) patch(u, at int) {
+	g.prog.Units[u].Code[at].A = g.pc(u)
+}
+
+func (g *codegen) expr(c *compiledExpr) int {
+	g.prog.Exprs = append(g.prog.Exprs, c)
+	return len(g.prog.Exprs) - 1
+}
+
+// value emits code that pushes the value of n. Names become LOOKUPs and
+// filter chains are unrolled into FILTER instructions; anything else is
+// evaluated as a single expression.
+func (g *codegen) value(u int, n exprNode, at nodePos) {
+	switch n := n.(type) {
+	case *nameExpr:
+		g.emit(u, at, instr{Op: opLookup, S: n.name})
+	case *filterExpr:
+		g.value(u, n.target, at)
+		g.filter(u, n.filter, at)
+	default:
+		g.emit(u, at, instr{Op: opEval, A: g.expr(&compiledExpr{root: n})})
+	}
+}
+
+// target emits in, an extends, include or import of the template c names.
+// A literal name is kept in the s operand; any other target is pushed for
+// in to pop.
+func (g *codegen) target(u int, c *compiledExpr, at nodePos, in instr) {
+	if lit, ok := c.root.(*literalExpr); ok {
+		if name, ok := lit.value.(string); ok && name != "" {
+			in.S = name
+			g.emit(u, at, in)
+			return
+		}
+	}
+	g.compiled(u, c, at)
+	g.emit(u, at, in)
+}
+
+// filter emits code that applies fc to the value on top of the stack.
+func (g *codegen) filter(u int, fc filterCall, at nodePos) {
+	for _, a := range fc.args {
+		g.value(u, a, at)
+	}
+	var names []string
+	for _, kw := range fc.kwargs {
+		g.value(u, kw.value, at)
+		names = append(names, kw.name)
+	}
+	g.emit(u, at, instr{Op: opFilter, S: fc.name, A: len(fc.args), Names: names})
+}
+
+// compiled pushes the value of a compiled expression. Sources that failed
+// to parse keep their literal/identifier fallback.
+func (g *codegen) compiled(u int, c *compiledExpr, at nodePos) {
+	if c.err != nil {
+		g.emit(u, at, instr{Op: opEval, A: g.expr(c)})
+		return
+	}
+	if _, ok := c.root.(*nameExpr); ok {
+		g.value(u, c.root, at)
+		return
+	}
+	if _, ok := c.root.(*filterExpr); ok {
+		g.value(u, c.root, at)
+		return
+	}
+	g.emit(u, at, instr{Op: opEval, A: g.expr(c)})
+}
+
+func (g *codegen) nodes(u int, nodes []node) error {
+	for _, n := range nodes {
+		if err := g.node(u, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *codegen) node(u int, n node) error {
+	at := n.position()
+	switch n := n.(type) {
+	case *textNode:
+		g.text(u, n.text, at)
+	case *rawNode:
+		g.text(u, n.text, at)
+	case *outputNode:
+		g.compiled(u, n.expr, at)
+		g.emit(u, at, instr{Op: opEmit, A: g.escapeMode()})
+	case *autoescapeNode:
+		prev := g.autoescape
+		g.autoescape = n.enabled
+		err := g.nodes(u, n.body)
+		g.autoescape = prev
+		return err
+	case *setNode:
+		if n.block {
+			// The captured body is output somewhere else, so its markup
+			// context is unknown.
+			outer := g.html
+			g.html = htmlContext{}
+			g.emit(u, at, instr{Op: opCapture})
+			if err := g.nodes(u, n.body); err != nil {
+				return err
+			}
+			g.emit(u, at, instr{Op: opEndCapture, A: 1})
+			g.html = outer
+			for _, fc := range n.filters {
+				g.filter(u, fc, at)
+			}
+		} else {
+			g.compiled(u, n.expr, at)
+		}
+		set := instr{Op: opSet, S: n.targets[0]}
+		if len(n.targets) > 1 {
+			set = instr{Op: opSet, Names: n.targets}
+		}
+		g.emit(u, at, set)
+	case *withNode:
+		g.emit(u, at, instr{Op: opPushFrame})
+		var loop *loopLabels
+		if len(g.loops) > 0 {
+			loop = g.loops[len(g.loops)-1]
+			loop.frames++
+		}
+		for _, a := range n.assigns {
+			g.compiled(u, a.expr, at)
+			g.emit(u, at, instr{Op: opSet, S: a.name})
+		}
+		err := g.nodes(u, n.body)
+		if loop != nil {
+			loop.frames--
+		}
+		if err != nil {
+			return err
+		}
+		g.emit(u, at, instr{Op: opPopFrame})
+	case *ifNode:
+		ends := []int{}
+		entry := g.html
+		var exit *htmlContext
+		for _, b := range n.branches {
+			g.compiled(u, b.cond, at)
+			skip := g.emit(u, at, instr{Op: opJumpIfFalse})
+			g.html = entry
+			if err := g.nodes(u, b.body); err != nil {
+				return err
+			}
+			if exit == nil {
+				branchExit := g.html
+				exit = &branchExit
+			}
+			ends = append(ends, g.emit(u, at, instr{Op: opJump}))
+			g.patch(u, skip)
+		}
+		g.html = entry
+		if err := g.nodes(u, n.elseBody); err != nil {
+			return err
+		}
+		// Branches are expected to leave the markup in the same state;
+		// the first one decides the context of what follows.
+		if exit != nil {
+			g.html = *exit
+		}
+		for _, at := range ends {
+			g.patch(u, at)
+		}
+	case *forNode:
+		g.compiled(u, n.iter, at)
+		iter := instr{Op: opIter}
+		if n.cond != nil {
+			iter.A, iter.B, iter.Names = g.expr(n.cond), iterFiltered, n.targets
+		}
+		if n.recursive {
+			iter.B |= iterRecursive
+		}
+		g.emit(u, at, iter)
+		top := g.pc(u)
+		step := instr{Op: opNext, S: n.targets[0]}
+		if len(n.targets) > 1 {
+			step = instr{Op: opNext, Names: n.targets}
+		}
+		next := g.emit(u, at, step)
+		loop := &loopLabels{top: top}
+		g.loops = append(g.loops, loop)
+		entry := g.html
+		err := g.nodes(u, n.body)
+		g.loops = g.loops[:len(g.loops)-1]
+		if err != nil {
+			return err
+		}
+		g.emit(u, at, instr{Op: opPopFrame})
+		g.emit(u, at, instr{Op: opJump, A: top})
+		g.patch(u, next)
+		for _, b := range loop.breaks {
+			g.patch(u, b)
+		}
+		end := g.emit(u, at, instr{Op: opIterEnd})
+		if len(n.elseBody) > 0 {
+			exit := g.html
+			g.html = entry
+			if err := g.nodes(u, n.elseBody); err != nil {
+				return err
+			}
+			g.html = exit
+			g.patch(u, end)
+		}
+	case *loopControlNode:
+		loop := g.loops[len(g.loops)-1]
+		for i := 0; i <= loop.frames; i++ {
+			g.emit(u, at, instr{Op: opPopFrame})
+		}
+		if n.brk {
+			loop.breaks = append(loop.breaks, g.emit(u, at, instr{Op: opJump}))
+		} else {
+			g.emit(u, at, instr{Op: opJump, A: loop.top})
+		}
+	case *blockNode:
+		b := g.newUnit(n.name, nil)
+		g.prog.Blocks[n.name] = b
+		g.prog.Units[b].Required = n.required
+		if err := g.nodes(b, n.body); err != nil {
+			return err
+		}
+		g.emit(u, at, instr{Op: opBlockCall, S: n.name})
+	case *extendsNode:
+		g.target(u, n.target, at, instr{Op: opExtends})
+	case *includeNode:
+		flags := 0
+		if n.ignoreMissing {
+			flags |= includeIgnoreMissing
+		}
+		if n.withContext {
+			flags |= includeWithContext
+		}
+		g.target(u, n.target, at, instr{Op: opInclude, A: flags})
+	case *importNode:
+		g.target(u, n.target, at, instr{Op: opImport, A: boolOperand(n.withContext), Names: []string{n.alias}})
+	case *fromImportNode:
+		names := make([]string, 0, len(n.names)*2)
+		for _, pair := range n.names {
+			names = append(names, pair[0], pair[1])
+		}
+		g.target(u, n.target, at, instr{Op: opFromImport, A: boolOperand(n.withContext), Names: names})
+	case *macroNode:
+		m := g.newUnit(n.def.Name, n.def.Params)
+		g.prog.Units[m].CatchVarargs = n.def.CatchVarargs
+		g.prog.Units[m].CatchKwargs = n.def.CatchKwargs
+		outer := g.html
+		g.html = htmlContext{}
+		if err := g.nodes(m, n.def.body); err != nil {
+			return err
+		}
+		g.html = outer
+		g.emit(u, at, instr{Op: opMacro, A: m})
+	case *callNode:
+		g.value(u, n.call.fn, at)
+		for _, a := range n.call.args {
+			g.value(u, a, at)
+		}
+		names := make([]string, 0, len(n.call.kwargs))
+		for _, kw := range n.call.kwargs {
+			g.value(u, kw.value, at)
+			names = append(names, kw.name)
+		}
+		body := g.newUnit("caller", n.params)
+		if err := g.nodes(body, n.body); err != nil {
+			return err
+		}
+		g.emit(u, at, instr{Op: opCall, A: len(n.call.args), B: body, Names: names})
+	case *filterBlockNode:
+		g.emit(u, at, instr{Op: opCapture})
+		g.emit(u, at, instr{Op: opPushFrame})
+		if err := g.nodes(u, n.body); err != nil {
+			return err
+		}
+		g.emit(u, at, instr{Op: opPopFrame})
+		g.emit(u, at, instr{Op: opEndCapture})
+		for _, fc := range n.filters {
+			g.filter(u, fc, at)
+		}
+		g.emit(u, at, instr{Op: opEmit})
+	case *extensionNode:
+		if n.hasBody {
+			// The extension decides where its body is output, so the
+			// markup context inside it is unknown.
+			outer := g.html
+			g.html = htmlContext{}
+			g.emit(u, at, instr{Op: opCapture})
+			g.emit(u, at, instr{Op: opPushFrame})
+			if err := g.nodes(u, n.body); err != nil {
+				return err
+			}
+			g.emit(u, at, instr{Op: opPopFrame})
+			g.emit(u, at, instr{Op: opEndCapture, A: 1})
+			g.html = outer
+		}
+		for _, a := range n.args {
+			g.value(u, a, at)
+		}
+		var names []string
+		for _, kw := range n.kwargs {
+			g.value(u, kw.value, at)
+			names = append(names, kw.name)
+		}
+		body := 0
+		if n.hasBody {
+			body = 1
+		}
+		if g.prog.extensions == nil {
+			g.prog.extensions = map[string]Extension{}
+		}
+		g.prog.extensions[n.tag] = n.ext
+		g.emit(u, at, instr{Op: opTag, S: n.tag, A: len(n.args), B: body, Names: names})
+	case *clientEventNode:
+		g.emit(u, at, instr{Op: opClientEvent, S: n.expr, Names: []string{n.event}})
+		g.html = g.html.advance(`data-nc-on` + n.event + `=""`)
+	default:
+		return fmt.Errorf("unsupported node %T", n)
+	}
+	return nil
+}
+
+// text emits literal template text and advances the HTML context over it.
+func (g *codegen) text(u int, s string, at nodePos) {
+	g.emit(u, at, instr{Op: opText, S: s})
+	g.html = g.html.advance(s)
+}
+
+// escapeMode returns the EMIT operand for the next {{ }} output.
+func (g *codegen) escapeMode() int {
+	if !g.autoescape {
+		return escNone
+	}
+	if !g.contextual {
+		return escHTML
+	}
+	mode := g.html.escapeMode()
+	g.html = g.html.afterOutput()
+	return mode
+}
+
+func boolOperand(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
@@ -9,6 +9,7 @@ import (
 
 var includeRe = regexp.MustCompile(`\{%\s*include\s+(["'][^"']+["'])\s*%\}`)
 var extendsRe = regexp.MustCompile(`\{%\s*extends\s+(["'][^"']+["'])\s*%\}`)
+var superCallRe = regexp.MustCompile(`\{\{-?\s*super\(\s*\)\s*-?\}\}`)
 var compileStmtRe = regexp.MustCompile(`\{%\s*([A-Za-z_][A-Za-z0-9_]*)\b([^%]*)%\}`)
 
 func unquote(s string) string {
@@ -130,70 +131,119 @@ func extractBlocks(src string) map[string]blockSpan {
 	return blocks
 }
 
-func mergeExtends(baseSrc, childSrc string) string {
-	baseBlocks := extractBlocks(baseSrc)
-	childBlocks := extractBlocks(childSrc)
+// blockMerger flattens an extends chain into the source of its root
+// template, the way the chain renders: each block is replaced by its most
+// derived definition, with super() calls inlining the next one.
+type blockMerger struct {
+	// defs holds the definitions of each block, most derived first.
+	defs map[string][]blockDef
+	// spans holds the blocks of each source in the order they open.
+	spans map[string][]blockSpan
+}
 
-	type edit struct {
-		start int
-		end   int
-		val   string
-	}
-	edits := []edit{}
+type blockDef struct {
+	src  string
+	span blockSpan
+}
 
-	for name, bb := range baseBlocks {
-		cb, ok := childBlocks[name]
-		if !ok {
-			continue
+// mergeExtends returns the root of chain, a template followed by the
+// templates it extends, with the blocks of the whole chain resolved.
+func mergeExtends(chain []string) string {
+	m := &blockMerger{defs: map[string][]blockDef{}, spans: map[string][]blockSpan{}}
+	for _, src := range chain {
+		spans := []blockSpan{}
+		for _, span := range extractBlocks(src) {
+			spans = append(spans, span)
+			m.defs[span.name] = append(m.defs[span.name], blockDef{src: src, span: span})
 		}
-
-		baseBody := baseSrc[bb.bodyStart:bb.bodyEnd]
-		childBody := childSrc[cb.bodyStart:cb.bodyEnd]
-		childBody = strings.ReplaceAll(childBody, "{{ super() }}", baseBody)
-		edits = append(edits, edit{start: bb.bodyStart, end: bb.bodyEnd, val: childBody})
+		sort.Slice(spans, func(i, j int) bool { return spans[i].openStart < spans[j].openStart })
+		m.spans[src] = spans
 	}
+	root := chain[len(chain)-1]
+	return m.render(root, 0, len(root), false, nil)
+}
 
-	out := baseSrc
-	sort.Slice(edits, func(i, j int) bool {
-		return edits[i].start > edits[j].start
-	})
-	for _, e := range edits {
-		out = out[:e.start] + e.val + out[e.end:]
+// render writes src[start:end] with the blocks in it resolved. Blocks keep
+// their tags unless inline is set, as it is for text pasted by super(),
+// which has its own block already. super renders the next definition of
+// the block being rendered, if there is one.
+func (m *blockMerger) render(src string, start, end int, inline bool, super func() string) string {
+	var b strings.Builder
+	text := func(s string) {
+		if super != nil {
+			s = superCallRe.ReplaceAllStringFunc(s, func(string) string { return super() })
+		}
+		b.WriteString(s)
 	}
-	return out
+	pos := start
+	for _, span := range m.spans[src] {
+		if span.openStart < pos || span.closeEnd > end {
+			continue
+		}
+		text(src[pos:span.openStart])
+		b.WriteString(m.block(span.name, 0, inline))
+		pos = span.closeEnd
+	}
+	text(src[pos:end])
+	return b.String()
 }
 
-func removeExtendsTag(src string) string {
-	return extendsRe.ReplaceAllString(src, "")
+// block renders the i'th definition of the block name.
+func (m *blockMerger) block(name string, i int, inline bool) string {
+	defs := m.defs[name]
+	d := defs[i]
+	var super func() string
+	if i+1 < len(defs) {
+		super = func() string { return m.block(name, i+1, true) }
+	}
+	body := m.render(d.src, d.span.bodyStart, d.span.bodyEnd, true, super)
+	if inline {
+		return body
+	}
+	return d.src[d.span.openStart:d.span.openEnd] + body + d.src[d.span.bodyEnd:d.span.closeEnd]
 }
 
 func extractExtendsPrelude(src string) string {
-	type frame struct{ kind string }
+	type frame struct {
+		kind  string
+		start int
+	}
 	var out strings.Builder
 	stack := []frame{}
 	tags := compileStmtRe.FindAllStringSubmatchIndex(src, -1)
+	keep := func(raw string) {
+		out.WriteString(raw)
+		if !strings.HasSuffix(raw, "\n") {
+			out.WriteString("\n")
+		}
+	}
 
 	for _, m := range tags {
 		kw := strings.TrimSpace(src[m[2]:m[3]])
 		raw := src[m[0]:m[1]]
 
 		switch kw {
-		case "block", "if", "for", "macro", "call", "filter", "raw", "verbatim", "client":
+		case "block", "if", "for", "macro", "call", "filter", "raw", "verbatim", "client", "with":
 			stack = append(stack, frame{kind: kw})
 			continue
-		case "endblock", "endif", "endfor", "endmacro", "endcall", "endfilter", "endraw", "endverbatim", "endclient":
+		case "endblock", "endif", "endfor", "endmacro", "endcall", "endfilter", "endraw", "endverbatim", "endclient", "endwith", "endset":
 			if len(stack) > 0 {
+				top := stack[len(stack)-1]
 				stack = stack[:len(stack)-1]
+				if kw == "endset" && len(stack) == 0 {
+					keep(src[top.start:m[1]])
+				}
 			}
 			continue
 		case "extends":
 			continue
 		case "set":
+			if _, value, _, err := compileSetHead(strings.TrimSuffix(strings.TrimSpace(src[m[4]:m[5]]), "-")); err == nil && value == nil {
+				stack = append(stack, frame{kind: kw, start: m[0]})
+				continue
+			}
 			if len(stack) == 0 {
-				out.WriteString(raw)
-				if !strings.HasSuffix(raw, "\n") {
-					out.WriteString("\n")
-				}
+				keep(raw)
 			}
 		}
 	}
@@ -202,18 +252,17 @@ func extractExtendsPrelude(src string) string {
 }
 
 func (e *Env) compileTemplate(name string) (string, error) {
-	entry, err := e.readTemplate(name)
+	src, err := e.readTemplate(name)
 	if err != nil {
 		return "", err
 	}
 
-	child := entry
-
+	chain := []string{src}
 	seen := map[string]bool{name: true}
 	for {
-		m := extendsRe.FindStringSubmatch(child)
+		m := extendsRe.FindStringSubmatch(src)
 		if m == nil {
-			return removeExtendsTag(child), nil
+			break
 		}
 
 		baseName := unquote(m[1])
@@ -222,14 +271,28 @@ func (e *Env) compileTemplate(name string) (string, error) {
 		}
 		seen[baseName] = true
 
-		baseRaw, err := e.readTemplate(baseName)
+		src, err = e.readTemplate(baseName)
 		if err != nil {
 			return "", err
 		}
-		base := baseRaw
+		chain = append(chain, src)
+	}
+	if len(chain) == 1 {
+		return src, nil
+	}
 
-		prelude := extractExtendsPrelude(child)
-		child = prelude + mergeExtends(base, child)
-		child = removeExtendsTag(child)
+	var prelude strings.Builder
+	for _, child := range chain[:len(chain)-1] {
+		prelude.WriteString(extractExtendsPrelude(child))
+	}
+	return prelude.String() + mergeExtends(chain), nil
+}
+
+// loadProgram returns the compiled program for name from the template cache.
+func (e *Env) loadProgram(name string) (*program, error) {
+	t, err := e.GetTemplate(name)
+	if err != nil {
+		return nil, err
 	}
+	return t.prog, nil
 }
@@ -83,6 +83,11 @@ func ValidateTemplateContract(src string, scope map[string]any) error {
 	if err != nil {
 		return err
 	}
+	return contract.Validate(scope)
+}
+
+// Validate checks scope against the declared props.
+func (contract TemplateContract) Validate(scope map[string]any) error {
 	if len(contract.Props) == 0 {
 		return nil
 	}
@@ -113,6 +118,11 @@ func ApplyTemplateContractDefaults(src string, scope map[string]any) error {
 	if err != nil {
 		return err
 	}
+	return contract.ApplyDefaults(scope)
+}
+
+// ApplyDefaults fills missing props in scope from their declared defaults.
+func (contract TemplateContract) ApplyDefaults(scope map[string]any) error {
 	if len(contract.Props) == 0 {
 		return nil
 	}
@@ -0,0 +1,177 @@
+package nunchucks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TemplateError is a failure located in a template. Render, RenderString,
+// Compile and PrecompileDirWithOptions return it so callers can report
+// where a problem is rather than only what it is.
+type TemplateError struct {
+	// Template is the name the template was loaded with, or "" for a
+	// string rendered with RenderString.
+	Template string
+	// Line and Column are 1-based; zero when the position is unknown.
+	Line   int
+	Column int
+	// Source is the offending source line, when the source is available.
+	Source string
+	// Stack lists the include, import, extends and block call sites that
+	// led to Template, innermost first.
+	Stack []TemplateFrame
+	// Err is the underlying cause.
+	Err error
+}
+
+// TemplateFrame is one call site in a TemplateError stack.
+type TemplateFrame struct {
+	Template string `json:"template"`
+	Line     int    `json:"line,omitempty"`
+}
+
+func (f TemplateFrame) String() string {
+	return location(f.Template, f.Line, 0)
+}
+
+func (e *TemplateError) Error() string {
+	return location(e.Template, e.Line, e.Column) + ": " + e.message()
+}
+
+func (e *TemplateError) Unwrap() error { return e.Err }
+
+func (e *TemplateError) message() string {
+	if e.Err == nil {
+		return "template error"
+	}
+	return e.Err.Error()
+}
+
+// Snippet returns the offending source line with a caret under the
+// column, or "" when the source is unknown.
+func (e *TemplateError) Snippet() string {
+	if e.Source == "" || e.Line == 0 {
+		return ""
+	}
+	gutter := fmt.Sprintf("%4d | ", e.Line)
+	out := gutter + e.Source
+	if e.Column > 0 {
+		pad := strings.Repeat(" ", len(gutter)-2) + "| "
+		for i := 0; i < e.Column-1 && i < len(e.Source); i++ {
+			if e.Source[i] == '\t' {
+				pad += "\t"
+			} else {
+				pad += " "
+			}
+		}
+		out += "\n" + pad + "^"
+	}
+	return out
+}
+
+// Detail returns the error with its snippet and stack on separate lines.
+func (e *TemplateError) Detail() string {
+	var b strings.Builder
+	b.WriteString(e.Error())
+	if s := e.Snippet(); s != "" {
+		b.WriteString("\n")
+		b.WriteString(s)
+	}
+	for _, f := range e.Stack {
+		b.WriteString("\n  from ")
+		b.WriteString(f.String())
+	}
+	return b.String()
+}
+
+// MarshalJSON serializes the error for API responses.
+func (e *TemplateError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Template string          `json:"template"`
+		Line     int             `json:"line,omitempty"`
+		Column   int             `json:"column,omitempty"`
+		Message  string          `json:"message"`
+		Source   string          `json:"source,omitempty"`
+		Snippet  string          `json:"snippet,omitempty"`
+		Stack    []TemplateFrame `json:"stack,omitempty"`
+	}{
+		Template: e.Template,
+		Line:     e.Line,
+		Column:   e.Column,
+		Message:  e.message(),
+		Source:   e.Source,
+		Snippet:  e.Snippet(),
+		Stack:    e.Stack,
+	})
+}
+
+func location(name string, line, col int) string {
+	if name == "" {
+		name = "<string>"
+	}
+	switch {
+	case line > 0 && col > 0:
+		return fmt.Sprintf("%s:%d:%d", name, line, col)
+	case line > 0:
+		return fmt.Sprintf("%s:%d", name, line)
+	}
+	return name
+}
+
+// sourceLine returns line n (1-based) of src.
+func sourceLine(src string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	for i := 1; i < n; i++ {
+		idx := strings.IndexByte(src, '\n')
+		if idx < 0 {
+			return ""
+		}
+		src = src[idx+1:]
+	}
+	if idx := strings.IndexByte(src, '\n'); idx >= 0 {
+		src = src[:idx]
+	}
+	return strings.TrimRight(src, "\r")
+}
+
+// positionOf returns the 1-based line and column of offset in src.
+func positionOf(src string, offset int) (int, int) {
+	if offset > len(src) {
+		offset = len(src)
+	}
+	line := 1 + strings.Count(src[:offset], "\n")
+	col := offset + 1
+	if idx := strings.LastIndexByte(src[:offset], '\n'); idx >= 0 {
+		col = offset - idx
+	}
+	return line, col
+}
+
+// newTemplateError locates err in the template name with source src. An
+// error that is already a TemplateError is returned unchanged.
+func newTemplateError(name, src string, line, col int, err error) *TemplateError {
+	var te *TemplateError
+	if errors.As(err, &te) {
+		return te
+	}
+	return &TemplateError{
+		Template: name,
+		Line:     line,
+		Column:   col,
+		Source:   sourceLine(src, line),
+		Err:      err,
+	}
+}
+
+// asTemplateError wraps err so it names template name when it does not
+// already carry a location.
+func asTemplateError(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return newTemplateError(name, "", 0, 0, err)
+}
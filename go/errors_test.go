@@ -0,0 +1,143 @@
+package nunchucks
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTemplateErrorLocatesSyntaxErrors(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	_, err := env.RenderString("<p>ok</p>\n<p>{{ user. }}</p>", nil)
+	var te *TemplateError
+	if !errors.As(err, &te) {
+		t.Fatalf("expected TemplateError, got %v", err)
+	}
+	if te.Template != "" || te.Line != 2 || te.Column != 12 {
+		t.Fatalf("unexpected location: %q %d:%d", te.Template, te.Line, te.Column)
+	}
+	wantSnippet := "   2 | <p>{{ user. }}</p>\n     |            ^"
+	if te.Snippet() != wantSnippet {
+		t.Fatalf("unexpected snippet\nwant:\n%s\n got:\n%s", wantSnippet, te.Snippet())
+	}
+	if !strings.HasPrefix(te.Error(), "<string>:2:12: invalid expression") {
+		t.Fatalf("unexpected message: %s", te.Error())
+	}
+}
+
+func TestTemplateErrorReportsUnclosedTagsAtTheirOpener(t *testing.T) {
+	files := map[string]string{"page.njk": "a\n  {% for x in xs %}\n{{ x }}"}
+	env := Configure(ConfigOptions{Loader: &testLoader{files: files}})
+	_, err := env.Render("page.njk", nil)
+	var te *TemplateError
+	if !errors.As(err, &te) {
+		t.Fatalf("expected TemplateError, got %v", err)
+	}
+	if te.Template != "page.njk" || te.Line != 2 || te.Column != 3 || te.Err.Error() != "missing endfor" {
+		t.Fatalf("unexpected error: %s", te.Detail())
+	}
+}
+
+func TestTemplateErrorCarriesIncludeAndExtendsStack(t *testing.T) {
+	files := map[string]string{
+		"base.njk":    "<main>\n{% block body %}{% endblock %}\n</main>",
+		"page.njk":    "{% extends \"base.njk\" %}\n{% block body %}\n{% include \"partial.njk\" %}\n{% endblock %}",
+		"partial.njk": "<p>\n{{ format(1) }}\n</p>",
+	}
+	env := Configure(ConfigOptions{Loader: &testLoader{files: files}})
+	_, err := env.Render("page.njk", nil)
+	var te *TemplateError
+	if !errors.As(err, &te) {
+		t.Fatalf("expected TemplateError, got %v", err)
+	}
+	if te.Template != "partial.njk" || te.Line != 2 || te.Source != "{{ format(1) }}" {
+		t.Fatalf("unexpected location: %s", te.Detail())
+	}
+	if !strings.Contains(te.Err.Error(), `"format" is undefined`) {
+		t.Fatalf("unexpected cause: %v", te.Err)
+	}
+	wantStack := []TemplateFrame{{"page.njk", 3}, {"base.njk", 2}, {"page.njk", 1}}
+	if !reflect.DeepEqual(te.Stack, wantStack) {
+		t.Fatalf("unexpected stack\nwant: %v\n got: %v", wantStack, te.Stack)
+	}
+
+	data, err := json.Marshal(te)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	for _, want := range []string{`"template":"partial.njk"`, `"line":2`, `"snippet":"   2 | {{ format(1) }}`, `"stack":[{"template":"page.njk","line":3}`} {
+		if !strings.Contains(string(data), want) {
+			t.Fatalf("expected JSON to contain %s, got %s", want, data)
+		}
+	}
+}
+
+func TestTemplateErrorLocatesMissingIncludeAtCallSite(t *testing.T) {
+	files := map[string]string{"page.njk": "x\n{% include \"nope.njk\" %}"}
+	env := Configure(ConfigOptions{Loader: &testLoader{files: files}})
+	_, err := env.Render("page.njk", nil)
+	var te *TemplateError
+	if !errors.As(err, &te) {
+		t.Fatalf("expected TemplateError, got %v", err)
+	}
+	if te.Template != "page.njk" || te.Line != 2 {
+		t.Fatalf("unexpected location: %s", te.Detail())
+	}
+
+	_, err = env.Render("nope.njk", nil)
+	if !errors.As(err, &te) || te.Template != "nope.njk" {
+		t.Fatalf("expected TemplateError naming the missing template, got %v", err)
+	}
+	if _, err := env.Compile("nope.njk"); !errors.As(err, &te) {
+		t.Fatalf("expected Compile to return a TemplateError, got %v", err)
+	}
+}
+
+func TestStrictUndefinedRaisesLocatedErrors(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}, Undefined: UndefinedStrict})
+	ctx := map[string]any{"user": map[string]any{"name": "sam"}}
+
+	cases := map[string]string{
+		"<p>\n{{ usr.name }}</p>":    `"usr.name" is undefined`,
+		"<p>\n{{ user.nmae }}</p>":   `"user.nmae" is undefined`,
+		"<p>\n{{ greet(user) }}</p>": `"greet" is undefined`,
+	}
+	for src, want := range cases {
+		_, err := env.RenderString(src, ctx)
+		var te *TemplateError
+		if !errors.As(err, &te) {
+			t.Fatalf("%q: expected TemplateError, got %v", src, err)
+		}
+		if te.Line != 2 || te.Err.Error() != want {
+			t.Fatalf("%q: unexpected error: %s", src, te.Detail())
+		}
+	}
+
+	src := `{{ user.name }}|{{ usr is defined }}|{{ user.nmae is undefined }}|{{ usr.name | default("anon") }}|{% if usr %}x{% endif %}`
+	out, err := env.RenderString(src, ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "sam|false|true|anon|" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+}
+
+func TestDebugUndefinedRendersMarkers(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}, Undefined: UndefinedDebug})
+	out, err := env.RenderString(`<p>{{ usr.name }}</p><p>{{ title }}</p>`, map[string]any{"title": "ok"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "<p>{{ usr.name: undefined }}</p><p>ok</p>" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+
+	lenient := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	out, err = lenient.RenderString(`<p>{{ usr.name }}</p>`, nil)
+	if err != nil || out != "<p></p>" {
+		t.Fatalf("expected lenient mode to render empty output, got %q, %v", out, err)
+	}
+}
@@ -0,0 +1,288 @@
+package nunchucks
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// SafeString marks markup that is already escaped. Autoescaping writes it
+// unchanged; the safe and escape filters, macros, caller() and super()
+// all produce it.
+type SafeString string
+
+func (s SafeString) String() string { return string(s) }
+
+// defaultAutoescape reports whether templates named like name are escaped
+// when ConfigOptions.Autoescape is not set.
+func defaultAutoescape(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".html", ".htm", ".njk":
+		return true
+	default:
+		return false
+	}
+}
+
+func (e *Env) autoescapeFor(name string) bool {
+	if e.autoescape != nil {
+		return *e.autoescape
+	}
+	return defaultAutoescape(name)
+}
+
+// escHTML escapes v for HTML text and attribute values. SafeStrings
+// pass through untouched.
+func escapeHTML(v any) SafeString {
+	if s, ok := v.(SafeString); ok {
+		return s
+	}
+	return SafeString(html.EscapeString(fmt.Sprint(v)))
+}
+
+// Escape modes carried in the a operand of EMIT. The low bits pick the
+// encoder; escInAttr and escInUnquotedAttr additionally encode the
+// result for the attribute value it is written into.
+const (
+	escNone = iota
+	escHTML
+	escURL       // start of a URL: filter the scheme, then normalize
+	escURLPath   // inside a URL path: normalize
+	escURLQuery  // inside a query or fragment: percent-encode
+	escJS        // JS expression: encode as a JSON value
+	escJSString  // inside a JS string literal
+	escCSS       // CSS value: allow plain words only
+	escCSSString // inside a CSS string literal
+
+	escInAttr         = 1 << 4
+	escInUnquotedAttr = 1 << 5
+	escModeMask       = escInAttr - 1
+)
+
+// unsafeOutput replaces values that cannot be made safe in their context,
+// such as a javascript: URL in href.
+const unsafeOutput = "ZnunchucksZ"
+
+// outputString formats an emitted value, escaping it for mode.
+func outputString(v any, mode int) string {
+	switch {
+	case mode == escNone:
+		return fmt.Sprint(v)
+	case mode == escHTML:
+		if isMissing(v) || v == nil {
+			return fmt.Sprint(v)
+		}
+		return string(escapeHTML(v))
+	}
+	return contextEscape(v, mode)
+}
+
+// contextEscape encodes v for a contextual escape mode. SafeStrings are
+// trusted as HTML only: they pass through in text and plain attribute
+// values but are still encoded in URL, JS and CSS contexts.
+func contextEscape(v any, mode int) string {
+	if _, ok := v.(SafeString); ok && mode&escModeMask == escNone {
+		return string(v.(SafeString))
+	}
+	var s string
+	switch mode & escModeMask {
+	case escJS:
+		s = jsValueEscape(v)
+	case escNone:
+		s = outputText(v)
+	default:
+		text := outputText(v)
+		switch mode & escModeMask {
+		case escURL:
+			s = filterURL(text)
+		case escURLPath:
+			s = normalizeURL(text)
+		case escURLQuery:
+			s = percentEncode(text, isUnreservedURLByte)
+		case escJSString:
+			s = jsStringEscape(text)
+		case escCSS:
+			s = filterCSS(text)
+		case escCSSString:
+			s = cssStringEscape(text)
+		default:
+			s = html.EscapeString(text)
+		}
+	}
+	switch {
+	case mode&escInUnquotedAttr != 0:
+		return unquotedAttrEscape(s)
+	case mode&escInAttr != 0:
+		return html.EscapeString(s)
+	}
+	return s
+}
+
+func outputText(v any) string {
+	if isMissing(v) || v == nil {
+		return ""
+	}
+	return fmt.Sprint(plainString(v))
+}
+
+// filterURL rejects URLs whose scheme could run code and normalizes the
+// rest. Browsers ignore whitespace and control characters in a scheme, so
+// they are dropped before it is checked.
+func filterURL(s string) string {
+	var scheme strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch <= ' ' {
+			continue
+		}
+		if ch == ':' {
+			switch strings.ToLower(scheme.String()) {
+			case "http", "https", "mailto", "tel":
+			default:
+				return "#" + unsafeOutput
+			}
+			break
+		}
+		if ch == '/' || ch == '?' || ch == '#' {
+			break
+		}
+		scheme.WriteByte(ch)
+	}
+	return normalizeURL(s)
+}
+
+// normalizeURL percent-encodes bytes that are not valid anywhere in a URL
+// while keeping its structure and existing escapes.
+func normalizeURL(s string) string {
+	return percentEncode(s, func(ch byte) bool {
+		return isUnreservedURLByte(ch) || strings.IndexByte(":/?#[]@!$&'()*+,;=%", ch) >= 0
+	})
+}
+
+func isUnreservedURLByte(ch byte) bool {
+	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9') || ch == '-' || ch == '.' || ch == '_' || ch == '~'
+}
+
+func percentEncode(s string, keep func(byte) bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if keep(ch) {
+			b.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", ch)
+	}
+	return b.String()
+}
+
+// jsValueEscape encodes v as a JS literal. encoding/json already escapes
+// <, > and & so the result cannot close a script element.
+func jsValueEscape(v any) string {
+	if isMissing(v) || v == nil {
+		return "null"
+	}
+	b, err := json.Marshal(plainString(v))
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return string(b)
+}
+
+func jsStringEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '\\':
+			b.WriteString(`\\`)
+		case '\'', '"', '`', '<', '>', '&', '/', '=':
+			fmt.Fprintf(&b, `\u%04x`, r)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\u2028', '\u2029':
+			fmt.Fprintf(&b, `\u%04x`, r)
+		default:
+			if r < ' ' {
+				fmt.Fprintf(&b, `\u%04x`, r)
+				continue
+			}
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// filterCSS only lets through values made of words, numbers, units,
+// colours and lists; anything that could open a string, url() or rule is
+// replaced.
+func filterCSS(s string) string {
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if isUnreservedURLByte(ch) || ch == ' ' || ch == '#' || ch == '%' || ch == ',' || ch == '+' || ch == '!' {
+			continue
+		}
+		return unsafeOutput
+	}
+	lower := strings.ToLower(s)
+	if strings.Contains(lower, "expression") || strings.Contains(lower, "mozbinding") {
+		return unsafeOutput
+	}
+	return s
+}
+
+func cssStringEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+		if r >= utf8.RuneSelf || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == ' ' {
+			b.WriteRune(r)
+			continue
+		}
+		fmt.Fprintf(&b, `\%x `, r)
+	}
+	return b.String()
+}
+
+// unquotedAttrEscape escapes everything that could end an unquoted
+// attribute value or start a new attribute.
+func unquotedAttrEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '&', '<', '>', '"', '\'', '`', '=', ' ', '\t', '\n', '\r', '\f':
+			fmt.Fprintf(&b, "&#%d;", r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// safePreservingFilters keep their input marked safe: they only change
+// case or whitespace, so they cannot introduce markup.
+var safePreservingFilters = map[string]bool{
+	"lower":      true,
+	"upper":      true,
+	"trim":       true,
+	"title":      true,
+	"capitalize": true,
+	"center":     true,
+	"indent":     true,
+	"truncate":   true,
+}
+
+// plainString unwraps SafeString so comparisons treat it as a string.
+func plainString(v any) any {
+	if s, ok := v.(SafeString); ok {
+		return string(s)
+	}
+	return v
+}
@@ -0,0 +1,90 @@
+package nunchucks
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestContextualEscapingInjectionCorpus(t *testing.T) {
+	on := true
+	env := Configure(ConfigOptions{
+		Loader:           &testLoader{files: map[string]string{}},
+		Autoescape:       &on,
+		ContextualEscape: true,
+	})
+
+	cases := []struct {
+		name string
+		src  string
+		v    any
+		want string
+	}{
+		{"text", `<p>{{ v }}</p>`, `<script>alert(1)</script>`, `<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>`},
+		{"comment", `<!-- {{ v }} -->`, `--><script>`, `<!-- --&gt;&lt;script&gt; -->`},
+		{"quoted attr", `<div title="{{ v }}">`, `" onmouseover="alert(1)`, `<div title="&#34; onmouseover=&#34;alert(1)">`},
+		{"single quoted attr", `<div title='{{ v }}'>`, `' autofocus onfocus='x`, `<div title='&#39; autofocus onfocus=&#39;x'>`},
+		{"unquoted attr", `<div class={{ v }}>`, `a onclick=alert(1)`, `<div class=a&#32;onclick&#61;alert(1)>`},
+		{"attr name position", `<div {{ v }}>`, `x onclick=alert(1)`, `<div x&#32;onclick&#61;alert(1)>`},
+		{"javascript url", `<a href="{{ v }}">`, `javascript:alert(1)`, `<a href="#ZnunchucksZ">`},
+		{"obfuscated javascript url", `<a href="{{ v }}">`, " JaVa\tScRiPt:alert(1)", `<a href="#ZnunchucksZ">`},
+		{"data url", `<img src="{{ v }}">`, `data:text/html;base64,PHNjcmlwdD4=`, `<img src="#ZnunchucksZ">`},
+		{"safe url", `<a href="{{ v }}">`, `https://example.com/a b?q="x"`, `<a href="https://example.com/a%20b?q=%22x%22">`},
+		{"relative url", `<a href="{{ v }}">`, `/users/1`, `<a href="/users/1">`},
+		{"url path", `<a href="/users/{{ v }}">`, `javascript:alert(1)`, `<a href="/users/javascript:alert(1)">`},
+		{"url query", `<a href="/search?q={{ v }}">`, `a&b=<c>`, `<a href="/search?q=a%26b%3D%3Cc%3E">`},
+		{"unquoted url", `<a href={{ v }}>`, `javascript:alert(1)`, `<a href=#ZnunchucksZ>`},
+		{"script value", `<script>var x = {{ v }};</script>`, `</script><script>alert(1)</script>`, `<script>var x = "\u003c/script\u003e\u003cscript\u003ealert(1)\u003c/script\u003e";</script>`},
+		{"script string", `<script>var x = "{{ v }}";</script>`, `"; alert(1); "`, `<script>var x = "\u0022; alert(1); \u0022";</script>`},
+		{"script single string", `<script>var x = '{{ v }}';</script>`, `'+alert(1)+'`, `<script>var x = '\u0027+alert(1)+\u0027';</script>`},
+		{"script after string", `<script>var a = "x"; var b = {{ v }};</script>`, `alert(1)`, `<script>var a = "x"; var b = "alert(1)";</script>`},
+		{"event handler", `<button onclick="go({{ v }})">`, `1);alert(1`, `<button onclick="go(&#34;1);alert(1&#34;)">`},
+		{"event handler string", `<button onclick="go('{{ v }}')">`, `');alert('`, `<button onclick="go('\u0027);alert(\u0027')">`},
+		{"style value", `<style>p { color: {{ v }}; }</style>`, `red; background: url(//evil)`, `<style>p { color: ZnunchucksZ; }</style>`},
+		{"style plain value", `<style>p { color: {{ v }}; }</style>`, `#ff0000`, `<style>p { color: #ff0000; }</style>`},
+		{"style expression", `<p style="width: {{ v }}">`, `expression(alert(1))`, `<p style="width: ZnunchucksZ">`},
+		{"style string", `<style>p::after { content: "{{ v }}"; }</style>`, `"}</style><script>`, `<style>p::after { content: "\22 \7d \3c \2f style\3e \3c script\3e "; }</style>`},
+		{"after script closes", `<script>var x = 1;</script><p>{{ v }}</p>`, `<b>`, `<script>var x = 1;</script><p>&lt;b&gt;</p>`},
+		{"safe in text", `<p>{{ v | safe }}</p>`, `<b>ok</b>`, `<p><b>ok</b></p>`},
+		{"safe in url", `<a href="{{ v | safe }}">`, `javascript:alert(1)`, `<a href="#ZnunchucksZ">`},
+		{"safe in script", `<script>var x = {{ v | safe }};</script>`, `</script>`, `<script>var x = "\u003c/script\u003e";</script>`},
+	}
+	for _, tc := range cases {
+		out, err := env.RenderString(tc.src, map[string]any{"v": tc.v})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+		if out != tc.want {
+			t.Errorf("%s: unexpected output\nwant: %s\n got: %s", tc.name, tc.want, out)
+		}
+	}
+}
+
+func TestContextualEscapingTracksLoopsAndBranches(t *testing.T) {
+	on := true
+	env := Configure(ConfigOptions{
+		Loader:           &testLoader{files: map[string]string{}},
+		Autoescape:       &on,
+		ContextualEscape: true,
+	})
+	src := `{% for l in links %}<a href="{{ l }}" title="{% if l %}{{ l }}{% else %}none{% endif %}">{{ l }}</a>{% endfor %}`
+	out, err := env.RenderString(src, map[string]any{"links": []any{"/a", "javascript:x"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `<a href="/a" title="/a">/a</a><a href="#ZnunchucksZ" title="javascript:x">javascript:x</a>`
+	if out != want {
+		t.Fatalf("unexpected output\nwant: %s\n got: %s", want, out)
+	}
+}
+
+func TestContextualEscapingIsOptIn(t *testing.T) {
+	on := true
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}, Autoescape: &on})
+	out, err := env.RenderString(`<a href="{{ v }}">`, map[string]any{"v": "javascript:alert(1)"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(out, "javascript:alert(1)") {
+		t.Fatalf("expected plain HTML escaping without ContextualEscape, got %q", out)
+	}
+}
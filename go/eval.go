@@ -2,11 +2,11 @@ package nunchucks
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
 	"math"
 	"math/rand"
-	"net/url"
 	"reflect"
 	"regexp"
 	"sort"
@@ -15,31 +15,35 @@ import (
 	"time"
 )
 
-type TemplateFunc func(args []any, kwargs map[string]any, caller string) (any, error)
+// TemplateFunc is a function templates can call, such as a macro. caller
+// renders the body of the {% call %} block it was called from, or is nil.
+type TemplateFunc func(args []any, kwargs map[string]any, caller TemplateFunc) (any, error)
 
-type missingValue struct{}
+// missingValue is the value of an undefined name or attribute. name is the
+// expression that was undefined, as reported by strict and debug modes.
+type missingValue struct {
+	name string
+}
 
 func (missingValue) String() string { return "" }
 
 var missing = missingValue{}
 
-var callableExprRe = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*(?:\.[A-Za-z_][A-Za-z0-9_]*)*)\s*\((.*)\)$`)
+// errNoFilter is returned by builtinFilter for a name it does not know.
+var errNoFilter = errors.New("no such filter")
+
 var stripTagsRe = regexp.MustCompile(`(?s)<[^>]*>`)
-var urlizeRe = regexp.MustCompile(`https?://[^\s<]+`)
+var urlizeRe = regexp.MustCompile(`(?:https?://|www\.)[^\s<]+|[\w.+-]+@[\w-]+(?:\.[\w-]+)+`)
 var rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
 
 func getPath(data map[string]any, path string) (any, bool) {
 	parts := strings.Split(path, ".")
 	var cur any = data
 	for _, p := range parts {
-		m, ok := cur.(map[string]any)
+		v, ok := getAttr(cur, p)
 		if !ok {
 			return nil, false
 		}
-		v, exists := m[p]
-		if !exists {
-			return nil, false
-		}
 		cur = v
 	}
 	return cur, true
@@ -177,33 +181,6 @@ func splitTopLevelAssign(src string) (string, string, bool) {
 	return "", "", false
 }
 
-func parseCallableExpr(src string) (string, []string, bool) {
-	s := strings.TrimSpace(src)
-	m := callableExprRe.FindStringSubmatch(s)
-	if m == nil {
-		return "", nil, false
-	}
-	name := strings.TrimSpace(m[1])
-	argsRaw := strings.TrimSpace(m[2])
-	if argsRaw == "" {
-		return name, nil, true
-	}
-	return name, splitArgs(argsRaw), true
-}
-
-func parseCallableArgs(argExprs []string) ([]string, map[string]string) {
-	pos := make([]string, 0, len(argExprs))
-	kw := map[string]string{}
-	for _, raw := range argExprs {
-		if k, v, ok := splitTopLevelAssign(raw); ok {
-			kw[k] = v
-			continue
-		}
-		pos = append(pos, raw)
-	}
-	return pos, kw
-}
-
 func resolveIdentEx(name string, vars, ctx map[string]any) (any, bool) {
 	key := strings.TrimSpace(name)
 	if key == "" {
@@ -226,15 +203,15 @@ func resolveIdentEx(name string, vars, ctx map[string]any) (any, bool) {
 		}
 	}
 
-	return missing, false
+	return missingValue{name: key}, false
 }
 
-func resolveIdent(name string, vars, ctx map[string]any) any {
-	v, ok := resolveIdentEx(name, vars, ctx)
-	if !ok {
-		return missing
+// undefinedError reports that the undefined value v was used.
+func undefinedError(v any) error {
+	if mv, ok := v.(missingValue); ok && mv.name != "" {
+		return fmt.Errorf("%q is undefined", mv.name)
 	}
-	return v
+	return fmt.Errorf("value is undefined")
 }
 
 func isMissing(v any) bool {
@@ -303,7 +280,7 @@ func toSlice(v any) []any {
 		}
 		return out
 	}
-	rv := reflect.ValueOf(v)
+	rv := indirect(reflect.ValueOf(v))
 	if !rv.IsValid() {
 		return nil
 	}
@@ -317,42 +294,6 @@ func toSlice(v any) []any {
 	return nil
 }
 
-func isEmpty(v any) bool {
-	if v == nil {
-		return true
-	}
-	if isMissing(v) {
-		return true
-	}
-	switch t := v.(type) {
-	case string:
-		return t == ""
-	case []any:
-		return len(t) == 0
-	case map[string]any:
-		return len(t) == 0
-	case bool:
-		return !t
-	case int:
-		return t == 0
-	case float64:
-		return t == 0
-	}
-	rv := reflect.ValueOf(v)
-	switch rv.Kind() {
-	case reflect.Slice, reflect.Array, reflect.Map, reflect.String:
-		return rv.Len() == 0
-	}
-	return false
-}
-
-func parseFilterSpec(raw string) (string, []string) {
-	if name, args, ok := parseCallableExpr(raw); ok {
-		return strings.TrimSpace(name), args
-	}
-	return strings.TrimSpace(raw), nil
-}
-
 func valueByPathEx(v any, path string) (any, bool) {
 	if strings.TrimSpace(path) == "" {
 		return v, true
@@ -360,29 +301,15 @@ func valueByPathEx(v any, path string) (any, bool) {
 	parts := strings.Split(path, ".")
 	cur := v
 	for _, part := range parts {
-		switch t := cur.(type) {
-		case map[string]any:
-			next, ok := t[part]
-			if !ok {
-				return missing, false
-			}
-			cur = next
-		default:
-			rv := reflect.ValueOf(cur)
-			if !rv.IsValid() {
-				return missing, false
-			}
-			if rv.Kind() == reflect.Map {
-				mv := rv.MapIndex(reflect.ValueOf(part))
-				if mv.IsValid() {
-					cur = mv.Interface()
-				} else {
-					return missing, false
-				}
-			} else {
-				return missing, false
-			}
+		next, ok := getAttr(cur, part)
+		if i, err := strconv.Atoi(part); !ok && err == nil {
+			// An integer part indexes a sequence, as in "tags.0".
+			next, ok = getItem(cur, i)
+		}
+		if !ok {
+			return missingValue{name: path}, false
 		}
+		cur = next
 	}
 	return cur, true
 }
@@ -430,10 +357,12 @@ func isIterable(v any) bool {
 	if isMissing(v) || v == nil {
 		return false
 	}
-	rv := reflect.ValueOf(v)
+	rv := indirect(reflect.ValueOf(v))
 	switch rv.Kind() {
-	case reflect.Array, reflect.Slice, reflect.Map, reflect.String:
+	case reflect.Array, reflect.Slice, reflect.Map, reflect.String, reflect.Chan:
 		return true
+	case reflect.Func:
+		return isIteratorFunc(rv.Type())
 	default:
 		return false
 	}
@@ -464,13 +393,62 @@ func isMapping(v any) bool {
 	if isMissing(v) || v == nil {
 		return false
 	}
+	if _, ok := v.(OrderedMap); ok {
+		return true
+	}
 	rv := reflect.ValueOf(v)
 	return rv.Kind() == reflect.Map
 }
 
+// isInteger reports whether v is an integer; booleans are not.
+func isInteger(v any) bool {
+	switch v.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return true
+	}
+	return false
+}
+
+func isFloat(v any) bool {
+	switch v.(type) {
+	case float32, float64:
+		return true
+	}
+	return false
+}
+
+// sameAs reports whether a and b are the same value: the same map, slice,
+// pointer or func for reference types, and equal values of one type
+// otherwise.
+func sameAs(a, b any) bool {
+	ra, rb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if !ra.IsValid() || !rb.IsValid() {
+		return !ra.IsValid() && !rb.IsValid()
+	}
+	if ra.Type() != rb.Type() {
+		return false
+	}
+	switch ra.Kind() {
+	case reflect.Map, reflect.Pointer, reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return ra.Pointer() == rb.Pointer()
+	case reflect.Slice:
+		return ra.Pointer() == rb.Pointer() && ra.Len() == rb.Len()
+	}
+	return ra.Comparable() && ra.Equal(rb)
+}
+
+// hasCase reports whether s has a cased letter and is unchanged by fold,
+// as Python's str.islower and str.isupper do.
+func hasCase(s string, fold func(string) string) bool {
+	return s == fold(s) && strings.ToLower(s) != strings.ToUpper(s)
+}
+
 func isKnownTestName(name string) bool {
 	switch strings.ToLower(strings.TrimSpace(name)) {
-	case "defined", "undefined", "none", "null", "string", "number", "boolean", "bool", "iterable", "callable", "odd", "even", "divisibleby", "lower", "upper", "equalto", "sameas", "sequence", "mapping", "true", "false":
+	case "defined", "undefined", "none", "null", "boolean", "bool", "true", "false",
+		"integer", "float", "number", "string", "mapping", "sequence", "iterable", "callable", "escaped",
+		"odd", "even", "divisibleby", "lower", "upper", "truthy", "falsy", "filter", "test", "in", "sameas",
+		"eq", "equalto", "==", "ne", "!=", "gt", "greaterthan", ">", "ge", ">=", "lt", "lessthan", "<", "le", "<=":
 		return true
 	default:
 		return false
@@ -485,24 +463,33 @@ func evalTestKeyword(v any, kw string, args []any) bool {
 	case "undefined":
 		return isMissing(v)
 	case "none", "null":
-		return v == nil || isMissing(v)
+		return v == nil
 	case "string":
-		_, ok := v.(string)
-		return ok
+		switch v.(type) {
+		case string, SafeString:
+			return true
+		}
+		return false
 	case "number":
 		return isNumber(v)
+	case "integer":
+		return isInteger(v)
+	case "float":
+		return isFloat(v)
+	case "escaped":
+		_, ok := v.(SafeString)
+		return ok
+	case "truthy":
+		return truthy(v)
+	case "falsy":
+		return !truthy(v)
 	case "boolean", "bool":
 		_, ok := v.(bool)
 		return ok
 	case "iterable":
 		return isIterable(v)
 	case "callable":
-		switch v.(type) {
-		case TemplateFunc, func(...any) any:
-			return true
-		default:
-			return false
-		}
+		return isCallable(v)
 	case "odd":
 		return toInt(v, 0)%2 != 0
 	case "even":
@@ -517,23 +504,35 @@ func evalTestKeyword(v any, kw string, args []any) bool {
 		}
 		return toInt(v, 0)%d == 0
 	case "lower":
-		s := fmt.Sprint(v)
-		return s == strings.ToLower(s)
+		return hasCase(outputText(v), strings.ToLower)
 	case "upper":
-		s := fmt.Sprint(v)
-		return s == strings.ToUpper(s)
-	case "equalto":
+		return hasCase(outputText(v), strings.ToUpper)
+	case "equalto", "eq", "==":
 		if len(args) == 0 {
 			return false
 		}
 		return equalOp(v, args[0])
+	case "ne", "!=":
+		return len(args) > 0 && !equalOp(v, args[0])
+	case "gt", "greaterthan", ">":
+		return len(args) > 0 && compareOp(v, args[0], ">")
+	case "ge", ">=":
+		return len(args) > 0 && compareOp(v, args[0], ">=")
+	case "lt", "lessthan", "<":
+		return len(args) > 0 && compareOp(v, args[0], "<")
+	case "le", "<=":
+		return len(args) > 0 && compareOp(v, args[0], "<=")
+	case "in":
+		return len(args) > 0 && containsOp(args[0], v)
 	case "sameas":
 		if len(args) == 0 {
 			return false
 		}
-		return reflect.DeepEqual(v, args[0])
+		return sameAs(v, args[0])
 	case "sequence":
-		return isSequence(v)
+		// As in Jinja, anything with a length and items is a sequence,
+		// mappings included.
+		return isSequence(v) || isMapping(v)
 	case "mapping":
 		return isMapping(v)
 	case "true":
@@ -545,10 +544,6 @@ func evalTestKeyword(v any, kw string, args []any) bool {
 	}
 }
 
-func isTestKeyword(v any, kw string) bool {
-	return evalTestKeyword(v, kw, nil)
-}
-
 func compareAny(a any, b any, caseSens bool) int {
 	if isMissing(a) && isMissing(b) {
 		return 0
@@ -585,79 +580,242 @@ func compareAny(a any, b any, caseSens bool) int {
 	return 0
 }
 
-func applyFilter(name string, v any, args []any) any {
+// applyFilter runs the filter name on v. A filter added with Env.AddFilter
+// takes precedence over the built-in of the same name.
+func applyFilter(s *evalScope, name string, v any, args []any, kwargs map[string]any) (any, error) {
+	if fn, ok := s.env.customFilter(name); ok {
+		out, err := fn(&Context{scope: s}, v, args, kwargs)
+		if err != nil {
+			return nil, fmt.Errorf("filter %q: %w", name, err)
+		}
+		return out, nil
+	}
 	n := strings.TrimSpace(strings.ToLower(name))
+	if s.state != nil {
+		// Channels and iterators are read into a list first, so the
+		// filters that take sequences accept them.
+		items, ok, err := readIterSource(v, s.state.budget)
+		if err != nil {
+			return nil, fmt.Errorf("filter %q: %w", n, err)
+		}
+		if ok {
+			v = items
+		}
+	}
+	if out, ok, err := variadicFilter(s, n, v, args, kwargs); ok {
+		if err != nil {
+			return nil, fmt.Errorf("filter %q: %w", n, err)
+		}
+		return out, nil
+	}
+	args, err := bindArgs("filter", n, filterParams[n], args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	out, err := builtinFilter(s, n, v, args)
+	if err == errNoFilter {
+		return nil, fmt.Errorf("no filter named %q", n)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("filter %q: %w", n, err)
+	}
+	if _, ok := v.(SafeString); ok && safePreservingFilters[n] {
+		if s, ok := out.(string); ok {
+			return SafeString(s), nil
+		}
+	}
+	return out, nil
+}
+
+// param is a parameter of a built-in filter or test, with the value used
+// when a later parameter is passed by name and this one is not.
+type param struct {
+	name string
+	dflt any
+}
+
+// filterParams lists, in positional order, the parameters of the built-in
+// filters that take arguments, under their Jinja names. Filters not listed
+// take positional arguments only, except those that bind their own (see
+// variadicFilter).
+var filterParams = map[string][]param{
+	"attr":           {{"name", ""}},
+	"batch":          {{"linecount", 1}, {"fill_with", nil}},
+	"center":         {{"width", 80}},
+	"d":              {{"default_value", ""}, {"boolean", false}},
+	"default":        {{"default_value", ""}, {"boolean", false}},
+	"dictsort":       {{"case_sensitive", false}, {"by", "key"}, {"reverse", false}},
+	"dump":           {{"spaces", nil}},
+	"filesizeformat": {{"binary", false}},
+	"float":          {{"default", 0.0}},
+	"groupby":        {{"attribute", ""}, {"default", missing}, {"case_sensitive", false}},
+	"indent":         {{"width", 4}, {"first", false}, {"blank", false}},
+	"int":            {{"default", 0}, {"base", 10}},
+	"join":           {{"d", ""}, {"attribute", nil}},
+	"max":            {{"case_sensitive", false}, {"attribute", nil}},
+	"min":            {{"case_sensitive", false}, {"attribute", nil}},
+	"replace":        {{"old", ""}, {"new", ""}, {"count", -1}},
+	"round":          {{"precision", 0}, {"method", "common"}},
+	"slice":          {{"slices", 1}, {"fill_with", nil}},
+	"sort":           {{"reverse", false}, {"case_sensitive", false}, {"attribute", ""}},
+	"striptags":      {{"preserve_linebreaks", false}},
+	"sum":            {{"attribute", nil}, {"start", 0}},
+	"tojson":         {{"indent", nil}},
+	"trim":           {{"chars", nil}},
+	"truncate":       {{"length", 255}, {"killwords", false}, {"end", "..."}, {"leeway", 0}},
+	"unique":         {{"case_sensitive", false}, {"attribute", nil}},
+	"urlize":         {{"trim_url_limit", nil}, {"nofollow", false}, {"target", nil}, {"rel", nil}, {"extra_schemes", nil}},
+	"wordwrap":       {{"width", 79}, {"break_long_words", true}, {"wrapstring", nil}, {"break_on_hyphens", true}},
+	"xmlattr":        {{"autospace", true}},
+}
+
+// testParams lists the parameters of the built-in tests that take
+// arguments.
+var testParams = map[string][]param{
+	"divisibleby": {{"num", nil}},
+	"equalto":     {{"value", nil}},
+	"eq":          {{"value", nil}},
+	"==":          {{"value", nil}},
+	"ne":          {{"value", nil}},
+	"!=":          {{"value", nil}},
+	"gt":          {{"value", nil}},
+	"greaterthan": {{"value", nil}},
+	">":           {{"value", nil}},
+	"ge":          {{"value", nil}},
+	">=":          {{"value", nil}},
+	"lt":          {{"value", nil}},
+	"lessthan":    {{"value", nil}},
+	"<":           {{"value", nil}},
+	"le":          {{"value", nil}},
+	"<=":          {{"value", nil}},
+	"in":          {{"seq", nil}},
+	"sameas":      {{"other", nil}},
+}
+
+// bindArgs merges kwargs into args by parameter name, so the built-in sees
+// only positional arguments. Parameters skipped before one passed by name
+// take their defaults.
+func bindArgs(kind, name string, params []param, args []any, kwargs map[string]any) ([]any, error) {
+	if params == nil {
+		for k := range kwargs {
+			return nil, fmt.Errorf("%s %q got an unexpected keyword argument %q", kind, name, k)
+		}
+		return args, nil
+	}
+	if len(args) > len(params) {
+		return nil, fmt.Errorf("%s %q takes at most %d arguments, got %d", kind, name, len(params), len(args))
+	}
+	if len(kwargs) == 0 {
+		return args, nil
+	}
+	out := append([]any{}, args...)
+	for k, v := range kwargs {
+		i := 0
+		for i < len(params) && params[i].name != k {
+			i++
+		}
+		if i == len(params) {
+			return nil, fmt.Errorf("%s %q got an unexpected keyword argument %q", kind, name, k)
+		}
+		if i < len(args) {
+			return nil, fmt.Errorf("%s %q got multiple values for argument %q", kind, name, k)
+		}
+		for len(out) <= i {
+			out = append(out, params[len(out)].dflt)
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+func builtinFilter(s *evalScope, n string, v any, args []any) (any, error) {
 	switch n {
 	case "lower":
-		return strings.ToLower(fmt.Sprint(v))
+		return strings.ToLower(fmt.Sprint(v)), nil
 	case "upper":
-		return strings.ToUpper(fmt.Sprint(v))
+		return strings.ToUpper(fmt.Sprint(v)), nil
 	case "string":
-		return fmt.Sprint(v)
+		return fmt.Sprint(v), nil
 	case "trim":
-		return strings.TrimSpace(fmt.Sprint(v))
+		if chars := optString(argOr(args, 0, nil)); chars != "" {
+			return strings.Trim(fmt.Sprint(v), chars), nil
+		}
+		return strings.TrimSpace(fmt.Sprint(v)), nil
 	case "title":
-		return strings.Title(strings.TrimSpace(fmt.Sprint(v)))
+		return titleCase(fmt.Sprint(v)), nil
 	case "capitalize":
-		s := strings.TrimSpace(fmt.Sprint(v))
-		if s == "" {
-			return s
+		r := []rune(fmt.Sprint(v))
+		if len(r) == 0 {
+			return "", nil
 		}
-		return strings.ToUpper(s[:1]) + strings.ToLower(s[1:])
+		return strings.ToUpper(string(r[:1])) + strings.ToLower(string(r[1:])), nil
 	case "abs":
-		return math.Abs(toFloat(v, 0))
+		if i, ok := v.(int); ok {
+			if i < 0 {
+				return -i, nil
+			}
+			return i, nil
+		}
+		return math.Abs(toFloat(v, 0)), nil
 	case "int":
-		return toInt(v, 0)
+		base := toInt(argOr(args, 1, 10), 10)
+		if i, ok := toIntBase(v, base); ok {
+			return i, nil
+		}
+		return argOr(args, 0, 0), nil
 	case "float":
-		return toFloat(v, 0)
-	case "length":
+		if f, ok := toFloatEx(v); ok {
+			return f, nil
+		}
+		return argOr(args, 0, 0.0), nil
+	case "attr":
+		name := optString(argOr(args, 0, nil))
+		if out, ok := getAttr(v, name); ok {
+			return out, nil
+		}
+		return missingValue{name: name}, nil
+	case "items":
+		return itemPairs(s, v)
+	case "unique":
+		return uniqueValues(v, toBool(argOr(args, 0, false), false), optString(argOr(args, 1, nil))), nil
+	case "min", "max":
+		return extremeValue(v, toBool(argOr(args, 0, false), false), optString(argOr(args, 1, nil)), n == "max"), nil
+	case "tojson":
+		return toJSON(v, argOr(args, 0, nil))
+	case "pprint":
+		return pyRepr(v), nil
+	case "xmlattr":
+		return xmlAttr(s, v, toBool(argOr(args, 0, true), true))
+	case "filesizeformat":
+		return fileSizeFormat(v, toBool(argOr(args, 0, false), false)), nil
+	case "wordwrap":
+		wrap := "\n"
+		if w := argOr(args, 2, nil); w != nil {
+			wrap = optString(w)
+		}
+		return wordWrap(fmt.Sprint(v), toInt(argOr(args, 0, 79), 79), toBool(argOr(args, 1, true), true), wrap, toBool(argOr(args, 3, true), true))
+	case "length", "count":
 		if arr := toSlice(v); arr != nil {
-			return len(arr)
+			return len(arr), nil
+		}
+		if om, ok := v.(OrderedMap); ok {
+			return len(om.Keys()), nil
 		}
 		rv := reflect.ValueOf(v)
 		if rv.IsValid() {
 			switch rv.Kind() {
 			case reflect.String, reflect.Map, reflect.Array, reflect.Slice:
-				return rv.Len()
+				return rv.Len(), nil
 			}
 		}
-		return 0
-	case "first":
-		if arr := toSlice(v); len(arr) > 0 {
-			return arr[0]
-		}
-		s := fmt.Sprint(v)
-		if s == "" {
-			return ""
-		}
-		return string([]rune(s)[0])
-	case "last":
-		if arr := toSlice(v); len(arr) > 0 {
-			return arr[len(arr)-1]
-		}
-		s := fmt.Sprint(v)
-		if s == "" {
-			return ""
-		}
-		r := []rune(s)
-		return string(r[len(r)-1])
+		return 0, nil
+	case "first", "last":
+		return edgeItem(s, v, n == "last"), nil
 	case "join":
-		sep := ""
-		if len(args) > 0 {
-			sep = fmt.Sprint(args[0])
-		}
-		arr := toSlice(v)
-		if len(arr) == 0 {
-			return ""
-		}
-		parts := make([]string, 0, len(arr))
-		for _, it := range arr {
-			parts = append(parts, fmt.Sprint(it))
-		}
-		return strings.Join(parts, sep)
+		return joinValues(s, v, argOr(args, 0, ""), optString(argOr(args, 1, nil))), nil
 	case "list":
 		if arr := toSlice(v); arr != nil {
-			return arr
+			return arr, nil
 		}
 		rv := reflect.ValueOf(v)
 		if rv.IsValid() && rv.Kind() == reflect.Map {
@@ -669,7 +827,7 @@ func applyFilter(name string, v any, args []any) any {
 			sort.SliceStable(out, func(i, j int) bool {
 				return compareAny(out[i], out[j], false) < 0
 			})
-			return out
+			return out, nil
 		}
 		s := fmt.Sprint(v)
 		r := []rune(s)
@@ -677,7 +835,7 @@ func applyFilter(name string, v any, args []any) any {
 		for _, ch := range r {
 			out = append(out, string(ch))
 		}
-		return out
+		return out, nil
 	case "replace":
 		from := ""
 		to := ""
@@ -691,29 +849,41 @@ func applyFilter(name string, v any, args []any) any {
 		if len(args) > 2 {
 			count = toInt(args[2], -1)
 		}
-		return strings.Replace(fmt.Sprint(v), from, to, count)
+		return strings.Replace(fmt.Sprint(v), from, to, count), nil
 	case "reverse":
 		if arr := toSlice(v); arr != nil {
 			out := append([]any{}, arr...)
 			for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
 				out[i], out[j] = out[j], out[i]
 			}
-			return out
+			return out, nil
 		}
 		r := []rune(fmt.Sprint(v))
 		for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
 			r[i], r[j] = r[j], r[i]
 		}
-		return string(r)
+		return string(r), nil
 	case "round":
 		prec := 0
 		if len(args) > 0 {
 			prec = toInt(args[0], 0)
 		}
+		round := math.RoundToEven
+		if len(args) > 1 {
+			switch method := fmt.Sprint(args[1]); method {
+			case "common":
+			case "ceil":
+				round = math.Ceil
+			case "floor":
+				round = math.Floor
+			default:
+				return nil, fmt.Errorf(`method must be "common", "ceil" or "floor", got %q`, method)
+			}
+		}
 		f := toFloat(v, 0)
 		p := math.Pow(10, float64(prec))
-		return math.Round(f*p) / p
-	case "default":
+		return round(f*p) / p, nil
+	case "default", "d":
 		var dflt any = ""
 		if len(args) > 0 {
 			dflt = args[0]
@@ -722,47 +892,45 @@ func applyFilter(name string, v any, args []any) any {
 		if len(args) > 1 {
 			boolMode = toBool(args[1], false)
 		}
-		if v == nil {
-			return dflt
+		if v == nil || isMissing(v) || (boolMode && !truthy(v)) {
+			return dflt, nil
 		}
-		if boolMode && isEmpty(v) {
-			return dflt
+		return v, nil
+	case "escape", "e":
+		return escapeHTML(v), nil
+	case "forceescape":
+		return SafeString(html.EscapeString(fmt.Sprint(v))), nil
+	case "safe":
+		if v == nil || isMissing(v) {
+			return v, nil
 		}
-		if fmt.Sprint(v) == "" {
-			return dflt
+		if s, ok := v.(SafeString); ok {
+			return s, nil
 		}
-		return v
-	case "escape", "e", "forceescape":
-		return html.EscapeString(fmt.Sprint(v))
-	case "safe":
-		return v
+		return SafeString(fmt.Sprint(v)), nil
 	case "dump":
-		b, err := json.Marshal(v)
+		var b []byte
+		var err error
+		if indent := argOr(args, 0, nil); indent != nil {
+			b, err = json.MarshalIndent(v, "", spaces(indent, 0))
+		} else {
+			b, err = json.Marshal(v)
+		}
 		if err != nil {
-			return fmt.Sprint(v)
+			return fmt.Sprint(v), nil
 		}
-		return string(b)
+		return string(b), nil
 	case "wordcount":
-		return len(strings.Fields(fmt.Sprint(v)))
+		return len(wordRe.FindAllString(fmt.Sprint(v), -1)), nil
 	case "nl2br":
-		return strings.ReplaceAll(fmt.Sprint(v), "\n", "<br />\n")
+		return SafeString(strings.ReplaceAll(string(escapeHTML(v)), "\n", "<br />\n")), nil
 	case "urlencode":
-		return url.QueryEscape(fmt.Sprint(v))
+		return urlEncode(s, v)
 	case "urlize":
-		s := fmt.Sprint(v)
-		return urlizeRe.ReplaceAllStringFunc(s, func(m string) string {
-			return `<a href="` + m + `">` + m + `</a>`
-		})
+		trim := toInt(argOr(args, 0, nil), 0)
+		return urlize(v, trim, toBool(argOr(args, 1, false), false), optString(argOr(args, 2, nil)), optString(argOr(args, 3, nil))), nil
 	case "striptags":
-		preserve := false
-		if len(args) > 0 {
-			preserve = toBool(args[0], false)
-		}
-		s := stripTagsRe.ReplaceAllString(fmt.Sprint(v), "")
-		if preserve {
-			return s
-		}
-		return strings.Join(strings.Fields(s), " ")
+		return stripTags(fmt.Sprint(v), toBool(argOr(args, 0, false), false)), nil
 	case "truncate":
 		s := fmt.Sprint(v)
 		length := 255
@@ -777,11 +945,11 @@ func applyFilter(name string, v any, args []any) any {
 		if len(args) > 2 {
 			end = fmt.Sprint(args[2])
 		}
-		if len([]rune(s)) <= length {
-			return s
+		if len([]rune(s)) <= length+toInt(argOr(args, 3, 0), 0) {
+			return s, nil
 		}
 		if length <= len([]rune(end)) {
-			return end
+			return end, nil
 		}
 		cut := length - len([]rune(end))
 		r := []rune(s)
@@ -789,50 +957,29 @@ func applyFilter(name string, v any, args []any) any {
 			cut = 0
 		}
 		if killwords {
-			return string(r[:cut]) + end
+			return string(r[:cut]) + end, nil
 		}
 		chunk := string(r[:cut])
 		if idx := strings.LastIndex(chunk, " "); idx > 0 {
 			chunk = chunk[:idx]
 		}
-		return chunk + end
+		return chunk + end, nil
 	case "center":
 		width := 80
 		if len(args) > 0 {
 			width = toInt(args[0], 80)
 		}
-		s := fmt.Sprint(v)
-		if len(s) >= width {
-			return s
-		}
-		pad := width - len(s)
-		left := pad / 2
-		right := pad - left
-		return strings.Repeat(" ", left) + s + strings.Repeat(" ", right)
+		return centerText(fmt.Sprint(v), width), nil
 	case "indent":
-		width := 4
-		if len(args) > 0 {
-			width = toInt(args[0], 4)
-		}
-		prefix := strings.Repeat(" ", width)
-		lines := strings.Split(fmt.Sprint(v), "\n")
-		for i := range lines {
-			lines[i] = prefix + lines[i]
-		}
-		return strings.Join(lines, "\n")
+		return indentText(fmt.Sprint(v), argOr(args, 0, 4), toBool(argOr(args, 1, false), false), toBool(argOr(args, 2, false), false)), nil
 	case "sum":
-		arr := toSlice(v)
-		total := 0.0
-		for _, it := range arr {
-			total += toFloat(it, 0)
-		}
-		return total
+		return sumValues(v, optString(argOr(args, 0, nil)), argOr(args, 1, 0)), nil
 	case "random":
 		arr := toSlice(v)
 		if len(arr) == 0 {
-			return ""
+			return "", nil
 		}
-		return arr[rnd.Intn(len(arr))]
+		return arr[rnd.Intn(len(arr))], nil
 	case "batch":
 		size := 1
 		if len(args) > 0 {
@@ -842,11 +989,8 @@ func applyFilter(name string, v any, args []any) any {
 			size = 1
 		}
 		arr := toSlice(v)
-		fill := any(nil)
-		hasFill := len(args) > 1
-		if hasFill {
-			fill = args[1]
-		}
+		fill := argOr(args, 1, nil)
+		hasFill := fill != nil && !isMissing(fill)
 		out := []any{}
 		for i := 0; i < len(arr); i += size {
 			end := i + size
@@ -861,32 +1005,9 @@ func applyFilter(name string, v any, args []any) any {
 			}
 			out = append(out, chunk)
 		}
-		return out
+		return out, nil
 	case "slice":
-		parts := 1
-		if len(args) > 0 {
-			parts = toInt(args[0], 1)
-		}
-		if parts <= 0 {
-			parts = 1
-		}
-		arr := toSlice(v)
-		if len(arr) == 0 {
-			return []any{}
-		}
-		chunkSize := int(math.Ceil(float64(len(arr)) / float64(parts)))
-		if chunkSize <= 0 {
-			chunkSize = 1
-		}
-		out := []any{}
-		for i := 0; i < len(arr); i += chunkSize {
-			end := i + chunkSize
-			if end > len(arr) {
-				end = len(arr)
-			}
-			out = append(out, append([]any{}, arr[i:end]...))
-		}
-		return out
+		return sliceValues(v, toInt(argOr(args, 0, 1), 1), argOr(args, 1, nil)), nil
 	case "sort":
 		reverse := false
 		caseSens := false
@@ -900,25 +1021,26 @@ func applyFilter(name string, v any, args []any) any {
 		if len(args) > 2 {
 			attr = fmt.Sprint(args[2])
 		}
+		// attribute may list several, "last,first", compared in turn.
+		attrs := strings.Split(attr, ",")
 		arr := append([]any{}, toSlice(v)...)
 		sort.SliceStable(arr, func(i, j int) bool {
-			a := arr[i]
-			b := arr[j]
-			if attr != "" {
-				a = valueByPath(a, attr)
-				b = valueByPath(b, attr)
+			cmp := 0
+			for _, a := range attrs {
+				if cmp = compareAny(valueByPath(arr[i], strings.TrimSpace(a)), valueByPath(arr[j], strings.TrimSpace(a)), caseSens); cmp != 0 {
+					break
+				}
 			}
-			cmp := compareAny(a, b, caseSens)
 			if reverse {
 				return cmp > 0
 			}
 			return cmp < 0
 		})
-		return arr
+		return arr, nil
 	case "dictsort":
 		rv := reflect.ValueOf(v)
 		if !rv.IsValid() || rv.Kind() != reflect.Map {
-			return []any{}
+			return []any{}, nil
 		}
 		by := "key"
 		caseSens := false
@@ -943,7 +1065,7 @@ func applyFilter(name string, v any, args []any) any {
 			}
 		}
 		if by != "key" && by != "value" {
-			by = "key"
+			return nil, fmt.Errorf(`can only sort by "key" or "value", got %q`, by)
 		}
 		type pair struct {
 			k any
@@ -971,7 +1093,7 @@ func applyFilter(name string, v any, args []any) any {
 		for _, p := range pairs {
 			out = append(out, []any{p.k, p.v})
 		}
-		return out
+		return out, nil
 	case "groupby":
 		attr := ""
 		if len(args) > 0 {
@@ -1047,171 +1169,92 @@ func applyFilter(name string, v any, args []any) any {
 				"list":    g.list,
 			})
 		}
-		return out
-	case "select":
-		arr := toSlice(v)
-		out := []any{}
-		hasNeedle := len(args) > 0
-		var needle any
-		testName := ""
-		testArgs := []any{}
-		if hasNeedle {
-			if name, ok := args[0].(string); ok && isKnownTestName(name) {
-				testName = name
-				testArgs = args[1:]
-			} else {
-				needle = args[0]
-			}
-		}
-		for _, it := range arr {
-			if testName != "" {
-				if evalTestKeyword(it, testName, testArgs) {
-					out = append(out, it)
-				}
-			} else if hasNeedle {
-				if equalOp(it, needle) {
-					out = append(out, it)
-				}
-			} else if truthy(it) {
-				out = append(out, it)
-			}
-		}
-		return out
-	case "reject":
-		arr := toSlice(v)
-		out := []any{}
-		hasNeedle := len(args) > 0
-		var needle any
-		testName := ""
-		testArgs := []any{}
-		if hasNeedle {
-			if name, ok := args[0].(string); ok && isKnownTestName(name) {
-				testName = name
-				testArgs = args[1:]
-			} else {
-				needle = args[0]
-			}
-		}
-		for _, it := range arr {
-			if testName != "" {
-				if !evalTestKeyword(it, testName, testArgs) {
-					out = append(out, it)
-				}
-			} else if hasNeedle {
-				if !equalOp(it, needle) {
-					out = append(out, it)
-				}
-			} else if !truthy(it) {
-				out = append(out, it)
-			}
-		}
-		return out
-	case "selectattr":
-		attr := ""
-		if len(args) > 0 {
-			attr = fmt.Sprint(args[0])
-		}
-		arr := toSlice(v)
-		out := []any{}
-		hasNeedle := len(args) > 1
-		var needle any
-		testName := ""
-		testArgs := []any{}
-		if hasNeedle {
-			if name, ok := args[1].(string); ok && isKnownTestName(name) {
-				testName = name
-				testArgs = args[2:]
-			} else {
-				needle = args[1]
-			}
-		}
-		for _, it := range arr {
-			av := valueByPath(it, attr)
-			if testName != "" {
-				if evalTestKeyword(av, testName, testArgs) {
-					out = append(out, it)
-				}
-			} else if hasNeedle {
-				if equalOp(av, needle) {
-					out = append(out, it)
-				}
-			} else if truthy(av) {
-				out = append(out, it)
-			}
-		}
-		return out
-	case "rejectattr":
-		attr := ""
-		if len(args) > 0 {
-			attr = fmt.Sprint(args[0])
-		}
-		arr := toSlice(v)
-		out := []any{}
-		hasNeedle := len(args) > 1
-		var needle any
-		testName := ""
-		testArgs := []any{}
-		if hasNeedle {
-			if name, ok := args[1].(string); ok && isKnownTestName(name) {
-				testName = name
-				testArgs = args[2:]
-			} else {
-				needle = args[1]
-			}
-		}
-		for _, it := range arr {
-			av := valueByPath(it, attr)
-			if testName != "" {
-				if !evalTestKeyword(av, testName, testArgs) {
-					out = append(out, it)
-				}
-			} else if hasNeedle {
-				if !equalOp(av, needle) {
-					out = append(out, it)
-				}
-			} else if !truthy(av) {
-				out = append(out, it)
-			}
-		}
-		return out
+		return out, nil
 	default:
-		return v
+		return nil, errNoFilter
 	}
 }
 
-func invokeCallableValue(callable any, args []any, kwargs map[string]any, caller string) (any, error) {
+func invokeCallableValue(callable any, args []any, kwargs map[string]any, caller TemplateFunc) (any, error) {
 	switch fn := callable.(type) {
 	case TemplateFunc:
 		return fn(args, kwargs, caller)
 	case func(...any) any:
 		return fn(args...), nil
+	case *loopContext:
+		if fn.recurse == nil {
+			return "", fmt.Errorf("loop is not callable outside a recursive loop")
+		}
+		if len(args) != 1 {
+			return "", fmt.Errorf("loop() takes one iterable, got %d arguments", len(args))
+		}
+		return fn.recurse(args[0])
 	default:
+		if rv := reflect.ValueOf(callable); rv.Kind() == reflect.Func && !rv.IsNil() {
+			return callReflect(rv, args, kwargs)
+		}
 		return "", fmt.Errorf("value is not callable")
 	}
 }
 
-func invokeCallable(name string, argExprs []string, caller string, vars, ctx map[string]any) (any, error) {
-	raw := resolveIdent(name, vars, ctx)
-	posExprs, kwExprs := parseCallableArgs(argExprs)
-	args := make([]any, 0, len(posExprs))
-	kwargs := map[string]any{}
-	for _, a := range posExprs {
-		args = append(args, evalExpr(a, vars, ctx))
-	}
-	for k, expr := range kwExprs {
-		kwargs[k] = evalExpr(expr, vars, ctx)
+func isCallable(v any) bool {
+	switch fn := v.(type) {
+	case TemplateFunc, func(...any) any:
+		return true
+	case *loopContext:
+		return fn.recurse != nil
 	}
-	return invokeCallableValue(raw, args, kwargs, caller)
+	rv := reflect.ValueOf(v)
+	return rv.Kind() == reflect.Func && !rv.IsNil()
 }
 
-func truthy(v any) bool {
-	switch x := v.(type) {
-	case nil:
+// exprPath returns the dotted path of a name or attribute chain, or "".
+func exprPath(n exprNode) string {
+	switch n := n.(type) {
+	case *nameExpr:
+		return n.name
+	case *attrExpr:
+		if inner := exprPath(n.target); inner != "" {
+			return inner + "." + n.name
+		}
+	case *indexExpr:
+		inner := exprPath(n.target)
+		if inner == "" {
+			return ""
+		}
+		switch idx := n.index.(type) {
+		case *literalExpr:
+			if s, ok := idx.value.(string); ok {
+				return inner + "[" + strconv.Quote(s) + "]"
+			}
+			return inner + "[" + fmt.Sprint(idx.value) + "]"
+		default:
+			if key := exprPath(idx); key != "" {
+				return inner + "[" + key + "]"
+			}
+		}
+	}
+	return ""
+}
+
+// exprLabel names an expression in error messages.
+func exprLabel(n exprNode) string {
+	if path := exprPath(n); path != "" {
+		return fmt.Sprintf("%q", path)
+	}
+	return "value"
+}
+
+func truthy(v any) bool {
+	switch x := v.(type) {
+	case nil, missingValue:
 		return false
 	case bool:
 		return x
 	case string:
 		return strings.TrimSpace(x) != ""
+	case SafeString:
+		return strings.TrimSpace(string(x)) != ""
 	case int:
 		return x != 0
 	case int64:
@@ -1222,8 +1265,10 @@ func truthy(v any) bool {
 		return len(x) > 0
 	case map[string]any:
 		return len(x) > 0
+	case OrderedMap:
+		return len(x.Keys()) > 0
 	default:
-		return true
+		return reflectTruthy(v)
 	}
 }
 
@@ -1296,6 +1341,7 @@ func compareOp(a any, b any, op string) bool {
 }
 
 func equalOp(a any, b any) bool {
+	a, b = plainString(a), plainString(b)
 	if isMissing(a) && isMissing(b) {
 		return true
 	}
@@ -1319,6 +1365,7 @@ const (
 	tokPipe
 	tokPlus
 	tokMinus
+	tokTilde
 	tokStar
 	tokSlash
 	tokPercent
@@ -1336,13 +1383,57 @@ const (
 	tokElse
 	tokIs
 	tokIn
+	tokLBracket
+	tokRBracket
+	tokColon
+	tokLBrace
+	tokRBrace
 )
 
 type exprToken struct {
 	kind exprTokenKind
 	lit  string
+	pos  int
+}
+
+var exprTokenNames = map[exprTokenKind]string{
+	tokEOF:      "end of expression",
+	tokLParen:   `"("`,
+	tokRParen:   `")"`,
+	tokComma:    `","`,
+	tokElse:     `"else"`,
+	tokLBracket: `"["`,
+	tokRBracket: `"]"`,
+	tokColon:    `":"`,
+	tokLBrace:   `"{"`,
+	tokRBrace:   `"}"`,
+}
+
+func (k exprTokenKind) String() string {
+	if name, ok := exprTokenNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("token %d", int(k))
+}
+
+func (t exprToken) String() string {
+	if t.kind == tokEOF {
+		return t.kind.String()
+	}
+	if t.kind == tokString {
+		return strconv.Quote(t.lit)
+	}
+	return fmt.Sprintf("%q", t.lit)
+}
+
+// exprError is a syntax error at byte offset pos of an expression.
+type exprError struct {
+	pos int
+	msg string
 }
 
+func (e *exprError) Error() string { return e.msg }
+
 func lexExpr(src string) ([]exprToken, error) {
 	tokens := make([]exprToken, 0, len(src)/2)
 	i := 0
@@ -1357,7 +1448,7 @@ func lexExpr(src string) ([]exprToken, error) {
 			dot := ch == '.'
 			if ch == '.' {
 				if i+1 >= len(src) || src[i+1] < '0' || src[i+1] > '9' {
-					tokens = append(tokens, exprToken{kind: tokDot, lit: "."})
+					tokens = append(tokens, exprToken{kind: tokDot, lit: ".", pos: i})
 					i++
 					continue
 				}
@@ -1375,7 +1466,7 @@ func lexExpr(src string) ([]exprToken, error) {
 				}
 				break
 			}
-			tokens = append(tokens, exprToken{kind: tokNumber, lit: src[i:j]})
+			tokens = append(tokens, exprToken{kind: tokNumber, lit: src[i:j], pos: i})
 			i = j
 			continue
 		}
@@ -1393,9 +1484,9 @@ func lexExpr(src string) ([]exprToken, error) {
 				j++
 			}
 			if j >= len(src) {
-				return nil, fmt.Errorf("unterminated string")
+				return nil, &exprError{pos: i, msg: "unterminated string"}
 			}
-			tokens = append(tokens, exprToken{kind: tokString, lit: src[i+1 : j]})
+			tokens = append(tokens, exprToken{kind: tokString, lit: src[i+1 : j], pos: i})
 			i = j + 1
 			continue
 		}
@@ -1412,21 +1503,21 @@ func lexExpr(src string) ([]exprToken, error) {
 			lit := src[i:j]
 			switch lit {
 			case "and":
-				tokens = append(tokens, exprToken{kind: tokAnd, lit: lit})
+				tokens = append(tokens, exprToken{kind: tokAnd, lit: lit, pos: i})
 			case "or":
-				tokens = append(tokens, exprToken{kind: tokOr, lit: lit})
+				tokens = append(tokens, exprToken{kind: tokOr, lit: lit, pos: i})
 			case "not":
-				tokens = append(tokens, exprToken{kind: tokNot, lit: lit})
+				tokens = append(tokens, exprToken{kind: tokNot, lit: lit, pos: i})
 			case "is":
-				tokens = append(tokens, exprToken{kind: tokIs, lit: lit})
+				tokens = append(tokens, exprToken{kind: tokIs, lit: lit, pos: i})
 			case "in":
-				tokens = append(tokens, exprToken{kind: tokIn, lit: lit})
+				tokens = append(tokens, exprToken{kind: tokIn, lit: lit, pos: i})
 			case "if":
-				tokens = append(tokens, exprToken{kind: tokIf, lit: lit})
+				tokens = append(tokens, exprToken{kind: tokIf, lit: lit, pos: i})
 			case "else":
-				tokens = append(tokens, exprToken{kind: tokElse, lit: lit})
+				tokens = append(tokens, exprToken{kind: tokElse, lit: lit, pos: i})
 			default:
-				tokens = append(tokens, exprToken{kind: tokIdent, lit: lit})
+				tokens = append(tokens, exprToken{kind: tokIdent, lit: lit, pos: i})
 			}
 			i = j
 			continue
@@ -1436,27 +1527,27 @@ func lexExpr(src string) ([]exprToken, error) {
 			two := src[i : i+2]
 			switch two {
 			case "==":
-				tokens = append(tokens, exprToken{kind: tokEq, lit: two})
+				tokens = append(tokens, exprToken{kind: tokEq, lit: two, pos: i})
 				i += 2
 				continue
 			case "!=":
-				tokens = append(tokens, exprToken{kind: tokNe, lit: two})
+				tokens = append(tokens, exprToken{kind: tokNe, lit: two, pos: i})
 				i += 2
 				continue
 			case "<=":
-				tokens = append(tokens, exprToken{kind: tokLte, lit: two})
+				tokens = append(tokens, exprToken{kind: tokLte, lit: two, pos: i})
 				i += 2
 				continue
 			case ">=":
-				tokens = append(tokens, exprToken{kind: tokGte, lit: two})
+				tokens = append(tokens, exprToken{kind: tokGte, lit: two, pos: i})
 				i += 2
 				continue
 			case "&&":
-				tokens = append(tokens, exprToken{kind: tokAnd, lit: two})
+				tokens = append(tokens, exprToken{kind: tokAnd, lit: two, pos: i})
 				i += 2
 				continue
 			case "||":
-				tokens = append(tokens, exprToken{kind: tokOr, lit: two})
+				tokens = append(tokens, exprToken{kind: tokOr, lit: two, pos: i})
 				i += 2
 				continue
 			}
@@ -1464,47 +1555,381 @@ func lexExpr(src string) ([]exprToken, error) {
 
 		switch ch {
 		case '(':
-			tokens = append(tokens, exprToken{kind: tokLParen, lit: "("})
+			tokens = append(tokens, exprToken{kind: tokLParen, lit: "(", pos: i})
 		case ')':
-			tokens = append(tokens, exprToken{kind: tokRParen, lit: ")"})
+			tokens = append(tokens, exprToken{kind: tokRParen, lit: ")", pos: i})
 		case ',':
-			tokens = append(tokens, exprToken{kind: tokComma, lit: ","})
+			tokens = append(tokens, exprToken{kind: tokComma, lit: ",", pos: i})
+		case '[':
+			tokens = append(tokens, exprToken{kind: tokLBracket, lit: "[", pos: i})
+		case ']':
+			tokens = append(tokens, exprToken{kind: tokRBracket, lit: "]", pos: i})
+		case ':':
+			tokens = append(tokens, exprToken{kind: tokColon, lit: ":", pos: i})
+		case '{':
+			tokens = append(tokens, exprToken{kind: tokLBrace, lit: "{", pos: i})
+		case '}':
+			tokens = append(tokens, exprToken{kind: tokRBrace, lit: "}", pos: i})
 		case '.':
-			tokens = append(tokens, exprToken{kind: tokDot, lit: "."})
+			tokens = append(tokens, exprToken{kind: tokDot, lit: ".", pos: i})
 		case '|':
-			tokens = append(tokens, exprToken{kind: tokPipe, lit: "|"})
+			tokens = append(tokens, exprToken{kind: tokPipe, lit: "|", pos: i})
 		case '+':
-			tokens = append(tokens, exprToken{kind: tokPlus, lit: "+"})
+			tokens = append(tokens, exprToken{kind: tokPlus, lit: "+", pos: i})
 		case '-':
-			tokens = append(tokens, exprToken{kind: tokMinus, lit: "-"})
+			tokens = append(tokens, exprToken{kind: tokMinus, lit: "-", pos: i})
+		case '~':
+			tokens = append(tokens, exprToken{kind: tokTilde, lit: "~", pos: i})
 		case '*':
-			tokens = append(tokens, exprToken{kind: tokStar, lit: "*"})
+			tokens = append(tokens, exprToken{kind: tokStar, lit: "*", pos: i})
 		case '/':
-			tokens = append(tokens, exprToken{kind: tokSlash, lit: "/"})
+			tokens = append(tokens, exprToken{kind: tokSlash, lit: "/", pos: i})
 		case '%':
-			tokens = append(tokens, exprToken{kind: tokPercent, lit: "%"})
+			tokens = append(tokens, exprToken{kind: tokPercent, lit: "%", pos: i})
 		case '<':
-			tokens = append(tokens, exprToken{kind: tokLt, lit: "<"})
+			tokens = append(tokens, exprToken{kind: tokLt, lit: "<", pos: i})
 		case '>':
-			tokens = append(tokens, exprToken{kind: tokGt, lit: ">"})
+			tokens = append(tokens, exprToken{kind: tokGt, lit: ">", pos: i})
 		case '!':
-			tokens = append(tokens, exprToken{kind: tokNot, lit: "!"})
+			tokens = append(tokens, exprToken{kind: tokNot, lit: "!", pos: i})
 		case '=':
-			tokens = append(tokens, exprToken{kind: tokAssign, lit: "="})
+			tokens = append(tokens, exprToken{kind: tokAssign, lit: "=", pos: i})
 		default:
-			return nil, fmt.Errorf("unexpected token: %c", ch)
+			return nil, &exprError{pos: i, msg: fmt.Sprintf("unexpected character %q", ch)}
 		}
 		i++
 	}
-	tokens = append(tokens, exprToken{kind: tokEOF})
+	tokens = append(tokens, exprToken{kind: tokEOF, pos: len(src)})
 	return tokens, nil
 }
 
+// exprNode is a compiled expression. Expressions are parsed once and can be
+// evaluated any number of times against different scopes.
+type exprNode interface{}
+
+type literalExpr struct {
+	value any
+}
+
+type nameExpr struct {
+	name string
+}
+
+type attrExpr struct {
+	target exprNode
+	name   string
+}
+
+// indexExpr is target[index]: an item of a sequence or mapping, or an
+// attribute looked up by a computed name.
+type indexExpr struct {
+	target exprNode
+	index  exprNode
+}
+
+// sliceExpr is target[start:stop:step]. Omitted parts are nil.
+type sliceExpr struct {
+	target exprNode
+	start  exprNode
+	stop   exprNode
+	step   exprNode
+}
+
+// listExpr is a [a, b] list or (a, b) tuple literal. Both evaluate to a
+// []any; tuple only records how the literal was written.
+type listExpr struct {
+	items []exprNode
+	tuple bool
+}
+
+// dictExpr is a {key: value} literal. Keys are expressions whose values
+// are formatted as strings.
+type dictExpr struct {
+	keys   []exprNode
+	values []exprNode
+}
+
+type kwargExpr struct {
+	name  string
+	value exprNode
+}
+
+type callExpr struct {
+	fn     exprNode
+	args   []exprNode
+	kwargs []kwargExpr
+}
+
+type filterCall struct {
+	name   string
+	args   []exprNode
+	kwargs []kwargExpr
+}
+
+type filterExpr struct {
+	target exprNode
+	filter filterCall
+}
+
+type unaryExpr struct {
+	op      exprTokenKind
+	operand exprNode
+}
+
+type binaryExpr struct {
+	op    string
+	left  exprNode
+	right exprNode
+}
+
+type logicalExpr struct {
+	and   bool
+	left  exprNode
+	right exprNode
+}
+
+type compareStep struct {
+	op     string
+	right  exprNode
+	test   string
+	args   []exprNode
+	kwargs []kwargExpr
+	negate bool
+}
+
+type compareExpr struct {
+	left  exprNode
+	steps []compareStep
+}
+
+type condExpr struct {
+	then      exprNode
+	cond      exprNode
+	otherwise exprNode
+}
+
+// evalScope is what an expression is evaluated against: the variables in
+// scope and the Env rendering them, which is nil outside a render.
+type evalScope struct {
+	env   *Env
+	state *renderState
+	vars  map[string]any
+	ctx   map[string]any
+	// autoescape reports whether the template escapes its output, which
+	// makes join escape items joined with a SafeString.
+	autoescape bool
+}
+
+// orderedMaps reports whether OrderedMap values keep their own key order.
+func (s *evalScope) orderedMaps() bool {
+	return s.env != nil && s.env.preserveMapOrder
+}
+
+// compiledExpr is a parsed expression together with its source. When the
+// source does not parse, evaluation falls back to a literal or identifier.
+type compiledExpr struct {
+	src  string
+	root exprNode
+	err  error
+}
+
+func compileExpr(src string) *compiledExpr {
+	c := &compiledExpr{src: src}
+	toks, err := lexExpr(src)
+	if err != nil {
+		c.err = err
+		return c
+	}
+	p := &exprParser{toks: toks}
+	c.root, c.err = p.parseExpression()
+	if c.err == nil && p.cur().kind != tokEOF {
+		c.err = p.errorf("unexpected %s", p.cur())
+	}
+	return c
+}
+
+func (c *compiledExpr) eval(s *evalScope) any {
+	if c.err == nil {
+		v, err := evalNode(c.root, s)
+		if err == nil {
+			return v
+		}
+	}
+	if lit, ok := parseLiteral(strings.TrimSpace(c.src)); ok {
+		return lit
+	}
+	v, _ := s.state.lookup(strings.TrimSpace(c.src), s.vars, s.ctx)
+	return v
+}
+
+// evaluate returns the value of the expression, or the error raised while
+// computing it, such as calling a value that is not callable.
+func (c *compiledExpr) evaluate(s *evalScope) (any, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return evalNode(c.root, s)
+}
+
+// compileFilterChain parses `name(args) | other` as used by filter blocks.
+func compileFilterChain(src string) ([]filterCall, error) {
+	toks, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	out := []filterCall{}
+	for {
+		fc, err := p.parseFilterCall()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, fc)
+		if !p.match(tokPipe) {
+			break
+		}
+	}
+	if p.cur().kind != tokEOF {
+		return nil, p.errorf("unexpected %s in filter", p.cur())
+	}
+	return out, nil
+}
+
+// compileForIter parses what follows "in" in a for tag: the iterable, an
+// optional `if` filter and an optional `recursive` flag. The iterable is
+// not a conditional expression, so `if` starts the filter.
+func compileForIter(src string) (iter, cond *compiledExpr, recursive bool, err error) {
+	toks, err := lexExpr(src)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	p := &exprParser{toks: toks}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	iter = &compiledExpr{src: src, root: root}
+	if p.match(tokIf) {
+		test, err := p.parseExpression()
+		if err != nil {
+			return nil, nil, false, err
+		}
+		cond = &compiledExpr{src: src, root: test}
+	}
+	if t := p.cur(); t.kind == tokIdent && t.lit == "recursive" {
+		recursive = true
+		p.advance()
+	}
+	if p.cur().kind != tokEOF {
+		return nil, nil, false, p.errorf("unexpected %s", p.cur())
+	}
+	return iter, cond, recursive, nil
+}
+
+// compileSetHead parses what follows "set": comma-separated targets, each
+// a name or a namespace attribute (ns.attr), then `= value`. Several values
+// separated by commas form a tuple. Without "=" the tag is a block set with
+// a single target, whose body may be piped through filters; value is then
+// nil.
+func compileSetHead(src string) (targets []string, value *compiledExpr, filters []filterCall, err error) {
+	toks, err := lexExpr(src)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	p := &exprParser{toks: toks}
+	for {
+		if p.cur().kind != tokIdent {
+			return nil, nil, nil, p.errorf("expected name to set, got %s", p.cur())
+		}
+		target := p.cur().lit
+		p.advance()
+		if p.match(tokDot) {
+			if p.cur().kind != tokIdent {
+				return nil, nil, nil, p.errorf("expected attribute name after \".\", got %s", p.cur())
+			}
+			target += "." + p.cur().lit
+			p.advance()
+		}
+		targets = append(targets, target)
+		if !p.match(tokComma) {
+			break
+		}
+	}
+	if p.match(tokAssign) {
+		items := []exprNode{}
+		tuple := false
+		for {
+			v, err := p.parseExpression()
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			items = append(items, v)
+			if !p.match(tokComma) {
+				break
+			}
+			tuple = true
+			if p.cur().kind == tokEOF {
+				break
+			}
+		}
+		if p.cur().kind != tokEOF {
+			return nil, nil, nil, p.errorf("unexpected %s", p.cur())
+		}
+		root := items[0]
+		if tuple {
+			root = &listExpr{items: items, tuple: true}
+		}
+		return targets, &compiledExpr{src: src, root: root}, nil, nil
+	}
+	if len(targets) > 1 {
+		return nil, nil, nil, p.errorf("expected \"=\", got %s", p.cur())
+	}
+	for p.match(tokPipe) {
+		fc, err := p.parseFilterCall()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		filters = append(filters, fc)
+	}
+	if p.cur().kind != tokEOF {
+		return nil, nil, nil, p.errorf("unexpected %s", p.cur())
+	}
+	return targets, nil, filters, nil
+}
+
+// compileWithHead parses the `name = value, ...` assignments of a with tag.
+func compileWithHead(src string) ([]setAssign, error) {
+	toks, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	assigns := []setAssign{}
+	for p.cur().kind != tokEOF {
+		if p.cur().kind != tokIdent || p.next().kind != tokAssign {
+			return nil, p.errorf("expected name = value, got %s", p.cur())
+		}
+		name := p.cur().lit
+		p.advance()
+		p.advance()
+		v, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		assigns = append(assigns, setAssign{name: name, expr: &compiledExpr{src: src, root: v}})
+		if !p.match(tokComma) && p.cur().kind != tokEOF {
+			return nil, p.errorf("unexpected %s", p.cur())
+		}
+	}
+	return assigns, nil
+}
+
 type exprParser struct {
 	toks []exprToken
 	pos  int
-	vars map[string]any
-	ctx  map[string]any
+	// bareKeys reads identifier keys in dict literals as strings, as in
+	// JavaScript object literals, instead of as variables.
+	bareKeys bool
 }
 
 func (p *exprParser) cur() exprToken {
@@ -1535,19 +1960,23 @@ func (p *exprParser) match(k exprTokenKind) bool {
 	return false
 }
 
+func (p *exprParser) errorf(format string, args ...any) error {
+	return &exprError{pos: p.cur().pos, msg: fmt.Sprintf(format, args...)}
+}
+
 func (p *exprParser) expect(k exprTokenKind) error {
 	if p.cur().kind != k {
-		return fmt.Errorf("expected %v, got %v", k, p.cur().kind)
+		return p.errorf("expected %s, got %s", k, p.cur())
 	}
 	p.advance()
 	return nil
 }
 
-func (p *exprParser) parseExpression() (any, error) {
+func (p *exprParser) parseExpression() (exprNode, error) {
 	return p.parseConditional()
 }
 
-func (p *exprParser) parseConditional() (any, error) {
+func (p *exprParser) parseConditional() (exprNode, error) {
 	left, err := p.parseOr()
 	if err != nil {
 		return nil, err
@@ -1564,15 +1993,12 @@ func (p *exprParser) parseConditional() (any, error) {
 		if err != nil {
 			return nil, err
 		}
-		if truthy(cond) {
-			return left, nil
-		}
-		return right, nil
+		return &condExpr{then: left, cond: cond, otherwise: right}, nil
 	}
 	return left, nil
 }
 
-func (p *exprParser) parseOr() (any, error) {
+func (p *exprParser) parseOr() (exprNode, error) {
 	left, err := p.parseAnd()
 	if err != nil {
 		return nil, err
@@ -1583,12 +2009,12 @@ func (p *exprParser) parseOr() (any, error) {
 		if err != nil {
 			return nil, err
 		}
-		left = truthy(left) || truthy(right)
+		left = &logicalExpr{and: false, left: left, right: right}
 	}
 	return left, nil
 }
 
-func (p *exprParser) parseAnd() (any, error) {
+func (p *exprParser) parseAnd() (exprNode, error) {
 	left, err := p.parseCompare()
 	if err != nil {
 		return nil, err
@@ -1599,105 +2025,85 @@ func (p *exprParser) parseAnd() (any, error) {
 		if err != nil {
 			return nil, err
 		}
-		left = truthy(left) && truthy(right)
+		left = &logicalExpr{and: true, left: left, right: right}
 	}
 	return left, nil
 }
 
-func (p *exprParser) parseCompare() (any, error) {
-	left, err := p.parseAdd()
+func (p *exprParser) parseCompare() (exprNode, error) {
+	left, err := p.parseConcat()
 	if err != nil {
 		return nil, err
 	}
-	prev := left
-	hasCmp := false
-	result := true
+	steps := []compareStep{}
 
 	for {
 		op := p.cur().kind
 		if op != tokEq && op != tokNe && op != tokLt && op != tokLte && op != tokGt && op != tokGte && op != tokIs && op != tokIn && !(op == tokNot && p.next().kind == tokIn) {
 			break
 		}
-		hasCmp = true
 		opLit := p.cur().lit
-		isNot := false
 		if op == tokNot && p.next().kind == tokIn {
 			p.advance()
 			p.advance()
 			opLit = "not in"
 		} else if op == tokIs {
 			p.advance()
+			isNot := false
 			if p.cur().kind == tokNot {
 				isNot = true
 				p.advance()
 			}
-			if p.cur().kind == tokIdent {
-				testKw := p.cur().lit
-				if isKnownTestName(testKw) {
+			if p.cur().kind == tokIdent || p.cur().kind == tokIn {
+				step := compareStep{op: "is", test: p.cur().lit, negate: isNot}
+				p.advance()
+				switch p.cur().kind {
+				case tokLParen:
 					p.advance()
-					testArgs := []any{}
-					if p.cur().kind == tokLParen {
-						p.advance()
-						args, kwargs, err := p.parseCallArgs()
-						if err != nil {
-							return nil, err
-						}
-						if len(kwargs) > 0 {
-							return nil, fmt.Errorf("named args in tests not supported")
-						}
-						if err := p.expect(tokRParen); err != nil {
-							return nil, err
-						}
-						testArgs = args
+					args, kwargs, err := p.parseCallArgs()
+					if err != nil {
+						return nil, err
 					}
-					ok := evalTestKeyword(prev, testKw, testArgs)
-					if isNot {
-						ok = !ok
+					if err := p.expect(tokRParen); err != nil {
+						return nil, err
 					}
-					result = result && ok
-					// preserve chain semantics: a is defined is true compares bool->right next
-					prev = ok
-					continue
+					step.args = args
+					step.kwargs = kwargs
+				case tokIdent, tokString, tokNumber, tokLBracket, tokLBrace:
+					// As in Jinja, a test takes one argument without
+					// parentheses: `n is divisibleby 3`, `x is in [1, 2]`.
+					arg, err := p.parsePostfix(true)
+					if err != nil {
+						return nil, err
+					}
+					step.args = []exprNode{arg}
 				}
+				steps = append(steps, step)
+				continue
 			}
 			// fallback: "a is b"
-			right, err := p.parseAdd()
+			right, err := p.parseConcat()
 			if err != nil {
 				return nil, err
 			}
-			ok := compareOp(prev, right, "==")
-			if isNot {
-				ok = !ok
-			}
-			result = result && ok
-			prev = right
+			steps = append(steps, compareStep{op: "is", right: right, negate: isNot})
 			continue
 		} else {
 			p.advance()
 		}
-		right, err := p.parseAdd()
+		right, err := p.parseConcat()
 		if err != nil {
 			return nil, err
 		}
-		var ok bool
-		switch opLit {
-		case "in":
-			ok = containsOp(right, prev)
-		case "not in":
-			ok = !containsOp(right, prev)
-		default:
-			ok = compareOp(prev, right, opLit)
-		}
-		result = result && ok
-		prev = right
+		steps = append(steps, compareStep{op: opLit, right: right})
 	}
-	if hasCmp {
-		return result, nil
+	if len(steps) == 0 {
+		return left, nil
 	}
-	return left, nil
+	return &compareExpr{left: left, steps: steps}, nil
 }
 
-func (p *exprParser) parseAdd() (any, error) {
+func (p *exprParser) parseAdd() (exprNode, error) {
 	left, err := p.parseMul()
 	if err != nil {
 		return nil, err
@@ -1709,55 +2115,84 @@ func (p *exprParser) parseAdd() (any, error) {
 		if err != nil {
 			return nil, err
 		}
-		left = numericOp(left, right, op)
+		left = &binaryExpr{op: op, left: left, right: right}
 	}
 	return left, nil
 }
 
-func (p *exprParser) parseMul() (any, error) {
-	left, err := p.parseUnary()
+// parseConcat parses a ~ b, which joins both sides as strings. As in
+// Nunjucks, ~ binds looser than + and -, so "page-" ~ n + 1 adds first.
+func (p *exprParser) parseConcat() (exprNode, error) {
+	left, err := p.parseAdd()
+	if err != nil {
+		return nil, err
+	}
+	for p.cur().kind == tokTilde {
+		p.advance()
+		right, err := p.parseAdd()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: "~", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseMul() (exprNode, error) {
+	left, err := p.parseUnary(true)
 	if err != nil {
 		return nil, err
 	}
 	for p.cur().kind == tokStar || p.cur().kind == tokSlash || p.cur().kind == tokPercent {
 		op := p.cur().lit
 		p.advance()
-		right, err := p.parseUnary()
+		right, err := p.parseUnary(true)
 		if err != nil {
 			return nil, err
 		}
-		left = numericOp(left, right, op)
+		left = &binaryExpr{op: op, left: left, right: right}
 	}
 	return left, nil
 }
 
-func (p *exprParser) parseUnary() (any, error) {
-	if p.cur().kind == tokNot {
+// parseUnary parses a unary expression. As in Jinja, the filters after a
+// negated operand apply to the negation: -1|abs is 1. filters is false for
+// that operand, which leaves them to the caller.
+func (p *exprParser) parseUnary(filters bool) (exprNode, error) {
+	switch p.cur().kind {
+	case tokNot:
 		p.advance()
-		v, err := p.parseUnary()
+		v, err := p.parseUnary(filters)
 		if err != nil {
 			return nil, err
 		}
-		return !truthy(v), nil
-	}
-	if p.cur().kind == tokMinus {
+		return &unaryExpr{op: tokNot, operand: v}, nil
+	case tokMinus:
 		p.advance()
-		v, err := p.parseUnary()
+		v, err := p.parseUnary(false)
 		if err != nil {
 			return nil, err
 		}
-		return -toFloat(v, 0), nil
-	}
-	if p.cur().kind == tokPlus {
+		var neg exprNode = &unaryExpr{op: tokMinus, operand: v}
+		for filters && p.cur().kind == tokPipe {
+			p.advance()
+			fc, err := p.parseFilterCall()
+			if err != nil {
+				return nil, err
+			}
+			neg = &filterExpr{target: neg, filter: fc}
+		}
+		return neg, nil
+	case tokPlus:
 		p.advance()
-		return p.parseUnary()
+		return p.parseUnary(filters)
 	}
-	return p.parsePostfix()
+	return p.parsePostfix(filters)
 }
 
-func (p *exprParser) parseCallArgs() ([]any, map[string]any, error) {
-	args := []any{}
-	kwargs := map[string]any{}
+func (p *exprParser) parseCallArgs() ([]exprNode, []kwargExpr, error) {
+	args := []exprNode{}
+	kwargs := []kwargExpr{}
 	if p.cur().kind == tokRParen {
 		return args, kwargs, nil
 	}
@@ -1770,7 +2205,7 @@ func (p *exprParser) parseCallArgs() ([]any, map[string]any, error) {
 			if err != nil {
 				return nil, nil, err
 			}
-			kwargs[name] = v
+			kwargs = append(kwargs, kwargExpr{name: name, value: v})
 		} else {
 			v, err := p.parseExpression()
 			if err != nil {
@@ -1786,7 +2221,30 @@ func (p *exprParser) parseCallArgs() ([]any, map[string]any, error) {
 	return args, kwargs, nil
 }
 
-func (p *exprParser) parsePostfix() (any, error) {
+func (p *exprParser) parseFilterCall() (filterCall, error) {
+	if p.cur().kind != tokIdent {
+		return filterCall{}, p.errorf("expected filter name, got %s", p.cur())
+	}
+	fc := filterCall{name: p.cur().lit}
+	p.advance()
+	if p.cur().kind == tokLParen {
+		p.advance()
+		args, kwargs, err := p.parseCallArgs()
+		if err != nil {
+			return filterCall{}, err
+		}
+		if err := p.expect(tokRParen); err != nil {
+			return filterCall{}, err
+		}
+		fc.args = args
+		fc.kwargs = kwargs
+	}
+	return fc, nil
+}
+
+// parsePostfix parses a primary expression followed by attribute lookups,
+// subscripts, calls and, when filters is set, filters.
+func (p *exprParser) parsePostfix(filters bool) (exprNode, error) {
 	val, err := p.parsePrimary()
 	if err != nil {
 		return nil, err
@@ -1796,15 +2254,15 @@ func (p *exprParser) parsePostfix() (any, error) {
 		case tokDot:
 			p.advance()
 			if p.cur().kind != tokIdent {
-				return nil, fmt.Errorf("expected identifier after dot")
+				return nil, p.errorf("expected attribute name after \".\", got %s", p.cur())
 			}
-			key := p.cur().lit
+			val = &attrExpr{target: val, name: p.cur().lit}
 			p.advance()
-			switch m := val.(type) {
-			case map[string]any:
-				val = m[key]
-			default:
-				val = ""
+		case tokLBracket:
+			p.advance()
+			val, err = p.parseSubscript(val)
+			if err != nil {
+				return nil, err
 			}
 		case tokLParen:
 			p.advance()
@@ -1815,100 +2273,419 @@ func (p *exprParser) parsePostfix() (any, error) {
 			if err := p.expect(tokRParen); err != nil {
 				return nil, err
 			}
-			called, err := invokeCallableValue(val, args, kwargs, "")
-			if err != nil {
-				return nil, err
-			}
-			val = called
+			val = &callExpr{fn: val, args: args, kwargs: kwargs}
 		case tokPipe:
+			if !filters {
+				return val, nil
+			}
 			p.advance()
-			if p.cur().kind != tokIdent {
-				return nil, fmt.Errorf("expected filter name")
+			fc, err := p.parseFilterCall()
+			if err != nil {
+				return nil, err
 			}
-			fname := p.cur().lit
+			val = &filterExpr{target: val, filter: fc}
+		default:
+			return val, nil
+		}
+	}
+}
+
+// parseSubscript parses the part of target[...] after the "[": an index or a
+// start:stop:step slice.
+func (p *exprParser) parseSubscript(target exprNode) (exprNode, error) {
+	var parts [3]exprNode
+	colons := 0
+	for {
+		switch p.cur().kind {
+		case tokRBracket:
 			p.advance()
-			fargs := []any{}
-			if p.cur().kind == tokLParen {
-				p.advance()
-				args, kwargs, err := p.parseCallArgs()
-				if err != nil {
-					return nil, err
-				}
-				if len(kwargs) > 0 {
-					return nil, fmt.Errorf("named args in filters not supported")
-				}
-				fargs = args
-				if err := p.expect(tokRParen); err != nil {
-					return nil, err
+			if colons == 0 {
+				if parts[0] == nil {
+					return nil, p.errorf("expected index or slice inside []")
 				}
+				return &indexExpr{target: target, index: parts[0]}, nil
 			}
-			val = applyFilter(fname, val, fargs)
+			return &sliceExpr{target: target, start: parts[0], stop: parts[1], step: parts[2]}, nil
+		case tokColon:
+			if colons == 2 {
+				return nil, p.errorf("unexpected %s", p.cur())
+			}
+			colons++
+			p.advance()
 		default:
-			return val, nil
+			if parts[colons] != nil {
+				return nil, p.errorf("expected \"]\", got %s", p.cur())
+			}
+			part, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			parts[colons] = part
 		}
 	}
 }
 
-func (p *exprParser) parsePrimary() (any, error) {
+func (p *exprParser) parsePrimary() (exprNode, error) {
 	t := p.cur()
 	switch t.kind {
 	case tokNumber:
 		p.advance()
 		if strings.Contains(t.lit, ".") {
 			f, _ := strconv.ParseFloat(t.lit, 64)
-			return f, nil
+			return &literalExpr{value: f}, nil
 		}
 		i, _ := strconv.Atoi(t.lit)
-		return i, nil
+		return &literalExpr{value: i}, nil
 	case tokString:
 		p.advance()
-		return t.lit, nil
+		return &literalExpr{value: t.lit}, nil
 	case tokIdent:
 		p.advance()
 		switch t.lit {
 		case "true":
-			return true, nil
+			return &literalExpr{value: true}, nil
 		case "false":
-			return false, nil
-		case "null", "nil":
-			return nil, nil
+			return &literalExpr{value: false}, nil
+		case "True":
+			return &literalExpr{value: true}, nil
+		case "False":
+			return &literalExpr{value: false}, nil
+		case "null", "nil", "none", "None":
+			return &literalExpr{value: nil}, nil
 		default:
-			return resolveIdent(t.lit, p.vars, p.ctx), nil
+			return &nameExpr{name: t.lit}, nil
 		}
 	case tokLParen:
 		p.advance()
+		if p.match(tokRParen) {
+			return &listExpr{items: []exprNode{}, tuple: true}, nil
+		}
 		v, err := p.parseExpression()
 		if err != nil {
 			return nil, err
 		}
-		if err := p.expect(tokRParen); err != nil {
+		if p.cur().kind != tokComma {
+			if err := p.expect(tokRParen); err != nil {
+				return nil, err
+			}
+			return v, nil
+		}
+		p.advance()
+		rest, err := p.parseItems(tokRParen)
+		if err != nil {
 			return nil, err
 		}
-		return v, nil
+		return &listExpr{items: append([]exprNode{v}, rest...), tuple: true}, nil
+	case tokLBracket:
+		p.advance()
+		items, err := p.parseItems(tokRBracket)
+		if err != nil {
+			return nil, err
+		}
+		return &listExpr{items: items}, nil
+	case tokLBrace:
+		p.advance()
+		return p.parseDict()
 	default:
-		return "", fmt.Errorf("unexpected token in expression")
+		return nil, p.errorf("unexpected %s", t)
 	}
 }
 
-func evalExpr(expr string, vars, ctx map[string]any) any {
-	toks, err := lexExpr(expr)
-	if err != nil {
-		if lit, ok := parseLiteral(strings.TrimSpace(expr)); ok {
-			return lit
+// parseItems parses comma-separated expressions up to and including the
+// closing token, allowing a trailing comma.
+func (p *exprParser) parseItems(closer exprTokenKind) ([]exprNode, error) {
+	items := []exprNode{}
+	for !p.match(closer) {
+		v, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+		if !p.match(tokComma) {
+			if err := p.expect(closer); err != nil {
+				return nil, err
+			}
+			break
 		}
-		return resolveIdent(strings.TrimSpace(expr), vars, ctx)
 	}
-	p := &exprParser{toks: toks, vars: vars, ctx: ctx}
-	v, err := p.parseExpression()
+	return items, nil
+}
+
+// parseDict parses the part of a {key: value} literal after the "{".
+func (p *exprParser) parseDict() (exprNode, error) {
+	d := &dictExpr{keys: []exprNode{}, values: []exprNode{}}
+	for !p.match(tokRBrace) {
+		var key exprNode
+		if p.bareKeys && p.cur().kind == tokIdent && p.next().kind == tokColon {
+			key = &literalExpr{value: p.cur().lit}
+			p.advance()
+		} else {
+			k, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			key = k
+		}
+		if err := p.expect(tokColon); err != nil {
+			return nil, err
+		}
+		v, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		d.keys = append(d.keys, key)
+		d.values = append(d.values, v)
+		if !p.match(tokComma) {
+			if err := p.expect(tokRBrace); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	return d, nil
+}
+
+func evalArgs(args []exprNode, kwargs []kwargExpr, s *evalScope) ([]any, map[string]any, error) {
+	outArgs := make([]any, 0, len(args))
+	for _, a := range args {
+		v, err := evalNode(a, s)
+		if err != nil {
+			return nil, nil, err
+		}
+		outArgs = append(outArgs, v)
+	}
+	outKwargs := make(map[string]any, len(kwargs))
+	for _, kw := range kwargs {
+		v, err := evalNode(kw.value, s)
+		if err != nil {
+			return nil, nil, err
+		}
+		outKwargs[kw.name] = v
+	}
+	return outArgs, outKwargs, nil
+}
+
+func evalFilterCall(fc filterCall, v any, s *evalScope) (any, error) {
+	args, kwargs, err := evalArgs(fc.args, fc.kwargs, s)
 	if err != nil {
-		if lit, ok := parseLiteral(strings.TrimSpace(expr)); ok {
-			return lit
+		return nil, err
+	}
+	return applyFilter(s, fc.name, v, args, kwargs)
+}
+
+func evalNode(n exprNode, s *evalScope) (any, error) {
+	switch n := n.(type) {
+	case *literalExpr:
+		return n.value, nil
+	case *nameExpr:
+		v, _ := s.state.lookup(n.name, s.vars, s.ctx)
+		return v, nil
+	case *attrExpr:
+		target, err := evalNode(n.target, s)
+		if err != nil {
+			return nil, err
+		}
+		if v, ok := getAttr(target, n.name); ok {
+			return v, nil
 		}
-		return resolveIdent(strings.TrimSpace(expr), vars, ctx)
+		if fn, ok := mappingMethod(target, n.name, s.orderedMaps()); ok {
+			return fn, nil
+		}
+		return missingValue{name: exprPath(n)}, nil
+	case *indexExpr:
+		target, err := evalNode(n.target, s)
+		if err != nil {
+			return nil, err
+		}
+		key, err := evalNode(n.index, s)
+		if err != nil {
+			return nil, err
+		}
+		if v, ok := getItem(target, key); ok {
+			return v, nil
+		}
+		return missingValue{name: exprPath(n)}, nil
+	case *sliceExpr:
+		target, err := evalNode(n.target, s)
+		if err != nil {
+			return nil, err
+		}
+		var bounds [3]any
+		for i, part := range []exprNode{n.start, n.stop, n.step} {
+			if part == nil {
+				continue
+			}
+			if bounds[i], err = evalNode(part, s); err != nil {
+				return nil, err
+			}
+		}
+		return sliceValue(target, bounds[0], bounds[1], bounds[2])
+	case *listExpr:
+		out := make([]any, len(n.items))
+		for i, item := range n.items {
+			v, err := evalNode(item, s)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = literalItem(v)
+		}
+		return out, nil
+	case *dictExpr:
+		out := make(map[string]any, len(n.keys))
+		for i, k := range n.keys {
+			key, err := evalNode(k, s)
+			if err != nil {
+				return nil, err
+			}
+			if isMissing(key) {
+				return nil, undefinedError(key)
+			}
+			v, err := evalNode(n.values[i], s)
+			if err != nil {
+				return nil, err
+			}
+			out[fmt.Sprint(key)] = literalItem(v)
+		}
+		return out, nil
+	case *callExpr:
+		fn, err := evalNode(n.fn, s)
+		if err != nil {
+			return nil, err
+		}
+		if isMissing(fn) {
+			return nil, undefinedError(fn)
+		}
+		if !isCallable(fn) {
+			return nil, fmt.Errorf("%s is not callable", exprLabel(n.fn))
+		}
+		args, kwargs, err := evalArgs(n.args, n.kwargs, s)
+		if err != nil {
+			return nil, err
+		}
+		return invokeCallableValue(fn, args, kwargs, nil)
+	case *filterExpr:
+		target, err := evalNode(n.target, s)
+		if err != nil {
+			return nil, err
+		}
+		return evalFilterCall(n.filter, target, s)
+	case *unaryExpr:
+		v, err := evalNode(n.operand, s)
+		if err != nil {
+			return nil, err
+		}
+		if n.op == tokNot {
+			return !truthy(v), nil
+		}
+		return -toFloat(v, 0), nil
+	case *binaryExpr:
+		left, err := evalNode(n.left, s)
+		if err != nil {
+			return nil, err
+		}
+		right, err := evalNode(n.right, s)
+		if err != nil {
+			return nil, err
+		}
+		if n.op == "~" {
+			out := joinValues(s, []any{left, right}, "", "")
+			if s.state != nil {
+				if err := s.state.budget.grow(len(plainString(out).(string))); err != nil {
+					return nil, err
+				}
+			}
+			return out, nil
+		}
+		return numericOp(left, right, n.op), nil
+	case *logicalExpr:
+		left, err := evalNode(n.left, s)
+		if err != nil {
+			return nil, err
+		}
+		if n.and && !truthy(left) {
+			return false, nil
+		}
+		if !n.and && truthy(left) {
+			return true, nil
+		}
+		right, err := evalNode(n.right, s)
+		if err != nil {
+			return nil, err
+		}
+		return truthy(right), nil
+	case *compareExpr:
+		return evalCompare(n, s)
+	case *condExpr:
+		cond, err := evalNode(n.cond, s)
+		if err != nil {
+			return nil, err
+		}
+		if truthy(cond) {
+			return evalNode(n.then, s)
+		}
+		return evalNode(n.otherwise, s)
+	default:
+		return nil, fmt.Errorf("unsupported expression %T", n)
+	}
+}
+
+// literalItem stores undefined values in list and dict literals as nil, so
+// the collection serializes and compares like one built in Go.
+func literalItem(v any) any {
+	if isMissing(v) {
+		return nil
 	}
 	return v
 }
 
-func evalCond(cond string, vars, ctx map[string]any) bool {
-	return truthy(evalExpr(cond, vars, ctx))
+func evalCompare(n *compareExpr, s *evalScope) (any, error) {
+	prev, err := evalNode(n.left, s)
+	if err != nil {
+		return nil, err
+	}
+	result := true
+	for _, step := range n.steps {
+		if step.test != "" {
+			args, kwargs, err := evalArgs(step.args, step.kwargs, s)
+			if err != nil {
+				return nil, err
+			}
+			ok, err := runTest(s, prev, step.test, args, kwargs)
+			if err != nil {
+				return nil, err
+			}
+			if step.negate {
+				ok = !ok
+			}
+			result = result && ok
+			// preserve chain semantics: a is defined is true compares bool->right next
+			prev = ok
+			continue
+		}
+		right, err := evalNode(step.right, s)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		switch step.op {
+		case "is":
+			ok = compareOp(prev, right, "==")
+			if step.negate {
+				ok = !ok
+			}
+		case "in":
+			ok = containsOp(right, prev)
+		case "not in":
+			ok = !containsOp(right, prev)
+		default:
+			ok = compareOp(prev, right, step.op)
+		}
+		result = result && ok
+		prev = right
+	}
+	return result, nil
+}
+
+func evalExpr(expr string, vars, ctx map[string]any) any {
+	return compileExpr(expr).eval(&evalScope{vars: vars, ctx: ctx})
 }
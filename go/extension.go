@@ -0,0 +1,210 @@
+package nunchucks
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Extension adds custom tags, such as {% cache %} or {% markdown %}, to an
+// Env. Register one with Env.AddExtension.
+type Extension interface {
+	// Tags lists the tag names the extension handles.
+	Tags() []string
+	// Parse reads one use of a tag: it declares the arguments the tag is
+	// rendered with and, for a tag with a body, parses the body up to its
+	// end tag.
+	Parse(p *TagParser) error
+	// Render returns the output of a tag from its evaluated arguments and
+	// rendered body. The output is written as is, without escaping.
+	Render(ctx *Context, tag *Tag) (string, error)
+}
+
+// Tag is one use of an extension tag at render time.
+type Tag struct {
+	// Name is the tag name, one of the extension's Tags.
+	Name string
+	// Args and Kwargs are the values of the arguments added by Parse.
+	Args   []any
+	Kwargs map[string]any
+	// Body is the rendered body, or "" for a tag without one.
+	Body string
+}
+
+// TagParser reads an extension tag while its template is parsed.
+type TagParser struct {
+	p       *templateParser
+	tok     tmplToken
+	name    string
+	rest    string
+	args    []exprNode
+	kwargs  []kwargExpr
+	body    []node
+	hasBody bool
+}
+
+// Name returns the tag name.
+func (tp *TagParser) Name() string { return tp.name }
+
+// Args returns the source of the tag after its name, such as `"nav", 60`
+// for {% cache "nav", 60 %}.
+func (tp *TagParser) Args() string { return tp.rest }
+
+// Inside reports whether the tag is within the body of the extension tag
+// name.
+func (tp *TagParser) Inside(name string) bool {
+	for _, open := range tp.p.tags {
+		if open == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseArgs reads Args as call arguments, `expr, ..., name=expr`, and adds
+// them to the tag.
+func (tp *TagParser) ParseArgs() error {
+	toks, err := lexExpr(tp.rest)
+	if err != nil {
+		return tp.p.exprErrorAt(tp.tok, tp.rest, fmt.Errorf("invalid %s statement: %w", tp.name, err))
+	}
+	p := &exprParser{toks: toks}
+	if p.cur().kind == tokEOF {
+		return nil
+	}
+	args, kwargs, err := p.parseCallArgs()
+	if err == nil && p.cur().kind != tokEOF {
+		err = p.errorf("unexpected %s", p.cur())
+	}
+	if err != nil {
+		return tp.p.exprErrorAt(tp.tok, tp.rest, fmt.Errorf("invalid %s statement: %w", tp.name, err))
+	}
+	tp.args = append(tp.args, args...)
+	tp.kwargs = append(tp.kwargs, kwargs...)
+	return nil
+}
+
+// AddArg adds the expression src as the next positional argument.
+func (tp *TagParser) AddArg(src string) error {
+	c, err := tp.p.expr(tp.tok, src)
+	if err != nil {
+		return err
+	}
+	tp.args = append(tp.args, c.root)
+	return nil
+}
+
+// AddKwarg adds the expression src as the keyword argument name.
+func (tp *TagParser) AddKwarg(name, src string) error {
+	c, err := tp.p.expr(tp.tok, src)
+	if err != nil {
+		return err
+	}
+	tp.kwargs = append(tp.kwargs, kwargExpr{name: name, value: c.root})
+	return nil
+}
+
+// AddValue adds v as the next positional argument, as is. v must be nil, a
+// bool, an int, a float64 or a string, so that the template can still be
+// precompiled.
+func (tp *TagParser) AddValue(v any) error {
+	switch v.(type) {
+	case nil, bool, int, float64, string:
+		tp.args = append(tp.args, &literalExpr{value: v})
+		return nil
+	}
+	return fmt.Errorf("%s: unsupported argument value %T", tp.name, v)
+}
+
+// AddObjectArg adds the dict literal src as the next positional argument.
+// Its keys may be bare names, as in JavaScript: {count: 0} is
+// {"count": 0}.
+func (tp *TagParser) AddObjectArg(src string) error {
+	toks, err := lexExpr(src)
+	var obj exprNode
+	if err == nil {
+		p := &exprParser{toks: toks, bareKeys: true}
+		if p.cur().kind != tokLBrace {
+			err = p.errorf("expected an object, got %s", p.cur())
+		} else if obj, err = p.parsePrimary(); err == nil && p.cur().kind != tokEOF {
+			err = p.errorf("unexpected %s", p.cur())
+		}
+	}
+	if err != nil {
+		return tp.p.exprErrorAt(tp.tok, src, fmt.Errorf("invalid %s statement: %w", tp.name, err))
+	}
+	tp.args = append(tp.args, obj)
+	return nil
+}
+
+// ParseBody parses the tag's body up to the first of ends and returns the
+// end tag it stopped at. break and continue are not allowed in the body,
+// which is rendered in its own scope.
+func (tp *TagParser) ParseBody(ends ...string) (string, error) {
+	if len(ends) == 0 {
+		ends = []string{"end" + tp.name}
+	}
+	p := tp.p
+	scope := ""
+	if p.loop != "" {
+		scope = tp.name
+	}
+	p.tags = append(p.tags, tp.name)
+	body, end, err := p.parseBodyIn(scope, ends...)
+	p.tags = p.tags[:len(p.tags)-1]
+	if err != nil {
+		return "", err
+	}
+	tp.body = append(tp.body, body...)
+	tp.hasBody = true
+	return tagName(end.value), nil
+}
+
+// AddExtension registers ext for each of its tags, replacing an earlier
+// extension of the same name, including the built-in client, fetch and
+// state tags. Tags of the template language itself cannot be replaced.
+// Templates already parsed by the Env keep rendering their tags with the
+// extensions that parsed them.
+func (e *Env) AddExtension(ext Extension) {
+	if e.extensions == nil {
+		e.extensions = map[string]Extension{}
+	}
+	for _, tag := range ext.Tags() {
+		e.extensions[strings.TrimSpace(tag)] = ext
+	}
+}
+
+// parseExtension parses a tag handled by ext.
+func (p *templateParser) parseExtension(ext Extension, tok tmplToken, name, rest string) (node, error) {
+	tp := &TagParser{p: p, tok: tok, name: name, rest: rest}
+	if err := ext.Parse(tp); err != nil {
+		// A syntax error found by lexing Args is located within it.
+		var ee *exprError
+		if errors.As(err, &ee) {
+			return nil, p.exprErrorAt(tok, rest, err)
+		}
+		return nil, err
+	}
+	return &extensionNode{
+		nodePos: nodePos{tok.line, tok.col},
+		tag:     name,
+		args:    tp.args,
+		kwargs:  tp.kwargs,
+		body:    tp.body,
+		hasBody: tp.hasBody,
+		ext:     ext,
+	}, nil
+}
+
+// renderTag calls the extension that parsed tag.Name in prog, or for a
+// program loaded from IR, the one the Env has for it now.
+func (e *Env) renderTag(s *evalScope, prog *program, tag *Tag) (string, error) {
+	ext, ok := prog.extensions[tag.Name]
+	if !ok {
+		ext, ok = e.extensions[tag.Name]
+	}
+	if !ok {
+		return "", fmt.Errorf("no extension handles tag %q", tag.Name)
+	}
+	return ext.Render(&Context{scope: s}, tag)
+}
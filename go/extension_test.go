@@ -0,0 +1,169 @@
+package nunchucks
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testExtension provides {% icon name, size=n %}, {% once key %}...{% endonce %}
+// and {% markdown %}...{% endmarkdown %}.
+type testExtension struct{}
+
+type onceKey string
+
+func (testExtension) Tags() []string { return []string{"icon", "once", "markdown"} }
+
+func (testExtension) Parse(p *TagParser) error {
+	if err := p.ParseArgs(); err != nil {
+		return err
+	}
+	if p.Name() == "icon" {
+		return nil
+	}
+	_, err := p.ParseBody()
+	return err
+}
+
+func (testExtension) Render(ctx *Context, tag *Tag) (string, error) {
+	switch tag.Name {
+	case "icon":
+		if len(tag.Args) != 1 {
+			return "", fmt.Errorf("icon takes a name")
+		}
+		size := 24
+		if v, ok := tag.Kwargs["size"]; ok {
+			size = toInt(v, size)
+		}
+		return fmt.Sprintf(`<svg class="icon-%v" width="%d"></svg>`, tag.Args[0], size), nil
+	case "once":
+		key := onceKey(fmt.Sprint(tag.Args[0]))
+		if ctx.RenderValue(key) != nil {
+			return "", nil
+		}
+		ctx.SetRenderValue(key, true)
+		return tag.Body, nil
+	}
+	var out []string
+	for _, line := range strings.Split(strings.TrimSpace(tag.Body), "\n") {
+		if title, ok := strings.CutPrefix(line, "# "); ok {
+			out = append(out, "<h1>"+title+"</h1>")
+		} else {
+			out = append(out, "<p>"+line+"</p>")
+		}
+	}
+	return strings.Join(out, ""), nil
+}
+
+func TestExtensionTags(t *testing.T) {
+	files := map[string]string{
+		"page.njk": `{% for x in items %}{% once "style" %}<style>{{ x }}</style>{% endonce %}{% icon x, size=loop.index * 8 %}{% endfor %}
+{% markdown %}
+# {{ title }}
+{% set local = 1 %}Hello <b>{{ local }}</b>
+{% endmarkdown %}[{{ local }}]`,
+	}
+	env := Configure(ConfigOptions{Loader: &testLoader{files: files}})
+	env.AddExtension(testExtension{})
+	out, err := env.Render("page.njk", map[string]any{"items": []any{"home", "user"}, "title": "<Hi>"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `<style>home</style><svg class="icon-home" width="8"></svg><svg class="icon-user" width="16"></svg>
+<h1>&lt;Hi&gt;</h1><p>Hello <b>1</b></p>[]`
+	if out != want {
+		t.Fatalf("unexpected output\nwant: %q\n got: %q", want, out)
+	}
+
+	tpl, err := env.GetTemplate("page.njk")
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	data, err := tpl.EncodeIR()
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	plain := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	if _, err := plain.LoadIR(data); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if _, err := plain.Render("page.njk", map[string]any{"items": []any{"a"}}); err == nil || !strings.Contains(err.Error(), `no extension handles tag "once"`) {
+		t.Fatalf("expected missing extension error, got %v", err)
+	}
+	plain.AddExtension(testExtension{})
+	if got, err := plain.Render("page.njk", map[string]any{"items": []any{"home", "user"}, "title": "<Hi>"}); err != nil || got != want {
+		t.Fatalf("IR render mismatch: %q, %v", got, err)
+	}
+}
+
+// wordExtension renders {% word %} as its word.
+type wordExtension string
+
+func (wordExtension) Tags() []string                          { return []string{"word"} }
+func (wordExtension) Parse(p *TagParser) error                { return p.ParseArgs() }
+func (w wordExtension) Render(*Context, *Tag) (string, error) { return string(w), nil }
+
+func TestParsedTemplatesKeepTheirExtensions(t *testing.T) {
+	files := map[string]string{"a.njk": `{% word %}`, "b.njk": `{% word %}`}
+	env := Configure(ConfigOptions{Loader: &testLoader{files: files}})
+	env.AddExtension(wordExtension("old"))
+	if out, err := env.Render("a.njk", nil); err != nil || out != "old" {
+		t.Fatalf("unexpected render: %q, %v", out, err)
+	}
+	env.AddExtension(wordExtension("new"))
+	if out, err := env.Render("a.njk", nil); err != nil || out != "old" {
+		t.Fatalf("expected a parsed template to keep its extension, got %q, %v", out, err)
+	}
+	if out, err := env.Render("b.njk", nil); err != nil || out != "new" {
+		t.Fatalf("expected a new template to use the new extension, got %q, %v", out, err)
+	}
+}
+
+// valueExtension renders {% value text %} as text and a count from an
+// object argument, added without ParseArgs.
+type valueExtension struct{}
+
+func (valueExtension) Tags() []string { return []string{"value"} }
+
+func (valueExtension) Parse(p *TagParser) error {
+	if err := p.AddValue([]string{p.Args()}); err == nil {
+		return fmt.Errorf("expected a list value to be rejected")
+	}
+	if err := p.AddValue(p.Args()); err != nil {
+		return err
+	}
+	return p.AddObjectArg("{count: n + 1}")
+}
+
+func (valueExtension) Render(_ *Context, tag *Tag) (string, error) {
+	return fmt.Sprintf("%v=%v", tag.Args[0], tag.Args[1].(map[string]any)["count"]), nil
+}
+
+func TestTagParserAddsValuesAndObjects(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	env.AddExtension(valueExtension{})
+	if out, err := env.RenderString(`{% value hello %}`, map[string]any{"n": 2}); err != nil || out != "hello=3" {
+		t.Fatalf("unexpected render: %q, %v", out, err)
+	}
+}
+
+func TestExtensionErrorsAreLocated(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	env.AddExtension(testExtension{})
+	for src, want := range map[string]string{
+		"<p>\n{% icon %}</p>":         "icon takes a name",
+		"<p>\n{% icon \"a\" + %}</p>": "invalid icon statement",
+		"<p>\n{% once \"k\" %}</p>":   "missing endonce",
+		"<p>\n{% for x in xs %}{% once x %}{% break %}{% endonce %}{% endfor %}": "break is not allowed inside a once block",
+		"<p>\n{% fetch | '/x' %}</p>":                                            "fetch is only allowed inside a client block",
+		"<p>\n{% unknown %}</p>":                                                 `unknown tag "unknown"`,
+		"<p>\n{% client %}{% state app | { pressed: } %}{% endclient %}</p>":     "invalid state statement",
+	} {
+		_, err := env.RenderString(src, map[string]any{"xs": []any{1}})
+		var te *TemplateError
+		if !errors.As(err, &te) || te.Line != 2 || !strings.Contains(te.Err.Error(), want) {
+			t.Fatalf("%q: expected TemplateError containing %q on line 2, got %v", src, want, err)
+		}
+	}
+}
@@ -0,0 +1,909 @@
+package nunchucks
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"math"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	wordRe         = regexp.MustCompile(`[\p{L}\p{N}_]+`)
+	htmlCommentRe  = regexp.MustCompile(`(?s)<!--.*?-->`)
+	urlizeTrailRe  = regexp.MustCompile(`(?:[.,)]|&gt;)+$`)
+	xmlAttrBadName = " \t\n\f\r/>="
+)
+
+// builtinFilterNames lists the built-in filters, for the filter test.
+var builtinFilterNames = map[string]bool{
+	"abs": true, "attr": true, "batch": true, "capitalize": true, "center": true, "count": true,
+	"d": true, "default": true, "dictsort": true, "dump": true, "e": true, "escape": true,
+	"filesizeformat": true, "first": true, "float": true, "forceescape": true, "format": true,
+	"groupby": true, "indent": true, "int": true, "items": true, "join": true, "last": true,
+	"length": true, "list": true, "lower": true, "map": true, "max": true, "min": true,
+	"nl2br": true, "pprint": true, "random": true, "reject": true, "rejectattr": true,
+	"replace": true, "reverse": true, "round": true, "safe": true, "select": true,
+	"selectattr": true, "slice": true, "sort": true, "string": true, "striptags": true,
+	"sum": true, "title": true, "tojson": true, "trim": true, "truncate": true, "unique": true,
+	"upper": true, "urlencode": true, "urlize": true, "wordcount": true, "wordwrap": true,
+	"xmlattr": true,
+}
+
+// argOr returns args[i], or dflt when the filter was called with fewer
+// arguments.
+func argOr(args []any, i int, dflt any) any {
+	if i < len(args) {
+		return args[i]
+	}
+	return dflt
+}
+
+// optString is a filter's optional string argument, "" for none.
+func optString(v any) string {
+	if v == nil || isMissing(v) {
+		return ""
+	}
+	return fmt.Sprint(plainString(v))
+}
+
+// variadicFilter runs the built-in filters whose arguments depend on how
+// they are called, such as map(attribute="x") and map("upper", ...), and
+// which so bind keyword arguments themselves. ok is false for other
+// filters.
+func variadicFilter(s *evalScope, n string, v any, args []any, kwargs map[string]any) (out any, ok bool, err error) {
+	switch n {
+	case "map":
+		out, err = filterMap(s, v, args, kwargs)
+	case "format":
+		out, err = filterFormat(v, args, kwargs)
+	case "select", "reject", "selectattr", "rejectattr":
+		out, err = selectItems(s, n, v, args, kwargs)
+	default:
+		return nil, false, nil
+	}
+	return out, true, err
+}
+
+// filterMap applies a filter to each item, map("upper"), or looks up an
+// attribute of each, map(attribute="user.name", default="anon").
+func filterMap(s *evalScope, v any, args []any, kwargs map[string]any) (any, error) {
+	arr := toSlice(v)
+	out := make([]any, 0, len(arr))
+	if len(args) == 0 {
+		attr, ok := kwargs["attribute"]
+		if !ok {
+			return nil, fmt.Errorf("map requires a filter name or attribute=")
+		}
+		dflt, hasDefault := kwargs["default"]
+		for _, k := range sortedKeys(kwargs) {
+			if k != "attribute" && k != "default" {
+				return nil, fmt.Errorf("got an unexpected keyword argument %q", k)
+			}
+		}
+		for _, it := range arr {
+			av, found := valueByPathEx(it, optString(attr))
+			if !found && hasDefault {
+				av = dflt
+			}
+			out = append(out, av)
+		}
+		return out, nil
+	}
+	name, ok := plainString(args[0]).(string)
+	if !ok {
+		return nil, fmt.Errorf("filter name must be a string, got %T", args[0])
+	}
+	for _, it := range arr {
+		r, err := applyFilter(s, name, it, args[1:], kwargs)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// selectItems runs select, reject, selectattr and rejectattr. select keeps
+// the items that pass the test named by its first argument, called with
+// the rest, or the truthy items without one; the attr forms test an
+// attribute of each item, and reject keeps the items that fail. A first
+// argument that is not a test name is compared for equality, as in
+// Nunjucks.
+func selectItems(s *evalScope, n string, v any, args []any, kwargs map[string]any) (any, error) {
+	attr := ""
+	if strings.HasSuffix(n, "attr") && len(args) > 0 {
+		attr = optString(args[0])
+		args = args[1:]
+	}
+	testName := ""
+	var needle any
+	hasNeedle := len(args) > 0
+	if hasNeedle {
+		if name, ok := args[0].(string); ok && s.isTest(name) {
+			testName = name
+			args = args[1:]
+		} else {
+			needle = args[0]
+		}
+	}
+	if testName == "" {
+		for _, k := range sortedKeys(kwargs) {
+			return nil, fmt.Errorf("got an unexpected keyword argument %q", k)
+		}
+	}
+	keep := strings.HasPrefix(n, "select")
+	out := []any{}
+	for _, it := range toSlice(v) {
+		av := valueByPath(it, attr)
+		var ok bool
+		switch {
+		case testName != "":
+			var err error
+			if ok, err = runTest(s, av, testName, args, kwargs); err != nil {
+				return nil, err
+			}
+		case hasNeedle:
+			ok = equalOp(av, needle)
+		default:
+			ok = truthy(av)
+		}
+		if ok == keep {
+			out = append(out, it)
+		}
+	}
+	return out, nil
+}
+
+// sortedKeys returns the keys of m in order, so errors name the same
+// argument on every render.
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// filterFormat applies printf-style formatting, "%s of %d" | format(a, b),
+// or with named values, "%(n)d items" | format(n=3), as Python's % does.
+// Formatting a SafeString escapes the values it substitutes.
+func filterFormat(v any, args []any, kwargs map[string]any) (any, error) {
+	if len(args) > 0 && len(kwargs) > 0 {
+		return nil, fmt.Errorf("can't handle positional and keyword arguments at the same time")
+	}
+	_, safe := v.(SafeString)
+	named := kwargs
+	if named == nil && len(args) == 1 && isMapping(args[0]) {
+		named = map[string]any{}
+		keys, values, _ := mapEntries(args[0], false)
+		for i, k := range keys {
+			named[fmt.Sprint(k)] = values[i]
+		}
+	}
+	src := optString(v)
+	var b strings.Builder
+	next := 0
+	for i := 0; i < len(src); i++ {
+		if src[i] != '%' {
+			b.WriteByte(src[i])
+			continue
+		}
+		i++
+		if i >= len(src) {
+			return nil, fmt.Errorf("incomplete format")
+		}
+		var arg any
+		hasArg := false
+		if src[i] == '(' {
+			end := strings.IndexByte(src[i:], ')')
+			if end < 0 || named == nil {
+				return nil, fmt.Errorf("format requires a mapping")
+			}
+			key := src[i+1 : i+end]
+			val, ok := named[key]
+			if !ok {
+				return nil, fmt.Errorf("no value named %q", key)
+			}
+			arg, hasArg = val, true
+			i += end + 1
+		}
+		spec := "%"
+		for i < len(src) && strings.IndexByte("-+ #0", src[i]) >= 0 {
+			spec += string(src[i])
+			i++
+		}
+		for i < len(src) && (src[i] == '*' || src[i] == '.' || (src[i] >= '0' && src[i] <= '9')) {
+			if src[i] == '*' {
+				if next >= len(args) {
+					return nil, fmt.Errorf("not enough arguments for format string")
+				}
+				spec += strconv.Itoa(toInt(args[next], 0))
+				next++
+			} else {
+				spec += string(src[i])
+			}
+			i++
+		}
+		for i < len(src) && strings.IndexByte("hlL", src[i]) >= 0 {
+			i++
+		}
+		if i >= len(src) {
+			return nil, fmt.Errorf("incomplete format")
+		}
+		verb := src[i]
+		if verb == '%' {
+			b.WriteByte('%')
+			continue
+		}
+		if !hasArg {
+			if named != nil && kwargs != nil {
+				return nil, fmt.Errorf("format requires a mapping")
+			}
+			if next >= len(args) {
+				return nil, fmt.Errorf("not enough arguments for format string")
+			}
+			arg = args[next]
+			next++
+		}
+		text, err := formatValue(spec, verb, arg)
+		if err != nil {
+			return nil, err
+		}
+		if safe && (verb == 's' || verb == 'r' || verb == 'a' || verb == 'c') {
+			text = string(escapeHTML(text))
+		}
+		b.WriteString(text)
+	}
+	if named == nil && next < len(args) {
+		return nil, fmt.Errorf("not all arguments converted during string formatting")
+	}
+	if safe {
+		return SafeString(b.String()), nil
+	}
+	return b.String(), nil
+}
+
+// formatValue formats one value for a % conversion. spec holds the flags,
+// width and precision.
+func formatValue(spec string, verb byte, v any) (string, error) {
+	switch verb {
+	case 's':
+		return fmt.Sprintf(spec+"s", outputText(v)), nil
+	case 'r', 'a':
+		return fmt.Sprintf(spec+"s", pyRepr(v)), nil
+	case 'c':
+		if isNumber(v) {
+			return fmt.Sprintf(spec+"c", rune(toInt(v, 0))), nil
+		}
+		return fmt.Sprintf(spec+"s", outputText(v)), nil
+	case 'd', 'i', 'u', 'o', 'x', 'X':
+		if !isNumber(v) {
+			return "", fmt.Errorf("%%%c format: a number is required, not %T", verb, v)
+		}
+		goVerb := string(verb)
+		if verb == 'i' || verb == 'u' {
+			goVerb = "d"
+		}
+		f, _ := toFloatEx(v)
+		return fmt.Sprintf(spec+goVerb, int64(f)), nil
+	case 'e', 'E', 'f', 'F', 'g', 'G':
+		if !isNumber(v) {
+			return "", fmt.Errorf("%%%c format: a number is required, not %T", verb, v)
+		}
+		if (verb == 'g' || verb == 'G') && !strings.Contains(spec, ".") {
+			spec += ".6"
+		}
+		f, _ := toFloatEx(v)
+		return fmt.Sprintf(spec+string(verb), f), nil
+	}
+	return "", fmt.Errorf("unsupported format character %q", verb)
+}
+
+// pyRepr formats v as Python's repr would, for pprint and %r.
+func pyRepr(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return "None"
+	case missingValue:
+		return "Undefined"
+	case bool:
+		if t {
+			return "True"
+		}
+		return "False"
+	case string:
+		return pyQuote(t)
+	case SafeString:
+		return "Markup(" + pyQuote(string(t)) + ")"
+	case float32, float64:
+		f, _ := toFloatEx(v)
+		switch {
+		case math.IsInf(f, 1):
+			return "inf"
+		case math.IsInf(f, -1):
+			return "-inf"
+		case math.IsNaN(f):
+			return "nan"
+		}
+		s := strconv.FormatFloat(f, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".e") {
+			s += ".0"
+		}
+		return s
+	}
+	if isNumber(v) {
+		return fmt.Sprint(v)
+	}
+	if keys, values, ok := mapEntries(v, false); ok {
+		parts := make([]string, len(keys))
+		for i := range keys {
+			parts[i] = pyRepr(keys[i]) + ": " + pyRepr(values[i])
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+	}
+	if rv := indirect(reflect.ValueOf(v)); rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+		arr := toSlice(v)
+		parts := make([]string, len(arr))
+		for i, it := range arr {
+			parts[i] = pyRepr(it)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	}
+	return fmt.Sprint(v)
+}
+
+// pyQuote quotes s as a Python string literal: single quotes unless s
+// holds a single quote and no double quote.
+func pyQuote(s string) string {
+	quote := '\''
+	if strings.ContainsRune(s, '\'') && !strings.ContainsRune(s, '"') {
+		quote = '"'
+	}
+	var b strings.Builder
+	b.WriteRune(quote)
+	for _, r := range s {
+		switch {
+		case r == quote || r == '\\':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteRune(quote)
+	return b.String()
+}
+
+// toIntBase converts v as Jinja's int filter does: strings are parsed in
+// base, accepting its 0x, 0o or 0b prefix, and then as a float, which is
+// truncated. ok is false when v is not a number.
+func toIntBase(v any, base int) (int, bool) {
+	switch t := plainString(v).(type) {
+	case bool:
+		if t {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		s := strings.TrimSpace(t)
+		digits := strings.TrimLeft(s, "+-")
+		sign := s[:len(s)-len(digits)]
+		if len(digits) > 2 && digits[0] == '0' {
+			prefix := strings.ToLower(digits[:2])
+			if (base == 16 && prefix == "0x") || (base == 8 && prefix == "0o") || (base == 2 && prefix == "0b") {
+				digits = digits[2:]
+			}
+		}
+		if i, err := strconv.ParseInt(sign+digits, base, 64); err == nil {
+			return int(i), true
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+			return int(f), true
+		}
+		return 0, false
+	}
+	if f, ok := toFloatEx(v); ok {
+		return int(f), true
+	}
+	return 0, false
+}
+
+// toFloatEx converts v as Jinja's float filter does. ok is false when v
+// is not a number.
+func toFloatEx(v any) (float64, bool) {
+	switch t := plainString(v).(type) {
+	case bool:
+		if t {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+		return f, err == nil
+	}
+	if isNumber(v) {
+		rv := reflect.ValueOf(v)
+		switch {
+		case rv.CanInt():
+			return float64(rv.Int()), true
+		case rv.CanUint():
+			return float64(rv.Uint()), true
+		}
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+// indentText indents the lines of s by width, a number of spaces or the
+// indentation itself. The first line is indented only when first is set,
+// and empty lines only when blank is.
+func indentText(s string, width any, first, blank bool) string {
+	prefix, ok := plainString(width).(string)
+	if !ok {
+		prefix = spaces(width, 4)
+	}
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if (i == 0 && first) || (i > 0 && (blank || line != "")) {
+			lines[i] = prefix + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// spaces returns as many spaces as a filter's width argument n asks for,
+// or dflt when n is not a number. A negative width is no spaces.
+func spaces(n any, dflt int) string {
+	return strings.Repeat(" ", max(toInt(n, dflt), 0))
+}
+
+// centerText pads s to width runes, putting the odd space where Python's
+// str.center does.
+func centerText(s string, width int) string {
+	n := len([]rune(s))
+	if n >= width {
+		return s
+	}
+	pad := width - n
+	left := pad/2 + (pad & width & 1)
+	return strings.Repeat(" ", left) + s + strings.Repeat(" ", pad-left)
+}
+
+// titleCase upper-cases the first letter of each word and lower-cases the
+// rest. Words start after whitespace, hyphens and opening brackets.
+func titleCase(s string) string {
+	r := []rune(s)
+	start := true
+	for i, ch := range r {
+		if start {
+			r[i] = unicode.ToUpper(ch)
+		} else {
+			r[i] = unicode.ToLower(ch)
+		}
+		start = unicode.IsSpace(ch) || strings.ContainsRune("-({[<", ch)
+	}
+	return string(r)
+}
+
+// joinValues joins the items of v, or their attribute, with sep. When the
+// template autoescapes and sep or an item is a SafeString, the other parts
+// are escaped and the result is safe.
+func joinValues(s *evalScope, v any, sep any, attr string) any {
+	arr := toSlice(v)
+	if attr != "" {
+		items := arr
+		arr = make([]any, len(items))
+		for i, it := range items {
+			arr[i] = valueByPath(it, attr)
+		}
+	}
+	safe := false
+	if s.autoescape {
+		_, safe = sep.(SafeString)
+		for _, it := range arr {
+			if _, ok := it.(SafeString); ok {
+				safe = true
+			}
+		}
+	}
+	parts := make([]string, len(arr))
+	for i, it := range arr {
+		if safe {
+			parts[i] = string(escapeHTML(it))
+		} else {
+			parts[i] = outputText(it)
+		}
+	}
+	if safe {
+		return SafeString(strings.Join(parts, string(escapeHTML(sep))))
+	}
+	return strings.Join(parts, outputText(sep))
+}
+
+// sumValues adds the items of v, or their attribute, to start. The total
+// is an int when every addend is one.
+func sumValues(v any, attr string, start any) any {
+	ints := isIntValue(start)
+	total := toFloat(start, 0)
+	for _, it := range toSlice(v) {
+		if attr != "" {
+			it = valueByPath(it, attr)
+		}
+		ints = ints && isIntValue(it)
+		total += toFloat(it, 0)
+	}
+	if ints {
+		return int(total)
+	}
+	return total
+}
+
+func isIntValue(v any) bool {
+	switch v.(type) {
+	case int, int64:
+		return true
+	}
+	return false
+}
+
+// sliceValues splits v into n columns, as Jinja's slice does: the first
+// len(v) % n columns get one extra item and the others get fill, if set.
+func sliceValues(v any, n int, fill any) []any {
+	arr := toSlice(v)
+	if n <= 0 {
+		n = 1
+	}
+	per := len(arr) / n
+	extra := len(arr) % n
+	out := make([]any, 0, n)
+	offset := 0
+	for i := 0; i < n; i++ {
+		start := offset + i*per
+		if i < extra {
+			offset++
+		}
+		end := offset + (i+1)*per
+		col := append([]any{}, arr[start:end]...)
+		if fill != nil && !isMissing(fill) && i >= extra {
+			col = append(col, fill)
+		}
+		out = append(out, col)
+	}
+	return out
+}
+
+// sortKey is an item's value for sort, unique, min and max: its attribute
+// when attr is set, lower-cased when the comparison ignores case.
+func sortKey(it any, attr string, caseSens bool) any {
+	if attr != "" {
+		it = valueByPath(it, attr)
+	}
+	if s, ok := plainString(it).(string); ok && !caseSens {
+		return strings.ToLower(s)
+	}
+	return it
+}
+
+// uniqueValues returns the items of v without duplicates, keeping the
+// first of each.
+func uniqueValues(v any, caseSens bool, attr string) []any {
+	seen := map[string]bool{}
+	out := []any{}
+	for _, it := range toSlice(v) {
+		key := sortKey(it, attr, caseSens)
+		id := fmt.Sprintf("%T|%v", key, key)
+		if isNumber(key) {
+			id = fmt.Sprint(toFloat(key, 0))
+		}
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, it)
+		}
+	}
+	return out
+}
+
+// extremeValue returns the smallest item of v, or the largest with max.
+// It is undefined for an empty sequence.
+func extremeValue(v any, caseSens bool, attr string, max bool) any {
+	arr := toSlice(v)
+	if len(arr) == 0 {
+		return missing
+	}
+	best := arr[0]
+	for _, it := range arr[1:] {
+		cmp := compareAny(sortKey(it, attr, caseSens), sortKey(best, attr, caseSens), true)
+		if (max && cmp > 0) || (!max && cmp < 0) {
+			best = it
+		}
+	}
+	return best
+}
+
+// itemPairs returns the (key, value) pairs of a mapping. An undefined
+// value has none.
+func itemPairs(s *evalScope, v any) ([]any, error) {
+	if v == nil || isMissing(v) {
+		return []any{}, nil
+	}
+	keys, values, ok := mapEntries(v, s.orderedMaps())
+	if !ok {
+		return nil, fmt.Errorf("can only get item pairs from a mapping, got %T", v)
+	}
+	out := make([]any, len(keys))
+	for i := range keys {
+		out[i] = []any{keys[i], values[i]}
+	}
+	return out, nil
+}
+
+// edgeItem returns the first or last item of a list, character of a string
+// or key of a mapping, as first and last do. It is undefined when v is
+// empty.
+func edgeItem(s *evalScope, v any, last bool) any {
+	items := toSlice(v)
+	if keys, _, ok := mapEntries(v, s.orderedMaps()); ok {
+		items = keys
+	} else if items == nil && !isMissing(v) && v != nil {
+		r := []rune(fmt.Sprint(plainString(v)))
+		items = make([]any, len(r))
+		for i, c := range r {
+			items[i] = string(c)
+		}
+	}
+	if len(items) == 0 {
+		return missing
+	}
+	if last {
+		return items[len(items)-1]
+	}
+	return items[0]
+}
+
+// urlEncode quotes a string for a URL query. A mapping, or a list of
+// key/value pairs, is encoded as a query string: {"a": "x y"} is a=x+y.
+func urlEncode(s *evalScope, v any) (string, error) {
+	keys, values, ok := mapEntries(v, s.orderedMaps())
+	if !ok {
+		pairs := toSlice(v)
+		if pairs == nil {
+			return url.QueryEscape(outputText(v)), nil
+		}
+		for _, pair := range pairs {
+			kv := toSlice(pair)
+			if len(kv) != 2 {
+				return "", fmt.Errorf("expected a list of key/value pairs, got %s", pyRepr(pair))
+			}
+			keys, values = append(keys, kv[0]), append(values, kv[1])
+		}
+	}
+	parts := make([]string, len(keys))
+	for i := range keys {
+		parts[i] = url.QueryEscape(outputText(keys[i])) + "=" + url.QueryEscape(outputText(values[i]))
+	}
+	return strings.Join(parts, "&"), nil
+}
+
+// toJSON encodes v as JSON that is safe to write into HTML: <, >, & and '
+// are escaped as \u sequences.
+func toJSON(v any, indent any) (SafeString, error) {
+	if isMissing(v) {
+		v = nil
+	}
+	var b []byte
+	var err error
+	if indent == nil {
+		b, err = json.Marshal(v)
+	} else {
+		b, err = json.MarshalIndent(v, "", spaces(indent, 0))
+	}
+	if err != nil {
+		return "", err
+	}
+	return SafeString(strings.ReplaceAll(string(b), "'", `\u0027`)), nil
+}
+
+// xmlAttr renders the entries of a mapping as escaped HTML attributes,
+// skipping nil and undefined values, with a leading space if autospace.
+func xmlAttr(s *evalScope, v any, autospace bool) (SafeString, error) {
+	keys, values, ok := mapEntries(v, s.orderedMaps())
+	if !ok {
+		return "", fmt.Errorf("can only render attributes from a mapping, got %T", v)
+	}
+	parts := []string{}
+	for i, k := range keys {
+		val := values[i]
+		if val == nil || isMissing(val) {
+			continue
+		}
+		name := fmt.Sprint(k)
+		if name == "" || strings.ContainsAny(name, xmlAttrBadName) {
+			return "", fmt.Errorf("invalid character in attribute name: %q", name)
+		}
+		parts = append(parts, string(escapeHTML(name))+`="`+string(escapeHTML(val))+`"`)
+	}
+	out := strings.Join(parts, " ")
+	if autospace && out != "" {
+		out = " " + out
+	}
+	return SafeString(out), nil
+}
+
+// fileSizeFormat formats a number of bytes in decimal units (kB, MB), or
+// binary ones (KiB, MiB) if binary is set.
+func fileSizeFormat(v any, binary bool) string {
+	size := toFloat(v, 0)
+	base := 1000.0
+	prefixes := []string{"kB", "MB", "GB", "TB", "PB", "EB", "ZB", "YB"}
+	if binary {
+		base = 1024
+		prefixes = []string{"KiB", "MiB", "GiB", "TiB", "PiB", "EiB", "ZiB", "YiB"}
+	}
+	switch {
+	case size == 1:
+		return "1 Byte"
+	case size < base:
+		return fmt.Sprintf("%d Bytes", int(size))
+	}
+	unit := base
+	for i, prefix := range prefixes {
+		unit *= base
+		if size < unit || i == len(prefixes)-1 {
+			return fmt.Sprintf("%.1f %s", base*size/unit, prefix)
+		}
+	}
+	return ""
+}
+
+// wordWrap wraps each line of s to width runes, as Python's textwrap does,
+// and joins the wrapped lines with wrap.
+func wordWrap(s string, width int, breakLong bool, wrap string, hyphens bool) (string, error) {
+	if width <= 0 {
+		return "", fmt.Errorf("invalid width %d (must be > 0)", width)
+	}
+	lines := strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+	if len(lines) > 1 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	out := make([]string, len(lines))
+	for i, line := range lines {
+		out[i] = strings.Join(wrapLine(line, width, breakLong, hyphens), wrap)
+	}
+	return strings.Join(out, wrap), nil
+}
+
+// wrapLine is textwrap.wrap for one line: whitespace runs and words are
+// chunks, lines are filled greedily, and whitespace is dropped at line
+// ends.
+func wrapLine(line string, width int, breakLong, hyphens bool) []string {
+	var chunks [][]rune
+	for _, f := range splitChunks(line, hyphens) {
+		chunks = append(chunks, []rune(f))
+	}
+	blank := func(c []rune) bool { return strings.TrimSpace(string(c)) == "" }
+	var lines []string
+	for len(chunks) > 0 {
+		var cur []rune
+		if blank(chunks[0]) && len(lines) > 0 {
+			chunks = chunks[1:]
+		}
+		for len(chunks) > 0 && len(cur)+len(chunks[0]) <= width {
+			cur = append(cur, chunks[0]...)
+			chunks = chunks[1:]
+		}
+		if len(chunks) > 0 && len(chunks[0]) > width {
+			if breakLong {
+				left := width - len(cur)
+				cur = append(cur, chunks[0][:left]...)
+				chunks[0] = chunks[0][left:]
+			} else if len(cur) == 0 {
+				cur = chunks[0]
+				chunks = chunks[1:]
+			}
+		}
+		if len(cur) > 0 && blank(cur[len(cur)-1:]) {
+			cur = []rune(strings.TrimRightFunc(string(cur), unicode.IsSpace))
+		}
+		if len(cur) > 0 {
+			lines = append(lines, string(cur))
+		}
+	}
+	return lines
+}
+
+// splitChunks splits a line into words and whitespace runs, with tabs and
+// other whitespace turned into spaces. With hyphens, words also break
+// after a hyphen between letters.
+func splitChunks(line string, hyphens bool) []string {
+	var chunks []string
+	var cur []rune
+	inSpace := false
+	flush := func() {
+		if len(cur) > 0 {
+			chunks = append(chunks, string(cur))
+			cur = nil
+		}
+	}
+	r := []rune(line)
+	for i, ch := range r {
+		space := unicode.IsSpace(ch)
+		if space != inSpace {
+			flush()
+			inSpace = space
+		}
+		if space {
+			cur = append(cur, ' ')
+			continue
+		}
+		cur = append(cur, ch)
+		if hyphens && ch == '-' && i > 0 && unicode.IsLetter(r[i-1]) && i+1 < len(r) && unicode.IsLetter(r[i+1]) {
+			flush()
+		}
+	}
+	flush()
+	return chunks
+}
+
+// stripTags removes tags and comments from s, decodes entities and, unless
+// preserve is set, collapses whitespace.
+func stripTags(s string, preserve bool) string {
+	s = htmlCommentRe.ReplaceAllString(s, "")
+	s = stripTagsRe.ReplaceAllString(s, "")
+	if !preserve {
+		s = strings.Join(strings.Fields(s), " ")
+	}
+	return html.UnescapeString(s)
+}
+
+// urlize turns URLs and email addresses in v into links. trim shortens
+// the link text to that many runes; rel and target add attributes.
+func urlize(v any, trim int, nofollow bool, target, rel string) SafeString {
+	rels := strings.Fields(rel)
+	if nofollow {
+		rels = append(rels, "nofollow")
+	}
+	sort.Strings(rels)
+	attrs := ""
+	if len(rels) > 0 {
+		attrs += ` rel="` + html.EscapeString(strings.Join(rels, " ")) + `"`
+	}
+	if target != "" {
+		attrs += ` target="` + html.EscapeString(target) + `"`
+	}
+	text := func(m string) string {
+		r := []rune(m)
+		if trim > 0 && len(r) >= trim {
+			return string(r[:trim]) + "..."
+		}
+		return m
+	}
+	s := string(escapeHTML(v))
+	return SafeString(urlizeRe.ReplaceAllStringFunc(s, func(m string) string {
+		trail := urlizeTrailRe.FindString(m)
+		m = m[:len(m)-len(trail)]
+		href := m
+		switch {
+		case strings.HasPrefix(m, "www."):
+			href = "https://" + m
+		case !strings.Contains(m, "://"):
+			return `<a href="mailto:` + m + `">` + m + `</a>` + trail
+		}
+		return `<a href="` + href + `"` + attrs + `>` + text(m) + `</a>` + trail
+	}))
+}
@@ -1,6 +1,7 @@
 package nunchucks
 
 import (
+	"errors"
 	"strings"
 	"testing"
 )
@@ -195,3 +196,185 @@ func TestBuiltinRangeFunctionAndListMap(t *testing.T) {
 		}
 	}
 }
+
+func TestFilterAndTestKeywordArguments(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	ctx := map[string]any{
+		"phrase": "alpha beta gamma",
+		"n":      2.567,
+		"users":  []any{map[string]any{"name": "cy"}, map[string]any{"name": "al"}, map[string]any{"name": "bo"}},
+		"data":   map[string]any{"b": 1, "a": 2},
+	}
+	cases := map[string]string{
+		`{{ phrase | truncate(length=10, end="…") }}`:                         "alpha…",
+		`{{ phrase | truncate(10, killwords=true) }}`:                         "alpha b...",
+		`{{ n | round(precision=2, method='floor') }}`:                        "2.56",
+		`{{ n | round(1, "ceil") }} {{ n | round }}`:                          "2.6 3",
+		`{{ users | sort(attribute='name', reverse=true) | first | string }}`: "map[name:cy]",
+		`{{ users | sort(attribute="name") | first | string }}`:               "map[name:al]",
+		`{{ data | dictsort(by="value") | first | first }}`:                   "b",
+		`{{ missing | default(default_value="x") }}`:                          "x",
+		`{{ "" | default("y", boolean=true) }}`:                               "y",
+		`{{ "a-b-a" | replace("a", "c", count=1) }}`:                          "c-b-a",
+		`{{ "x" | int(default=7) }}`:                                          "7",
+		`{{ 9 is divisibleby(num=3) }} {{ "a" is equalto(value="a") }}`:       "true true",
+	}
+	for src, want := range cases {
+		out, err := env.RenderString(src, ctx)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", src, err)
+		}
+		if out != want {
+			t.Fatalf("%s: want %q, got %q", src, want, out)
+		}
+	}
+
+	for src, want := range map[string]string{
+		"<p>\n{{ n | round(method='up') }}</p>":              `filter "round": method must be "common", "ceil" or "floor", got "up"`,
+		"<p>\n{{ n | truncate(size=3) }}</p>":                `filter "truncate" got an unexpected keyword argument "size"`,
+		"<p>\n{{ n | truncate(3, length=4) }}</p>":           `filter "truncate" got multiple values for argument "length"`,
+		"<p>\n{{ n | center(1, 2) }}</p>":                    `filter "center" takes at most 1 arguments, got 2`,
+		"<p>\n{{ n | upper(loud=true) }}</p>":                `filter "upper" got an unexpected keyword argument "loud"`,
+		"<p>\n{{ data | dictsort(by='size') }}</p>":          `filter "dictsort": can only sort by "key" or "value", got "size"`,
+		"<p>\n{{ n | nosuchfilter }}</p>":                    `no filter named "nosuchfilter"`,
+		"<p>\n{{ n is divisibleby(by=3) }}</p>":              `test "divisibleby" got an unexpected keyword argument "by"`,
+		"<p>\n{% filter nosuchfilter %}x{% endfilter %}</p>": `no filter named "nosuchfilter"`,
+	} {
+		_, err := env.RenderString(src, ctx)
+		var te *TemplateError
+		if !errors.As(err, &te) || te.Line != 2 || te.Err.Error() != want {
+			t.Fatalf("%q: expected TemplateError %q on line 2, got %v", src, want, err)
+		}
+	}
+}
+
+// TestJinjaFilterParity ports cases from Jinja's test_filters.py. Python
+// reprs such as True and 2.0 render as Go values do here: true and 2.
+func TestJinjaFilterParity(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	ctx := map[string]any{
+		"users": []any{
+			map[string]any{"name": "foo", "role": "dev", "age": 30},
+			map[string]any{"name": "bar", "role": "ops", "age": 41, "lastname": "jones"},
+			map[string]any{"name": "baz", "role": "dev", "age": 25},
+		},
+		"rows":   []any{[]any{"a", 1}, []any{"b", 2}},
+		"prices": []any{map[string]any{"real": map[string]any{"value": 2}}, map[string]any{"real": map[string]any{"value": 3}}},
+		"data":   map[string]any{"b": nil, "a": []any{1, "x"}},
+	}
+	cases := []struct{ src, want string }{
+		{`{{ "foo bar"|capitalize }}`, "Foo bar"},
+		{`{{ "fOO BAR"|capitalize }}`, "Foo bar"},
+		{`{{ "foo"|center(9) }}`, "   foo   "},
+		{`{{ "ab"|center(5) }}`, "  ab "},
+		{`{{ missing|default("no") }}|{{ false|default("no") }}|{{ false|default("no", true) }}|{{ "yes"|d("no") }}|{{ ""|default("no") }}`, "no|false|no|yes|"},
+		{`{{ range(10)|batch(3, "X")|last|join(",") }}`, "9,X,X"},
+		{`{{ range(10)|batch(3, none)|last|join(",") }}`, "9"},
+		{`{{ range(10)|slice(3)|map("join", ",")|join("|") }}`, "0,1,2,3|4,5,6|7,8,9"},
+		{`{{ range(10)|slice(3, "X")|map("join", ",")|join("|") }}`, "0,1,2,3|4,5,6,X|7,8,9,X"},
+		{`{{ "  ..stays.."|trim }}|{{ "  ..stays.."|trim(" .") }}`, "..stays..|stays"},
+		{`{{ markup|striptags }}`, "just a small example link to a webpage"},
+		{`{{ "a &amp; b"|striptags }}`, "a & b"},
+		{`{{ 1|filesizeformat }}|{{ 100|filesizeformat }}|{{ 1000|filesizeformat }}|{{ 1000000|filesizeformat }}|{{ 1000000000000|filesizeformat }}`, "1 Byte|100 Bytes|1.0 kB|1.0 MB|1.0 TB"},
+		{`{{ -1|filesizeformat }}|{{ -2000|filesizeformat }}|{{ -1|abs }}|{{ -2|string|length }}`, "-1 Bytes|-2000 Bytes|1|2"},
+		{`{{ [3, 4]|first }}|{{ [3, 4]|last }}|{{ "héllo"|first }}|{{ "héllo"|last }}|{{ {"b": 1, "a": 2}|first }}`, "3|4|h|o|a"},
+		{`{{ []|first is undefined }}|{{ []|last is undefined }}|{{ ""|first is undefined }}|{{ {}|last is undefined }}`, "true|true|true|true"},
+		{`{{ "a b/c"|urlencode }}|{{ {"a": "x y", "b&": 1}|urlencode }}|{{ [["a", "x y"], ["a", 2]]|urlencode }}`, "a+b%2Fc|a=x+y&b%26=1|a=x+y&a=2"},
+		{`{{ 1000|filesizeformat(true) }}|{{ 1000000|filesizeformat(true) }}|{{ 1000000000|filesizeformat(binary=true) }}`, "1000 Bytes|976.6 KiB|953.7 MiB"},
+		{`{{ "42"|float }}|{{ "abc"|float }}|{{ "x"|float(default="n/a") }}|{{ true|float }}`, "42|0|n/a|1"},
+		{`{{ "42"|int }}|{{ "abc"|int }}|{{ "32.32"|int }}|{{ "0x33"|int }}`, "42|0|32|0"},
+		{`{{ "0x4d32"|int(0, 16) }}|{{ "011"|int(0, 8) }}|{{ "0b101"|int(base=2) }}|{{ "z"|int(default=-1) }}`, "19762|9|5|-1"},
+		{`{{ [1, 2, 3]|join("|") }}|{{ users|join(", ", attribute="name") }}|{{ [1, none, 2]|join }}`, "1|2|3|foo, bar, baz|12"},
+		{`{{ "hello world"|length }}|{{ [1, 2]|count }}`, "11|2"},
+		{`{{ data|pprint }}|{{ "it's"|pprint }}|{{ 2.0|pprint }}`, `{'a': [1, 'x'], 'b': None}|"it's"|2.0`},
+		{`{{ "foo bar"|title }}|{{ "foo's bar"|title }}|{{ "foo   bar"|title }}|{{ "foo-bar"|title }}|{{ tabbed|title }}`, "Foo Bar|Foo's Bar|Foo   Bar|Foo-Bar|Foo\tBar"},
+		{`{{ "foo (bar)"|title }}|{{ "foo {bar}"|title }}|{{ "foo [bar]"|title }}|{{ "foo <bar>"|title }}`, "Foo (Bar)|Foo {Bar}|Foo [Bar]|Foo <Bar>"},
+		{`{{ "foobar baz bar"|truncate(15) }}|{{ "foobar baz barx"|truncate(12, true, ">>>") }}|{{ "foobar baz bar qux"|truncate(15, false, ">>>") }}`, "foobar baz bar|foobar ba>>>|foobar baz>>>"},
+		{`{{ "foo bar baz"|truncate(9, leeway=2) }}|{{ "foo bar baz"|truncate(9) }}`, "foo bar baz|foo..."},
+		{`{{ "foo bar baz"|wordcount }}|{{ "joel-is a slug"|wordcount }}`, "3|4"},
+		{`{{ greeting|wordwrap(20) }}`, "Hello!\nThis is Jinja saying\nsomething."},
+		{`{{ "aaa bbbbbbbbbb"|wordwrap(5) }}|{{ "aaa bbbbbbb"|wordwrap(5, false, "/") }}`, "aaa b\nbbbbb\nbbbb|aaa/bbbbbbb"},
+		{`{{ "a long-winded sentence here"|wordwrap(8, wrapstring="|") }}|{{ "a long-winded"|wordwrap(8, break_on_hyphens=false, wrapstring="|") }}`, "a long-|winded|sentence|here|a long-w|inded"},
+		{`{{ {"foo": 42, "bar": 23, "fish": none, "spam": missing, "blub:blub": "<?>"}|xmlattr }}`, ` bar="23" blub:blub="&lt;?&gt;" foo="42"`},
+		{`<a{{ {"href": "/"}|xmlattr }}>|{{ {"a": 1}|xmlattr(false) }}`, `<a href="/">|a="1"`},
+		{`{{ {"a": "<b>'x'</b>", "n": [1, none]}|tojson }}`, `{"a":"\u003cb\u003e\u0027x\u0027\u003c/b\u003e","n":[1,null]}`},
+		{`{{ [1]|tojson(2) }}`, "[\n  1\n]"},
+		{`{{ ["1", "2", "3"]|map("int")|sum }}|{{ ["a", "b"]|map("upper")|join }}|{{ ["ab", "cd"]|map("replace", "a", "z")|join }}`, "6|AB|zbcd"},
+		{`{{ users|map(attribute="name")|join("|") }}|{{ users|map(attribute="lastname", default="smith")|join(", ") }}|{{ rows|map(attribute="0")|join }}`, "foo|bar|baz|smith, jones, smith|ab"},
+		{`{{ ["ab", "cd"]|map("truncate", length=1, end="")|join }}`, "ac"},
+		{`{{ "abAB"|list|unique|join }}|{{ ["a", "A", "b"]|unique(case_sensitive=true)|join }}|{{ users|unique(attribute="role")|map(attribute="name")|join(",") }}`, "ab|aAb|foo,bar"},
+		{`{{ [1, 2, 3]|min }}|{{ [1, 2, 3]|max }}|{{ ["a", "B"]|min }}|{{ ["a", "B"]|max(case_sensitive=true) }}|{{ users|max(attribute="age")|attr("name") }}|{{ []|max }}`, "1|3|a|a|bar|"},
+		{`{{ {"b": 2, "a": 1}|items|map("join", "=")|join(",") }}|{{ missing|items|length }}`, "a=1,b=2|0"},
+		{`{{ users|first|attr("name") }}|{{ users|first|attr("nope") is undefined }}`, "foo|true"},
+		{`{{ "%s|%s"|format("a", "b") }}|{{ "%(test)s"|format(test="a") }}|{{ "%.2f"|format(3.14159) }}|{{ "%05d"|format(42) }}|{{ "%-5s|"|format("ab") }}|{{ "%x"|format(255) }}|{{ "100%%"|format }}`, "a|b|a|3.14|00042|ab   ||ff|100%"},
+		{`{{ "%r %g %i"|format("x", 0.5, 7.9) }}`, "'x' 0.5 7"},
+		{`{{ text|indent(2, false, false) }}`, "\n  foo bar\n"},
+		{`{{ text|indent(2, false, true) }}`, "\n  foo bar\n  "},
+		{`{{ text|indent(2, true, false) }}`, "  \n  foo bar\n"},
+		{`{{ text|indent(2, true, true) }}`, "  \n  foo bar\n  "},
+		{`{{ "x"|indent(-2, true) }}|{{ [1]|tojson(-1) }}|{{ [1]|dump(-1) }}`, "x|[\n1\n]|[\n1\n]"},
+		{`{{ "jinja"|indent }}|{{ "jinja"|indent(first=true) }}|{{ "jinja"|indent(blank=true) }}|{{ lines|indent(">") }}`, "jinja|    jinja|jinja|a\n>b"},
+		{`{{ [1, 2, 3, 4, 5, 6]|sum }}|{{ prices|sum("real.value") }}|{{ [1, 2]|sum(start=10) }}|{{ [0.5, 1]|sum }}`, "21|5|13|1.5"},
+		{`{{ 2.5|round }}|{{ 3.5|round }}|{{ 2.7|round }}|{{ 2.1|round(0, "ceil") }}`, "2|4|3|3"},
+		{`{{ (-1)|abs }}|{{ 1|abs }}|{{ (-1.5)|abs }}`, "1|1|1.5"},
+		{`{{ users|sort(attribute="role,age")|map(attribute="name")|join(",") }}`, "baz,foo,bar"},
+		{`{{ "foo http://www.example.com/ bar"|urlize }}`, `foo <a href="http://www.example.com/">http://www.example.com/</a> bar`},
+		{`{{ "mail email@example.com."|urlize }}|{{ "see www.example.org."|urlize }}`, `mail <a href="mailto:email@example.com">email@example.com</a>.|see <a href="https://www.example.org">www.example.org</a>.`},
+		{`{{ "http://www.example.org/long/path"|urlize(15, true, target="_blank") }}`, `<a href="http://www.example.org/long/path" rel="nofollow" target="_blank">http://www.exam...</a>`},
+		{`{{ {"a": 1}|dump }}|{{ [1]|dump(2) }}`, "{\"a\":1}|[\n  1\n]"},
+	}
+	ctx["text"] = "\nfoo bar\n"
+	ctx["lines"] = "a\nb"
+	ctx["tabbed"] = "FOO\tBAR"
+	ctx["greeting"] = "Hello!\nThis is Jinja saying something."
+	ctx["markup"] = "  <p>just a small   \n <a href=\"#\">example</a> link</p>\n<p>to a webpage</p> <!-- <p>and some commented stuff</p> -->"
+	for _, c := range cases {
+		out, err := env.RenderString(c.src, ctx)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.src, err)
+		}
+		if out != c.want {
+			t.Fatalf("%s:\nwant %q\n got %q", c.src, c.want, out)
+		}
+	}
+
+	for src, want := range map[string]string{
+		`{{ "%s %s"|format("a") }}`:                  `filter "format": not enough arguments for format string`,
+		`{{ "%s"|format("a", "b") }}`:                `filter "format": not all arguments converted during string formatting`,
+		`{{ "%d"|format("a") }}`:                     `filter "format": %d format: a number is required, not string`,
+		`{{ "%s"|format("a", b=1) }}`:                `filter "format": can't handle positional and keyword arguments at the same time`,
+		`{{ users|map }}`:                            `filter "map": map requires a filter name or attribute=`,
+		`{{ users|map(attribute="a", x=1) }}`:        `filter "map": got an unexpected keyword argument "x"`,
+		`{{ {"a b": 1}|xmlattr }}`:                   `filter "xmlattr": invalid character in attribute name: "a b"`,
+		`{{ 3|items }}`:                              `filter "items": can only get item pairs from a mapping, got int`,
+		`{{ "x"|wordwrap(0) }}`:                      `filter "wordwrap": invalid width 0 (must be > 0)`,
+		`{{ [1, 2]|urlencode }}`:                     `filter "urlencode": expected a list of key/value pairs, got 1`,
+		`{{ users|map("nosuchfilter")|first }}`:      `filter "map": no filter named "nosuchfilter"`,
+		`{{ [1]|unique(case_sensitive=true, x=1) }}`: `filter "unique" got an unexpected keyword argument "x"`,
+	} {
+		_, err := env.RenderString(src, ctx)
+		var te *TemplateError
+		if !errors.As(err, &te) || te.Err.Error() != want {
+			t.Fatalf("%s: expected TemplateError %q, got %v", src, want, err)
+		}
+	}
+}
+
+func TestJoinEscapesAroundSafeStrings(t *testing.T) {
+	files := map[string]string{
+		"page.njk":  `{{ ["<foo>", "<span>foo</span>"|safe]|join }}|{{ ["<a>", "<b>"]|join }}|{{ ["<a>", "<b>"]|join("<br>"|safe) }}`,
+		"plain.txt": `{{ ["<foo>", "<span>foo</span>"|safe]|join }}`,
+	}
+	env := Configure(ConfigOptions{Loader: &testLoader{files: files}})
+	out, err := env.Render("page.njk", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "&lt;foo&gt;<span>foo</span>|&lt;a&gt;&lt;b&gt;|&lt;a&gt;<br>&lt;b&gt;"; out != want {
+		t.Fatalf("want %q, got %q", want, out)
+	}
+	out, err = env.Render("plain.txt", nil)
+	if err != nil || out != "<foo><span>foo</span>" {
+		t.Fatalf("expected an unescaped join without autoescape, got %q, %v", out, err)
+	}
+}
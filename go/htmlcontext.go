@@ -0,0 +1,405 @@
+package nunchucks
+
+import (
+	"strings"
+)
+
+// htmlState is the part of an HTML document a template is writing to.
+type htmlState uint8
+
+const (
+	stateText        htmlState = iota // element content
+	stateTag                          // inside a start tag, between attributes
+	stateAttrName                     // reading an attribute name
+	stateAfterName                    // after an attribute name, before '='
+	stateBeforeValue                  // after '=', before the attribute value
+	stateAttr                         // inside an attribute value
+	stateComment                      // inside <!-- -->
+	stateScript                       // body of a <script> element
+	stateStyle                        // body of a <style> element
+)
+
+// attrKind says how an attribute value is interpreted by the browser.
+type attrKind uint8
+
+const (
+	attrPlain attrKind = iota
+	attrURL
+	attrJS
+	attrCSS
+)
+
+// urlPart tracks how far into a URL attribute value the template is.
+type urlPart uint8
+
+const (
+	urlStart urlPart = iota // nothing written yet, so the scheme is open
+	urlPath                 // after the scheme or first path character
+	urlQuery                // after '?' or '#'
+)
+
+type jsState uint8
+
+const (
+	jsCode jsState = iota
+	jsDoubleQuote
+	jsSingleQuote
+	jsTemplate
+	jsLineComment
+	jsBlockComment
+)
+
+type cssState uint8
+
+const (
+	cssCode cssState = iota
+	cssDoubleQuote
+	cssSingleQuote
+)
+
+// htmlContext is the escaping context at one point in a template. It is
+// advanced over literal text at compile time so every {{ }} can be escaped
+// for the place it appears in.
+type htmlContext struct {
+	state    htmlState
+	element  string
+	attrName string
+	attr     attrKind
+	delim    byte
+	url      urlPart
+	js       jsState
+	css      cssState
+}
+
+// advance returns the context after the literal text s.
+func (c htmlContext) advance(s string) htmlContext {
+	for i := 0; i < len(s); {
+		switch c.state {
+		case stateText:
+			j := strings.IndexByte(s[i:], '<')
+			if j < 0 {
+				return c
+			}
+			i += j + 1
+			if strings.HasPrefix(s[i:], "!--") {
+				c.state = stateComment
+				i += 3
+				continue
+			}
+			closing := i < len(s) && s[i] == '/'
+			start := i
+			if closing {
+				start++
+			}
+			n := 0
+			for start+n < len(s) && isTagNameByte(s[start+n]) {
+				n++
+			}
+			if n == 0 {
+				continue
+			}
+			element := ""
+			if !closing {
+				element = strings.ToLower(s[start : start+n])
+			}
+			c = htmlContext{state: stateTag, element: element}
+			i = start + n
+		case stateComment:
+			j := strings.Index(s[i:], "-->")
+			if j < 0 {
+				return c
+			}
+			i += j + 3
+			c.state = stateText
+		case stateTag:
+			switch ch := s[i]; {
+			case ch == '>':
+				i++
+				c = c.enterElement()
+			case isHTMLSpace(ch) || ch == '/':
+				i++
+			default:
+				c.state = stateAttrName
+				c.attrName = ""
+			}
+		case stateAttrName:
+			switch ch := s[i]; {
+			case ch == '=':
+				c.state = stateBeforeValue
+				i++
+			case isHTMLSpace(ch):
+				c.state = stateAfterName
+				i++
+			case ch == '>' || ch == '/':
+				c.state = stateTag
+			default:
+				c.attrName += strings.ToLower(string(ch))
+				i++
+			}
+		case stateAfterName:
+			switch ch := s[i]; {
+			case isHTMLSpace(ch):
+				i++
+			case ch == '=':
+				c.state = stateBeforeValue
+				i++
+			default:
+				c.state = stateTag
+			}
+		case stateBeforeValue:
+			ch := s[i]
+			if isHTMLSpace(ch) {
+				i++
+				continue
+			}
+			c.state = stateAttr
+			c.attr = attrKindFor(c.attrName)
+			c.url, c.js, c.css = urlStart, jsCode, cssCode
+			c.delim = 0
+			if ch == '"' || ch == '\'' {
+				c.delim = ch
+				i++
+			}
+		case stateAttr:
+			var end int
+			if c.delim != 0 {
+				end = strings.IndexByte(s[i:], c.delim)
+			} else {
+				end = strings.IndexAny(s[i:], " \t\r\n\f>")
+			}
+			value := s[i:]
+			if end >= 0 {
+				value = s[i : i+end]
+			}
+			c = c.advanceAttrValue(value)
+			if end < 0 {
+				return c
+			}
+			i += end
+			if c.delim != 0 {
+				i++
+			}
+			c.state = stateTag
+			c.attrName, c.attr, c.delim = "", attrPlain, 0
+		case stateScript, stateStyle:
+			end := indexFold(s[i:], "</"+c.element)
+			body := s[i:]
+			if end >= 0 {
+				body = s[i : i+end]
+			}
+			if c.state == stateScript {
+				c.js = advanceJS(c.js, body)
+			} else {
+				c.css = advanceCSS(c.css, body)
+			}
+			if end < 0 {
+				return c
+			}
+			i += end
+			c = htmlContext{state: stateText}
+		}
+	}
+	return c
+}
+
+// enterElement moves from the end of a start tag into the element body.
+func (c htmlContext) enterElement() htmlContext {
+	switch c.element {
+	case "script":
+		return htmlContext{state: stateScript, element: c.element}
+	case "style":
+		return htmlContext{state: stateStyle, element: c.element}
+	}
+	return htmlContext{state: stateText}
+}
+
+func (c htmlContext) advanceAttrValue(value string) htmlContext {
+	switch c.attr {
+	case attrURL:
+		if value == "" {
+			return c
+		}
+		if strings.ContainsAny(value, "?#") {
+			c.url = urlQuery
+		} else if c.url == urlStart {
+			c.url = urlPath
+		}
+	case attrJS:
+		c.js = advanceJS(c.js, value)
+	case attrCSS:
+		c.css = advanceCSS(c.css, value)
+	}
+	return c
+}
+
+// afterOutput returns the context after a {{ }} was written. Output at the
+// start of a URL leaves the scheme decided.
+func (c htmlContext) afterOutput() htmlContext {
+	if c.state == stateAttr && c.attr == attrURL && c.url == urlStart {
+		c.url = urlPath
+	}
+	if c.state == stateBeforeValue {
+		c.state = stateAttr
+		c.attr = attrKindFor(c.attrName)
+		c.url, c.js, c.css = urlPath, jsCode, cssCode
+		c.delim = 0
+	}
+	return c
+}
+
+// escapeMode returns the EMIT operand for output written in this context.
+func (c htmlContext) escapeMode() int {
+	switch c.state {
+	case stateScript:
+		return jsEscapeMode(c.js)
+	case stateStyle:
+		return cssEscapeMode(c.css)
+	case stateBeforeValue, stateAttr:
+		inAttr := escInAttr
+		if c.state == stateBeforeValue || c.delim == 0 {
+			inAttr = escInUnquotedAttr
+		}
+		kind := attrKindFor(c.attrName)
+		switch kind {
+		case attrURL:
+			switch {
+			case c.state == stateBeforeValue || c.url == urlStart:
+				return escURL | inAttr
+			case c.url == urlQuery:
+				return escURLQuery | inAttr
+			}
+			return escURLPath | inAttr
+		case attrJS:
+			js := c.js
+			if c.state == stateBeforeValue {
+				js = jsCode
+			}
+			return jsEscapeMode(js) | inAttr
+		case attrCSS:
+			css := c.css
+			if c.state == stateBeforeValue {
+				css = cssCode
+			}
+			return cssEscapeMode(css) | inAttr
+		}
+		return escNone | inAttr
+	case stateTag, stateAttrName, stateAfterName:
+		// Output in attribute-name position must not open new attributes.
+		return escNone | escInUnquotedAttr
+	}
+	return escHTML
+}
+
+func jsEscapeMode(s jsState) int {
+	switch s {
+	case jsDoubleQuote, jsSingleQuote, jsTemplate:
+		return escJSString
+	}
+	return escJS
+}
+
+func cssEscapeMode(s cssState) int {
+	if s == cssDoubleQuote || s == cssSingleQuote {
+		return escCSSString
+	}
+	return escCSS
+}
+
+func advanceJS(s jsState, text string) jsState {
+	for i := 0; i < len(text); i++ {
+		ch := text[i]
+		switch s {
+		case jsCode:
+			switch {
+			case ch == '"':
+				s = jsDoubleQuote
+			case ch == '\'':
+				s = jsSingleQuote
+			case ch == '`':
+				s = jsTemplate
+			case ch == '/' && i+1 < len(text) && text[i+1] == '/':
+				s = jsLineComment
+				i++
+			case ch == '/' && i+1 < len(text) && text[i+1] == '*':
+				s = jsBlockComment
+				i++
+			}
+		case jsDoubleQuote, jsSingleQuote, jsTemplate:
+			if ch == '\\' {
+				i++
+				continue
+			}
+			if (s == jsDoubleQuote && ch == '"') || (s == jsSingleQuote && ch == '\'') || (s == jsTemplate && ch == '`') {
+				s = jsCode
+			}
+		case jsLineComment:
+			if ch == '\n' {
+				s = jsCode
+			}
+		case jsBlockComment:
+			if ch == '*' && i+1 < len(text) && text[i+1] == '/' {
+				s = jsCode
+				i++
+			}
+		}
+	}
+	return s
+}
+
+func advanceCSS(s cssState, text string) cssState {
+	for i := 0; i < len(text); i++ {
+		ch := text[i]
+		switch s {
+		case cssCode:
+			if ch == '"' {
+				s = cssDoubleQuote
+			} else if ch == '\'' {
+				s = cssSingleQuote
+			}
+		default:
+			if ch == '\\' {
+				i++
+				continue
+			}
+			if (s == cssDoubleQuote && ch == '"') || (s == cssSingleQuote && ch == '\'') {
+				s = cssCode
+			}
+		}
+	}
+	return s
+}
+
+// attrKindFor classifies an attribute by name: event handlers hold JS,
+// style holds CSS and URL-valued attributes get scheme filtering.
+func attrKindFor(name string) attrKind {
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		name = name[i+1:]
+	}
+	switch {
+	case strings.HasPrefix(name, "on"):
+		return attrJS
+	case name == "style":
+		return attrCSS
+	}
+	switch name {
+	case "href", "src", "action", "formaction", "cite", "background", "poster", "codebase", "longdesc", "usemap", "manifest", "icon", "srcset", "data":
+		return attrURL
+	}
+	if strings.Contains(name, "url") || strings.Contains(name, "uri") || strings.Contains(name, "src") || strings.Contains(name, "href") {
+		return attrURL
+	}
+	return attrPlain
+}
+
+func isTagNameByte(ch byte) bool {
+	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9') || ch == '-' || ch == ':'
+}
+
+func isHTMLSpace(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == '\f'
+}
+
+// indexFold is strings.Index ignoring ASCII case in s.
+func indexFold(s, substr string) int {
+	return strings.Index(strings.ToLower(s), strings.ToLower(substr))
+}
@@ -0,0 +1,73 @@
+package nunchucks
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestImportedModulesExportSetsAndHidePrivateNames(t *testing.T) {
+	files := map[string]string{
+		"forms.njk": `{% set DEFAULT_CLASS = "field" %}{% set _secret = "s" %}{% set loaded = tick() %}` +
+			`{% macro _label(text) %}<label>{{ text }}</label>{% endmacro %}` +
+			`{% macro input(name) %}{{ _label(name) }}<input class="{{ DEFAULT_CLASS }}" name="{{ name }}">{% endmacro %}`,
+		"page.njk": `{% import "forms.njk" as forms with context %}{% for f in fields %}{% import "forms.njk" as ui with context %}{{ ui.input(f) }}{% endfor %}` +
+			`|{{ forms.DEFAULT_CLASS }}|{{ forms._secret }}|{{ forms._label }}`,
+		"star.njk": `{% from "forms.njk" import * with context %}{{ input("q") }}|{{ DEFAULT_CLASS }}|{{ _label is defined }}`,
+	}
+	env := Configure(ConfigOptions{Loader: &testLoader{files: files}})
+	loads := 0
+	ctx := map[string]any{
+		"fields": []any{"a", "b"},
+		"tick":   func(...any) any { loads++; return loads },
+	}
+	out, err := env.Render("page.njk", ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `<label>a</label><input class="field" name="a"><label>b</label><input class="field" name="b">|field||`
+	if out != want {
+		t.Fatalf("unexpected output\nwant: %q\n got: %q", want, out)
+	}
+	if loads != 1 {
+		t.Fatalf("expected the module to run once per render, ran %d times", loads)
+	}
+
+	out, err = env.Render("star.njk", ctx)
+	if err != nil || out != `<label>q</label><input class="field" name="q">|field|false` {
+		t.Fatalf("unexpected output %q, %v", out, err)
+	}
+
+	_, err = env.RenderString(`{% from "forms.njk" import _label %}`, nil)
+	if err == nil || !strings.Contains(err.Error(), `cannot import "_label": names starting with an underscore are private`) {
+		t.Fatalf("expected a private name error, got %v", err)
+	}
+	_, err = env.RenderString(`{% from "forms.njk" import select with context %}`, ctx)
+	var te *TemplateError
+	if !errors.As(err, &te) || te.Err.Error() != `cannot import "select": the template does not define it` {
+		t.Fatalf("expected a missing name error, got %v", err)
+	}
+}
+
+func TestImportCyclesAreReported(t *testing.T) {
+	files := map[string]string{
+		"self.njk":    `{% import "self.njk" as me %}`,
+		"a.njk":       `{% from "b.njk" import y %}{% macro x() %}x{% endmacro %}`,
+		"b.njk":       `{% from "a.njk" import x %}{% macro y() %}y{% endmacro %}`,
+		"page.njk":    `{% import "a.njk" as a %}`,
+		"loop.njk":    `{% include "imports.njk" %}`,
+		"imports.njk": `{% import "loop.njk" as l %}`,
+	}
+	env := Configure(ConfigOptions{Loader: &testLoader{files: files}, Limits: Limits{MaxDepth: 64}})
+	for name, want := range map[string]string{
+		"self.njk": "import cycle detected: self.njk -> self.njk",
+		"page.njk": "import cycle detected: a.njk -> b.njk -> a.njk",
+		"loop.njk": "import cycle detected: loop.njk -> imports.njk -> loop.njk",
+	} {
+		_, err := env.Render(name, nil)
+		var te *TemplateError
+		if !errors.As(err, &te) || !strings.Contains(te.Err.Error(), want) {
+			t.Fatalf("%s: expected %q, got %v", name, want, err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package nunchucks
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMultiLevelInheritance(t *testing.T) {
+	files := map[string]string{
+		"base.njk":   `<title>{% block title %}Site{% endblock %}</title><main>{% block body %}[{% block inner %}base{% endblock %}]{% endblock %}</main>{% block foot %}{% endblock %}`,
+		"layout.njk": `{% extends "base.njk" %}{% block title %}{{super()}} - Docs{% endblock %}{% block foot %}<nav>{% block links %}none{% endblock %}</nav>{% endblock %}`,
+		"page.njk":   `{% extends "layout.njk" %}{% block title %}Intro | {{  super( ) }}{% endblock %}{% block inner %}page<{{ super() }}>{% endblock %}{% block links %}a b{% endblock %}`,
+	}
+	env := Configure(ConfigOptions{Loader: &testLoader{files: files}})
+	want := "<title>Intro | Site - Docs</title><main>[page<base>]</main><nav>a b</nav>"
+	out, err := env.Render("page.njk", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != want {
+		t.Fatalf("unexpected output\nwant: %q\n got: %q", want, out)
+	}
+
+	compiled, err := env.Compile("page.njk")
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	out, err = env.RenderString(compiled, nil)
+	if err != nil {
+		t.Fatalf("render compiled: %v\n%s", err, compiled)
+	}
+	if out != want {
+		t.Fatalf("unexpected compiled output\nwant: %q\n got: %q\nsource: %s", want, out, compiled)
+	}
+}
+
+func TestSelfRequiredAndScopedBlocks(t *testing.T) {
+	files := map[string]string{
+		"base.njk":  `<title>{% block title required %}{% endblock %}</title><h1>{{ self.title() }}</h1>`,
+		"page.njk":  `{% extends "base.njk" %}{% block title %}Home{% endblock %}`,
+		"empty.njk": `{% extends "base.njk" %}`,
+		"list.njk":  `{% for item in items %}{% block item scoped %}<li>{{ item }}</li>{% endblock %}{% endfor %}`,
+	}
+	env := Configure(ConfigOptions{Loader: &testLoader{files: files}})
+	out, err := env.Render("page.njk", nil)
+	if err != nil || out != "<title>Home</title><h1>Home</h1>" {
+		t.Fatalf("unexpected output %q, %v", out, err)
+	}
+	out, err = env.Render("list.njk", map[string]any{"items": []any{"a", "b"}})
+	if err != nil || out != "<li>a</li><li>b</li>" {
+		t.Fatalf("unexpected output %q, %v", out, err)
+	}
+
+	_, err = env.Render("empty.njk", nil)
+	var te *TemplateError
+	if !errors.As(err, &te) || te.Template != "base.njk" || te.Err.Error() != `required block "title" is not overridden` {
+		t.Fatalf("expected a required block error, got %v", err)
+	}
+	_, err = env.RenderString(`{% block title required %}x{% endblock %}`, nil)
+	if err == nil || !strings.Contains(err.Error(), `required block "title" may only contain whitespace`) {
+		t.Fatalf("expected a parse error, got %v", err)
+	}
+	_, err = env.RenderString(`{% block title sticky %}{% endblock %}`, nil)
+	if err == nil || !strings.Contains(err.Error(), "invalid block statement") {
+		t.Fatalf("expected a parse error, got %v", err)
+	}
+}
@@ -0,0 +1,697 @@
+package nunchucks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// irVersion is bumped whenever the serialized program format changes.
+const irVersion = 4
+
+type opcode uint8
+
+const (
+	opText        opcode = iota // TEXT s: write s
+	opEval                      // EVAL a: push expression a
+	opLookup                    // LOOKUP s: push variable s
+	opFilter                    // FILTER s a names: pop kwargs names, a args and a value, push the filtered value
+	opEmit                      // EMIT a: pop a value and write it with escape mode a
+	opJumpIfFalse               // JUMP_IF_FALSE a: pop a value, jump to a when falsy
+	opJump                      // JUMP a
+	opPushFrame                 // PUSH_FRAME: enter a copy of the current scope
+	opPopFrame                  // POP_FRAME: leave the innermost scope
+	opSet                       // SET s: pop a value into variable or namespace attribute s, or unpack it into names
+	opIter                      // ITER a b names: pop an iterable and start a loop over it with loop flags b, keeping items for which expression a holds with names bound
+	opNext                      // NEXT s a: push a frame binding the next item to s (or unpacking it into names), or jump to a
+	opIterEnd                   // ITER_END a: drop the innermost loop, jumping to a (when set) if it visited any item
+	opCall                      // CALL a names b: call with a args, kwargs names and unit b as caller
+	opCapture                   // CAPTURE: redirect output into a buffer
+	opEndCapture                // END_CAPTURE a: push the captured output, as a SafeString when a is set
+	opBlockCall                 // BLOCK_CALL s: render the most derived block s
+	opExtends                   // EXTENDS s: render the parent template s (popped when s is empty) after this one
+	opInclude                   // INCLUDE s a: render template s (popped when s is empty) with include flags a
+	opImport                    // IMPORT s names a: bind the macros of s (popped when s is empty) to names[0]
+	opFromImport                // FROM_IMPORT s names a: bind macros of s (popped when s is empty) as name/alias pairs
+	opMacro                     // MACRO a: define the macro in unit a
+	opTag                       // TAG s a names b: pop kwargs names, a args and, when b is set, a body, and write the output of extension tag s
+	opClientEvent               // CLIENT_EVENT s names: bind client event names[0] to handler s
+)
+
+var opcodeNames = [...]string{
+	opText:        "TEXT",
+	opEval:        "EVAL",
+	opLookup:      "LOOKUP",
+	opFilter:      "FILTER",
+	opEmit:        "EMIT",
+	opJumpIfFalse: "JUMP_IF_FALSE",
+	opJump:        "JUMP",
+	opPushFrame:   "PUSH_FRAME",
+	opPopFrame:    "POP_FRAME",
+	opSet:         "SET",
+	opIter:        "ITER",
+	opNext:        "NEXT",
+	opIterEnd:     "ITER_END",
+	opCall:        "CALL",
+	opCapture:     "CAPTURE",
+	opEndCapture:  "END_CAPTURE",
+	opBlockCall:   "BLOCK_CALL",
+	opExtends:     "EXTENDS",
+	opInclude:     "INCLUDE",
+	opImport:      "IMPORT",
+	opFromImport:  "FROM_IMPORT",
+	opMacro:       "MACRO",
+	opTag:         "TAG",
+	opClientEvent: "CLIENT_EVENT",
+}
+
+func (op opcode) String() string {
+	if int(op) < len(opcodeNames) {
+		return opcodeNames[op]
+	}
+	return fmt.Sprintf("OP(%d)", op)
+}
+
+func (op opcode) MarshalText() ([]byte, error) {
+	if int(op) >= len(opcodeNames) {
+		return nil, fmt.Errorf("unknown opcode %d", op)
+	}
+	return []byte(opcodeNames[op]), nil
+}
+
+func (op *opcode) UnmarshalText(b []byte) error {
+	for i, name := range opcodeNames {
+		if name == string(b) {
+			*op = opcode(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown opcode %q", string(b))
+}
+
+// Loop flags carried in the b operand of ITER.
+const (
+	iterFiltered = 1 << iota
+	iterRecursive
+)
+
+// Include flags carried in the a operand of INCLUDE.
+const (
+	includeIgnoreMissing = 1 << iota
+	includeWithContext
+)
+
+// instr is a single VM instruction. Operands are interpreted per opcode.
+type instr struct {
+	Op    opcode   `json:"op"`
+	S     string   `json:"s,omitempty"`
+	A     int      `json:"a,omitempty"`
+	B     int      `json:"b,omitempty"`
+	Names []string `json:"names,omitempty"`
+	Line  int      `json:"line,omitempty"`
+	Col   int      `json:"col,omitempty"`
+}
+
+func (in instr) String() string {
+	var b strings.Builder
+	b.WriteString(in.Op.String())
+	switch in.Op {
+	case opText:
+		fmt.Fprintf(&b, " %q", in.S)
+	case opEval, opEmit, opJumpIfFalse, opJump, opMacro, opIterEnd, opEndCapture:
+		fmt.Fprintf(&b, " %d", in.A)
+	case opSet:
+		if len(in.Names) > 0 {
+			fmt.Fprintf(&b, " %s", strings.Join(in.Names, ","))
+		} else {
+			fmt.Fprintf(&b, " %s", in.S)
+		}
+	case opLookup, opBlockCall, opExtends:
+		fmt.Fprintf(&b, " %s", in.S)
+	case opNext:
+		if len(in.Names) > 0 {
+			fmt.Fprintf(&b, " %s %d", strings.Join(in.Names, ","), in.A)
+		} else {
+			fmt.Fprintf(&b, " %s %d", in.S, in.A)
+		}
+	case opFilter:
+		fmt.Fprintf(&b, " %s %d", in.S, in.A)
+		if len(in.Names) > 0 {
+			fmt.Fprintf(&b, " %v", in.Names)
+		}
+	case opInclude:
+		fmt.Fprintf(&b, " %s %d", in.S, in.A)
+	case opTag:
+		fmt.Fprintf(&b, " %s %d %v %d", in.S, in.A, in.Names, in.B)
+	case opCall:
+		fmt.Fprintf(&b, " %d %v %d", in.A, in.Names, in.B)
+	case opIter:
+		if in.B != 0 {
+			fmt.Fprintf(&b, " %d %d %v", in.A, in.B, in.Names)
+		}
+	case opImport, opFromImport, opClientEvent:
+		fmt.Fprintf(&b, " %s %v", in.S, in.Names)
+	}
+	return b.String()
+}
+
+// unit is a run of instructions: the template body, a block or a macro.
+type unit struct {
+	Name   string       `json:"name,omitempty"`
+	Params []MacroParam `json:"params,omitempty"`
+	Code   []instr      `json:"code"`
+	// Required marks a block that must be overridden.
+	Required bool `json:"required,omitempty"`
+	// CatchVarargs and CatchKwargs mark a macro that collects extra
+	// arguments in varargs and kwargs.
+	CatchVarargs bool `json:"varargs,omitempty"`
+	CatchKwargs  bool `json:"kwargs,omitempty"`
+}
+
+// program is a compiled template. Units[0] is the template body; blocks,
+// macros and call bodies live in their own units.
+type program struct {
+	Version  int              `json:"version"`
+	Name     string           `json:"name"`
+	Exprs    []*compiledExpr  `json:"exprs"`
+	Units    []unit           `json:"units"`
+	Blocks   map[string]int   `json:"blocks,omitempty"`
+	Contract TemplateContract `json:"contract"`
+	// Newline records whether the source ended with a newline, which
+	// decides how global templates are joined to the page.
+	Newline bool `json:"newline,omitempty"`
+	// Autoescape records whether the template escapes output, which
+	// decides whether its macros return SafeString.
+	Autoescape bool `json:"autoescape,omitempty"`
+	// source is the template text, used for error snippets. It is not
+	// serialized, so templates loaded from IR report positions only.
+	source string
+	// extensions holds the extensions that parsed the template's tags.
+	// Templates loaded from IR use the Env's extensions instead.
+	extensions map[string]Extension
+}
+
+// EncodeIR serializes the compiled template so it can be shipped and
+// loaded with Env.LoadIR without its source.
+func (t *Template) EncodeIR() ([]byte, error) {
+	return json.Marshal(t.prog)
+}
+
+// LoadIR adds a template serialized with EncodeIR to the cache under its
+// original name, so extends, include and import resolve it without the
+// loader. A ModTimeLoader that still has the source takes precedence.
+func (e *Env) LoadIR(data []byte) (*Template, error) {
+	prog, err := decodeProgram(data)
+	if err != nil {
+		return nil, err
+	}
+	t := &Template{env: e, name: prog.Name, prog: prog}
+	e.storeTemplate(t)
+	return t, nil
+}
+
+func decodeProgram(data []byte) (*program, error) {
+	var prog program
+	if err := json.Unmarshal(data, &prog); err != nil {
+		return nil, err
+	}
+	if prog.Version != irVersion {
+		return nil, fmt.Errorf("unsupported IR version %d", prog.Version)
+	}
+	if len(prog.Units) == 0 {
+		return nil, fmt.Errorf("IR for %q has no code", prog.Name)
+	}
+	for i := range prog.Units {
+		for j, p := range prog.Units[i].Params {
+			if p.HasDefault {
+				prog.Units[i].Params[j].def = compileExpr(p.Default)
+			}
+		}
+	}
+	return &prog, nil
+}
+
+// exprJSON is the serialized form of an expression node.
+type exprJSON struct {
+	Kind   string        `json:"k"`
+	Value  any           `json:"v,omitempty"`
+	Name   string        `json:"n,omitempty"`
+	Op     string        `json:"op,omitempty"`
+	X      *exprJSON     `json:"x,omitempty"`
+	Y      *exprJSON     `json:"y,omitempty"`
+	Z      *exprJSON     `json:"z,omitempty"`
+	Args   []*exprJSON   `json:"args,omitempty"`
+	Kwargs []*exprJSON   `json:"kwargs,omitempty"`
+	Steps  []compareJSON `json:"steps,omitempty"`
+}
+
+type compareJSON struct {
+	Op     string      `json:"op"`
+	Y      *exprJSON   `json:"y,omitempty"`
+	Test   string      `json:"test,omitempty"`
+	Args   []*exprJSON `json:"args,omitempty"`
+	Kwargs []*exprJSON `json:"kwargs,omitempty"`
+	Negate bool        `json:"negate,omitempty"`
+}
+
+func (c *compiledExpr) MarshalJSON() ([]byte, error) {
+	out := struct {
+		Src string    `json:"src,omitempty"`
+		AST *exprJSON `json:"ast,omitempty"`
+	}{Src: c.src}
+	if c.err == nil {
+		ast, err := encodeExpr(c.root)
+		if err != nil {
+			return nil, err
+		}
+		out.AST = ast
+	}
+	return json.Marshal(out)
+}
+
+func (c *compiledExpr) UnmarshalJSON(b []byte) error {
+	var in struct {
+		Src string    `json:"src"`
+		AST *exprJSON `json:"ast"`
+	}
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+	if in.AST == nil {
+		*c = *compileExpr(in.Src)
+		return nil
+	}
+	root, err := decodeExpr(in.AST)
+	if err != nil {
+		return err
+	}
+	*c = compiledExpr{src: in.Src, root: root}
+	return nil
+}
+
+// encodeKwargs serializes named arguments as "kwarg" entries.
+func encodeKwargs(kwargs []kwargExpr) ([]*exprJSON, error) {
+	var out []*exprJSON
+	for _, kw := range kwargs {
+		v, err := encodeExpr(kw.value)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &exprJSON{Kind: "kwarg", Name: kw.name, X: v})
+	}
+	return out, nil
+}
+
+func encodeExprs(nodes []exprNode) ([]*exprJSON, error) {
+	if len(nodes) == 0 {
+		return nil, nil
+	}
+	out := make([]*exprJSON, 0, len(nodes))
+	for _, n := range nodes {
+		j, err := encodeExpr(n)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, j)
+	}
+	return out, nil
+}
+
+func encodeExpr(n exprNode) (*exprJSON, error) {
+	switch n := n.(type) {
+	case *literalExpr:
+		switch v := n.value.(type) {
+		case nil:
+			return &exprJSON{Kind: "nil"}, nil
+		case bool:
+			return &exprJSON{Kind: "bool", Value: v}, nil
+		case int:
+			return &exprJSON{Kind: "int", Value: v}, nil
+		case float64:
+			return &exprJSON{Kind: "float", Value: v}, nil
+		case string:
+			return &exprJSON{Kind: "str", Value: v}, nil
+		}
+		return nil, fmt.Errorf("unsupported literal %T", n.value)
+	case *nameExpr:
+		return &exprJSON{Kind: "name", Name: n.name}, nil
+	case *attrExpr:
+		x, err := encodeExpr(n.target)
+		if err != nil {
+			return nil, err
+		}
+		return &exprJSON{Kind: "attr", Name: n.name, X: x}, nil
+	case *indexExpr:
+		x, err := encodeExpr(n.target)
+		if err != nil {
+			return nil, err
+		}
+		y, err := encodeExpr(n.index)
+		if err != nil {
+			return nil, err
+		}
+		return &exprJSON{Kind: "index", X: x, Y: y}, nil
+	case *sliceExpr:
+		x, err := encodeExpr(n.target)
+		if err != nil {
+			return nil, err
+		}
+		out := &exprJSON{Kind: "slice", X: x}
+		// Omitted bounds are encoded as null.
+		for _, part := range []exprNode{n.start, n.stop, n.step} {
+			var j *exprJSON
+			if part != nil {
+				if j, err = encodeExpr(part); err != nil {
+					return nil, err
+				}
+			}
+			out.Args = append(out.Args, j)
+		}
+		return out, nil
+	case *listExpr:
+		items, err := encodeExprs(n.items)
+		if err != nil {
+			return nil, err
+		}
+		if n.tuple {
+			return &exprJSON{Kind: "tuple", Args: items}, nil
+		}
+		return &exprJSON{Kind: "list", Args: items}, nil
+	case *dictExpr:
+		out := &exprJSON{Kind: "dict"}
+		for i, k := range n.keys {
+			x, err := encodeExpr(k)
+			if err != nil {
+				return nil, err
+			}
+			y, err := encodeExpr(n.values[i])
+			if err != nil {
+				return nil, err
+			}
+			out.Args = append(out.Args, &exprJSON{Kind: "entry", X: x, Y: y})
+		}
+		return out, nil
+	case *callExpr:
+		x, err := encodeExpr(n.fn)
+		if err != nil {
+			return nil, err
+		}
+		args, err := encodeExprs(n.args)
+		if err != nil {
+			return nil, err
+		}
+		kwargs, err := encodeKwargs(n.kwargs)
+		if err != nil {
+			return nil, err
+		}
+		return &exprJSON{Kind: "call", X: x, Args: args, Kwargs: kwargs}, nil
+	case *filterExpr:
+		x, err := encodeExpr(n.target)
+		if err != nil {
+			return nil, err
+		}
+		args, err := encodeExprs(n.filter.args)
+		if err != nil {
+			return nil, err
+		}
+		kwargs, err := encodeKwargs(n.filter.kwargs)
+		if err != nil {
+			return nil, err
+		}
+		return &exprJSON{Kind: "filter", Name: n.filter.name, X: x, Args: args, Kwargs: kwargs}, nil
+	case *unaryExpr:
+		x, err := encodeExpr(n.operand)
+		if err != nil {
+			return nil, err
+		}
+		op := "-"
+		if n.op == tokNot {
+			op = "not"
+		}
+		return &exprJSON{Kind: "unary", Op: op, X: x}, nil
+	case *binaryExpr:
+		x, err := encodeExpr(n.left)
+		if err != nil {
+			return nil, err
+		}
+		y, err := encodeExpr(n.right)
+		if err != nil {
+			return nil, err
+		}
+		return &exprJSON{Kind: "binary", Op: n.op, X: x, Y: y}, nil
+	case *logicalExpr:
+		x, err := encodeExpr(n.left)
+		if err != nil {
+			return nil, err
+		}
+		y, err := encodeExpr(n.right)
+		if err != nil {
+			return nil, err
+		}
+		kind := "or"
+		if n.and {
+			kind = "and"
+		}
+		return &exprJSON{Kind: kind, X: x, Y: y}, nil
+	case *compareExpr:
+		x, err := encodeExpr(n.left)
+		if err != nil {
+			return nil, err
+		}
+		out := &exprJSON{Kind: "compare", X: x}
+		for _, step := range n.steps {
+			s := compareJSON{Op: step.op, Test: step.test, Negate: step.negate}
+			if step.right != nil {
+				if s.Y, err = encodeExpr(step.right); err != nil {
+					return nil, err
+				}
+			}
+			if s.Args, err = encodeExprs(step.args); err != nil {
+				return nil, err
+			}
+			if s.Kwargs, err = encodeKwargs(step.kwargs); err != nil {
+				return nil, err
+			}
+			out.Steps = append(out.Steps, s)
+		}
+		return out, nil
+	case *condExpr:
+		x, err := encodeExpr(n.then)
+		if err != nil {
+			return nil, err
+		}
+		y, err := encodeExpr(n.cond)
+		if err != nil {
+			return nil, err
+		}
+		z, err := encodeExpr(n.otherwise)
+		if err != nil {
+			return nil, err
+		}
+		return &exprJSON{Kind: "cond", X: x, Y: y, Z: z}, nil
+	}
+	return nil, fmt.Errorf("unsupported expression %T", n)
+}
+
+func decodeExprs(in []*exprJSON) ([]exprNode, error) {
+	out := make([]exprNode, 0, len(in))
+	for _, j := range in {
+		n, err := decodeExpr(j)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func decodeKwargs(in []*exprJSON) ([]kwargExpr, error) {
+	var out []kwargExpr
+	for _, j := range in {
+		v, err := decodeExpr(j.X)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, kwargExpr{name: j.Name, value: v})
+	}
+	return out, nil
+}
+
+func decodeExpr(j *exprJSON) (exprNode, error) {
+	if j == nil {
+		return nil, fmt.Errorf("missing expression")
+	}
+	switch j.Kind {
+	case "nil":
+		return &literalExpr{}, nil
+	case "bool":
+		v, _ := j.Value.(bool)
+		return &literalExpr{value: v}, nil
+	case "int":
+		v, _ := j.Value.(float64)
+		return &literalExpr{value: int(v)}, nil
+	case "float":
+		v, _ := j.Value.(float64)
+		return &literalExpr{value: v}, nil
+	case "str":
+		v, _ := j.Value.(string)
+		return &literalExpr{value: v}, nil
+	case "name":
+		return &nameExpr{name: j.Name}, nil
+	case "attr":
+		x, err := decodeExpr(j.X)
+		if err != nil {
+			return nil, err
+		}
+		return &attrExpr{target: x, name: j.Name}, nil
+	case "index":
+		x, err := decodeExpr(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeExpr(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &indexExpr{target: x, index: y}, nil
+	case "slice":
+		x, err := decodeExpr(j.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(j.Args) != 3 {
+			return nil, fmt.Errorf("slice needs 3 bounds, got %d", len(j.Args))
+		}
+		var parts [3]exprNode
+		for i, a := range j.Args {
+			if a == nil {
+				continue
+			}
+			if parts[i], err = decodeExpr(a); err != nil {
+				return nil, err
+			}
+		}
+		return &sliceExpr{target: x, start: parts[0], stop: parts[1], step: parts[2]}, nil
+	case "list", "tuple":
+		items, err := decodeExprs(j.Args)
+		if err != nil {
+			return nil, err
+		}
+		return &listExpr{items: items, tuple: j.Kind == "tuple"}, nil
+	case "dict":
+		out := &dictExpr{keys: []exprNode{}, values: []exprNode{}}
+		for _, e := range j.Args {
+			if e == nil {
+				return nil, fmt.Errorf("missing dict entry")
+			}
+			x, err := decodeExpr(e.X)
+			if err != nil {
+				return nil, err
+			}
+			y, err := decodeExpr(e.Y)
+			if err != nil {
+				return nil, err
+			}
+			out.keys = append(out.keys, x)
+			out.values = append(out.values, y)
+		}
+		return out, nil
+	case "call":
+		x, err := decodeExpr(j.X)
+		if err != nil {
+			return nil, err
+		}
+		args, err := decodeExprs(j.Args)
+		if err != nil {
+			return nil, err
+		}
+		kwargs, err := decodeKwargs(j.Kwargs)
+		if err != nil {
+			return nil, err
+		}
+		return &callExpr{fn: x, args: args, kwargs: kwargs}, nil
+	case "filter":
+		x, err := decodeExpr(j.X)
+		if err != nil {
+			return nil, err
+		}
+		args, err := decodeExprs(j.Args)
+		if err != nil {
+			return nil, err
+		}
+		kwargs, err := decodeKwargs(j.Kwargs)
+		if err != nil {
+			return nil, err
+		}
+		return &filterExpr{target: x, filter: filterCall{name: j.Name, args: args, kwargs: kwargs}}, nil
+	case "unary":
+		x, err := decodeExpr(j.X)
+		if err != nil {
+			return nil, err
+		}
+		op := tokMinus
+		if j.Op == "not" {
+			op = tokNot
+		}
+		return &unaryExpr{op: op, operand: x}, nil
+	case "binary":
+		x, err := decodeExpr(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeExpr(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &binaryExpr{op: j.Op, left: x, right: y}, nil
+	case "and", "or":
+		x, err := decodeExpr(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeExpr(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &logicalExpr{and: j.Kind == "and", left: x, right: y}, nil
+	case "compare":
+		x, err := decodeExpr(j.X)
+		if err != nil {
+			return nil, err
+		}
+		out := &compareExpr{left: x}
+		for _, s := range j.Steps {
+			step := compareStep{op: s.Op, test: s.Test, negate: s.Negate}
+			if s.Y != nil {
+				if step.right, err = decodeExpr(s.Y); err != nil {
+					return nil, err
+				}
+			}
+			if len(s.Args) > 0 {
+				if step.args, err = decodeExprs(s.Args); err != nil {
+					return nil, err
+				}
+			}
+			if step.kwargs, err = decodeKwargs(s.Kwargs); err != nil {
+				return nil, err
+			}
+			out.steps = append(out.steps, step)
+		}
+		return out, nil
+	case "cond":
+		x, err := decodeExpr(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeExpr(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		z, err := decodeExpr(j.Z)
+		if err != nil {
+			return nil, err
+		}
+		return &condExpr{then: x, cond: y, otherwise: z}, nil
+	}
+	return nil, fmt.Errorf("unknown expression kind %q", j.Kind)
+}
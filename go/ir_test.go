@@ -0,0 +1,112 @@
+package nunchucks
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIRRoundTripRendersWithoutSources(t *testing.T) {
+	files := map[string]string{
+		"base.njk":   `<title>{% block title %}Base{% endblock %}</title>{% block body %}{% endblock %}`,
+		"macros.njk": `{% macro badge(text, tone="info") %}<b class="{{ tone }}">{{ text | upper }}</b>{% endmacro %}`,
+		"page.njk": `{# @props
+items: list
+#}{% extends "base.njk" %}{% import ["missing.njk", "macros.njk"] as ui %}
+{% block title %}Page - {{ super() }}{% endblock %}
+{% block body %}{% for x in items %}{% if loop.first %}[{% endif %}{{ ui.badge(x) }}{% endfor %}{% filter lower %}END{% endfilter %}{{ items[-1] }}{{ items[::-1] | join("") }}{% set nav = [{"href": "/", "label": "Home"}, ("a", "b")] %}{{ nav[0].label }}{{ nav[1] | length }}{% for k, v in {"b": 2, "a": 1} %}{{ k }}{{ v }}{% endfor %}{% for x in items if x != "a" %}{{ loop.cycle("o", "e") }}{% break %}{% else %}-{% endfor %}{{ "abcdefgh" | truncate(length=5, end="~") }}{{ ("abcdefgh" | truncate(length=5, end="~") | length) is divisibleby(num=5) }}{% client %}{% fetch | '/api/' + items[0] | as data %}{% state app | { n: items | length } %}{% endclient %}{% endblock %}`,
+	}
+	src := Configure(ConfigOptions{Loader: &testLoader{files: files}})
+	ctx := map[string]any{"items": []any{"a", "b"}}
+	want, err := src.Render("page.njk", ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dst := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	for name := range files {
+		tpl, err := src.GetTemplate(name)
+		if err != nil {
+			t.Fatalf("compile %s: %v", name, err)
+		}
+		data, err := tpl.EncodeIR()
+		if err != nil {
+			t.Fatalf("encode %s: %v", name, err)
+		}
+		if _, err := dst.LoadIR(data); err != nil {
+			t.Fatalf("load %s: %v", name, err)
+		}
+	}
+
+	got, err := dst.Render("page.njk", ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != want {
+		t.Fatalf("IR render mismatch\nwant: %q\n got: %q", want, got)
+	}
+	if _, err := dst.Render("page.njk", map[string]any{}); err == nil || !strings.Contains(err.Error(), `missing required prop "items"`) {
+		t.Fatalf("expected contract to survive serialization, got %v", err)
+	}
+}
+
+func TestLoadIRRejectsUnknownVersion(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	if _, err := env.LoadIR([]byte(`{"version":99,"name":"x","units":[{"code":[]}]}`)); err == nil {
+		t.Fatalf("expected version error")
+	}
+}
+
+func TestTraceLogsInstructions(t *testing.T) {
+	var trace strings.Builder
+	env := Configure(ConfigOptions{
+		Loader: &testLoader{files: map[string]string{"page.njk": `Hi {{ name | upper }}`}},
+		Trace:  &trace,
+	})
+	out, err := env.Render("page.njk", map[string]any{"name": "sam"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "Hi SAM" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+	want := []string{
+		`page.njk 0000 TEXT "Hi "`,
+		`page.njk 0001 LOOKUP name`,
+		`page.njk 0002 FILTER upper 0`,
+		`page.njk 0003 EMIT 1`,
+	}
+	if got := strings.Split(strings.TrimSpace(trace.String()), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected trace\nwant: %q\n got: %q", want, got)
+	}
+}
+
+func TestPrecompileDirWritesIR(t *testing.T) {
+	viewsDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(viewsDir, "index.njk"), []byte(`<h1>{{ title }}</h1>`), 0o644); err != nil {
+		t.Fatalf("write index.njk: %v", err)
+	}
+	env := Configure(ConfigOptions{Path: viewsDir})
+	outDir := t.TempDir()
+	if err := env.PrecompileDirWithOptions(outDir, nil, PrecompileOptions{IR: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(outDir, "index.njk.ir.json"))
+	if err != nil {
+		t.Fatalf("expected IR output: %v", err)
+	}
+	loaded := Configure(ConfigOptions{Loader: MemoryLoader(nil)})
+	tpl, err := loaded.LoadIR(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out, err := tpl.Render(map[string]any{"title": "Hello"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "<h1>Hello</h1>" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+}
@@ -0,0 +1,302 @@
+package nunchucks
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	commentStart = "{#"
+	commentEnd   = "#}"
+)
+
+type tmplTokenKind int
+
+const (
+	tmplText tmplTokenKind = iota
+	tmplOutput
+	tmplTag
+)
+
+type tmplToken struct {
+	kind  tmplTokenKind
+	value string
+	start int
+	end   int
+	line  int
+	col   int
+}
+
+// delimiters holds the configured variable and block markers for a lexer.
+type delimiters struct {
+	variableStart string
+	variableEnd   string
+	blockStart    string
+	blockEnd      string
+}
+
+func (e *Env) delimiters() delimiters {
+	return delimiters{
+		variableStart: e.variableStart,
+		variableEnd:   e.variableEnd,
+		blockStart:    e.blockStart,
+		blockEnd:      e.blockEnd,
+	}
+}
+
+type templateLexer struct {
+	src       string
+	delims    delimiters
+	pos       int
+	tokens    []tmplToken
+	trimNext  bool
+	lineStart []int
+}
+
+// lexTemplate splits a template source into text, output and tag tokens.
+// Comments are dropped, raw/verbatim bodies are emitted as text and
+// whitespace control markers ({%- -%}) trim the neighbouring text.
+func lexTemplate(src string, d delimiters) ([]tmplToken, error) {
+	lx := &templateLexer{src: src, delims: d, lineStart: []int{0}}
+	for i := 0; i < len(src); i++ {
+		if src[i] == '\n' {
+			lx.lineStart = append(lx.lineStart, i+1)
+		}
+	}
+	if err := lx.run(); err != nil {
+		return nil, err
+	}
+	return lx.tokens, nil
+}
+
+func (lx *templateLexer) position(offset int) (int, int) {
+	lo, hi := 0, len(lx.lineStart)-1
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if lx.lineStart[mid] <= offset {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo + 1, offset - lx.lineStart[lo] + 1
+}
+
+func (lx *templateLexer) emit(kind tmplTokenKind, value string, start, end int) {
+	line, col := lx.position(start)
+	lx.tokens = append(lx.tokens, tmplToken{kind: kind, value: value, start: start, end: end, line: line, col: col})
+}
+
+func (lx *templateLexer) emitText(start, end int) {
+	text := lx.src[start:end]
+	if lx.trimNext {
+		trimmed := strings.TrimLeft(text, " \t\r\n")
+		start += len(text) - len(trimmed)
+		text = trimmed
+		lx.trimNext = false
+	}
+	if text == "" {
+		return
+	}
+	lx.emit(tmplText, text, start, end)
+}
+
+func (lx *templateLexer) trimPrevText() {
+	if len(lx.tokens) == 0 {
+		return
+	}
+	last := &lx.tokens[len(lx.tokens)-1]
+	if last.kind != tmplText {
+		return
+	}
+	last.value = strings.TrimRight(last.value, " \t\r\n")
+	if last.value == "" {
+		lx.tokens = lx.tokens[:len(lx.tokens)-1]
+	}
+}
+
+// nextOpen returns the offset and kind of the next opening delimiter.
+func (lx *templateLexer) nextOpen(from int) (int, string) {
+	best := -1
+	kind := ""
+	for _, cand := range []struct {
+		open string
+		kind string
+	}{
+		{lx.delims.variableStart, "output"},
+		{lx.delims.blockStart, "tag"},
+		{commentStart, "comment"},
+	} {
+		idx := strings.Index(lx.src[from:], cand.open)
+		if idx < 0 {
+			continue
+		}
+		idx += from
+		if best < 0 || idx < best {
+			best = idx
+			kind = cand.kind
+		}
+	}
+	return best, kind
+}
+
+// scanClose finds the closing delimiter, skipping over quoted strings and
+// bracketed expressions such as dict literals, whose own closing braces may
+// look like the delimiter.
+func (lx *templateLexer) scanClose(from int, closer string) int {
+	quote := byte(0)
+	depth := 0
+	for i := from; i < len(lx.src); i++ {
+		ch := lx.src[i]
+		if quote != 0 {
+			if ch == '\\' {
+				i++
+				continue
+			}
+			if ch == quote {
+				quote = 0
+			}
+			continue
+		}
+		if ch == '"' || ch == '\'' {
+			quote = ch
+			continue
+		}
+		if depth == 0 && strings.HasPrefix(lx.src[i:], closer) {
+			return i
+		}
+		switch ch {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			if depth > 0 {
+				depth--
+			}
+		}
+	}
+	// An unbalanced quote or bracket should not hide the closer entirely.
+	if idx := strings.Index(lx.src[from:], closer); idx >= 0 {
+		return from + idx
+	}
+	return -1
+}
+
+// errorAt reports a lexing failure at offset. The template name is filled
+// in by parseTemplate.
+func (lx *templateLexer) errorAt(offset int, msg string) error {
+	line, col := lx.position(offset)
+	return &TemplateError{Line: line, Column: col, Source: sourceLine(lx.src, line), Err: errors.New(msg)}
+}
+
+func (lx *templateLexer) run() error {
+	for lx.pos < len(lx.src) {
+		open, kind := lx.nextOpen(lx.pos)
+		if open < 0 {
+			lx.emitText(lx.pos, len(lx.src))
+			return nil
+		}
+		lx.emitText(lx.pos, open)
+
+		switch kind {
+		case "comment":
+			close := strings.Index(lx.src[open+len(commentStart):], commentEnd)
+			if close < 0 {
+				return lx.errorAt(open, "unclosed comment")
+			}
+			inner := lx.src[open+len(commentStart) : open+len(commentStart)+close]
+			if strings.HasPrefix(inner, "-") {
+				lx.trimPrevText()
+			}
+			lx.trimNext = strings.HasSuffix(inner, "-")
+			lx.pos = open + len(commentStart) + close + len(commentEnd)
+		case "output", "tag":
+			opener, closer, tk := lx.delims.variableStart, lx.delims.variableEnd, tmplOutput
+			if kind == "tag" {
+				opener, closer, tk = lx.delims.blockStart, lx.delims.blockEnd, tmplTag
+			}
+			innerStart := open + len(opener)
+			close := lx.scanClose(innerStart, closer)
+			if close < 0 {
+				return lx.errorAt(open, "unclosed tag")
+			}
+			inner := lx.src[innerStart:close]
+			if strings.HasPrefix(inner, "-") {
+				lx.trimPrevText()
+				inner = inner[1:]
+			}
+			trimAfter := false
+			if strings.HasSuffix(inner, "-") {
+				trimAfter = true
+				inner = inner[:len(inner)-1]
+			}
+			end := close + len(closer)
+			lx.emit(tk, strings.TrimSpace(inner), open, end)
+			lx.trimNext = trimAfter
+			lx.pos = end
+
+			if tk == tmplTag {
+				name := tagName(strings.TrimSpace(inner))
+				if name == "raw" || name == "verbatim" {
+					if err := lx.lexRawBody(name); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// lexRawBody emits everything up to the matching end tag as a single text
+// token, followed by the end tag itself.
+func (lx *templateLexer) lexRawBody(name string) error {
+	from := lx.pos
+	rawStart := lx.tokens[len(lx.tokens)-1].start
+	for {
+		idx := strings.Index(lx.src[from:], lx.delims.blockStart)
+		if idx < 0 {
+			return lx.errorAt(rawStart, "missing end"+name)
+		}
+		open := from + idx
+		innerStart := open + len(lx.delims.blockStart)
+		close := strings.Index(lx.src[innerStart:], lx.delims.blockEnd)
+		if close < 0 {
+			return lx.errorAt(rawStart, "missing end"+name)
+		}
+		inner := lx.src[innerStart : innerStart+close]
+		trimBefore := strings.HasPrefix(inner, "-")
+		trimAfter := strings.HasSuffix(inner, "-")
+		if strings.Trim(inner, " \t\r\n-") != "end"+name {
+			from = innerStart
+			continue
+		}
+		end := innerStart + close + len(lx.delims.blockEnd)
+		body := lx.src[lx.pos:open]
+		if lx.trimNext {
+			body = strings.TrimLeft(body, " \t\r\n")
+			lx.trimNext = false
+		}
+		if trimBefore {
+			body = strings.TrimRight(body, " \t\r\n")
+		}
+		if body != "" {
+			lx.emit(tmplText, body, lx.pos, open)
+		}
+		lx.emit(tmplTag, "end"+name, open, end)
+		lx.trimNext = trimAfter
+		lx.pos = end
+		return nil
+	}
+}
+
+// tagName returns the leading keyword of a tag body.
+func tagName(inner string) string {
+	for i := 0; i < len(inner); i++ {
+		c := inner[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '_' {
+			continue
+		}
+		return inner[:i]
+	}
+	return inner
+}
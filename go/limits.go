@@ -0,0 +1,145 @@
+package nunchucks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Limits bounds the work one render may do, so templates from untrusted
+// sources cannot pin a CPU or exhaust memory. Zero fields are unlimited.
+type Limits struct {
+	// MaxLoopIterations caps the for-loop iterations of a render, counted
+	// across all loops, and the length of lists built by range().
+	MaxLoopIterations int
+	// MaxDepth caps how deeply includes, imports, macro calls and block
+	// calls through self and super() may nest.
+	MaxDepth int
+	// MaxOutputBytes caps the size of the rendered output, and of every
+	// string the render builds on the way: captured blocks, macro output and
+	// ~ concatenations.
+	MaxOutputBytes int64
+	// MaxRenderTime caps the wall-clock time of a render.
+	MaxRenderTime time.Duration
+}
+
+// Sentinel errors matched by a LimitError with errors.Is.
+var (
+	ErrLoopLimit   = errors.New("loop iteration limit exceeded")
+	ErrDepthLimit  = errors.New("recursion depth limit exceeded")
+	ErrOutputLimit = errors.New("output size limit exceeded")
+	ErrTimeLimit   = errors.New("render time limit exceeded")
+)
+
+// LimitError reports that a render exceeded one of its Limits. Err is the
+// sentinel for the limit and Limit its configured value, in nanoseconds for
+// ErrTimeLimit.
+type LimitError struct {
+	Err   error
+	Limit int64
+}
+
+func (e *LimitError) Error() string {
+	if e.Err == ErrTimeLimit {
+		return fmt.Sprintf("%v (%s)", e.Err, time.Duration(e.Limit))
+	}
+	return fmt.Sprintf("%v (%d)", e.Err, e.Limit)
+}
+
+func (e *LimitError) Unwrap() error { return e.Err }
+
+// renderBudget tracks one top-level render against its context and limits.
+type renderBudget struct {
+	ctx        context.Context
+	limits     Limits
+	iterations int
+	depth      int
+}
+
+// newRenderBudget starts a budget for a render under ctx. The returned
+// cancel func releases the render time limit's timer.
+func (e *Env) newRenderBudget(ctx context.Context) (*renderBudget, context.CancelFunc) {
+	cancel := context.CancelFunc(func() {})
+	if d := e.limits.MaxRenderTime; d > 0 {
+		ctx, cancel = context.WithTimeoutCause(ctx, d, &LimitError{Err: ErrTimeLimit, Limit: int64(d)})
+	}
+	return &renderBudget{ctx: ctx, limits: e.limits}, cancel
+}
+
+// check reports why the render's context is done, if it is.
+func (b *renderBudget) check() error {
+	if b.ctx.Err() != nil {
+		return context.Cause(b.ctx)
+	}
+	return nil
+}
+
+// iterate accounts for one loop iteration.
+func (b *renderBudget) iterate() error {
+	b.iterations++
+	if max := b.limits.MaxLoopIterations; max > 0 && b.iterations > max {
+		return &LimitError{Err: ErrLoopLimit, Limit: int64(max)}
+	}
+	return b.check()
+}
+
+// allocate fails when a list of n items would exceed the loop limit.
+func (b *renderBudget) allocate(n int) error {
+	if max := b.limits.MaxLoopIterations; max > 0 && n > max {
+		return &LimitError{Err: ErrLoopLimit, Limit: int64(max)}
+	}
+	return nil
+}
+
+// enter accounts for one more level of include or macro nesting. Each
+// successful enter must be paired with a leave.
+func (b *renderBudget) enter() error {
+	if max := b.limits.MaxDepth; max > 0 && b.depth >= max {
+		return &LimitError{Err: ErrDepthLimit, Limit: int64(max)}
+	}
+	if err := b.check(); err != nil {
+		return err
+	}
+	b.depth++
+	return nil
+}
+
+func (b *renderBudget) leave() {
+	b.depth--
+}
+
+// grow fails when a string of n bytes, built by ~ or captured from a
+// block, would exceed the output limit.
+func (b *renderBudget) grow(n int) error {
+	if max := b.limits.MaxOutputBytes; max > 0 && int64(n) > max {
+		return &LimitError{Err: ErrOutputLimit, Limit: max}
+	}
+	return b.check()
+}
+
+// limit bounds the output written to w by the output limit. Output captured
+// in memory is bounded too, so a render cannot build strings of any size.
+func (b *renderBudget) limit(w io.Writer) io.Writer {
+	if max := b.limits.MaxOutputBytes; max > 0 {
+		return &limitWriter{w: w, max: max}
+	}
+	return w
+}
+
+// limitWriter fails writes that would take the output past max bytes.
+type limitWriter struct {
+	w   io.Writer
+	n   int64
+	max int64
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.n+int64(len(p)) > l.max {
+		return 0, &LimitError{Err: ErrOutputLimit, Limit: l.max}
+	}
+	n, err := l.w.Write(p)
+	l.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,110 @@
+package nunchucks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimitsStopRunawayTemplates(t *testing.T) {
+	files := map[string]string{
+		"range.njk":   "x\n{% for i in range(0, 100000000) %}{{ i }}{% endfor %}",
+		"nested.njk":  "{% for a in range(0, 50) %}{% for b in range(0, 50) %}.{% endfor %}{% endfor %}",
+		"recurse.njk": "{% macro down(n) %}{{ down(n + 1) }}{% endmacro %}{{ down(0) }}",
+		"big.njk":     "{% for i in range(0, 1000) %}0123456789{% endfor %}",
+		"self.njk":    "{% block a %}{{ self.a() }}{% endblock %}",
+		"base.njk":    "{% block a %}{{ self.a() }}{% endblock %}",
+		"super.njk":   `{% extends "base.njk" %}{% block a %}{{ super() }}{% endblock %}`,
+		"concat.njk":  "{% set ns = namespace(s='x') %}{% for i in range(28) %}{% set ns.s = ns.s ~ ns.s %}{% endfor %}{{ ns.s|length }}",
+		"capture.njk": "{% set s %}{% for i in range(0, 1000) %}0123456789{% endfor %}{% endset %}{{ s|length }}",
+		"macro.njk":   "{% macro m() %}{% for i in range(0, 1000) %}0123456789{% endfor %}{% endmacro %}{{ m()|length }}",
+	}
+	for i := 0; i < 30; i++ {
+		files[fmt.Sprintf("include%d.njk", i)] = fmt.Sprintf(`{%% include "include%d.njk" %%}`, i+1)
+		files[fmt.Sprintf("import%d.njk", i)] = fmt.Sprintf(`{%% import "import%d.njk" as next %%}`, i+1)
+	}
+	env := Configure(ConfigOptions{
+		Loader: &testLoader{files: files},
+		Limits: Limits{MaxLoopIterations: 1000, MaxDepth: 20, MaxOutputBytes: 5000},
+	})
+
+	cases := []struct {
+		name string
+		want error
+	}{
+		{"range.njk", ErrLoopLimit},
+		{"nested.njk", ErrLoopLimit},
+		{"recurse.njk", ErrDepthLimit},
+		{"include0.njk", ErrDepthLimit},
+		{"import0.njk", ErrDepthLimit},
+		{"big.njk", ErrOutputLimit},
+		{"self.njk", ErrDepthLimit},
+		{"super.njk", ErrDepthLimit},
+		{"concat.njk", ErrOutputLimit},
+		{"capture.njk", ErrOutputLimit},
+		{"macro.njk", ErrOutputLimit},
+	}
+	for _, tc := range cases {
+		_, err := env.Render(tc.name, nil)
+		if !errors.Is(err, tc.want) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.want, err)
+		}
+		var le *LimitError
+		var te *TemplateError
+		if !errors.As(err, &le) || !errors.As(err, &te) || te.Line == 0 {
+			t.Fatalf("%s: expected a located LimitError, got %#v", tc.name, err)
+		}
+	}
+
+	out, err := env.Render("nested.njk", nil)
+	if err == nil || out != "" {
+		t.Fatalf("expected no output from a failed render, got %q", out)
+	}
+	if _, err := Configure(ConfigOptions{Loader: &testLoader{files: files}}).Render("big.njk", nil); err != nil {
+		t.Fatalf("expected no limits by default, got %v", err)
+	}
+}
+
+func TestRenderContextCancellationAndTimeLimit(t *testing.T) {
+	files := map[string]string{
+		"slow.njk": "{% for a in range(0, 5000) %}{% for b in range(0, 5000) %}{% endfor %}{% endfor %}",
+	}
+	env := Configure(ConfigOptions{Loader: &testLoader{files: files}})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := env.RenderContext(ctx, "slow.njk", nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := env.RenderContext(ctx, "slow.njk", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	limited := Configure(ConfigOptions{
+		Loader: &testLoader{files: files},
+		Limits: Limits{MaxRenderTime: 20 * time.Millisecond},
+	})
+	_, err := limited.Render("slow.njk", nil)
+	if !errors.Is(err, ErrTimeLimit) || !strings.Contains(err.Error(), "render time limit exceeded (20ms)") {
+		t.Fatalf("expected ErrTimeLimit, got %v", err)
+	}
+
+	start := time.Now()
+	_, err = limited.RenderString("{{ range(0, 100000000) | length }}", nil)
+	if !errors.Is(err, ErrTimeLimit) || time.Since(start) > time.Second {
+		t.Fatalf("expected building a long range to stop at the time limit, got %v after %v", err, time.Since(start))
+	}
+
+	slow := func() string {
+		time.Sleep(50 * time.Millisecond)
+		return "done"
+	}
+	if _, err := limited.RenderString("{{ slow() }}", map[string]any{"slow": slow}); !errors.Is(err, ErrTimeLimit) {
+		t.Fatalf("expected a render that ran past the time limit to fail, got %v", err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type LoaderResponse struct {
@@ -18,6 +19,12 @@ type Loader interface {
 	Read(name string) LoaderResponse
 }
 
+// ModTimeLoader is implemented by loaders that can report when a template
+// last changed. Cached templates are reloaded when the reported time moves.
+type ModTimeLoader interface {
+	ModTime(name string) (time.Time, error)
+}
+
 func ExtractComments(s string) string {
 	return s
 }
@@ -46,11 +53,20 @@ func FileSystemLoader(root string) Loader {
 
 func (l *fileSystemLoader) TypeName() string { return "file" }
 
-func (l *fileSystemLoader) Source(name string) LoaderResponse {
+// resolve maps a template name to a path inside the loader root.
+func (l *fileSystemLoader) resolve(name string) (string, bool) {
 	res := filepath.Clean(filepath.Join(l.base, name))
 
 	rel, err := filepath.Rel(l.base, res)
 	if err != nil || rel == "." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || rel == ".." {
+		return res, false
+	}
+	return res, true
+}
+
+func (l *fileSystemLoader) Source(name string) LoaderResponse {
+	res, ok := l.resolve(name)
+	if !ok {
 		msg := fmt.Sprintf("No file found: %s", res)
 		PErr(msg)
 		return LoaderResponse{Err: msg, Res: res}
@@ -76,3 +92,15 @@ func (l *fileSystemLoader) Read(name string) LoaderResponse {
 	}
 	return LoaderResponse{Err: "", Res: ExtractComments(string(b))}
 }
+
+func (l *fileSystemLoader) ModTime(name string) (time.Time, error) {
+	res, ok := l.resolve(name)
+	if !ok {
+		return time.Time{}, fmt.Errorf("No file found: %s", res)
+	}
+	info, err := os.Stat(res)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
@@ -0,0 +1,86 @@
+package nunchucks
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLoopFeatures(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	ctx := map[string]any{
+		"users": []any{
+			map[string]any{"name": "ann", "active": true, "group": "a"},
+			map[string]any{"name": "bob", "active": false, "group": "a"},
+			map[string]any{"name": "cat", "active": true, "group": "b"},
+			map[string]any{"name": "dan", "active": true, "group": "b"},
+		},
+		"empty": []any{},
+		"nums":  []any{1, 2, 3, 4, 5},
+		"tree": []any{
+			map[string]any{"name": "root", "children": []any{
+				map[string]any{"name": "a", "children": []any{map[string]any{"name": "a1"}}},
+				map[string]any{"name": "b"},
+			}},
+		},
+	}
+
+	cases := map[string]string{
+		`{% for u in users if u.active %}{{ loop.index }}{{ u.name }}{% if not loop.last %},{% endif %}{% endfor %}`:                                                "1ann,2cat,3dan",
+		`{% for u in users if u.active %}{{ loop.length }}{% endfor %}`:                                                                                             "333",
+		`{% for x in empty %}x{% else %}none{% endfor %}`:                                                                                                           "none",
+		`{% for u in users if u.name == "zed" %}x{% else %}no match{% endfor %}`:                                                                                    "no match",
+		`{% for x in nums %}{{ x }}{% else %}none{% endfor %}`:                                                                                                      "12345",
+		`{% for x in nums %}<tr class="{{ loop.cycle('odd', 'even') }}">{% endfor %}`:                                                                               `<tr class="odd"><tr class="even"><tr class="odd"><tr class="even"><tr class="odd">`,
+		`{% for u in users %}{% if loop.changed(u.group) %}[{{ u.group }}]{% endif %}{{ u.name }}{% endfor %}`:                                                      "[a]annbob[b]catdan",
+		`{% for x in nums %}{{ loop.previtem is defined }}{{ loop.previtem }}-{{ loop.nextitem }};{% endfor %}`:                                                     "false-2;true1-3;true2-4;true3-5;true4-;",
+		`{% for x in nums %}{% if x == 3 %}{% break %}{% endif %}{{ x }}{% endfor %}`:                                                                               "12",
+		`{% for x in nums %}{% if x is even %}{% continue %}{% endif %}{{ x }}{% endfor %}`:                                                                         "135",
+		`{% for x in nums %}{% for y in nums %}{% if y > 2 %}{% break %}{% endif %}{{ x }}{{ y }} {% endfor %}{% if x == 2 %}{% break %}{% endif %}{% endfor %}`:    "11 12 21 22 ",
+		`{% for x in nums %}{% if x == 1 %}{% break %}{% endif %}{% else %}none{% endfor %}`:                                                                        "",
+		`{% for x in [1, 2] %}{% for y in [] %}{% else %}{% continue %}{% endfor %}{{ x }}{% endfor %}`:                                                             "",
+		`{% for node in tree recursive %}<li>{{ node.name }}@{{ loop.depth }}{% if node.children %}<ul>{{ loop(node.children) }}</ul>{% endif %}</li>{% endfor %}`:  "<li>root@1<ul><li>a@2<ul><li>a1@3</li></ul></li><li>b@2</li></ul></li>",
+		`{% for x in nums %}{% set y = x * 2 %}{% if x == 1 %}{{ z is defined }}{% endif %}{% set z = y %}{% endfor %}{{ y is defined }}`:                           "falsefalse",
+		`{% set ns = namespace() %}{% for x in nums %}{% macro m() %}{{ x }}{% endmacro %}{% if loop.first %}{% set ns.m = m %}{% endif %}{% endfor %}{{ ns.m() }}`: "1",
+		`{% set ns = namespace() %}{% for x in nums %}{% if loop.first %}{% set ns.loop = loop %}{% endif %}{% endfor %}{{ ns.loop.index }}{{ ns.loop.last }}`:      "1false",
+		`{% for node in tree recursive %}{{ loop.depth0 }}{{ node.name }}{% if node.children %}{{ loop(node.children) }}{% endif %}{% endfor %}`:                    "0root1a2a11b",
+	}
+	for src, want := range cases {
+		out, err := env.RenderString(src, ctx)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", src, err)
+		}
+		if out != want {
+			t.Fatalf("%s: want %q, got %q", src, want, out)
+		}
+	}
+}
+
+func TestLoopControlErrors(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	for src, want := range map[string]string{
+		`{% break %}`: "break is only allowed inside a for loop",
+		`{% macro m() %}{% continue %}{% endmacro %}`:                               "continue is only allowed inside a for loop",
+		`{% for x in xs %}{% macro m() %}{% break %}{% endmacro %}{% endfor %}`:     "break is only allowed inside a for loop",
+		`{% for x in xs %}{% filter upper %}{% break %}{% endfilter %}{% endfor %}`: "break is not allowed inside a filter block",
+		`{% for x in xs if %}{% endfor %}`:                                          "invalid expression",
+		`{% for x in xs recursive y %}{% endfor %}`:                                 `unexpected "y"`,
+	} {
+		_, err := env.RenderString(src, map[string]any{"xs": []any{1}})
+		var te *TemplateError
+		if !errors.As(err, &te) || !strings.Contains(err.Error(), want) {
+			t.Fatalf("%s: expected TemplateError containing %q, got %v", src, want, err)
+		}
+	}
+
+	if _, err := env.RenderString(`{% for x in xs %}{{ loop([x]) }}{% endfor %}`, map[string]any{"xs": []any{1}}); err == nil || !strings.Contains(err.Error(), `"loop" is not callable`) {
+		t.Fatalf("expected non-recursive loop call to fail, got %v", err)
+	}
+
+	limited := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}, Limits: Limits{MaxDepth: 3}})
+	deep := map[string]any{"c": []any{map[string]any{"c": []any{map[string]any{"c": []any{map[string]any{"c": []any{}}}}}}}}
+	_, err := limited.RenderString(`{% for n in [root] recursive %}{{ loop(n.c) }}{% endfor %}`, map[string]any{"root": deep})
+	if !errors.Is(err, ErrDepthLimit) {
+		t.Fatalf("expected depth limit for recursive loops, got %v", err)
+	}
+}
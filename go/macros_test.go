@@ -0,0 +1,45 @@
+package nunchucks
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMacroVarargsKwargsAndCallerArguments(t *testing.T) {
+	files := map[string]string{
+		"ui.njk": `{% macro tag(name) %}<{{ name }}{% for k, v in kwargs %} {{ k }}="{{ v }}"{% endfor %}>{{ varargs | join(" ") }}</{{ name }}>{% endmacro %}` +
+			`{% macro list_items(items) %}<ul>{% for item in items %}<li>{{ caller(item, loop.index) }}</li>{% endfor %}</ul>{% endmacro %}` +
+			`{% macro tree(nodes) %}<ul>{% for n in nodes %}<li>{{ n.name }}{% if n.children %}{{ tree(n.children) }}{% endif %}</li>{% endfor %}</ul>{% endmacro %}` +
+			`{% macro pair(a, b="-") %}{{ a }}{{ b }}{% endmacro %}`,
+		"page.njk": `{% import "ui.njk" as ui %}{{ ui.tag("p", "a", "b", id="x") }}` +
+			`{% set sep = ": " %}{% call(item, n=0) ui.list_items(items) %}{{ n }}{{ sep }}{{ item }}{% endcall %}{{ ui.tree(nodes) }}`,
+	}
+	env := Configure(ConfigOptions{Loader: &testLoader{files: files}})
+	ctx := map[string]any{
+		"items": []any{"one", "two"},
+		"nodes": []any{map[string]any{"name": "a", "children": []any{map[string]any{"name": "b"}}}},
+	}
+	out, err := env.Render("page.njk", ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `<p id="x">a b</p><ul><li>1: one</li><li>2: two</li></ul><ul><li>a<ul><li>b</li></ul></li></ul>`
+	if out != want {
+		t.Fatalf("unexpected output\nwant: %q\n got: %q", want, out)
+	}
+
+	cases := map[string]string{
+		`{% from "ui.njk" import pair %}{{ pair(1, c=2) }}`:  `macro "pair" got an unexpected keyword argument "c"`,
+		`{% from "ui.njk" import pair %}{{ pair(1, 2, 3) }}`: `macro "pair" takes at most 2 arguments, got 3`,
+		`{% from "ui.njk" import pair %}{{ pair(1, a=2) }}`:  `macro "pair" got multiple values for argument "a"`,
+		`{% macro m(a, b, a=1) %}{% endmacro %}`:             `duplicate parameter "a"`,
+		`{% call(x, x) m() %}{% endcall %}`:                  `duplicate parameter "x"`,
+	}
+	for src, want := range cases {
+		_, err := env.RenderString(src, nil)
+		var te *TemplateError
+		if !errors.As(err, &te) || te.Err.Error() != want {
+			t.Fatalf("%s: expected %q, got %v", src, want, err)
+		}
+	}
+}
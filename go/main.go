@@ -1,6 +1,11 @@
 package nunchucks
 
-import "strings"
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
 
 // ConfigOptions controls environment setup for rendering templates.
 type ConfigOptions struct {
@@ -14,6 +19,25 @@ type ConfigOptions struct {
 	GlobalTemplates     []string
 	GlobalHeadTemplates []string
 	GlobalFootTemplates []string
+	// Autoescape forces HTML escaping of {{ }} output on or off. When nil,
+	// .html, .htm and .njk templates are escaped and other templates are not.
+	Autoescape *bool
+	// ContextualEscape escapes autoescaped output for where it appears in
+	// the HTML: attribute values, URLs (dropping javascript: and other
+	// unsafe schemes), <script> and <style> bodies and event handlers.
+	ContextualEscape bool
+	// Undefined selects how undefined names and attributes are rendered.
+	// The zero value is UndefinedLenient.
+	Undefined UndefinedMode
+	// PreserveMapOrder visits OrderedMap values in their own key order.
+	// Otherwise loops and items(), keys() and values() visit every mapping
+	// sorted by key, so output does not depend on Go's map order.
+	PreserveMapOrder bool
+	// Limits bounds the loop iterations, nesting depth, output size and
+	// time of each render.
+	Limits Limits
+	// Trace, when set, receives one line per executed VM instruction.
+	Trace io.Writer
 }
 
 // Env is the Go renderer environment.
@@ -25,11 +49,35 @@ type Env struct {
 	blockStart          string
 	blockEnd            string
 	globals             map[string]any
+	filters             map[string]FilterFunc
+	tests               map[string]TestFunc
+	extensions          map[string]Extension
 	globalTemplates     []string
 	globalHeadTemplates []string
 	globalFootTemplates []string
+	cache               templateCache
+	autoescape          *bool
+	contextualEscape    bool
+	undefined           UndefinedMode
+	preserveMapOrder    bool
+	limits              Limits
+	trace               io.Writer
 }
 
+// UndefinedMode controls what {{ }} does with a name or attribute that is
+// not defined. Tests such as `is defined` and the default filter see
+// undefined values the same way in every mode.
+type UndefinedMode string
+
+const (
+	// UndefinedLenient renders undefined values as empty strings.
+	UndefinedLenient UndefinedMode = "lenient"
+	// UndefinedStrict fails the render with a TemplateError.
+	UndefinedStrict UndefinedMode = "strict"
+	// UndefinedDebug renders a visible {{ name: undefined }} marker.
+	UndefinedDebug UndefinedMode = "debug"
+)
+
 const (
 	defaultVariableStart = "{{"
 	defaultVariableEnd   = "}}"
@@ -37,9 +85,25 @@ const (
 	defaultBlockEnd      = "%}"
 )
 
-func builtinGlobals() map[string]any {
+func builtinGlobals(budget *renderBudget) map[string]any {
 	return map[string]any{
-		"range": TemplateFunc(func(args []any, _ map[string]any, _ string) (any, error) {
+		"namespace": TemplateFunc(func(args []any, kwargs map[string]any, _ TemplateFunc) (any, error) {
+			ns := &namespace{attrs: map[string]any{}}
+			for _, arg := range args {
+				keys, values, ok := mapEntries(arg, false)
+				if !ok {
+					return nil, fmt.Errorf("namespace() takes mappings and named arguments, got %T", arg)
+				}
+				for i, k := range keys {
+					ns.attrs[fmt.Sprint(k)] = values[i]
+				}
+			}
+			for k, v := range kwargs {
+				ns.attrs[k] = v
+			}
+			return ns, nil
+		}),
+		"range": TemplateFunc(func(args []any, _ map[string]any, _ TemplateFunc) (any, error) {
 			start := 0
 			stop := 0
 			step := 1
@@ -61,15 +125,25 @@ func builtinGlobals() map[string]any {
 			if step == 0 {
 				step = 1
 			}
+			n := 0
+			if step > 0 && stop > start {
+				n = (stop - start + step - 1) / step
+			} else if step < 0 && start > stop {
+				n = (start - stop - step - 1) / -step
+			}
+			if err := budget.allocate(n); err != nil {
+				return nil, err
+			}
 
+			// A long range takes a while to build, so the render's
+			// deadline is checked along the way.
 			out := []any{}
-			if step > 0 {
-				for i := start; i < stop; i += step {
-					out = append(out, i)
+			for i := start; step > 0 && i < stop || step < 0 && i > stop; i += step {
+				if len(out)%4096 == 4095 {
+					if err := budget.check(); err != nil {
+						return nil, err
+					}
 				}
-				return out, nil
-			}
-			for i := start; i > stop; i += step {
 				out = append(out, i)
 			}
 			return out, nil
@@ -138,7 +212,7 @@ func Configure(opts ConfigOptions) *Env {
 		configuredGlobals = map[string]any{}
 	}
 
-	return &Env{
+	env := &Env{
 		basePath:            path,
 		loader:              ldr,
 		variableStart:       variableStart,
@@ -149,32 +223,99 @@ func Configure(opts ConfigOptions) *Env {
 		globalTemplates:     globals,
 		globalHeadTemplates: headGlobals,
 		globalFootTemplates: footGlobals,
+		autoescape:          opts.Autoescape,
+		contextualEscape:    opts.ContextualEscape,
+		undefined:           opts.Undefined,
+		preserveMapOrder:    opts.PreserveMapOrder,
+		limits:              opts.Limits,
+		trace:               opts.Trace,
 	}
+	env.AddExtension(clientExtension{})
+	return env
 }
 
 // Render loads and renders a template file with the provided context.
 func (e *Env) Render(name string, ctx map[string]any) (string, error) {
-	raw, err := e.readRawTemplate(name)
+	tpl, err := e.GetTemplate(name)
 	if err != nil {
-		return "", err
+		return "", asTemplateError(name, err)
 	}
-	renderCtx := e.buildRenderContext(ctx)
-	if err := ApplyTemplateContractDefaults(e.normalizeTemplateSource(raw), renderCtx); err != nil {
-		return "", err
+	return tpl.Render(ctx)
+}
+
+// RenderTo loads a template file and streams its output to w.
+func (e *Env) RenderTo(w io.Writer, name string, ctx map[string]any) error {
+	tpl, err := e.GetTemplate(name)
+	if err != nil {
+		return asTemplateError(name, err)
 	}
-	if err := ValidateTemplateContract(e.normalizeTemplateSource(raw), renderCtx); err != nil {
+	return tpl.Execute(w, ctx)
+}
+
+// RenderContext renders a template file like Render, stopping with the
+// context's error once ctx is cancelled or its deadline passes.
+func (e *Env) RenderContext(ctx context.Context, name string, data map[string]any) (string, error) {
+	tpl, err := e.GetTemplate(name)
+	if err != nil {
+		return "", asTemplateError(name, err)
+	}
+	var b strings.Builder
+	if err := e.execute(ctx, &b, name, tpl.prog, "", data); err != nil {
 		return "", err
 	}
-	src, err := e.compileTemplate(name)
+	return b.String(), nil
+}
+
+// RenderBlock renders only the block named block of the template name, for
+// partial page updates. The template and the layouts it extends run first
+// without output, so their top-level set statements and imports apply, and
+// the block renders as it would in the full page, with super() and the
+// blocks nested in it. Global templates are run but not written.
+func (e *Env) RenderBlock(name, block string, ctx map[string]any) (string, error) {
+	tpl, err := e.GetTemplate(name)
 	if err != nil {
+		return "", asTemplateError(name, err)
+	}
+	var b strings.Builder
+	if err := e.execute(context.Background(), &b, name, tpl.prog, block, ctx); err != nil {
 		return "", err
 	}
-	return e.renderString(src, renderCtx)
+	return b.String(), nil
+}
+
+// CallMacro calls the macro named macro defined in the template name with
+// args and kwargs, and returns its output. The macro sees the Env's
+// globals, as if the template were imported with context.
+func (e *Env) CallMacro(name, macro string, args []any, kwargs map[string]any) (string, error) {
+	tpl, err := e.GetTemplate(name)
+	if err != nil {
+		return "", asTemplateError(name, err)
+	}
+	budget, cancel := e.newRenderBudget(context.Background())
+	defer cancel()
+	f := &frame{state: e.newRenderState(budget), ctx: e.buildRenderContext(nil), vars: map[string]any{}}
+	macros, err := e.loadModule(tpl, f, true)
+	if err != nil {
+		return "", asTemplateError(name, err)
+	}
+	fn, ok := macros[macro].(TemplateFunc)
+	if !ok {
+		return "", asTemplateError(name, fmt.Errorf("no macro named %q", macro))
+	}
+	out, err := fn(args, kwargs, nil)
+	if err != nil {
+		return "", asTemplateError(name, err)
+	}
+	return outputText(out), nil
 }
 
 // Compile resolves includes/extends into a compiled template string.
 func (e *Env) Compile(name string) (string, error) {
-	return e.compileTemplate(name)
+	out, err := e.compileTemplate(name)
+	if err != nil {
+		return "", asTemplateError(name, err)
+	}
+	return out, nil
 }
 
 // RenderString renders a string template with the provided context.
@@ -1,11 +1,15 @@
 package nunchucks
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type testLoader struct {
@@ -227,6 +231,28 @@ func TestExpressionPrecedenceComparisonsAndTernary(t *testing.T) {
 	}
 }
 
+func TestTildeConcatenatesAsStrings(t *testing.T) {
+	on := true
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}, Autoescape: &on})
+	ctx := map[string]any{"n": 4, "tag": "<i>"}
+	for src, want := range map[string]string{
+		`{{ "a" ~ 1 ~ missing ~ n }}`:              "a14",
+		`{{ 1 ~ 2 * 3 }}`:                          "16",
+		`{{ "page-" ~ n + 1 }}`:                    "page-5",
+		`{{ n + 1 ~ "x" }}`:                        "5x",
+		`{{ n - 1 ~ n == "34" }}`:                  "true",
+		`{{ "x" ~ "y" | upper }}`:                  "xY",
+		`{{ ("a" ~ n) | length }}`:                 "2",
+		`{{ tag ~ "!" }}`:                          "&lt;i&gt;!",
+		`{{ "<b>" | safe ~ tag ~ "</b>" | safe }}`: "<b>&lt;i&gt;</b>",
+	} {
+		out, err := env.RenderString(src, ctx)
+		if err != nil || out != want {
+			t.Fatalf("%s: want %q, got %q, %v", src, want, out, err)
+		}
+	}
+}
+
 func TestIncludeIgnoreMissingAndWithoutContext(t *testing.T) {
 	files := map[string]string{
 		"main.njk": `{% include "part.njk" without context %}
@@ -248,6 +274,33 @@ func TestIncludeIgnoreMissingAndWithoutContext(t *testing.T) {
 	}
 }
 
+func TestIncludeCycleIsReported(t *testing.T) {
+	files := map[string]string{
+		"self.njk":  `{% include "self.njk" %}`,
+		"a.njk":     `A{% include "b.njk" %}`,
+		"b.njk":     `B{% include "a.njk" %}`,
+		"page.njk":  `{% include "a.njk" %}`,
+		"leaf.njk":  `leaf`,
+		"twice.njk": `{% include "leaf.njk" %}{% include "leaf.njk" %}`,
+	}
+	env := Configure(ConfigOptions{Loader: &testLoader{files: files}})
+	for name, cycle := range map[string]string{
+		"self.njk": "self.njk -> self.njk",
+		"a.njk":    "a.njk -> b.njk -> a.njk",
+		"page.njk": "a.njk -> b.njk -> a.njk",
+	} {
+		_, err := env.Render(name, nil)
+		var te *TemplateError
+		if !errors.As(err, &te) || !strings.Contains(te.Err.Error(), "include cycle detected: "+cycle) {
+			t.Fatalf("%s: expected include cycle %q, got %v", name, cycle, err)
+		}
+	}
+	out, err := env.Render("twice.njk", nil)
+	if err != nil || out != "leafleaf" {
+		t.Fatalf("expected a template to be included twice, got %q, %v", out, err)
+	}
+}
+
 func TestLoopMetadata(t *testing.T) {
 	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
 	src := `{% for item in items %}[{{ loop.index0 }}:{{ loop.first }}:{{ loop.last }}:{{ item }}]{% endfor %}`
@@ -363,6 +416,19 @@ app.pressed = !app.pressed;
 	if !strings.Contains(out, `const app = window.__nunchucks.state["app"];`) {
 		t.Fatalf("missing state variable alias: %q", out)
 	}
+
+	src = `{% client %}{% state app | { users: users | length, alerts: [], ui: { modalOpen: false, "tab-id": tabs[0] } } | export "AppState" %}{% endclient %}`
+	out, err = env.RenderString(src, map[string]any{"users": []any{"a", "b"}, "tabs": []any{"home"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(out, `window.__nunchucks.state["app"] = {"alerts":[],"ui":{"modalOpen":false,"tab-id":"home"},"users":2};`) {
+		t.Fatalf("missing nested state payload: %q", out)
+	}
+
+	if _, err := env.RenderString(`{% client %}{% state app | { pressed: } | %}{% endclient %}`, nil); err == nil || !strings.Contains(err.Error(), "invalid state statement") {
+		t.Fatalf("expected invalid state statement error, got %v", err)
+	}
 }
 
 func TestInlineClientEventBindingTransform(t *testing.T) {
@@ -556,3 +622,253 @@ func TestCommentsPreventIncludeResolution(t *testing.T) {
 		t.Fatalf("expected commented include to be ignored, got %q", out)
 	}
 }
+
+func TestNestedLoopsAndConditionals(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	src := `{% for row in rows %}<{% for cell in row %}{% if cell %}{% if cell > 1 %}big{% else %}one{% endif %}{% else %}zero{% endif %};{% endfor %}>{% endfor %}`
+	out, err := env.RenderString(src, map[string]any{
+		"rows": []any{[]any{0, 1}, []any{2}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `<zero;one;><big;>`
+	if out != want {
+		t.Fatalf("unexpected output\nwant: %q\n got: %q", want, out)
+	}
+}
+
+func TestSetInsideLoopRunsPerIteration(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	src := `{% set label = "outer" %}{% for item in items %}{% set label = item | upper %}{{ label }},{% endfor %}{{ label }}`
+	out, err := env.RenderString(src, map[string]any{"items": []any{"a", "b"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `A,B,outer`
+	if out != want {
+		t.Fatalf("unexpected output\nwant: %q\n got: %q", want, out)
+	}
+}
+
+func TestWhitespaceControlTrimsAdjacentText(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	src := "<ul>\n  {%- for item in items %}\n  <li>{{- item -}}  </li>\n  {%- endfor %}\n</ul>"
+	out, err := env.RenderString(src, map[string]any{"items": []any{"a", "b"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "<ul>\n  <li>a</li>\n  <li>b</li>\n</ul>"
+	if out != want {
+		t.Fatalf("unexpected output\nwant: %q\n got: %q", want, out)
+	}
+}
+
+func TestParseErrorsForUnbalancedTags(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	cases := map[string]string{
+		`{% for x in xs %}{% if x %}{% endfor %}`: "unexpected endfor, expected endif",
+		`{% if x %}a`:  "missing endif",
+		`{% endfor %}`: "unexpected endfor",
+		`{% bogus %}`:  `unknown tag "bogus"`,
+		`{{ name `:     "unclosed tag",
+	}
+	for src, want := range cases {
+		_, err := env.RenderString(src, map[string]any{})
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("RenderString(%q) error = %v, want %q", src, err, want)
+		}
+	}
+}
+
+func TestRawBlockKeepsTagsAndDelimitersInStrings(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	src := `{% raw %}{% for x in xs %}{{ x }}{% endfor %}{% endraw %}|{{ "}}" }}`
+	out, err := env.RenderString(src, map[string]any{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `{% for x in xs %}{{ x }}{% endfor %}|}}`
+	if out != want {
+		t.Fatalf("unexpected output\nwant: %q\n got: %q", want, out)
+	}
+}
+
+func TestGetTemplateReturnsCachedTemplate(t *testing.T) {
+	files := map[string]string{
+		"base.njk":  `<main>{% block body %}{% endblock %}</main>`,
+		"page.njk":  `{% extends "base.njk" %}{% block body %}{% include "part.njk" %}{% endblock %}`,
+		"part.njk":  `{{ name }}`,
+		"other.njk": `x`,
+	}
+	env := Configure(ConfigOptions{Loader: &testLoader{files: files}})
+
+	first, err := env.GetTemplate("page.njk")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, err := env.GetTemplate("page.njk")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first != second {
+		t.Fatalf("expected repeated GetTemplate to return the cached template")
+	}
+
+	out, err := first.Render(map[string]any{"name": "sam"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "<main>sam</main>" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+
+	// Parents and partials are served from the cache too.
+	files["part.njk"] = `changed`
+	out, err = env.Render("page.njk", map[string]any{"name": "sam"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "<main>sam</main>" {
+		t.Fatalf("expected cached partial, got %q", out)
+	}
+}
+
+func TestInvalidateReloadsTemplate(t *testing.T) {
+	files := map[string]string{"page.njk": `v1`}
+	env := Configure(ConfigOptions{Loader: &testLoader{files: files}})
+
+	if out, _ := env.Render("page.njk", nil); out != "v1" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+	files["page.njk"] = `v2`
+	if out, _ := env.Render("page.njk", nil); out != "v1" {
+		t.Fatalf("expected cached output before Invalidate, got %q", out)
+	}
+	env.Invalidate("page.njk")
+	if out, _ := env.Render("page.njk", nil); out != "v2" {
+		t.Fatalf("expected reloaded output after Invalidate, got %q", out)
+	}
+}
+
+func TestFileSystemTemplatesReloadWhenModified(t *testing.T) {
+	viewsDir := t.TempDir()
+	path := filepath.Join(viewsDir, "index.njk")
+	if err := os.WriteFile(path, []byte(`<h1>{{ title }}</h1>`), 0o644); err != nil {
+		t.Fatalf("write index.njk: %v", err)
+	}
+	env := Configure(ConfigOptions{Path: viewsDir})
+
+	first, err := env.GetTemplate("index.njk")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if again, _ := env.GetTemplate("index.njk"); again != first {
+		t.Fatalf("expected unchanged file to be served from the cache")
+	}
+
+	if err := os.WriteFile(path, []byte(`<h2>{{ title }}</h2>`), 0o644); err != nil {
+		t.Fatalf("rewrite index.njk: %v", err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	out, err := env.Render("index.njk", map[string]any{"title": "Hello"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "<h2>Hello</h2>" {
+		t.Fatalf("expected modified template to be reloaded, got %q", out)
+	}
+}
+
+func TestTemplateRenderConcurrently(t *testing.T) {
+	files := map[string]string{
+		"macros.njk": `{% macro item(x) %}<li>{{ x }}</li>{% endmacro %}`,
+		"page.njk":   `{% import "macros.njk" as m %}<ul>{% for x in items %}{{ m.item(x) }}{% endfor %}</ul>`,
+	}
+	env := Configure(ConfigOptions{Loader: &testLoader{files: files}})
+	tpl, err := env.GetTemplate("page.njk")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			out, err := tpl.Render(map[string]any{"items": []any{i, i + 1}})
+			if err != nil {
+				errs <- err
+				return
+			}
+			want := fmt.Sprintf("<ul><li>%d</li><li>%d</li></ul>", i, i+1)
+			if out != want {
+				errs <- fmt.Errorf("want %q, got %q", want, out)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestAutoescapeByTemplateExtension(t *testing.T) {
+	files := map[string]string{
+		"page.njk":   `<p>{{ body }}</p>`,
+		"page.txt":   `<p>{{ body }}</p>`,
+		"macros.njk": `{% macro card(title) %}<div>{{ title }}{{ caller() }}</div>{% endmacro %}`,
+		"call.njk":   `{% from "macros.njk" import card %}{% call card("<b>") %}<i>{{ body }}</i>{% endcall %}`,
+	}
+	env := Configure(ConfigOptions{Loader: &testLoader{files: files}})
+	ctx := map[string]any{"body": `<script>alert("x")</script>`}
+
+	cases := map[string]string{
+		"page.njk": `<p>&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;</p>`,
+		"page.txt": `<p><script>alert("x")</script></p>`,
+		"call.njk": `<div>&lt;b&gt;<i>&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;</i></div>`,
+	}
+	for name, want := range cases {
+		out, err := env.Render(name, ctx)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if out != want {
+			t.Fatalf("%s: unexpected output\nwant: %q\n got: %q", name, want, out)
+		}
+	}
+}
+
+func TestAutoescapeSafeStringsAndBlocks(t *testing.T) {
+	on := true
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}, Autoescape: &on})
+	src := `{{ v }}|{{ v | safe }}|{{ v | escape }}|{{ trusted }}|{{ trusted | upper }}|{% autoescape false %}{{ v }}{% endautoescape %}`
+	out, err := env.RenderString(src, map[string]any{"v": "<b>", "trusted": SafeString("<i>")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := `&lt;b&gt;|<b>|&lt;b&gt;|<i>|<I>|<b>`; out != want {
+		t.Fatalf("unexpected output\nwant: %q\n got: %q", want, out)
+	}
+
+	if _, err := env.RenderString(`{% autoescape maybe %}{% endautoescape %}`, nil); err == nil {
+		t.Fatalf("expected invalid autoescape error")
+	}
+}
+
+func TestRenderStringDoesNotAutoescapeByDefault(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	out, err := env.RenderString(`{{ v }}`, map[string]any{"v": "<b>"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "<b>" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+}
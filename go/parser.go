@@ -0,0 +1,495 @@
+package nunchucks
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var forHeadRe = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*(?:\s*,\s*[A-Za-z_][A-Za-z0-9_]*)*)\s+in\s+([\s\S]+)$`)
+var macroHeadRe = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)\s*\(([\s\S]*)\)$`)
+var inlineClientEventPrefixRe = regexp.MustCompile(`\bon([A-Za-z][A-Za-z0-9_]*)\s*=\s*$`)
+
+type templateParser struct {
+	name   string
+	src    string
+	toks   []tmplToken
+	pos    int
+	blocks map[string]*blockNode
+	exts   map[string]Extension
+	// tags lists the extension tags whose bodies are being parsed.
+	tags []string
+	// loop is "for" inside a loop body, "filter", "set" or an extension
+	// tag inside a block capturing output in one, and "" where break and
+	// continue have no loop to act on.
+	loop string
+}
+
+// parseTemplate lexes and parses a template source into a node tree.
+func parseTemplate(name, src string, d delimiters, exts map[string]Extension) (*parsedTemplate, error) {
+	toks, err := lexTemplate(src, d)
+	if err != nil {
+		var te *TemplateError
+		if errors.As(err, &te) {
+			te.Template = name
+		}
+		return nil, err
+	}
+	p := &templateParser{name: name, src: src, toks: toks, blocks: map[string]*blockNode{}, exts: exts}
+	root, _, err := p.parseBody()
+	if err != nil {
+		return nil, err
+	}
+	return &parsedTemplate{name: name, raw: src, root: root, blocks: p.blocks}, nil
+}
+
+func isEndTag(name string) bool {
+	switch name {
+	case "else", "elif", "elseif":
+		return true
+	}
+	return strings.HasPrefix(name, "end")
+}
+
+// parseBody consumes nodes until one of ends is reached. The last entry of
+// ends names the closing tag reported when the input runs out.
+func (p *templateParser) parseBody(ends ...string) ([]node, *tmplToken, error) {
+	nodes := []node{}
+	for p.pos < len(p.toks) {
+		tok := p.toks[p.pos]
+		p.pos++
+
+		switch tok.kind {
+		case tmplText:
+			nodes = append(nodes, &textNode{nodePos: nodePos{tok.line, tok.col}, text: tok.value})
+		case tmplOutput:
+			if n := p.clientEvent(nodes, tok); n != nil {
+				nodes = append(nodes, n)
+				continue
+			}
+			expr, err := p.expr(tok, tok.value)
+			if err != nil {
+				return nil, nil, err
+			}
+			nodes = append(nodes, &outputNode{nodePos: nodePos{tok.line, tok.col}, expr: expr})
+		case tmplTag:
+			name := tagName(tok.value)
+			for _, end := range ends {
+				if name == end {
+					return nodes, &tok, nil
+				}
+			}
+			if isEndTag(name) {
+				if len(ends) > 0 {
+					return nil, nil, p.errorAt(tok, 0, fmt.Errorf("unexpected %s, expected %s", name, ends[len(ends)-1]))
+				}
+				return nil, nil, p.errorAt(tok, 0, fmt.Errorf("unexpected %s", name))
+			}
+			n, err := p.parseTag(tok, name, strings.TrimSpace(tok.value[len(name):]))
+			if err != nil {
+				return nil, nil, p.errorAt(tok, 0, err)
+			}
+			if n != nil {
+				nodes = append(nodes, n)
+			}
+		}
+	}
+	if len(ends) > 0 {
+		return nil, nil, fmt.Errorf("missing %s", ends[len(ends)-1])
+	}
+	return nodes, nil, nil
+}
+
+// parseParams parses the parameter list of a macro or caller. A name may
+// appear only once.
+func parseParams(src string) ([]MacroParam, error) {
+	params := parseMacroParams(src)
+	seen := make(map[string]bool, len(params))
+	for _, param := range params {
+		if seen[param.Name] {
+			return nil, fmt.Errorf("duplicate parameter %q", param.Name)
+		}
+		seen[param.Name] = true
+		if param.def != nil && param.def.err != nil {
+			return nil, fmt.Errorf("invalid default for %q: %w", param.Name, param.def.err)
+		}
+	}
+	return params, nil
+}
+
+// splitCallerParams splits the parameters of caller off the front of a call
+// statement, `(item, i=0) list(items)`, and returns the rest.
+func splitCallerParams(rest string) ([]MacroParam, string, error) {
+	if !strings.HasPrefix(rest, "(") {
+		return nil, rest, nil
+	}
+	depth, quote := 0, byte(0)
+	for i := 0; i < len(rest); i++ {
+		switch ch := rest[i]; {
+		case quote != 0:
+			if ch == '\\' {
+				i++
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'':
+			quote = ch
+		case ch == '(':
+			depth++
+		case ch == ')':
+			depth--
+			if depth == 0 {
+				params, err := parseParams(rest[1:i])
+				return params, strings.TrimSpace(rest[i+1:]), err
+			}
+		}
+	}
+	return nil, "", fmt.Errorf("invalid call statement: call %s", rest)
+}
+
+// usesName reports whether the tags and outputs among toks refer to the
+// variable name.
+func usesName(toks []tmplToken, name string) bool {
+	for _, tok := range toks {
+		if tok.kind == tmplText {
+			continue
+		}
+		etoks, err := lexExpr(tok.value)
+		if err != nil {
+			continue
+		}
+		for i, t := range etoks {
+			if t.kind == tokIdent && t.lit == name && (i == 0 || etoks[i-1].kind != tokDot) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// blankBody reports whether body is only whitespace.
+func blankBody(body []node) bool {
+	for _, n := range body {
+		t, ok := n.(*textNode)
+		if !ok || strings.TrimSpace(t.text) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// parseBodyIn is parseBody with break and continue scoped to loop.
+func (p *templateParser) parseBodyIn(loop string, ends ...string) ([]node, *tmplToken, error) {
+	outer := p.loop
+	p.loop = loop
+	defer func() { p.loop = outer }()
+	return p.parseBody(ends...)
+}
+
+// errorAt locates err at offset bytes into the source of tok. Errors that
+// already carry a location, such as those of nested tags, are kept.
+func (p *templateParser) errorAt(tok tmplToken, offset int, err error) error {
+	line, col := positionOf(p.src, tok.start+offset)
+	return newTemplateError(p.name, p.src, line, col, err)
+}
+
+// expr compiles src, which appears inside tok, reporting syntax errors at
+// the offending position.
+func (p *templateParser) expr(tok tmplToken, src string) (*compiledExpr, error) {
+	c := compileExpr(src)
+	if c.err == nil {
+		return c, nil
+	}
+	return nil, p.exprErrorAt(tok, src, fmt.Errorf("invalid expression %q: %w", strings.TrimSpace(src), c.err))
+}
+
+// exprErrorAt locates err, a failure to parse src within tok, at the
+// offending character when err wraps an exprError.
+func (p *templateParser) exprErrorAt(tok tmplToken, src string, err error) error {
+	offset := strings.Index(p.src[tok.start:tok.end], src)
+	if offset < 0 {
+		offset = 0
+	}
+	var ee *exprError
+	if errors.As(err, &ee) {
+		offset += ee.pos
+	}
+	return p.errorAt(tok, offset, err)
+}
+
+// clientEvent turns `onClick={{ expr }}` into a client event binding by
+// trimming the attribute prefix off the preceding text node.
+func (p *templateParser) clientEvent(nodes []node, tok tmplToken) node {
+	if len(nodes) == 0 {
+		return nil
+	}
+	prev, ok := nodes[len(nodes)-1].(*textNode)
+	if !ok {
+		return nil
+	}
+	m := inlineClientEventPrefixRe.FindStringSubmatchIndex(prev.text)
+	if m == nil {
+		return nil
+	}
+	event := strings.ToLower(prev.text[m[2]:m[3]])
+	prev.text = prev.text[:m[0]]
+	return &clientEventNode{nodePos: nodePos{tok.line, tok.col}, event: event, expr: tok.value}
+}
+
+func (p *templateParser) parseTag(tok tmplToken, name, rest string) (node, error) {
+	pos := nodePos{tok.line, tok.col}
+	switch name {
+	case "if":
+		return p.parseIf(tok, rest)
+	case "for":
+		m := forHeadRe.FindStringSubmatch(rest)
+		if m == nil {
+			return nil, fmt.Errorf("invalid for statement: %s", tok.value)
+		}
+		iter, cond, recursive, err := compileForIter(m[2])
+		if err != nil {
+			return nil, p.exprErrorAt(tok, m[2], fmt.Errorf("invalid expression %q: %w", strings.TrimSpace(m[2]), err))
+		}
+		body, end, err := p.parseBodyIn("for", "else", "endfor")
+		if err != nil {
+			return nil, err
+		}
+		targets := strings.Split(m[1], ",")
+		for i := range targets {
+			targets[i] = strings.TrimSpace(targets[i])
+		}
+		n := &forNode{nodePos: pos, targets: targets, iter: iter, cond: cond, recursive: recursive, body: body}
+		if tagName(end.value) == "else" {
+			if n.elseBody, _, err = p.parseBody("endfor"); err != nil {
+				return nil, err
+			}
+		}
+		return n, nil
+	case "break", "continue":
+		switch {
+		case rest != "":
+			return nil, fmt.Errorf("invalid %s statement: %s", name, tok.value)
+		case p.loop != "" && p.loop != "for":
+			return nil, fmt.Errorf("%s is not allowed inside a %s block", name, p.loop)
+		case p.loop == "":
+			return nil, fmt.Errorf("%s is only allowed inside a for loop", name)
+		}
+		return &loopControlNode{nodePos: pos, brk: name == "break"}, nil
+	case "set":
+		targets, value, filters, err := compileSetHead(rest)
+		if err != nil {
+			return nil, p.exprErrorAt(tok, rest, fmt.Errorf("invalid set statement: %w", err))
+		}
+		n := &setNode{nodePos: pos, targets: targets, expr: value, filters: filters}
+		if value == nil {
+			scope := ""
+			if p.loop != "" {
+				scope = "set"
+			}
+			n.block = true
+			if n.body, _, err = p.parseBodyIn(scope, "endset"); err != nil {
+				return nil, err
+			}
+		}
+		return n, nil
+	case "with":
+		assigns, err := compileWithHead(rest)
+		if err != nil {
+			return nil, p.exprErrorAt(tok, rest, fmt.Errorf("invalid with statement: %w", err))
+		}
+		body, _, err := p.parseBody("endwith")
+		if err != nil {
+			return nil, err
+		}
+		return &withNode{nodePos: pos, assigns: assigns, body: body}, nil
+	case "block":
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("invalid block statement: %s", tok.value)
+		}
+		b := &blockNode{nodePos: pos, name: fields[0]}
+		for _, mod := range fields[1:] {
+			switch mod {
+			case "required":
+				b.required = true
+			case "scoped":
+				// Blocks always see the variables around them.
+			default:
+				return nil, fmt.Errorf("invalid block statement: %s", tok.value)
+			}
+		}
+		body, _, err := p.parseBodyIn("", "endblock")
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.blocks[b.name]; ok {
+			return nil, fmt.Errorf("block %q defined twice", b.name)
+		}
+		if b.required && !blankBody(body) {
+			return nil, fmt.Errorf("required block %q may only contain whitespace", b.name)
+		}
+		b.body = body
+		p.blocks[b.name] = b
+		return b, nil
+	case "extends":
+		if rest == "" {
+			return nil, fmt.Errorf("invalid extends statement: %s", tok.value)
+		}
+		target, err := p.expr(tok, rest)
+		if err != nil {
+			return nil, err
+		}
+		return &extendsNode{nodePos: pos, target: target}, nil
+	case "include":
+		src, ignoreMissing, withContext, ok := parseIncludeStmt(tok.value)
+		if !ok {
+			return nil, fmt.Errorf("invalid include statement: %s", tok.value)
+		}
+		target, err := p.expr(tok, src)
+		if err != nil {
+			return nil, err
+		}
+		return &includeNode{nodePos: pos, target: target, ignoreMissing: ignoreMissing, withContext: withContext}, nil
+	case "import":
+		src, alias, flags, ok := parseImportStmt(tok.value)
+		if !ok {
+			return nil, fmt.Errorf("invalid import statement: %s", tok.value)
+		}
+		target, err := p.expr(tok, src)
+		if err != nil {
+			return nil, err
+		}
+		return &importNode{nodePos: pos, target: target, alias: alias, withContext: parseContextModeFlags(flags, false)}, nil
+	case "from":
+		src, spec, flags, ok := parseFromImportStmt(tok.value)
+		if !ok {
+			return nil, fmt.Errorf("invalid from-import statement: %s", tok.value)
+		}
+		target, err := p.expr(tok, src)
+		if err != nil {
+			return nil, err
+		}
+		names := parseImportedNames(spec)
+		for _, pair := range names {
+			if strings.HasPrefix(pair[0], "_") {
+				return nil, fmt.Errorf("cannot import %q: names starting with an underscore are private", pair[0])
+			}
+		}
+		return &fromImportNode{nodePos: pos, target: target, names: names, withContext: parseContextModeFlags(flags, false)}, nil
+	case "macro":
+		m := macroHeadRe.FindStringSubmatch(rest)
+		if m == nil {
+			return nil, fmt.Errorf("invalid macro statement: %s", tok.value)
+		}
+		bodyStart, first := tok.end, p.pos
+		body, end, err := p.parseBodyIn("", "endmacro")
+		if err != nil {
+			return nil, err
+		}
+		params, err := parseParams(m[2])
+		if err != nil {
+			return nil, err
+		}
+		def := MacroDef{
+			Name:         m[1],
+			Params:       params,
+			CatchVarargs: usesName(p.toks[first:p.pos], "varargs"),
+			CatchKwargs:  usesName(p.toks[first:p.pos], "kwargs"),
+			Body:         p.src[bodyStart:end.start],
+			body:         body,
+		}
+		return &macroNode{nodePos: pos, def: def}, nil
+	case "call":
+		params, src, err := splitCallerParams(rest)
+		if err != nil {
+			return nil, err
+		}
+		expr, err := p.expr(tok, src)
+		if err != nil {
+			return nil, err
+		}
+		call, ok := expr.root.(*callExpr)
+		if !ok {
+			return nil, fmt.Errorf("invalid call expression: %s", src)
+		}
+		body, _, err := p.parseBodyIn("", "endcall")
+		if err != nil {
+			return nil, err
+		}
+		return &callNode{nodePos: pos, call: call, params: params, body: body}, nil
+	case "filter":
+		filters, err := compileFilterChain(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter statement: %s", tok.value)
+		}
+		scope := ""
+		if p.loop != "" {
+			scope = "filter"
+		}
+		body, _, err := p.parseBodyIn(scope, "endfilter")
+		if err != nil {
+			return nil, err
+		}
+		return &filterBlockNode{nodePos: pos, filters: filters, body: body}, nil
+	case "autoescape":
+		var enabled bool
+		switch strings.Trim(rest, `"'`) {
+		case "true", "":
+			enabled = true
+		case "false":
+			enabled = false
+		default:
+			return nil, fmt.Errorf("invalid autoescape statement: %s", tok.value)
+		}
+		body, _, err := p.parseBody("endautoescape")
+		if err != nil {
+			return nil, err
+		}
+		return &autoescapeNode{nodePos: pos, enabled: enabled, body: body}, nil
+	case "raw", "verbatim":
+		text := ""
+		if p.pos < len(p.toks) && p.toks[p.pos].kind == tmplText {
+			text = p.toks[p.pos].value
+			p.pos++
+		}
+		if p.pos >= len(p.toks) || tagName(p.toks[p.pos].value) != "end"+name {
+			return nil, fmt.Errorf("missing end%s", name)
+		}
+		p.pos++
+		return &rawNode{nodePos: pos, text: text}, nil
+	default:
+		if ext, ok := p.exts[name]; ok {
+			return p.parseExtension(ext, tok, name, rest)
+		}
+		return nil, fmt.Errorf("unknown tag %q", name)
+	}
+}
+
+func (p *templateParser) parseIf(tok tmplToken, cond string) (node, error) {
+	n := &ifNode{nodePos: nodePos{tok.line, tok.col}}
+	for {
+		expr, err := p.expr(tok, cond)
+		if err != nil {
+			return nil, err
+		}
+		body, end, err := p.parseBody("elif", "elseif", "else", "endif")
+		if err != nil {
+			return nil, err
+		}
+		n.branches = append(n.branches, ifBranch{cond: expr, body: body})
+		switch tagName(end.value) {
+		case "elif", "elseif":
+			tok = *end
+			cond = strings.TrimSpace(end.value[len(tagName(end.value)):])
+			continue
+		case "else":
+			elseBody, _, err := p.parseBody("endif")
+			if err != nil {
+				return nil, err
+			}
+			n.elseBody = elseBody
+		}
+		return n, nil
+	}
+}
@@ -0,0 +1,43 @@
+package nunchucks
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRenderBlockRendersOnlyTheBlock(t *testing.T) {
+	files := map[string]string{
+		"layout.njk": `{% set site = "Docs" %}<html>{% block main %}{% endblock %}</html>`,
+		"search.njk": `{% extends "layout.njk" %}{% import "ui.njk" as ui %}{% set heading = "Search " + q %}` +
+			`{% block main %}<h1>{{ site }}: {{ heading }}</h1>{% block results %}<ul>{% for r in results %}{{ ui.item(r) }}{% endfor %}</ul>{% endblock %}{% endblock %}`,
+		"ui.njk": `{% macro item(text, tag="li") %}<{{ tag }}>{{ text }}</{{ tag }}>{% endmacro %}`,
+	}
+	env := Configure(ConfigOptions{Loader: &testLoader{files: files}})
+	ctx := map[string]any{"q": "go", "results": []any{"a", "<b>"}}
+
+	out, err := env.RenderBlock("search.njk", "results", ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "<ul><li>a</li><li>&lt;b&gt;</li></ul>"; out != want {
+		t.Fatalf("unexpected output\nwant: %q\n got: %q", want, out)
+	}
+	out, err = env.RenderBlock("search.njk", "main", ctx)
+	if err != nil || out != "<h1>Docs: Search go</h1><ul><li>a</li><li>&lt;b&gt;</li></ul>" {
+		t.Fatalf("unexpected output %q, %v", out, err)
+	}
+
+	_, err = env.RenderBlock("search.njk", "sidebar", ctx)
+	var te *TemplateError
+	if !errors.As(err, &te) || te.Template != "search.njk" || te.Err.Error() != `no block named "sidebar"` {
+		t.Fatalf("expected a missing block error, got %v", err)
+	}
+
+	out, err = env.CallMacro("ui.njk", "item", []any{"<x>"}, map[string]any{"tag": "p"})
+	if err != nil || out != "<p>&lt;x&gt;</p>" {
+		t.Fatalf("unexpected macro output %q, %v", out, err)
+	}
+	if _, err := env.CallMacro("ui.njk", "nope", nil, nil); !errors.As(err, &te) || te.Err.Error() != `no macro named "nope"` {
+		t.Fatalf("expected a missing macro error, got %v", err)
+	}
+}
@@ -1,7 +1,9 @@
 package nunchucks
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -9,6 +11,9 @@ import (
 
 type PrecompileOptions struct {
 	OutputFormat string
+	// IR writes each template's compiled program (<name>.ir.json) instead
+	// of its rendered output.
+	IR bool
 }
 
 func IsTemplateFile(name string) bool {
@@ -22,6 +27,9 @@ func IsTemplateFile(name string) bool {
 }
 
 func outputPathFor(rel string, opts PrecompileOptions) string {
+	if opts.IR {
+		return rel + ".ir.json"
+	}
 	if strings.EqualFold(strings.TrimSpace(opts.OutputFormat), "html") && strings.EqualFold(filepath.Ext(rel), ".njk") {
 		return strings.TrimSuffix(rel, filepath.Ext(rel)) + ".html"
 	}
@@ -66,19 +74,74 @@ func (e *Env) PrecompileDirWithOptions(outDir string, ctx map[string]any, opts P
 		}
 		rel = filepath.ToSlash(rel)
 
-		rendered, err := e.Render(rel, ctx)
-		if err != nil {
-			return fmt.Errorf("render %s: %w", rel, err)
-		}
-
 		dst := filepath.Join(outDir, filepath.FromSlash(outputPathFor(rel, opts)))
-		if strings.TrimSpace(rendered) == "" {
-			_ = os.Remove(dst)
-			return nil
+		if opts.IR {
+			return e.writeIR(rel, dst)
 		}
-		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
-			return err
-		}
-		return os.WriteFile(dst, []byte(rendered), 0o644)
+
+		return e.renderFile(rel, dst, ctx)
 	})
 }
+
+// renderFile streams the rendered template rel into dst. The output goes to
+// a temporary file that replaces dst once rendering succeeds; blank output
+// removes dst instead.
+func (e *Env) renderFile(rel, dst string, ctx map[string]any) error {
+	tpl, err := e.GetTemplate(rel)
+	if err != nil {
+		return asTemplateError(rel, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := &blankWriter{w: tmp, blank: true}
+	err = tpl.Execute(w, ctx)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if w.blank {
+		_ = os.Remove(dst)
+		return nil
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// blankWriter records whether only whitespace has been written through it.
+type blankWriter struct {
+	w     io.Writer
+	blank bool
+}
+
+func (b *blankWriter) Write(p []byte) (int, error) {
+	if b.blank && len(bytes.TrimSpace(p)) > 0 {
+		b.blank = false
+	}
+	return b.w.Write(p)
+}
+
+func (e *Env) writeIR(rel, dst string) error {
+	tpl, err := e.GetTemplate(rel)
+	if err != nil {
+		return asTemplateError(rel, err)
+	}
+	data, err := tpl.EncodeIR()
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", rel, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, 0o644)
+}
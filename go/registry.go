@@ -0,0 +1,148 @@
+package nunchucks
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FilterFunc is a filter added with Env.AddFilter. value is the filtered
+// value, and args and kwargs are the arguments the filter was called with.
+// A non-nil error fails the render with a TemplateError at the call site.
+type FilterFunc func(ctx *Context, value any, args []any, kwargs map[string]any) (any, error)
+
+// TestFunc is a test added with Env.AddTest. It is used by `value is name`
+// and by the select, reject, selectattr and rejectattr filters.
+type TestFunc func(ctx *Context, value any, args []any, kwargs map[string]any) (bool, error)
+
+// Context is the render a custom filter or test was called from.
+type Context struct {
+	scope *evalScope
+}
+
+// Env returns the environment rendering the template.
+func (c *Context) Env() *Env { return c.scope.env }
+
+// Lookup returns the variable name as the template sees it at the call
+// site: a local set, loop or macro variable, a context value, or else a
+// global.
+func (c *Context) Lookup(name string) (any, bool) {
+	v, ok := c.scope.state.lookup(name, c.scope.vars, c.scope.ctx)
+	if !ok {
+		return nil, false
+	}
+	return v, true
+}
+
+// RenderValue returns what SetRenderValue stored under key during this
+// render, or nil.
+func (c *Context) RenderValue(key any) any {
+	if c.scope.state == nil {
+		return nil
+	}
+	return c.scope.state.values[key]
+}
+
+// SetRenderValue stores value under key for the rest of the render, so an
+// extension can number or deduplicate what its tags output. Use an
+// unexported key type, as with context.WithValue.
+func (c *Context) SetRenderValue(key, value any) {
+	if c.scope.state == nil {
+		return
+	}
+	if c.scope.state.values == nil {
+		c.scope.state.values = map[any]any{}
+	}
+	c.scope.state.values[key] = value
+}
+
+// AddFilter makes fn available as the filter name, replacing a built-in
+// filter of the same name. Add filters, tests and globals before rendering;
+// they are not safe to add while templates render.
+func (e *Env) AddFilter(name string, fn FilterFunc) {
+	if e.filters == nil {
+		e.filters = map[string]FilterFunc{}
+	}
+	e.filters[strings.TrimSpace(name)] = fn
+}
+
+// AddTest makes fn available as the test name, replacing a built-in test
+// of the same name.
+func (e *Env) AddTest(name string, fn TestFunc) {
+	if e.tests == nil {
+		e.tests = map[string]TestFunc{}
+	}
+	e.tests[strings.TrimSpace(name)] = fn
+}
+
+// AddGlobal makes value available to every template as name, like
+// ConfigOptions.Globals, including imported templates and templates
+// included without context. Variables and render context values of the
+// same name take precedence, and a global replaces a built-in such as
+// range.
+func (e *Env) AddGlobal(name string, value any) {
+	e.globals[strings.TrimSpace(name)] = value
+}
+
+func (e *Env) customFilter(name string) (FilterFunc, bool) {
+	if e == nil {
+		return nil, false
+	}
+	fn, ok := e.filters[name]
+	return fn, ok
+}
+
+func (e *Env) customTest(name string) (TestFunc, bool) {
+	if e == nil {
+		return nil, false
+	}
+	fn, ok := e.tests[name]
+	return fn, ok
+}
+
+// isTest reports whether name is an added or built-in test.
+func (s *evalScope) isTest(name string) bool {
+	if _, ok := s.env.customTest(name); ok {
+		return true
+	}
+	return isKnownTestName(name)
+}
+
+// isFilter reports whether name is an added or built-in filter.
+func (s *evalScope) isFilter(name string) bool {
+	if _, ok := s.env.customFilter(name); ok {
+		return true
+	}
+	return builtinFilterNames[strings.ToLower(strings.TrimSpace(name))]
+}
+
+// runTest applies the test name to v, preferring one added with
+// Env.AddTest over the built-in of the same name.
+func runTest(s *evalScope, v any, name string, args []any, kwargs map[string]any) (bool, error) {
+	if fn, ok := s.env.customTest(name); ok {
+		ok, err := fn(&Context{scope: s}, v, args, kwargs)
+		if err != nil {
+			return false, fmt.Errorf("test %q: %w", name, err)
+		}
+		return ok, nil
+	}
+	if !isKnownTestName(name) {
+		return false, fmt.Errorf("no test named %q", name)
+	}
+	n := strings.ToLower(strings.TrimSpace(name))
+	args, err := bindArgs("test", n, testParams[n], args, kwargs)
+	if err != nil {
+		return false, err
+	}
+	if len(testParams[n]) > 0 && len(args) == 0 {
+		return false, fmt.Errorf("test %q requires an argument", n)
+	}
+	switch n {
+	case "filter":
+		name, ok := plainString(v).(string)
+		return ok && s.isFilter(name), nil
+	case "test":
+		name, ok := plainString(v).(string)
+		return ok && s.isTest(name), nil
+	}
+	return evalTestKeyword(v, name, args), nil
+}
@@ -0,0 +1,108 @@
+package nunchucks
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestAddFilterTestAndGlobal(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	env.AddFilter("money", func(ctx *Context, v any, args []any, _ map[string]any) (any, error) {
+		symbol := "$"
+		if cur, ok := ctx.Lookup("currency"); ok {
+			symbol = fmt.Sprint(cur)
+		}
+		if len(args) > 0 {
+			symbol = fmt.Sprint(args[0])
+		}
+		return fmt.Sprintf("%s%.2f", symbol, toFloat(v, 0)), nil
+	})
+	env.AddFilter("slugify", func(_ *Context, v any, _ []any, _ map[string]any) (any, error) {
+		return strings.Join(strings.Fields(strings.ToLower(fmt.Sprint(v))), "-"), nil
+	})
+	env.AddFilter("upper", func(_ *Context, v any, _ []any, _ map[string]any) (any, error) {
+		return "UP:" + strings.ToUpper(fmt.Sprint(v)), nil
+	})
+	env.AddTest("prime", func(_ *Context, v any, _ []any, _ map[string]any) (bool, error) {
+		n := toInt(v, 0)
+		if n < 2 {
+			return false, nil
+		}
+		for d := 2; d*d <= n; d++ {
+			if n%d == 0 {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	env.AddGlobal("greet", func(name string) string { return "hi " + name })
+
+	ctx := map[string]any{"price": 3.5, "nums": []any{1, 2, 3, 4, 5}, "currency": "€"}
+	cases := map[string]string{
+		`{{ price | money }}`:                      "€3.50",
+		`{{ price | money("£") }}`:                 "£3.50",
+		`{{ "Hello Big World" | slugify }}`:        "hello-big-world",
+		`{{ "a" | upper }}`:                        "UP:A",
+		`{{ 7 is prime }} {{ 8 is not prime }}`:    "true true",
+		`{{ nums | select("prime") | join(",") }}`: "2,3,5",
+		`{{ nums | reject("prime") | join(",") }}`: "1,4",
+		`{% filter slugify %}A B{% endfilter %}`:   "a-b",
+		`{{ greet("sam") }}`:                       "hi sam",
+		`{% set s = "X Y" | slugify %}{{ s }}`:     "x-y",
+	}
+	for src, want := range cases {
+		out, err := env.RenderString(src, ctx)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", src, err)
+		}
+		if out != want {
+			t.Fatalf("%s: want %q, got %q", src, want, out)
+		}
+	}
+}
+
+func TestGlobalsReachImportedMacrosAndIncludes(t *testing.T) {
+	files := map[string]string{
+		"macros.njk": `{% macro link(title) %}<a href="/{{ slugify(title) }}">{% for i in range(2) %}{{ i }}{% endfor %}</a>{% endmacro %}`,
+		"page.njk":   `{% from "macros.njk" import link %}{{ link("Hello World") }}|{% include "part.njk" without context %}`,
+		"part.njk":   `{% set ns = namespace(n=site) %}{{ ns.n }} {{ name is defined }}`,
+	}
+	env := Configure(ConfigOptions{Loader: &testLoader{files: files}, Globals: map[string]any{"site": "docs"}})
+	env.AddGlobal("slugify", func(s string) string { return strings.ReplaceAll(strings.ToLower(s), " ", "-") })
+	out, err := env.Render("page.njk", map[string]any{"name": "sam", "site": "shadowed"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := `<a href="/hello-world">01</a>|docs false`; out != want {
+		t.Fatalf("want %q, got %q", want, out)
+	}
+}
+
+func TestCustomFilterAndTestErrorsAreLocated(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	errBad := errors.New("bad amount")
+	env.AddFilter("money", func(_ *Context, v any, _ []any, _ map[string]any) (any, error) {
+		return nil, errBad
+	})
+	env.AddTest("valid", func(_ *Context, v any, _ []any, _ map[string]any) (bool, error) {
+		return false, errBad
+	})
+
+	for src, want := range map[string]string{
+		"<p>\n{{ price | money }}</p>":           `filter "money": bad amount`,
+		"<p>\n{{ price is valid }}</p>":          `test "valid": bad amount`,
+		"<p>\n{{ [1] | select(\"valid\") }}</p>": `filter "select": test "valid": bad amount`,
+		"<p>\n{{ price is prime }}</p>":          `no test named "prime"`,
+	} {
+		_, err := env.RenderString(src, map[string]any{"price": 1})
+		var te *TemplateError
+		if !errors.As(err, &te) || te.Line != 2 || te.Err.Error() != want {
+			t.Fatalf("%q: expected TemplateError %q on line 2, got %v", src, want, err)
+		}
+		if want != `no test named "prime"` && !errors.Is(err, errBad) {
+			t.Fatalf("%q: expected error to wrap the filter's error", src)
+		}
+	}
+}
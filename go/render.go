@@ -1,42 +1,135 @@
 package nunchucks
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
-var exprRe = regexp.MustCompile(`\{\{\s*([\s\S]*?)\s*\}\}`)
-var stmtRe = regexp.MustCompile(`\{%\s*([A-Za-z_][A-Za-z0-9_]*)\b([\s\S]*?)%\}`)
 var commentRe = regexp.MustCompile(`\{#([\s\S]*?)#\}`)
-var clientOpenRe = regexp.MustCompile(`\{%\s*client\s*%\}`)
-var clientCloseRe = regexp.MustCompile(`\{%\s*endclient\s*%\}`)
-var fetchStmtRe = regexp.MustCompile(`\{%\s*fetch\s+([\s\S]*?)%\}`)
-var stateStmtRe = regexp.MustCompile(`\{%\s*state\s+([\s\S]*?)%\}`)
-var inlineClientEventRe = regexp.MustCompile(`\bon([A-Za-z][A-Za-z0-9_]*)\s*=\s*\{\{\s*([\s\S]*?)\s*\}\}`)
-
+var importedNameRe = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)(?:\s+as\s+([A-Za-z_][A-Za-z0-9_]*))?$`)
+var includeStmtRe = regexp.MustCompile(`^include\s+([\s\S]+?)(\s+ignore\s+missing)?(?:\s+(with|without)\s+context)?$`)
+var importStmtRe = regexp.MustCompile(`^import\s+([\s\S]+?)\s+as\s+([A-Za-z_][A-Za-z0-9_]*)([\s\S]*)$`)
+var fromImportStmtRe = regexp.MustCompile(`^from\s+([\s\S]+?)\s+import\s+([\s\S]+?)(?:\s+(with\s+context|without\s+context))?$`)
+
+// MacroDef describes a macro. A macro whose body uses varargs or kwargs
+// collects the positional and keyword arguments that match no parameter
+// in them; other macros reject extra arguments.
 type MacroDef struct {
-	Params []MacroParam
-	Body   string
+	Name         string
+	Params       []MacroParam
+	CatchVarargs bool
+	CatchKwargs  bool
+	Body         string
+	body         []node
 }
 
 type MacroParam struct {
-	Name       string
-	Default    string
-	HasDefault bool
+	Name       string `json:"name"`
+	Default    string `json:"default,omitempty"`
+	HasDefault bool   `json:"hasDefault,omitempty"`
+	def        *compiledExpr
 }
 
-func cloneMap(in map[string]any) map[string]any {
-	out := make(map[string]any, len(in))
-	for k, v := range in {
-		out[k] = v
+func (p MacroParam) defaultValue(s *evalScope) any {
+	if p.def == nil {
+		return evalExpr(p.Default, s.vars, s.ctx)
 	}
-	return out
+	return p.def.eval(s)
+}
+
+// renderState is shared by every frame of a single top-level render.
+type renderState struct {
+	events []inlineClientEventBinding
+	budget *renderBudget
+	// values holds what extensions keep for the rest of the render.
+	values map[any]any
+	// modules caches the templates imported during the render.
+	modules map[*program][]importedModule
+	// running names the templates whose top level is running, outermost
+	// first, so an include or import cycle is reported instead of
+	// recursing forever.
+	running []string
+	// globals holds the Env's globals and the built-in ones, which every
+	// template sees whatever context it renders with.
+	globals map[string]any
+}
+
+// newRenderState starts the state of a render within budget.
+func (e *Env) newRenderState(budget *renderBudget) *renderState {
+	globals := builtinGlobals(budget)
+	for k, v := range e.globals {
+		globals[k] = v
+	}
+	return &renderState{budget: budget, globals: globals}
+}
+
+// enterTemplate records that the top level of the template name starts
+// running for statement, an include or import, unless that would close a
+// cycle. Each successful enterTemplate must be paired with a leaveTemplate.
+func (st *renderState) enterTemplate(name, statement string) error {
+	for i, running := range st.running {
+		if running == name {
+			cycle := append(append([]string{}, st.running[i:]...), name)
+			return fmt.Errorf("%s cycle detected: %s", statement, strings.Join(cycle, " -> "))
+		}
+	}
+	st.running = append(st.running, name)
+	return nil
+}
+
+func (st *renderState) leaveTemplate() {
+	st.running = st.running[:len(st.running)-1]
+}
+
+// lookup resolves name in vars, then ctx, then the render's globals.
+func (st *renderState) lookup(name string, vars, ctx map[string]any) (any, bool) {
+	v, ok := resolveIdentEx(name, vars, ctx)
+	if !ok && st != nil {
+		if g, found := st.globals[strings.TrimSpace(name)]; found {
+			return g, true
+		}
+	}
+	return v, ok
+}
+
+// templateRun tracks inheritance while one template (and its parents) render.
+type templateRun struct {
+	blocks     map[string][]blockRef
+	parent     *program
+	parentLine int
+	// skipBlocks is set while the templates run only for their top-level
+	// variables, before a single block is rendered.
+	skipBlocks bool
+}
+
+// blockRef locates a block's unit in the program that defines it.
+type blockRef struct {
+	prog *program
+	unit int
 }
 
-func cloneMacros(in map[string]MacroDef) map[string]MacroDef {
-	out := make(map[string]MacroDef, len(in))
+// frame is the scope a unit of code is executed in.
+type frame struct {
+	state *renderState
+	run   *templateRun
+	ctx   map[string]any
+	vars  map[string]any
+}
+
+func (f *frame) withVars(vars map[string]any) *frame {
+	next := *f
+	next.vars = vars
+	return &next
+}
+
+func cloneMap(in map[string]any) map[string]any {
+	out := make(map[string]any, len(in))
 	for k, v := range in {
 		out[k] = v
 	}
@@ -48,80 +141,134 @@ func stripComments(src string) string {
 }
 
 func (e *Env) renderString(src string, ctx map[string]any) (string, error) {
-	src = e.normalizeTemplateSource(src)
-	ctx = e.buildRenderContext(ctx)
-	if err := ApplyTemplateContractDefaults(src, ctx); err != nil {
-		return "", err
-	}
-	if err := ValidateTemplateContract(src, ctx); err != nil {
-		return "", err
-	}
-	src = stripComments(src)
-	var err error
-	src, err = e.prependGlobalTemplates(src)
+	tpl, err := parseTemplate("", src, e.delimiters(), e.extensions)
 	if err != nil {
 		return "", err
 	}
-	for k, v := range builtinGlobals() {
-		if _, ok := ctx[k]; !ok {
-			ctx[k] = v
-		}
-	}
-	out, err := e.renderWithState(src, ctx, map[string]any{}, map[string]MacroDef{})
+	prog, err := compileProgram(tpl, e.autoescapeFor(""), e.contextualEscape)
 	if err != nil {
-		return "", err
+		return "", asTemplateError("", err)
 	}
-	out, err = e.injectGlobalFragments(out, ctx)
-	if err != nil {
+	var b strings.Builder
+	if err := e.execute(context.Background(), &b, "", prog, "", ctx); err != nil {
 		return "", err
 	}
-	return out, nil
+	return b.String(), nil
 }
 
-func (e *Env) buildRenderContext(ctx map[string]any) map[string]any {
-	base := cloneMap(e.globals)
-	if base == nil {
-		base = map[string]any{}
+// execute checks data against the program's contract and renders the
+// program as a top-level template to w, within the Env's limits and the
+// lifetime of ctx. A non-empty block renders only that block of the page.
+func (e *Env) execute(ctx context.Context, w io.Writer, name string, prog *program, block string, data map[string]any) error {
+	data = e.buildRenderContext(data)
+	if err := prog.Contract.ApplyDefaults(data); err != nil {
+		return asTemplateError(name, err)
 	}
-	for k, v := range ctx {
-		base[k] = v
+	if err := prog.Contract.Validate(data); err != nil {
+		return asTemplateError(name, err)
 	}
-	return base
+	budget, cancel := e.newRenderBudget(ctx)
+	defer cancel()
+	if err := e.renderRoot(budget.limit(w), prog, block, data, budget); err != nil {
+		return asTemplateError(name, err)
+	}
+	// Work between the checks, such as one long concatenation, can still
+	// run past the deadline; such a render fails too.
+	if err := budget.check(); err != nil {
+		return asTemplateError(name, err)
+	}
+	return nil
 }
 
-func (e *Env) prependGlobalTemplates(src string) (string, error) {
-	if len(e.globalTemplates) == 0 {
-		return src, nil
+// renderRoot renders a top-level template together with the configured
+// global templates and head/foot fragments. Output is streamed to w unless
+// head or foot fragments are configured: those are injected before </head>
+// and </body>, so the page is buffered first. A single block is written
+// without them.
+func (e *Env) renderRoot(w io.Writer, prog *program, block string, ctx map[string]any, budget *renderBudget) error {
+	if block != "" || len(e.globalHeadTemplates) == 0 && len(e.globalFootTemplates) == 0 {
+		return e.renderPage(w, prog, block, ctx, budget)
 	}
+
 	var b strings.Builder
+	if err := e.renderPage(budget.limit(&b), prog, "", ctx, budget); err != nil {
+		return err
+	}
+	out, err := e.injectGlobalFragments(b.String(), ctx, budget)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, out)
+	return err
+}
+
+// renderPage writes the global templates, the template itself and the
+// inline client event runtime to w. For a single block, the global
+// templates still run, for the macros and variables they define, but only
+// the block is written.
+func (e *Env) renderPage(w io.Writer, prog *program, block string, ctx map[string]any, budget *renderBudget) error {
+	state := e.newRenderState(budget)
+	state.running = []string{prog.Name}
+	f := &frame{state: state, ctx: ctx, vars: map[string]any{}}
+	globalOut := w
+	if block != "" {
+		globalOut = io.Discard
+	}
 	for _, name := range e.globalTemplates {
-		tpl, err := e.readTemplate(name)
+		global, err := e.loadProgram(name)
 		if err != nil {
-			return "", err
+			return asTemplateError(name, err)
 		}
-		b.WriteString(tpl)
-		if !strings.HasSuffix(tpl, "\n") {
-			b.WriteString("\n")
+		// The macros and variables of global templates are the page's.
+		vars, err := e.runTemplate(globalOut, global, "", f)
+		if err != nil {
+			return err
+		}
+		for k, v := range vars {
+			if k != "self" {
+				f.vars[k] = v
+			}
+		}
+		if !global.Newline {
+			if _, err := io.WriteString(globalOut, "\n"); err != nil {
+				return err
+			}
 		}
 	}
-	b.WriteString(src)
-	return b.String(), nil
+	if err := e.renderTemplateBlock(w, prog, block, f); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, inlineClientEventRuntime(f.state.events))
+	return err
 }
 
-func (e *Env) renderGlobalFragmentTemplates(names []string, ctx map[string]any) (string, error) {
+func (e *Env) buildRenderContext(ctx map[string]any) map[string]any {
+	base := cloneMap(e.globals)
+	if base == nil {
+		base = map[string]any{}
+	}
+	for k, v := range ctx {
+		base[k] = v
+	}
+	return base
+}
+
+func (e *Env) renderGlobalFragmentTemplates(names []string, ctx map[string]any, budget *renderBudget) (string, error) {
 	if len(names) == 0 {
 		return "", nil
 	}
 	var b strings.Builder
 	for _, name := range names {
-		tpl, err := e.readTemplate(name)
+		prog, err := e.loadProgram(name)
 		if err != nil {
-			return "", err
+			return "", asTemplateError(name, err)
 		}
-		out, err := e.renderWithState(tpl, ctx, map[string]any{}, map[string]MacroDef{})
-		if err != nil {
+		var frag strings.Builder
+		f := &frame{state: e.newRenderState(budget), ctx: ctx, vars: map[string]any{}}
+		if err := e.renderTemplate(&frag, prog, f); err != nil {
 			return "", err
 		}
+		out := frag.String() + inlineClientEventRuntime(f.state.events)
 		b.WriteString(out)
 		if !strings.HasSuffix(out, "\n") {
 			b.WriteString("\n")
@@ -146,12 +293,12 @@ func injectBeforeClosingTag(html, tag, fragment string) string {
 	return html[:idx] + fragment + html[idx:]
 }
 
-func (e *Env) injectGlobalFragments(out string, ctx map[string]any) (string, error) {
-	head, err := e.renderGlobalFragmentTemplates(e.globalHeadTemplates, ctx)
+func (e *Env) injectGlobalFragments(out string, ctx map[string]any, budget *renderBudget) (string, error) {
+	head, err := e.renderGlobalFragmentTemplates(e.globalHeadTemplates, ctx, budget)
 	if err != nil {
 		return "", err
 	}
-	foot, err := e.renderGlobalFragmentTemplates(e.globalFootTemplates, ctx)
+	foot, err := e.renderGlobalFragmentTemplates(e.globalFootTemplates, ctx, budget)
 	if err != nil {
 		return "", err
 	}
@@ -161,81 +308,6 @@ func (e *Env) injectGlobalFragments(out string, ctx map[string]any) (string, err
 	return out, nil
 }
 
-func (e *Env) renderWithState(src string, ctx, vars map[string]any, macros map[string]MacroDef) (string, error) {
-	out := src
-	var err error
-
-	out, raws, err := extractRawBlocks(out)
-	if err != nil {
-		return "", err
-	}
-
-	out, err = e.applyFromImports(out, ctx, vars, macros)
-	if err != nil {
-		return "", err
-	}
-
-	out, err = e.applyImports(out, ctx, vars, macros)
-	if err != nil {
-		return "", err
-	}
-
-	out, err = e.applyMacroDefs(out, ctx, vars, macros)
-	if err != nil {
-		return "", err
-	}
-
-	out, err = applySets(out, vars, ctx)
-	if err != nil {
-		return "", err
-	}
-
-	out, err = e.applyIncludes(out, ctx, vars, macros)
-	if err != nil {
-		return "", err
-	}
-
-	out, err = e.applyForLoops(out, vars, ctx, macros)
-	if err != nil {
-		return "", err
-	}
-
-	out, err = e.applyIfElse(out, vars, ctx, macros)
-	if err != nil {
-		return "", err
-	}
-
-	out, err = e.applyFilterBlocks(out, vars, ctx, macros)
-	if err != nil {
-		return "", err
-	}
-
-	out, err = e.applyCallBlocks(out, vars, ctx, macros)
-	if err != nil {
-		return "", err
-	}
-
-	out, err = e.applyClientBlocks(out, vars, ctx, macros)
-	if err != nil {
-		return "", err
-	}
-
-	out, eventBindings := extractInlineClientEvents(out)
-
-	out = exprRe.ReplaceAllStringFunc(out, func(m string) string {
-		mm := exprRe.FindStringSubmatch(m)
-		if len(mm) < 2 {
-			return ""
-		}
-		return fmt.Sprint(evalExpr(mm[1], vars, ctx))
-	})
-
-	out = stmtRe.ReplaceAllString(out, "")
-	out = appendInlineClientEventRuntime(out, eventBindings)
-	out = restoreRawBlocks(out, raws)
-	return out, nil
-}
-
 func parseFetchPipeSpec(raw string) (endpoint string, asVar string, mode string, ok bool) {
 	parts := strings.Split(raw, "|")
 	tokens := make([]string, 0, len(parts))
@@ -277,117 +349,118 @@ func parseFetchPipeSpec(raw string) (endpoint string, asVar string, mode string,
 	return endpoint, asVar, mode, true
 }
 
-func transformFetchStatementsToJS(body string, vars, ctx map[string]any) string {
-	idx := 0
-	return fetchStmtRe.ReplaceAllStringFunc(body, func(m string) string {
-		parts := fetchStmtRe.FindStringSubmatch(m)
-		if len(parts) < 2 {
-			return m
-		}
-		endpointExpr, asVar, mode, ok := parseFetchPipeSpec(parts[1])
-		if !ok {
-			return m
-		}
-		endpointVal := evalExpr(endpointExpr, vars, ctx)
-		endpoint := fmt.Sprintf("%q", fmt.Sprint(endpointVal))
-		resName := fmt.Sprintf("__nc_fetch_res_%d", idx)
-		idx++
-		lines := []string{
-			fmt.Sprintf("const %s = await fetch(%s);", resName, endpoint),
-		}
-		if asVar != "" {
-			lines = append(lines, fmt.Sprintf("const %s = await %s.%s();", asVar, resName, mode))
-		}
-		return strings.Join(lines, "\n")
-	})
-}
-
-func parseStateObjectLiteral(raw string, vars, ctx map[string]any) map[string]any {
-	s := strings.TrimSpace(raw)
-	if s == "" {
-		return map[string]any{}
+// parseStateSpec parses `name | { key: value, ... } | ...` and returns the
+// name and the source of the initial state, a dict literal whose bare keys
+// are strings, as in JavaScript. Anything after the second pipe is
+// ignored. The object is "" when the spec has none.
+func parseStateSpec(raw string) (name, obj string, err error) {
+	toks, err := lexExpr(raw)
+	if err != nil {
+		return "", "", err
 	}
-	if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
-		s = strings.TrimSpace(s[1 : len(s)-1])
+	p := &exprParser{toks: toks, bareKeys: true}
+	if p.cur().kind != tokIdent {
+		return "", "", p.errorf("expected state name, got %s", p.cur())
 	}
-	if strings.TrimSpace(s) == "" {
-		return map[string]any{}
+	name = p.cur().lit
+	p.advance()
+	if p.cur().kind == tokEOF {
+		return name, "", nil
 	}
+	if err := p.expect(tokPipe); err != nil {
+		return "", "", err
+	}
+	if k := p.cur().kind; k == tokPipe || k == tokEOF {
+		return name, "", nil
+	}
+	if p.cur().kind != tokLBrace {
+		return "", "", p.errorf("expected state object, got %s", p.cur())
+	}
+	start := p.cur().pos
+	if _, err := p.parsePrimary(); err != nil {
+		return "", "", err
+	}
+	if k := p.cur().kind; k != tokPipe && k != tokEOF {
+		return "", "", p.errorf("unexpected %s", p.cur())
+	}
+	return name, raw[start:p.cur().pos], nil
+}
 
-	out := map[string]any{}
-	parts := splitArgs(s)
-	for _, part := range parts {
-		p := strings.TrimSpace(part)
-		if p == "" {
-			continue
-		}
+// clientExtension implements the client tag and the fetch and state tags
+// used inside it.
+type clientExtension struct{}
 
-		key := ""
-		valExpr := ""
-		if k, v, ok := splitTopLevelAssign(p); ok {
-			key = strings.TrimSpace(k)
-			valExpr = strings.TrimSpace(v)
-		} else {
-			kv := strings.SplitN(p, ":", 2)
-			if len(kv) != 2 {
-				continue
-			}
-			key = strings.TrimSpace(kv[0])
-			valExpr = strings.TrimSpace(kv[1])
-		}
+func (clientExtension) Tags() []string { return []string{"client", "fetch", "state"} }
 
-		key = strings.Trim(key, `"'`)
-		if key == "" {
-			continue
-		}
-		out[key] = evalExpr(valExpr, vars, ctx)
+func (clientExtension) Parse(p *TagParser) error {
+	if p.Name() == "client" {
+		_, err := p.ParseBody("endclient")
+		return err
 	}
-	return out
-}
-
-func parseStatePipeSpec(raw string, vars, ctx map[string]any) (string, map[string]any, bool) {
-	parts := strings.Split(raw, "|")
-	tokens := make([]string, 0, len(parts))
-	for _, p := range parts {
-		t := strings.TrimSpace(p)
-		if t == "" {
-			continue
+	if !p.Inside("client") {
+		return fmt.Errorf("%s is only allowed inside a client block", p.Name())
+	}
+	if p.Name() == "fetch" {
+		endpoint, asVar, mode, ok := parseFetchPipeSpec(p.Args())
+		if !ok {
+			return fmt.Errorf("invalid fetch statement: %s", p.Args())
 		}
-		tokens = append(tokens, t)
+		if err := p.AddArg(endpoint); err != nil {
+			return err
+		}
+		if asVar != "" {
+			if err := p.AddKwarg("as", strconv.Quote(asVar)); err != nil {
+				return err
+			}
+		}
+		return p.AddKwarg("mode", strconv.Quote(mode))
 	}
-	if len(tokens) == 0 {
-		return "", nil, false
+	name, obj, err := parseStateSpec(p.Args())
+	if err != nil {
+		return fmt.Errorf("invalid state statement: %w", err)
 	}
-
-	name := strings.TrimSpace(tokens[0])
-	if name == "" {
-		return "", nil, false
+	if err := p.AddValue(name); err != nil {
+		return err
 	}
-	initial := map[string]any{}
-	if len(tokens) > 1 {
-		initial = parseStateObjectLiteral(tokens[1], vars, ctx)
+	if obj == "" {
+		return nil
 	}
-	return name, initial, true
+	return p.AddObjectArg(obj)
 }
 
-func transformStateStatementsToJS(body string, vars, ctx map[string]any) string {
-	return stateStmtRe.ReplaceAllStringFunc(body, func(m string) string {
-		parts := stateStmtRe.FindStringSubmatch(m)
-		if len(parts) < 2 {
-			return m
-		}
-		name, initial, ok := parseStatePipeSpec(parts[1], vars, ctx)
-		if !ok {
-			return m
+// fetchCount numbers the fetch responses of a render, so each gets its
+// own const.
+type fetchCount struct{}
+
+func (clientExtension) Render(ctx *Context, tag *Tag) (string, error) {
+	switch tag.Name {
+	case "client":
+		return "<script type=\"module\" data-nunchucks-client>(async () => {\n" + tag.Body +
+			"\n})().catch((err) => console.error(\"nunchucks client block error\", err));</script>", nil
+	case "fetch":
+		idx, _ := ctx.RenderValue(fetchCount{}).(int)
+		ctx.SetRenderValue(fetchCount{}, idx+1)
+		resName := fmt.Sprintf("__nc_fetch_res_%d", idx)
+		lines := []string{
+			fmt.Sprintf("const %s = await fetch(%q);", resName, fmt.Sprint(tag.Args[0])),
 		}
-		payload, err := json.Marshal(initial)
-		if err != nil {
-			return m
+		if asVar, ok := tag.Kwargs["as"]; ok {
+			lines = append(lines, fmt.Sprintf("const %s = await %s.%s();", asVar, resName, tag.Kwargs["mode"]))
 		}
-		return fmt.Sprintf(`window.__nunchucks = window.__nunchucks || { state: {} };
+		return strings.Join(lines, "\n"), nil
+	}
+	name := tag.Args[0].(string)
+	var initial any = map[string]any{}
+	if len(tag.Args) > 1 {
+		initial = tag.Args[1]
+	}
+	payload, err := json.Marshal(initial)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`window.__nunchucks = window.__nunchucks || { state: {} };
 window.__nunchucks.state[%q] = %s;
-const %s = window.__nunchucks.state[%q];`, name, string(payload), name, name)
-	})
+const %s = window.__nunchucks.state[%q];`, name, string(payload), name, name), nil
 }
 
 type inlineClientEventBinding struct {
@@ -395,30 +468,11 @@ type inlineClientEventBinding struct {
 	Expr string
 }
 
-func extractInlineClientEvents(src string) (string, []inlineClientEventBinding) {
-	idx := 0
-	bindings := []inlineClientEventBinding{}
-	out := inlineClientEventRe.ReplaceAllStringFunc(src, func(m string) string {
-		parts := inlineClientEventRe.FindStringSubmatch(m)
-		if len(parts) < 3 {
-			return m
-		}
-		eventName := strings.ToLower(strings.TrimSpace(parts[1]))
-		expr := strings.TrimSpace(parts[2])
-		id := fmt.Sprintf("__nc_evt_%d", idx)
-		idx++
-		bindings = append(bindings, inlineClientEventBinding{
-			ID:   id,
-			Expr: expr,
-		})
-		return fmt.Sprintf(`data-nc-on%s="%s"`, eventName, id)
-	})
-	return out, bindings
-}
-
-func appendInlineClientEventRuntime(src string, bindings []inlineClientEventBinding) string {
+// inlineClientEventRuntime returns the script that binds the inline client
+// events of a render, or "" when there are none.
+func inlineClientEventRuntime(bindings []inlineClientEventBinding) string {
 	if len(bindings) == 0 {
-		return src
+		return ""
 	}
 
 	var b strings.Builder
@@ -459,138 +513,60 @@ if (document.readyState === "loading") {
 }
 })();</script>`)
 
-	return src + b.String()
+	return b.String()
 }
 
-func (e *Env) applyClientBlocks(src string, vars, ctx map[string]any, macros map[string]MacroDef) (string, error) {
-	out := src
-	for {
-		open := clientOpenRe.FindStringIndex(out)
-		if open == nil {
-			return out, nil
-		}
-		close := clientCloseRe.FindStringIndex(out[open[1]:])
-		if close == nil {
-			return "", fmt.Errorf("missing endclient")
-		}
-
-		bodyStart := open[1]
-		bodyEnd := open[1] + close[0]
-		closeEnd := open[1] + close[1]
-		body := out[bodyStart:bodyEnd]
-
-		body = transformFetchStatementsToJS(body, vars, ctx)
-		body = transformStateStatementsToJS(body, vars, ctx)
-
-		renderedBody, err := e.renderWithState(body, ctx, cloneMap(vars), cloneMacros(macros))
-		if err != nil {
-			return "", err
-		}
-
-		script := `<script type="module" data-nunchucks-client>(async () => {
-` + renderedBody + `
-})().catch((err) => console.error("nunchucks client block error", err));</script>`
-
-		out = out[:open[0]] + script + out[closeEnd:]
+// parseIncludeStmt splits `include target [ignore missing] [with|without
+// context]` into the target expression and its flags.
+func parseIncludeStmt(inner string) (target string, ignoreMissing, withContext, ok bool) {
+	m := includeStmtRe.FindStringSubmatch(strings.TrimSpace(inner))
+	if m == nil {
+		return "", false, false, false
 	}
+	return m[1], m[2] != "", m[3] != "without", true
 }
 
-type includeSpec struct {
-	Name          string
-	IgnoreMissing bool
-	WithContext   bool
-}
-
-func parseIncludeSpec(inner string) (includeSpec, bool) {
-	s := strings.TrimSpace(inner)
-	if !strings.HasPrefix(s, "include ") {
-		return includeSpec{}, false
-	}
-	rest := strings.TrimSpace(strings.TrimPrefix(s, "include "))
-	quote := byte(0)
-	if strings.HasPrefix(rest, "\"") {
-		quote = '"'
-	} else if strings.HasPrefix(rest, "'") {
-		quote = '\''
-	} else {
-		return includeSpec{}, false
+// renderInclude renders the template target names into w. With
+// ignoreMissing, a target that does not exist renders nothing. Including a
+// template that is already being rendered is an error.
+func (e *Env) renderInclude(w io.Writer, target any, ignoreMissing, withContext bool, f *frame) error {
+	if err := f.state.budget.enter(); err != nil {
+		return err
 	}
-	end := 1
-	for end < len(rest) && rest[end] != quote {
-		if rest[end] == '\\' {
-			end += 2
-			continue
+	defer f.state.budget.leave()
+
+	tpl, err := e.resolveTemplate(target)
+	if err != nil {
+		var missing *loaderError
+		if ignoreMissing && errors.As(err, &missing) {
+			return nil
 		}
-		end++
+		return err
 	}
-	if end >= len(rest) {
-		return includeSpec{}, false
+	if err := f.state.enterTemplate(tpl.prog.Name, "include"); err != nil {
+		return err
 	}
-	name := rest[1:end]
-	flags := strings.ToLower(strings.TrimSpace(rest[end+1:]))
+	defer f.state.leaveTemplate()
 
-	spec := includeSpec{Name: name, WithContext: true}
-	if strings.Contains(flags, "ignore missing") {
-		spec.IgnoreMissing = true
+	var incCtx map[string]any
+	var incVars map[string]any
+	if withContext {
+		incCtx = f.ctx
+		incVars = cloneMap(f.vars)
+	} else {
+		incCtx = map[string]any{}
+		incVars = map[string]any{}
 	}
-	if strings.Contains(flags, "without context") {
-		spec.WithContext = false
+	scope := mergeScope(incVars, incCtx)
+	if err := tpl.prog.Contract.ApplyDefaults(scope); err != nil {
+		return err
 	}
-	if strings.Contains(flags, "with context") {
-		spec.WithContext = true
+	incCtx, incVars = splitScope(scope, incCtx, incVars)
+	if err := tpl.prog.Contract.Validate(scope); err != nil {
+		return err
 	}
-	return spec, true
-}
-
-func (e *Env) applyIncludes(src string, ctx, vars map[string]any, macros map[string]MacroDef) (string, error) {
-	re := regexp.MustCompile(`\{%\s*include\s+[\s\S]*?%\}`)
-	out := src
-	for {
-		m := re.FindStringIndex(out)
-		if m == nil {
-			return out, nil
-		}
-		raw := out[m[0]:m[1]]
-		inner := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(raw, "{%"), "%}"))
-		spec, ok := parseIncludeSpec(inner)
-		if !ok {
-			return "", fmt.Errorf("invalid include statement: %s", raw)
-		}
-
-		rawIncludeSrc, err := e.readRawTemplate(spec.Name)
-		if err != nil {
-			if spec.IgnoreMissing {
-				out = out[:m[0]] + out[m[1]:]
-				continue
-			}
-			return "", err
-		}
-		includeSrc := stripComments(rawIncludeSrc)
-
-		var incCtx map[string]any
-		var incVars map[string]any
-		if spec.WithContext {
-			incCtx = ctx
-			incVars = cloneMap(vars)
-		} else {
-			incCtx = map[string]any{}
-			incVars = map[string]any{}
-		}
-		scope := mergeScope(incVars, incCtx)
-		if err := ApplyTemplateContractDefaults(rawIncludeSrc, scope); err != nil {
-			return "", err
-		}
-		incCtx, incVars = splitScope(scope, incCtx, incVars)
-		if err := ValidateTemplateContract(rawIncludeSrc, scope); err != nil {
-			return "", err
-		}
 
-		rendered, err := e.renderWithState(includeSrc, incCtx, incVars, cloneMacros(macros))
-		if err != nil {
-			return "", err
-		}
-		out = out[:m[0]] + rendered + out[m[1]:]
-	}
+	return e.renderTemplate(w, tpl.prog, &frame{state: f.state, ctx: incCtx, vars: incVars})
 }
 
 func mergeScope(vars, ctx map[string]any) map[string]any {
@@ -614,51 +590,6 @@ func splitScope(scope, ctx, vars map[string]any) (map[string]any, map[string]any
 	return nextCtx, nextVars
 }
 
-func extractRawBlocks(src string) (string, map[string]string, error) {
-	out := src
-	store := map[string]string{}
-	index := 0
-
-	handle := func(tag string) error {
-		openRe := regexp.MustCompile(`\{%\s*` + tag + `\s*%\}`)
-		closeRe := regexp.MustCompile(`\{%\s*end` + tag + `\s*%\}`)
-		for {
-			open := openRe.FindStringIndex(out)
-			if open == nil {
-				return nil
-			}
-			close := closeRe.FindStringIndex(out[open[1]:])
-			if close == nil {
-				return fmt.Errorf("missing end%s", tag)
-			}
-			bodyStart := open[1]
-			bodyEnd := open[1] + close[0]
-			closeEnd := open[1] + close[1]
-			key := fmt.Sprintf("@@NUNCHUCKS_RAW_%d@@", index)
-			index++
-			store[key] = out[bodyStart:bodyEnd]
-			out = out[:open[0]] + key + out[closeEnd:]
-		}
-	}
-
-	if err := handle("raw"); err != nil {
-		return "", nil, err
-	}
-	if err := handle("verbatim"); err != nil {
-		return "", nil, err
-	}
-
-	return out, store, nil
-}
-
-func restoreRawBlocks(src string, store map[string]string) string {
-	out := src
-	for k, v := range store {
-		out = strings.ReplaceAll(out, k, v)
-	}
-	return out
-}
-
 func parseMacroParams(s string) []MacroParam {
 	parts := splitArgs(strings.TrimSpace(s))
 	out := make([]MacroParam, 0, len(parts))
@@ -668,7 +599,7 @@ func parseMacroParams(s string) []MacroParam {
 			continue
 		}
 		if k, v, ok := splitTopLevelAssign(t); ok {
-			out = append(out, MacroParam{Name: k, Default: v, HasDefault: true})
+			out = append(out, MacroParam{Name: k, Default: v, HasDefault: true, def: compileExpr(v)})
 			continue
 		}
 		out = append(out, MacroParam{Name: t})
@@ -676,68 +607,19 @@ func parseMacroParams(s string) []MacroParam {
 	return out
 }
 
-func (e *Env) registerMacro(name string, def MacroDef, ctx, vars map[string]any, macros map[string]MacroDef) {
-	macros[name] = def
-	vars[name] = TemplateFunc(func(args []any, kwargs map[string]any, caller string) (any, error) {
-		localVars := cloneMap(vars)
-		for i, p := range def.Params {
-			if i < len(args) {
-				localVars[p.Name] = args[i]
-				continue
-			}
-			if v, ok := kwargs[p.Name]; ok {
-				localVars[p.Name] = v
-				continue
-			}
-			if p.HasDefault {
-				localVars[p.Name] = evalExpr(p.Default, localVars, ctx)
-			} else {
-				localVars[p.Name] = nil
-			}
-		}
-		localVars["caller"] = TemplateFunc(func(_ []any, _ map[string]any, _ string) (any, error) {
-			return caller, nil
-		})
-		return e.renderWithState(def.Body, ctx, localVars, cloneMacros(macros))
-	})
-}
-
-func (e *Env) applyMacroDefs(src string, ctx, vars map[string]any, macros map[string]MacroDef) (string, error) {
-	openRe := regexp.MustCompile(`\{%\s*macro\s+([A-Za-z_][A-Za-z0-9_]*)\s*\((.*?)\)\s*%\}`)
-	closeRe := regexp.MustCompile(`\{%\s*endmacro\s*%\}`)
-	out := src
-
-	for {
-		open := openRe.FindStringSubmatchIndex(out)
-		if open == nil {
-			return out, nil
-		}
-		close := closeRe.FindStringIndex(out[open[1]:])
-		if close == nil {
-			return "", fmt.Errorf("missing endmacro")
-		}
-
-		name := strings.TrimSpace(out[open[2]:open[3]])
-		argsRaw := strings.TrimSpace(out[open[4]:open[5]])
-		bodyStart := open[1]
-		bodyEnd := open[1] + close[0]
-		closeEnd := open[1] + close[1]
-
-		def := MacroDef{Params: parseMacroParams(argsRaw), Body: out[bodyStart:bodyEnd]}
-		e.registerMacro(name, def, ctx, vars, macros)
-		out = out[:open[0]] + out[closeEnd:]
-	}
-}
-
+// parseImportedNames parses the names of a from-import as name/alias
+// pairs. `*` imports every public name and is kept as the pair ("*", "*").
 func parseImportedNames(s string) [][2]string {
+	if strings.TrimSpace(s) == "*" {
+		return [][2]string{{"*", "*"}}
+	}
 	out := [][2]string{}
 	for _, p := range splitArgs(s) {
 		t := strings.TrimSpace(p)
 		if t == "" {
 			continue
 		}
-		re := regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)(?:\s+as\s+([A-Za-z_][A-Za-z0-9_]*))?$`)
-		m := re.FindStringSubmatch(t)
+		m := importedNameRe.FindStringSubmatch(t)
 		if m == nil {
 			continue
 		}
@@ -751,21 +633,19 @@ func parseImportedNames(s string) [][2]string {
 }
 
 func parseImportStmt(inner string) (file string, alias string, flags string, ok bool) {
-	re := regexp.MustCompile(`^import\s+(".*?"|'.*?')\s+as\s+([A-Za-z_][A-Za-z0-9_]*)([\s\S]*)$`)
-	m := re.FindStringSubmatch(strings.TrimSpace(inner))
+	m := importStmtRe.FindStringSubmatch(strings.TrimSpace(inner))
 	if m == nil {
 		return "", "", "", false
 	}
-	return unquote(strings.TrimSpace(m[1])), strings.TrimSpace(m[2]), strings.TrimSpace(m[3]), true
+	return strings.TrimSpace(m[1]), strings.TrimSpace(m[2]), strings.TrimSpace(m[3]), true
 }
 
 func parseFromImportStmt(inner string) (file string, imports string, flags string, ok bool) {
-	re := regexp.MustCompile(`^from\s+(".*?"|'.*?')\s+import\s+([\s\S]+?)(?:\s+(with\s+context|without\s+context))?$`)
-	m := re.FindStringSubmatch(strings.TrimSpace(inner))
+	m := fromImportStmtRe.FindStringSubmatch(strings.TrimSpace(inner))
 	if m == nil {
 		return "", "", "", false
 	}
-	return unquote(strings.TrimSpace(m[1])), strings.TrimSpace(m[2]), strings.TrimSpace(m[3]), true
+	return strings.TrimSpace(m[1]), strings.TrimSpace(m[2]), strings.TrimSpace(m[3]), true
 }
 
 func parseContextModeFlags(flags string, defaultWithContext bool) bool {
@@ -779,388 +659,3 @@ func parseContextModeFlags(flags string, defaultWithContext bool) bool {
 	}
 	return withContext
 }
-
-func (e *Env) loadMacrosFromTemplate(name string, ctx map[string]any, withContext bool) (map[string]any, map[string]MacroDef, error) {
-	importSrc, err := e.readTemplate(name)
-	if err != nil {
-		return nil, nil, err
-	}
-	resolved, err := e.resolveIncludes(importSrc, map[string]bool{name: true})
-	if err != nil {
-		return nil, nil, err
-	}
-	localMacros := map[string]MacroDef{}
-	namespace := map[string]any{}
-	macroCtx := map[string]any{}
-	if withContext {
-		macroCtx = ctx
-	}
-	_, err = e.applyMacroDefs(resolved, macroCtx, namespace, localMacros)
-	if err != nil {
-		return nil, nil, err
-	}
-	return namespace, localMacros, nil
-}
-
-func (e *Env) applyImports(src string, ctx, vars map[string]any, macros map[string]MacroDef) (string, error) {
-	importRe := regexp.MustCompile(`\{%\s*import\s+[\s\S]*?%\}`)
-	out := src
-
-	for {
-		m := importRe.FindStringSubmatchIndex(out)
-		if m == nil {
-			return out, nil
-		}
-		raw := out[m[0]:m[1]]
-		inner := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(raw, "{%"), "%}"))
-		name, alias, flags, ok := parseImportStmt(inner)
-		if !ok {
-			return "", fmt.Errorf("invalid import statement: %s", raw)
-		}
-		withContext := parseContextModeFlags(flags, false)
-
-		namespace, localMacros, err := e.loadMacrosFromTemplate(name, ctx, withContext)
-		if err != nil {
-			return "", err
-		}
-		vars[alias] = namespace
-
-		for k, v := range localMacros {
-			macros[alias+"."+k] = v
-		}
-
-		out = out[:m[0]] + out[m[1]:]
-	}
-}
-
-func (e *Env) applyFromImports(src string, ctx, vars map[string]any, macros map[string]MacroDef) (string, error) {
-	fromRe := regexp.MustCompile(`\{%\s*from\s+[\s\S]*?%\}`)
-	out := src
-	for {
-		m := fromRe.FindStringSubmatchIndex(out)
-		if m == nil {
-			return out, nil
-		}
-		raw := out[m[0]:m[1]]
-		inner := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(raw, "{%"), "%}"))
-		name, importSpec, flags, ok := parseFromImportStmt(inner)
-		if !ok {
-			return "", fmt.Errorf("invalid from-import statement: %s", raw)
-		}
-		withContext := parseContextModeFlags(flags, false)
-
-		namespace, localMacros, err := e.loadMacrosFromTemplate(name, ctx, withContext)
-		if err != nil {
-			return "", err
-		}
-		for _, pair := range parseImportedNames(importSpec) {
-			remote := pair[0]
-			local := pair[1]
-			if fn, ok := namespace[remote]; ok {
-				vars[local] = fn
-			}
-			if def, ok := localMacros[remote]; ok {
-				macros[local] = def
-			}
-		}
-		out = out[:m[0]] + out[m[1]:]
-	}
-}
-
-func applySets(src string, vars, ctx map[string]any) (string, error) {
-	setRe := regexp.MustCompile(`\{%\s*set\s+([\s\S]*?)%\}`)
-	out := src
-	for {
-		m := setRe.FindStringSubmatchIndex(out)
-		if m == nil {
-			return out, nil
-		}
-		body := strings.TrimSpace(out[m[2]:m[3]])
-		parts := splitArgs(body)
-		for _, part := range parts {
-			kv := strings.SplitN(part, "=", 2)
-			if len(kv) != 2 {
-				continue
-			}
-			k := strings.TrimSpace(kv[0])
-			v := evalExpr(strings.TrimSpace(kv[1]), vars, ctx)
-			vars[k] = v
-		}
-		out = out[:m[0]] + out[m[1]:]
-	}
-}
-
-func (e *Env) applyForLoops(src string, vars, ctx map[string]any, macros map[string]MacroDef) (string, error) {
-	forOpenRe := regexp.MustCompile(`\{%\s*for\s+([A-Za-z_][A-Za-z0-9_]*)\s+in\s+([\s\S]*?)%\}`)
-	endForRe := regexp.MustCompile(`\{%\s*endfor\s*%\}`)
-	out := src
-
-	for {
-		open := forOpenRe.FindStringSubmatchIndex(out)
-		if open == nil {
-			return out, nil
-		}
-
-		close := endForRe.FindStringIndex(out[open[1]:])
-		if close == nil {
-			return "", fmt.Errorf("missing endfor")
-		}
-		closeStart := open[1] + close[0]
-		closeEnd := open[1] + close[1]
-
-		varName := strings.TrimSpace(out[open[2]:open[3]])
-		expr := strings.TrimSpace(out[open[4]:open[5]])
-		body := out[open[1]:closeStart]
-
-		iter := evalExpr(expr, vars, ctx)
-		tmp := ""
-
-		renderItem := func(item any, idx int, length int) error {
-			nextVars := cloneMap(vars)
-			nextVars[varName] = item
-			nextVars["loop"] = map[string]any{
-				"index":     idx + 1,
-				"index0":    idx,
-				"revindex":  length - idx,
-				"revindex0": length - idx - 1,
-				"first":     idx == 0,
-				"last":      idx == length-1,
-				"length":    length,
-			}
-			chunk, err := e.renderWithState(body, ctx, nextVars, cloneMacros(macros))
-			if err != nil {
-				return err
-			}
-			tmp += chunk
-			return nil
-		}
-
-		switch vv := iter.(type) {
-		case []any:
-			for i, item := range vv {
-				if err := renderItem(item, i, len(vv)); err != nil {
-					return "", err
-				}
-			}
-		case map[string]any:
-			arr := make([]any, 0, len(vv))
-			for _, item := range vv {
-				arr = append(arr, item)
-			}
-			for i, item := range arr {
-				if err := renderItem(item, i, len(arr)); err != nil {
-					return "", err
-				}
-			}
-		case nil:
-			// no-op
-		default:
-			if err := renderItem(vv, 0, 1); err != nil {
-				return "", err
-			}
-		}
-
-		out = out[:open[0]] + tmp + out[closeEnd:]
-	}
-}
-
-func (e *Env) applyIfElse(src string, vars, ctx map[string]any, macros map[string]MacroDef) (string, error) {
-	ifOpenRe := regexp.MustCompile(`\{%\s*if\s+([\s\S]*?)%\}`)
-	elifRe := regexp.MustCompile(`\{%\s*elif\s+([\s\S]*?)%\}`)
-	elseRe := regexp.MustCompile(`\{%\s*else\s*%\}`)
-	endIfRe := regexp.MustCompile(`\{%\s*endif\s*%\}`)
-
-	out := src
-	for {
-		open := ifOpenRe.FindStringSubmatchIndex(out)
-		if open == nil {
-			return out, nil
-		}
-
-		cond := strings.TrimSpace(out[open[2]:open[3]])
-		rest := out[open[1]:]
-		endif := endIfRe.FindStringIndex(rest)
-		if endif == nil {
-			return "", fmt.Errorf("missing endif")
-		}
-
-		endAbsStart := open[1] + endif[0]
-		endAbsEnd := open[1] + endif[1]
-		middle := out[open[1]:endAbsStart]
-
-		type branch struct {
-			cond *string
-			body string
-		}
-		branches := []branch{}
-
-		cursor := 0
-		firstCuts := []struct {
-			idx  int
-			isE  bool
-			cond string
-		}{{idx: len(middle), isE: true, cond: ""}}
-		for _, m := range elifRe.FindAllStringSubmatchIndex(middle, -1) {
-			firstCuts = append(firstCuts, struct {
-				idx  int
-				isE  bool
-				cond string
-			}{idx: m[0], isE: false, cond: strings.TrimSpace(middle[m[2]:m[3]])})
-		}
-		if m := elseRe.FindStringIndex(middle); m != nil {
-			firstCuts = append(firstCuts, struct {
-				idx  int
-				isE  bool
-				cond string
-			}{idx: m[0], isE: true, cond: ""})
-		}
-
-		minIdx := len(middle)
-		for _, c := range firstCuts {
-			if c.idx < minIdx {
-				minIdx = c.idx
-			}
-		}
-		firstBody := middle[cursor:minIdx]
-		c := cond
-		branches = append(branches, branch{cond: &c, body: firstBody})
-
-		segments := []struct {
-			kind  string
-			cond  string
-			start int
-			end   int
-		}{}
-
-		for _, m := range elifRe.FindAllStringSubmatchIndex(middle, -1) {
-			segments = append(segments, struct {
-				kind  string
-				cond  string
-				start int
-				end   int
-			}{kind: "elif", cond: strings.TrimSpace(middle[m[2]:m[3]]), start: m[0], end: m[1]})
-		}
-		if m := elseRe.FindStringIndex(middle); m != nil {
-			segments = append(segments, struct {
-				kind  string
-				cond  string
-				start int
-				end   int
-			}{kind: "else", cond: "", start: m[0], end: m[1]})
-		}
-
-		for i := 0; i < len(segments); i++ {
-			start := segments[i].end
-			end := len(middle)
-			for j := 0; j < len(segments); j++ {
-				if segments[j].start > segments[i].start && segments[j].start < end {
-					end = segments[j].start
-				}
-			}
-			if segments[i].kind == "elif" {
-				cc := segments[i].cond
-				branches = append(branches, branch{cond: &cc, body: middle[start:end]})
-			} else {
-				branches = append(branches, branch{cond: nil, body: middle[start:end]})
-			}
-		}
-
-		chosen := ""
-		for _, b := range branches {
-			if b.cond == nil {
-				chosen = b.body
-				break
-			}
-			if evalCond(*b.cond, vars, ctx) {
-				chosen = b.body
-				break
-			}
-		}
-
-		chosenOut, err := e.renderWithState(chosen, ctx, cloneMap(vars), cloneMacros(macros))
-		if err != nil {
-			return "", err
-		}
-
-		out = out[:open[0]] + chosenOut + out[endAbsEnd:]
-	}
-}
-
-func (e *Env) applyFilterBlocks(src string, vars, ctx map[string]any, macros map[string]MacroDef) (string, error) {
-	openRe := regexp.MustCompile(`\{%\s*filter\s+([\s\S]*?)%\}`)
-	closeRe := regexp.MustCompile(`\{%\s*endfilter\s*%\}`)
-	out := src
-
-	for {
-		open := openRe.FindStringSubmatchIndex(out)
-		if open == nil {
-			return out, nil
-		}
-		close := closeRe.FindStringIndex(out[open[1]:])
-		if close == nil {
-			return "", fmt.Errorf("missing endfilter")
-		}
-
-		filterExpr := strings.TrimSpace(out[open[2]:open[3]])
-		bodyStart := open[1]
-		bodyEnd := open[1] + close[0]
-		closeEnd := open[1] + close[1]
-		body := out[bodyStart:bodyEnd]
-
-		rendered, err := e.renderWithState(body, ctx, cloneMap(vars), cloneMacros(macros))
-		if err != nil {
-			return "", err
-		}
-
-		filtered := any(rendered)
-		for _, part := range strings.Split(filterExpr, "|") {
-			name, argExprs := parseFilterSpec(strings.TrimSpace(part))
-			args := make([]any, 0, len(argExprs))
-			for _, expr := range argExprs {
-				args = append(args, evalExpr(expr, vars, ctx))
-			}
-			filtered = applyFilter(name, filtered, args)
-		}
-
-		out = out[:open[0]] + fmt.Sprint(filtered) + out[closeEnd:]
-	}
-}
-
-func (e *Env) applyCallBlocks(src string, vars, ctx map[string]any, macros map[string]MacroDef) (string, error) {
-	openRe := regexp.MustCompile(`\{%\s*call\s+([\s\S]*?)%\}`)
-	closeRe := regexp.MustCompile(`\{%\s*endcall\s*%\}`)
-	out := src
-
-	for {
-		open := openRe.FindStringSubmatchIndex(out)
-		if open == nil {
-			return out, nil
-		}
-		close := closeRe.FindStringIndex(out[open[1]:])
-		if close == nil {
-			return "", fmt.Errorf("missing endcall")
-		}
-
-		callExpr := strings.TrimSpace(out[open[2]:open[3]])
-		bodyStart := open[1]
-		bodyEnd := open[1] + close[0]
-		closeEnd := open[1] + close[1]
-		body := out[bodyStart:bodyEnd]
-
-		name, args, ok := parseCallableExpr(callExpr)
-		if !ok {
-			return "", fmt.Errorf("invalid call expression: %s", callExpr)
-		}
-
-		callerBody, err := e.renderWithState(body, ctx, cloneMap(vars), cloneMacros(macros))
-		if err != nil {
-			return "", err
-		}
-		called, err := invokeCallable(name, args, callerBody, vars, ctx)
-		if err != nil {
-			return "", err
-		}
-
-		out = out[:open[0]] + fmt.Sprint(called) + out[closeEnd:]
-	}
-}
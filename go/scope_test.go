@@ -0,0 +1,74 @@
+package nunchucks
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSetBlocksNamespacesAndWith(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	ctx := map[string]any{"pair": []any{"k", "v"}, "name": "sam", "nums": []any{1, 2, 3, 4, 5}, "a": 1, "b": 1}
+
+	cases := map[string]string{
+		`{% set same = a == b %}{{ same }}`:                                    "true",
+		`{% set x, y = pair %}{{ x }}-{{ y }}`:                                 "k-v",
+		`{% set x, y = 1, 2 %}{{ y }}{{ x }}`:                                  "21",
+		`{% set t = 1, "two" %}{{ t | length }}{{ t[1] }}`:                     "2two",
+		`{% set body %}<b>{{ name }}</b>{% endset %}[{{ body }}]`:              "[<b>sam</b>]",
+		`{% set x | trim | upper %}  hi {{ name }}  {% endset %}[{{ x }}]`:     "[HI SAM]",
+		`{% set x = 1 %}{% for i in nums %}{% set x = i %}{% endfor %}{{ x }}`: "1",
+		`{% set ns = namespace(found=false, count=0) %}{% for i in nums %}{% if i > 2 %}{% set ns.found = true %}{% set ns.count = ns.count + 1 %}{% endif %}{% endfor %}{{ ns.found }} {{ ns.count }}`: "true 3",
+		`{% set ns = namespace({"last": "none"}) %}{% for i in nums %}{% set ns.last, y = i, 0 %}{% endfor %}{{ ns.last }}`:                                                                             "5",
+		`{% with p = 1, q = p + 1 %}{{ p }}{{ q }}{% set r = 3 %}{% endwith %}[{{ p }}{{ r }}]`:                                                                                                         "12[]",
+		`{% for i in nums %}{% with d = i * 2 %}{% if d > 4 %}{% break %}{% endif %}{{ d }}{% endwith %}{% endfor %}`:                                                                                   "24",
+	}
+	for src, want := range cases {
+		out, err := env.RenderString(src, ctx)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", src, err)
+		}
+		if out != want {
+			t.Fatalf("%s: want %q, got %q", src, want, out)
+		}
+	}
+
+	for src, want := range map[string]string{
+		`{% set user.name = 1 %}`:    `cannot set user.name: "user" is not a namespace`,
+		`{% set x, y = [1] %}`:       "cannot unpack 1 values into 2 names",
+		`{% set x, y %}{% endset %}`: "invalid set statement",
+		`{% set x = %}`:              "invalid set statement",
+		`{% set x %}unclosed`:        "missing endset",
+		`{% with x %}{% endwith %}`:  "expected name = value",
+		`{% for i in nums %}{% set c %}{% break %}{% endset %}{% endfor %}`: "break is not allowed inside a set block",
+	} {
+		_, err := env.RenderString(src, ctx)
+		var te *TemplateError
+		if !errors.As(err, &te) || !strings.Contains(err.Error(), want) {
+			t.Fatalf("%s: expected TemplateError containing %q, got %v", src, want, err)
+		}
+	}
+}
+
+func TestSetBlockCaptureIsNotEscapedTwice(t *testing.T) {
+	files := map[string]string{
+		"base.njk": `<main>{% block body %}{% endblock %}</main>`,
+		"page.njk": `{% extends "base.njk" %}{% set title %}<i>{{ v }}</i>{% endset %}{% block body %}{{ title }}{% endblock %}`,
+	}
+	env := Configure(ConfigOptions{Loader: &testLoader{files: files}})
+	out, err := env.Render("page.njk", map[string]any{"v": "<x>"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "<main><i>&lt;x&gt;</i></main>" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+
+	compiled, err := env.Compile("page.njk")
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	if !strings.Contains(compiled, `{% set title %}<i>{{ v }}</i>{% endset %}`) {
+		t.Fatalf("expected compiled template to keep the block set, got %q", compiled)
+	}
+}
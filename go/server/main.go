@@ -1,14 +1,29 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	nunchucks "github.com/SamuelDBines/nunjucks/go"
 )
 
+// playgroundLimits bounds every render of a request, since the files come
+// straight from the browser.
+var playgroundLimits = nunchucks.Limits{
+	MaxLoopIterations: 100000,
+	MaxDepth:          64,
+	MaxOutputBytes:    1 << 20,
+	MaxRenderTime:     2 * time.Second,
+}
+
+// playgroundTimeout bounds a whole request, which renders every file.
+const playgroundTimeout = 5 * time.Second
+
 type playgroundRenderRequest struct {
 	Template string            `json:"template"`
 	Files    map[string]string `json:"files"`
@@ -16,9 +31,10 @@ type playgroundRenderRequest struct {
 }
 
 type playgroundRenderResponse struct {
-	OK      bool              `json:"ok"`
-	Outputs map[string]string `json:"outputs,omitempty"`
-	Error   string            `json:"error,omitempty"`
+	OK      bool                                `json:"ok"`
+	Outputs map[string]string                   `json:"outputs,omitempty"`
+	Errors  map[string]*nunchucks.TemplateError `json:"errors,omitempty"`
+	Error   string                              `json:"error,omitempty"`
 }
 
 func writeJSON(w http.ResponseWriter, status int, body any) {
@@ -61,14 +77,24 @@ func renderPlayground(w http.ResponseWriter, r *http.Request) {
 		req.Template = "app.njk"
 	}
 
-	env := nunchucks.Configure(nunchucks.ConfigOptions{Loader: nunchucks.MemoryLoader(req.Files)})
+	env := nunchucks.Configure(nunchucks.ConfigOptions{
+		Loader: nunchucks.MemoryLoader(req.Files),
+		Limits: playgroundLimits,
+	})
+	ctx, cancel := context.WithTimeout(r.Context(), playgroundTimeout)
+	defer cancel()
 
 	outputs := map[string]string{}
+	renderErrors := map[string]*nunchucks.TemplateError{}
 	for name, content := range req.Files {
 		if strings.HasSuffix(strings.ToLower(name), ".njk") {
-			out, err := env.Render(name, req.Context)
+			out, err := env.RenderContext(ctx, name, req.Context)
 			if err != nil {
 				outputs[name] = "[render error] " + err.Error()
+				var te *nunchucks.TemplateError
+				if errors.As(err, &te) {
+					renderErrors[name] = te
+				}
 				continue
 			}
 			outputs[name] = out
@@ -78,12 +104,16 @@ func renderPlayground(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if _, ok := outputs[req.Template]; !ok {
-		if out, err := env.Render(req.Template, req.Context); err == nil {
+		if out, err := env.RenderContext(ctx, req.Template, req.Context); err == nil {
 			outputs[req.Template] = out
 		}
 	}
 
-	writeJSON(w, http.StatusOK, playgroundRenderResponse{OK: true, Outputs: outputs})
+	resp := playgroundRenderResponse{OK: true, Outputs: outputs}
+	if len(renderErrors) > 0 {
+		resp.Errors = renderErrors
+	}
+	writeJSON(w, http.StatusOK, resp)
 }
 
 func main() {
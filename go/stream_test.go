@@ -0,0 +1,84 @@
+package nunchucks
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRenderToMatchesRender(t *testing.T) {
+	files := map[string]string{
+		"base.njk": "<html><head></head><body>{% block body %}{% endblock %}</body></html>",
+		"page.njk": `{% extends "base.njk" %}{% block body %}{% for u in users %}<p>{{ u.name }}</p>{% include "row.njk" %}{% endfor %}{% endblock %}`,
+		"row.njk":  "<hr>",
+		"head.njk": "<meta name=x>",
+	}
+	ctx := map[string]any{"users": []any{map[string]any{"name": "a"}, map[string]any{"name": "<b>"}}}
+	for _, opts := range []ConfigOptions{
+		{Loader: &testLoader{files: files}},
+		{Loader: &testLoader{files: files}, GlobalHeadTemplates: []string{"head.njk"}},
+	} {
+		env := Configure(opts)
+		want, err := env.Render("page.njk", ctx)
+		if err != nil {
+			t.Fatalf("render: %v", err)
+		}
+		var b strings.Builder
+		if err := env.RenderTo(&b, "page.njk", ctx); err != nil {
+			t.Fatalf("render to: %v", err)
+		}
+		if b.String() != want {
+			t.Fatalf("streamed output differs\nwant: %s\n got: %s", want, b.String())
+		}
+	}
+}
+
+type failingWriter struct{ err error }
+
+func (w failingWriter) Write([]byte) (int, error) { return 0, w.err }
+
+func TestExecuteReportsWriteErrors(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{"page.njk": "hello"}}})
+	tpl, err := env.GetTemplate("page.njk")
+	if err != nil {
+		t.Fatalf("get template: %v", err)
+	}
+	broken := errors.New("broken pipe")
+	if err := tpl.Execute(failingWriter{broken}, nil); !errors.Is(err, broken) {
+		t.Fatalf("expected write error, got %v", err)
+	}
+}
+
+func benchmarkEnv() (*Env, map[string]any) {
+	files := map[string]string{
+		"export.njk": "id,name,email\n{% for r in rows %}{{ r.id }},{{ r.name }},{{ r.email }}\n{% endfor %}",
+	}
+	rows := make([]any, 20000)
+	for i := range rows {
+		rows[i] = map[string]any{"id": i, "name": "user", "email": "user@example.com"}
+	}
+	return Configure(ConfigOptions{Loader: &testLoader{files: files}}), map[string]any{"rows": rows}
+}
+
+func BenchmarkRenderString(b *testing.B) {
+	env, ctx := benchmarkEnv()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		out, err := env.Render("export.njk", ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.WriteString(io.Discard, out)
+	}
+}
+
+func BenchmarkRenderTo(b *testing.B) {
+	env, ctx := benchmarkEnv()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := env.RenderTo(io.Discard, "export.njk", ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
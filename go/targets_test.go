@@ -0,0 +1,85 @@
+package nunchucks
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDynamicTemplateTargets(t *testing.T) {
+	files := map[string]string{
+		"base.njk":        `<main>{% block body %}{% endblock %}</main>`,
+		"print.njk":       `<pre>{% block body %}{% endblock %}</pre>`,
+		"cards/post.njk":  `[post {{ card.title }}]`,
+		"cards/video.njk": `[video {{ card.title }}]`,
+		"cards/card.njk":  `[card]`,
+		"macros.njk":      `{% macro hi(n) %}hi {{ n }}{% endmacro %}`,
+		"page.njk": `{% extends layout %}{% block body %}` +
+			`{% for card in cards %}{% include ["cards/" ~ card.type ~ ".njk", "cards/card.njk"] %}{% endfor %}` +
+			`{% include ["nope.njk", "gone.njk"] ignore missing %}` +
+			`{% import lib as m %}{% from lib import hi %}{{ m.hi(1) }} {{ hi(2) }}{% endblock %}`,
+		"maybe.njk": `{% if print %}{% extends "print.njk" %}{% endif %}{% block body %}body{% endblock %}`,
+	}
+	env := Configure(ConfigOptions{Loader: &testLoader{files: files}})
+	ctx := map[string]any{
+		"layout": "base.njk",
+		"lib":    "macros.njk",
+		"cards": []any{
+			map[string]any{"type": "post", "title": "A"},
+			map[string]any{"type": "video", "title": "B"},
+			map[string]any{"type": "poll", "title": "C"},
+		},
+	}
+	out, err := env.Render("page.njk", ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "<main>[post A][video B][card]hi 1 hi 2</main>"; out != want {
+		t.Fatalf("unexpected output\nwant: %q\n got: %q", want, out)
+	}
+
+	ctx["layout"] = []any{"missing.njk", "print.njk"}
+	out, err = env.Render("page.njk", ctx)
+	if err != nil || !strings.HasPrefix(out, "<pre>") {
+		t.Fatalf("expected the first existing layout, got %q, %v", out, err)
+	}
+	tpl, err := env.GetTemplate("base.njk")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx["layout"] = tpl
+	if out, err = env.Render("page.njk", ctx); err != nil || !strings.HasPrefix(out, "<main>") {
+		t.Fatalf("expected a Template to be extended, got %q, %v", out, err)
+	}
+
+	for print, want := range map[bool]string{false: "body", true: "<pre>body</pre>"} {
+		out, err := env.Render("maybe.njk", map[string]any{"print": print})
+		if err != nil || out != want {
+			t.Fatalf("print=%v: got %q, %v", print, out, err)
+		}
+	}
+}
+
+func TestDynamicTemplateTargetErrors(t *testing.T) {
+	files := map[string]string{
+		"page.njk":   "x\n{% include partial %}",
+		"layout.njk": "{% extends [\"a.njk\", \"b.njk\"] %}",
+		"number.njk": "{% import 3 as m %}",
+	}
+	env := Configure(ConfigOptions{Loader: &testLoader{files: files}})
+	cases := map[string]string{
+		"page.njk":   `template name: "partial" is undefined`,
+		"layout.njk": `none of the templates ["a.njk" "b.njk"] exist`,
+		"number.njk": "template name must be a string or a list of strings, got int",
+	}
+	for name, want := range cases {
+		_, err := env.Render(name, nil)
+		var te *TemplateError
+		if !errors.As(err, &te) {
+			t.Fatalf("%s: expected TemplateError, got %v", name, err)
+		}
+		if te.Template != name || te.Err.Error() != want {
+			t.Fatalf("%s: unexpected error: %s", name, te.Detail())
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package nunchucks
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Template is a compiled template bound to the Env that loaded it. It keeps
+// the program and contract so rendering does not re-read or re-parse the
+// source, and it is safe to render from several goroutines at once.
+type Template struct {
+	env     *Env
+	name    string
+	prog    *program
+	modTime time.Time
+}
+
+// templateCache holds the compiled templates of one Env.
+type templateCache struct {
+	mu        sync.RWMutex
+	templates map[string]*Template
+}
+
+// loaderError reports that the loader could not read a template.
+type loaderError struct {
+	msg string
+}
+
+func (e *loaderError) Error() string { return e.msg }
+
+// Name returns the name the template was loaded with.
+func (t *Template) Name() string { return t.name }
+
+// Render renders the template with the provided context.
+func (t *Template) Render(ctx map[string]any) (string, error) {
+	var b strings.Builder
+	if err := t.env.execute(context.Background(), &b, t.name, t.prog, "", ctx); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Execute renders the template with the provided context, streaming the
+// output to w as it is produced. Output is buffered internally and flushed
+// before Execute returns; on error, w may hold a partial render.
+func (t *Template) Execute(w io.Writer, ctx map[string]any) error {
+	return t.ExecuteContext(context.Background(), w, ctx)
+}
+
+// ExecuteContext is Execute with a context that stops the render once it
+// is cancelled or its deadline passes.
+func (t *Template) ExecuteContext(ctx context.Context, w io.Writer, data map[string]any) error {
+	bw := bufio.NewWriter(w)
+	if err := t.env.execute(ctx, bw, t.name, t.prog, "", data); err != nil {
+		bw.Flush()
+		return err
+	}
+	return bw.Flush()
+}
+
+// GetTemplate returns the compiled template for name, loading and parsing
+// it on first use. Templates from a ModTimeLoader are reloaded when their
+// modification time changes; other loaders rely on Invalidate.
+func (e *Env) GetTemplate(name string) (*Template, error) {
+	var modTime time.Time
+	mtl, tracksTime := e.loader.(ModTimeLoader)
+	if tracksTime {
+		if t, err := mtl.ModTime(name); err == nil {
+			modTime = t
+		}
+	}
+
+	e.cache.mu.RLock()
+	cached, ok := e.cache.templates[name]
+	e.cache.mu.RUnlock()
+	if ok && (!tracksTime || cached.modTime.Equal(modTime)) {
+		return cached, nil
+	}
+
+	t, err := e.newTemplate(name, modTime)
+	if err != nil {
+		return nil, err
+	}
+	e.storeTemplate(t)
+	return t, nil
+}
+
+func (e *Env) storeTemplate(t *Template) {
+	e.cache.mu.Lock()
+	if e.cache.templates == nil {
+		e.cache.templates = map[string]*Template{}
+	}
+	e.cache.templates[t.name] = t
+	e.cache.mu.Unlock()
+}
+
+// Invalidate drops name from the template cache so the next lookup reads it
+// from the loader again. Templates that extend, include or import name are
+// unaffected because they resolve it by name at render time.
+func (e *Env) Invalidate(name string) {
+	e.cache.mu.Lock()
+	delete(e.cache.templates, name)
+	e.cache.mu.Unlock()
+}
+
+// resolveTemplate loads the template an extends, include or import target
+// names: a name, a Template, or a list of names of which the first that
+// exists is loaded.
+func (e *Env) resolveTemplate(target any) (*Template, error) {
+	switch t := target.(type) {
+	case string:
+		return e.GetTemplate(t)
+	case SafeString:
+		return e.GetTemplate(string(t))
+	case *Template:
+		return t, nil
+	case missingValue:
+		return nil, fmt.Errorf("template name: %w", undefinedError(t))
+	}
+	if !isSequence(target) {
+		return nil, fmt.Errorf("template name must be a string or a list of strings, got %T", target)
+	}
+	names := []string{}
+	for _, item := range toSlice(target) {
+		name, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("template name must be a string, got %T", item)
+		}
+		tpl, err := e.GetTemplate(name)
+		var missing *loaderError
+		if !errors.As(err, &missing) {
+			return tpl, err
+		}
+		names = append(names, name)
+	}
+	return nil, &loaderError{msg: fmt.Sprintf("none of the templates %q exist", names)}
+}
+
+func (e *Env) newTemplate(name string, modTime time.Time) (*Template, error) {
+	res := e.loader.Read(name)
+	if res.Err != "" {
+		return nil, &loaderError{msg: res.Err}
+	}
+	tpl, err := parseTemplate(name, res.Res, e.delimiters(), e.extensions)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := compileProgram(tpl, e.autoescapeFor(name), e.contextualEscape)
+	if err != nil {
+		return nil, asTemplateError(name, err)
+	}
+	return &Template{env: e, name: name, prog: prog, modTime: modTime}, nil
+}
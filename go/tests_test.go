@@ -0,0 +1,98 @@
+package nunchucks
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestJinjaTestParity ports cases from Jinja's test_tests.py. Python's
+// True and False render as true and false.
+func TestJinjaTestParity(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	env.AddFilter("shout", func(_ *Context, v any, _ []any, _ map[string]any) (any, error) {
+		return strings.ToUpper(outputText(v)) + "!", nil
+	})
+	ctx := map[string]any{
+		"foo":  false,
+		"safe": SafeString("foo"),
+		"user": map[string]any{"name": "foo", "profile": nil},
+		"nums": []any{1, 2, 3, 4, 5},
+		"users": []any{
+			map[string]any{"name": "foo", "age": 30, "profile": map[string]any{"name": "f"}},
+			map[string]any{"name": "bar", "age": 41},
+			map[string]any{"name": "baz", "age": 25},
+		},
+	}
+	cases := []struct{ src, want string }{
+		{`{{ none is none }}|{{ false is none }}|{{ 42 is none }}|{{ missing is none }}|{{ None is none }}`, "true|false|false|false|true"},
+		{`{{ true is true }}|{{ True is true }}|{{ 1 is true }}|{{ false is false }}|{{ 0 is false }}|{{ none is false }}`, "true|true|false|true|false|false"},
+		{`{{ false is boolean }}|{{ 0 is boolean }}|{{ none is boolean }}`, "true|false|false"},
+		{`{{ 42 is integer }}|{{ 3.14159 is integer }}|{{ false is integer }}|{{ none is integer }}`, "true|false|false|false"},
+		{`{{ 4.2 is float }}|{{ 42 is float }}|{{ none is float }}`, "true|false|false"},
+		{`{{ 42 is number }}|{{ 3.14 is number }}|{{ "42" is number }}|{{ none is number }}`, "true|true|false|false"},
+		{`{{ "foo" is string }}|{{ safe is string }}|{{ 42 is string }}|{{ none is string }}`, "true|true|false|false"},
+		{`{{ "foo" is sequence }}|{{ [] is sequence }}|{{ {} is sequence }}|{{ 42 is sequence }}|{{ none is sequence }}`, "true|true|true|false|false"},
+		{`{{ {} is mapping }}|{{ [] is mapping }}|{{ "foo" is mapping }}|{{ none is mapping }}`, "true|false|false|false"},
+		{`{{ [] is iterable }}|{{ {} is iterable }}|{{ 42 is iterable }}|{{ none is iterable }}`, "true|true|false|false"},
+		{`{{ range is callable }}|{{ 42 is callable }}`, "true|false"},
+		{`{{ "foo" is escaped }}|{{ safe is escaped }}|{{ "<b>"|safe is escaped }}`, "false|true|true"},
+		{`{{ 1 is odd }}|{{ 2 is odd }}|{{ 1 is even }}|{{ 2 is even }}`, "true|false|false|true"},
+		{`{{ 9 is divisibleby 3 }}|{{ 10 is divisibleby(3) }}|{{ 10 is divisibleby(num=5) }}`, "true|false|true"},
+		{`{{ "foo" is lower }}|{{ "FOO" is lower }}|{{ "123" is lower }}|{{ "FOO" is upper }}|{{ "Foo" is upper }}|{{ "1A" is upper }}`, "true|false|false|true|false|true"},
+		{`{{ missing is defined }}|{{ true is defined }}|{{ missing is undefined }}|{{ true is undefined }}`, "false|true|true|false"},
+		{`{{ user.name is defined }}|{{ user.profile is defined }}|{{ user.profile.name is defined }}|{{ user.nope.name is undefined }}|{{ users[5].name is defined }}`, "true|true|false|true|false"},
+		{`{{ 2 is eq 2 }}|{{ 2 is eq 3 }}|{{ 2 is ne 3 }}|{{ 2 is ne 2 }}|{{ 2 is lt 3 }}|{{ 2 is lt 2 }}`, "true|false|true|false|true|false"},
+		{`{{ 2 is le 2 }}|{{ 2 is le 1 }}|{{ 2 is gt 1 }}|{{ 2 is gt 2 }}|{{ 2 is ge 2 }}|{{ 2 is ge 3 }}`, "true|false|true|false|true|false"},
+		{`{{ 1 is greaterthan 0 }}|{{ 0 is greaterthan 1 }}|{{ 0 is lessthan 1 }}|{{ 1 is lessthan 0 }}|{{ "a" is equalto "a" }}|{{ 2 is not eq(3) }}`, "true|false|true|false|true|true"},
+		{`{{ foo is sameas false }}|{{ 0 is sameas false }}|{{ none is sameas none }}|{{ nums is sameas nums }}|{{ [1] is sameas [1] }}`, "true|false|true|true|false"},
+		{`{{ "o" is in "foo" }}|{{ "foo" is in "foo" }}|{{ "b" is in "foo" }}|{{ 1 is in ((1, 2)) }}|{{ 3 is in ((1, 2)) }}`, "true|true|false|true|false"},
+		{`{{ 1 is in [1, 2] }}|{{ 3 is in [1, 2] }}|{{ "foo" is in {"foo": 1} }}|{{ "baz" is in {"bar": 1} }}|{{ 3 is not in [1, 2] }}`, "true|false|true|false|true"},
+		{`{{ "trim" is filter }}|{{ "shout" is filter }}|{{ "nope" is filter }}|{{ "defined" is test }}|{{ "greaterthan" is test }}|{{ "nope" is test }}`, "true|true|false|true|true|false"},
+		{`{% if "shout" is filter %}{{ "hi"|shout }}{% endif %}`, "HI!"},
+		{`{{ 1 is truthy }}|{{ "" is truthy }}|{{ 0 is falsy }}|{{ [1] is falsy }}`, "true|false|true|false"},
+		{`{{ nums|select("greaterthan", 3)|join(",") }}|{{ nums|select(">", 3)|join(",") }}|{{ nums|reject("in", [2, 3])|join(",") }}`, "4,5|4,5|1,4,5"},
+		{`{{ nums|select("divisibleby", num=2)|join(",") }}|{{ nums|reject("lt", 3)|join(",") }}|{{ nums|select("==", 2)|join(",") }}`, "2,4|3,4,5|2"},
+		{`{{ users|selectattr("age", "ge", 30)|map(attribute="name")|join(",") }}|{{ users|rejectattr("name", "eq", "foo")|map(attribute="name")|join(",") }}`, "foo,bar|bar,baz"},
+		{`{{ users|selectattr("profile.name", "defined")|map(attribute="name")|join(",") }}|{{ users|selectattr("name", "in", ["bar", "baz"])|length }}`, "foo|2"},
+	}
+	for _, c := range cases {
+		out, err := env.RenderString(c.src, ctx)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.src, err)
+		}
+		if out != c.want {
+			t.Fatalf("%s:\nwant %q\n got %q", c.src, c.want, out)
+		}
+	}
+
+	for src, want := range map[string]string{
+		`{{ 2 is f }}`:                              `no test named "f"`,
+		`{{ 2 is eq }}`:                             `test "eq" requires an argument`,
+		`{{ 2 is gt(1, 2) }}`:                       `test "gt" takes at most 1 arguments, got 2`,
+		`{{ nums|select("odd", x=1) }}`:             `filter "select": test "odd" got an unexpected keyword argument "x"`,
+		`{{ nums|select(2, x=1) }}`:                 `filter "select": got an unexpected keyword argument "x"`,
+		`{{ nums|select("in")|first }}`:             `filter "select": test "in" requires an argument`,
+		`{{ users|selectattr("age", "lessthan") }}`: `filter "selectattr": test "lessthan" requires an argument`,
+	} {
+		_, err := env.RenderString(src, ctx)
+		var te *TemplateError
+		if !errors.As(err, &te) || te.Err.Error() != want {
+			t.Fatalf("%s: expected TemplateError %q, got %v", src, want, err)
+		}
+	}
+}
+
+func TestBuiltinFilterNamesAreFilters(t *testing.T) {
+	s := &evalScope{}
+	for name := range builtinFilterNames {
+		if _, err := applyFilter(s, name, "x", nil, nil); err != nil && strings.Contains(err.Error(), "no filter named") {
+			t.Fatalf("builtinFilterNames lists %q, which is not a filter", name)
+		}
+	}
+	for _, name := range []string{"nosuchfilter", "lowercase"} {
+		if s.isFilter(name) {
+			t.Fatalf("%q should not be a filter", name)
+		}
+	}
+}
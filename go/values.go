@@ -0,0 +1,697 @@
+package nunchucks
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// OrderedMap is a mapping that remembers the order of its keys, such as an
+// object decoded from JSON with its key order kept. Templates read it like
+// a map; with ConfigOptions.PreserveMapOrder loops visit it in Keys order
+// rather than sorted by key.
+type OrderedMap interface {
+	Keys() []string
+	Get(key string) (any, bool)
+}
+
+// namespace is what the namespace() global returns: an object whose
+// attributes `{% set ns.attr = value %}` can update from inside loops and
+// other scopes.
+type namespace struct {
+	attrs map[string]any
+}
+
+// getAttr looks up name on v: a map key, an exported struct field (by Go
+// name or json tag) or a method. Pointers and interfaces are followed.
+// Methods are returned as Go func values, callable from templates.
+func getAttr(v any, name string) (any, bool) {
+	switch m := v.(type) {
+	case map[string]any:
+		out, ok := m[name]
+		return out, ok
+	case OrderedMap:
+		return m.Get(name)
+	case *loopContext:
+		return m.attr(name)
+	case *namespace:
+		out, ok := m.attrs[name]
+		return out, ok
+	}
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return nil, false
+	}
+	if method := methodByName(rv, name); method.IsValid() {
+		return method.Interface(), true
+	}
+	rv = indirect(rv)
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		mv := rv.MapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()))
+		if !mv.IsValid() {
+			return nil, false
+		}
+		return mv.Interface(), true
+	case reflect.Struct:
+		index, ok := structFields(rv.Type())[name]
+		if !ok {
+			return nil, false
+		}
+		fv, err := rv.FieldByIndexErr(index)
+		if err != nil {
+			// A nil embedded pointer hides its promoted fields.
+			return nil, false
+		}
+		return fv.Interface(), true
+	}
+	return nil, false
+}
+
+// getItem looks up key in v, as target[key] does: an element of a
+// sequence or string by integer index (negative indices count from the
+// end), a map entry, or a struct field or method named by a string key.
+func getItem(v any, key any) (any, bool) {
+	key = plainString(key)
+	switch m := v.(type) {
+	case map[string]any:
+		name, ok := key.(string)
+		if !ok {
+			return nil, false
+		}
+		out, ok := m[name]
+		return out, ok
+	case OrderedMap:
+		name, ok := key.(string)
+		if !ok {
+			return nil, false
+		}
+		return m.Get(name)
+	}
+	rv := indirect(reflect.ValueOf(v))
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		if i, ok := seqIndex(key, rv.Len()); ok {
+			return rv.Index(i).Interface(), true
+		}
+		return nil, false
+	case reflect.String:
+		runes := []rune(rv.String())
+		if i, ok := seqIndex(key, len(runes)); ok {
+			return string(runes[i]), true
+		}
+		return nil, false
+	case reflect.Map:
+		kv, err := convertArg(key, rv.Type().Key())
+		if err != nil {
+			return nil, false
+		}
+		mv := rv.MapIndex(kv)
+		if !mv.IsValid() {
+			return nil, false
+		}
+		return mv.Interface(), true
+	}
+	if name, ok := key.(string); ok {
+		return getAttr(v, name)
+	}
+	return nil, false
+}
+
+// intValue returns v as an int when it is an integer or a whole float.
+func intValue(v any) (int, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		if f == math.Trunc(f) {
+			return int(f), true
+		}
+	}
+	return 0, false
+}
+
+// seqIndex resolves a possibly negative index into a sequence of length n.
+func seqIndex(key any, n int) (int, bool) {
+	i, ok := intValue(key)
+	if !ok {
+		return 0, false
+	}
+	if i < 0 {
+		i += n
+	}
+	return i, i >= 0 && i < n
+}
+
+// sliceValue is v[start:stop:step] with Python semantics: bounds may be
+// negative or out of range and nil bounds take their defaults. Lists give
+// []any and strings give strings.
+func sliceValue(v, start, stop, step any) (any, error) {
+	if v == nil || isMissing(v) {
+		return v, nil
+	}
+	by := 1
+	if step != nil {
+		n, ok := intValue(step)
+		if !ok {
+			return nil, fmt.Errorf("slice step must be an integer, got %T", step)
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("slice step cannot be zero")
+		}
+		by = n
+	}
+
+	rv := indirect(reflect.ValueOf(plainString(v)))
+	var runes []rune
+	n := 0
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		n = rv.Len()
+	case reflect.String:
+		runes = []rune(rv.String())
+		n = len(runes)
+	default:
+		return nil, fmt.Errorf("cannot slice %T", v)
+	}
+
+	from, err := sliceBound(start, n, by, true)
+	if err != nil {
+		return nil, err
+	}
+	to, err := sliceBound(stop, n, by, false)
+	if err != nil {
+		return nil, err
+	}
+	var picked []int
+	for i := from; (by > 0 && i < to) || (by < 0 && i > to); i += by {
+		picked = append(picked, i)
+	}
+
+	if rv.Kind() == reflect.String {
+		out := make([]rune, len(picked))
+		for j, i := range picked {
+			out[j] = runes[i]
+		}
+		if _, safe := v.(SafeString); safe {
+			return SafeString(out), nil
+		}
+		return string(out), nil
+	}
+	out := make([]any, len(picked))
+	for j, i := range picked {
+		out[j] = rv.Index(i).Interface()
+	}
+	return out, nil
+}
+
+// sliceBound clamps a start or stop bound of a slice over n items, as
+// Python does for the given step direction.
+func sliceBound(bound any, n, step int, isStart bool) (int, error) {
+	if bound == nil {
+		switch {
+		case step > 0 && isStart:
+			return 0, nil
+		case step > 0:
+			return n, nil
+		case isStart:
+			return n - 1, nil
+		}
+		return -1, nil
+	}
+	i, ok := intValue(bound)
+	if !ok {
+		return 0, fmt.Errorf("slice indices must be integers, got %T", bound)
+	}
+	if i < 0 {
+		i += n
+		if i < 0 {
+			if step > 0 {
+				return 0, nil
+			}
+			return -1, nil
+		}
+	}
+	if i >= n {
+		if step > 0 {
+			return n, nil
+		}
+		return n - 1, nil
+	}
+	return i, nil
+}
+
+// indirect follows pointers and interfaces down to a concrete value. A nil
+// pointer yields the invalid Value.
+func indirect(rv reflect.Value) reflect.Value {
+	for rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return reflect.Value{}
+		}
+		rv = rv.Elem()
+	}
+	return rv
+}
+
+// methodByName finds an exported method of rv, including pointer-receiver
+// methods of a struct passed by value.
+func methodByName(rv reflect.Value, name string) reflect.Value {
+	if name == "" || !isExportedName(name) {
+		return reflect.Value{}
+	}
+	for {
+		pointer := rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface
+		if pointer && rv.IsNil() {
+			return reflect.Value{}
+		}
+		if m := rv.MethodByName(name); m.IsValid() {
+			return m
+		}
+		if !pointer {
+			break
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() == reflect.Struct && !rv.CanAddr() {
+		ptr := reflect.New(rv.Type())
+		ptr.Elem().Set(rv)
+		return ptr.MethodByName(name)
+	}
+	return reflect.Value{}
+}
+
+func isExportedName(name string) bool {
+	return name[0] >= 'A' && name[0] <= 'Z'
+}
+
+var structFieldCache sync.Map // reflect.Type -> map[string][]int
+
+// structFields maps the names a template may use for the exported fields of
+// t to their indexes: the Go name and, when present, the json tag name.
+// Fields tagged json:"-" are only reachable by their Go name.
+func structFields(t reflect.Type) map[string][]int {
+	if cached, ok := structFieldCache.Load(t); ok {
+		return cached.(map[string][]int)
+	}
+	fields := map[string][]int{}
+	tagged := map[string][]int{}
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() || f.Anonymous && f.Type.Kind() == reflect.Struct {
+			continue
+		}
+		fields[f.Name] = f.Index
+		tag, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if tag != "" && tag != "-" {
+			tagged[tag] = f.Index
+		}
+	}
+	for name, index := range tagged {
+		if _, ok := fields[name]; !ok {
+			fields[name] = index
+		}
+	}
+	structFieldCache.Store(t, fields)
+	return fields
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// callReflect calls a Go function with template arguments, converting them
+// to its parameter types. A trailing error result is returned as the error.
+func callReflect(fn reflect.Value, args []any, kwargs map[string]any) (any, error) {
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("Go functions do not take keyword arguments")
+	}
+	t := fn.Type()
+	n := t.NumIn()
+	if t.IsVariadic() {
+		if len(args) < n-1 {
+			return nil, fmt.Errorf("expected at least %d arguments, got %d", n-1, len(args))
+		}
+	} else if len(args) != n {
+		return nil, fmt.Errorf("expected %d arguments, got %d", n, len(args))
+	}
+	in := make([]reflect.Value, len(args))
+	for i, a := range args {
+		var pt reflect.Type
+		if t.IsVariadic() && i >= n-1 {
+			pt = t.In(n - 1).Elem()
+		} else {
+			pt = t.In(i)
+		}
+		v, err := convertArg(a, pt)
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %w", i+1, err)
+		}
+		in[i] = v
+	}
+
+	out := fn.Call(in)
+	if len(out) > 0 && t.Out(len(out)-1) == errorType {
+		if err, _ := out[len(out)-1].Interface().(error); err != nil {
+			return nil, err
+		}
+		out = out[:len(out)-1]
+	}
+	switch len(out) {
+	case 0:
+		return nil, nil
+	case 1:
+		return out[0].Interface(), nil
+	}
+	values := make([]any, len(out))
+	for i, v := range out {
+		values[i] = v.Interface()
+	}
+	return values, nil
+}
+
+// convertArg converts a template value to a Go parameter of type t.
+// Numbers convert between kinds as long as no information is lost, which
+// lets whole floats from JSON data reach int parameters.
+func convertArg(a any, t reflect.Type) (reflect.Value, error) {
+	if a == nil {
+		switch t.Kind() {
+		case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+			return reflect.Zero(t), nil
+		}
+		return reflect.Value{}, fmt.Errorf("cannot use none as %s", t)
+	}
+	if isMissing(a) {
+		return reflect.Value{}, undefinedError(a)
+	}
+	av := reflect.ValueOf(plainString(a))
+	if av.Type().AssignableTo(t) {
+		return av, nil
+	}
+	switch {
+	case isNumberKind(av.Kind()) && isNumberKind(t.Kind()):
+		cv := av.Convert(t)
+		if back := cv.Convert(av.Type()); back.Interface() != av.Interface() && !isNaN(av) {
+			return reflect.Value{}, fmt.Errorf("cannot use %v as %s", a, t)
+		}
+		return cv, nil
+	case av.Kind() == reflect.String && t.Kind() == reflect.String:
+		return av.Convert(t), nil
+	}
+	return reflect.Value{}, fmt.Errorf("cannot use %T as %s", a, t)
+}
+
+func isNumberKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func isNaN(v reflect.Value) bool {
+	return (v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64) && math.IsNaN(v.Float())
+}
+
+// iterEntries returns the items a for loop visits in v: the elements of a
+// slice or array, the values of a mapping in mapEntries order, what a
+// channel yields until it is closed, or the values an iterator function
+// (func(yield func(V) bool) or func(yield func(K, V) bool)) passes to
+// yield. keys holds the matching mapping keys or iterator Ks, and is nil
+// for other collections. ok is false when v is not a collection. The budget
+// bounds how many items are drawn from channels and iterators, which may
+// never end.
+func iterEntries(v any, budget *renderBudget, ordered bool) (keys, items []any, ok bool, err error) {
+	if keys, items, ok := mapEntries(v, ordered); ok {
+		return keys, items, true, nil
+	}
+	rv := indirect(reflect.ValueOf(v))
+	if rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+		items = make([]any, rv.Len())
+		for i := range items {
+			items[i] = rv.Index(i).Interface()
+		}
+		return nil, items, true, nil
+	}
+	src, ok := newIterSource(v, budget)
+	if !ok {
+		return nil, nil, false, nil
+	}
+	defer src.stop()
+	if src.keyed {
+		keys = []any{}
+	}
+	for {
+		key, item, more, err := src.next()
+		if err != nil {
+			return nil, nil, true, err
+		}
+		if !more {
+			return keys, items, true, nil
+		}
+		if err := budget.allocate(len(items) + 1); err != nil {
+			return nil, nil, true, err
+		}
+		if src.keyed {
+			keys = append(keys, key)
+		}
+		items = append(items, item)
+	}
+}
+
+// readIterSource reads the items of a channel or an iterator function into
+// a list, as a for loop would visit them. ok is false for other values.
+func readIterSource(v any, budget *renderBudget) (items []any, ok bool, err error) {
+	rv := indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Chan && rv.Kind() != reflect.Func {
+		return nil, false, nil
+	}
+	_, items, ok, err = iterEntries(v, budget, false)
+	return items, ok, err
+}
+
+// iterSource draws the items of a channel or an iterator function one at a
+// time, so that a loop which stops early never asks for the rest. keyed is
+// set for iterators that yield keys with their values.
+type iterSource struct {
+	next  func() (key, item any, ok bool, err error)
+	stop  func()
+	keyed bool
+}
+
+// newIterSource returns the source of the items of v, a channel that can
+// be received from or an iterator function. ok is false for other values.
+// Waiting for an item ends when the render is cancelled. stop must be
+// called once no more items are wanted.
+func newIterSource(v any, budget *renderBudget) (src *iterSource, ok bool) {
+	rv := indirect(reflect.ValueOf(v))
+	switch {
+	case rv.Kind() == reflect.Chan && rv.Type().ChanDir()&reflect.RecvDir != 0:
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: rv},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(budget.ctx.Done())},
+		}
+		return &iterSource{
+			next: func() (any, any, bool, error) {
+				chosen, item, ok := reflect.Select(cases)
+				if chosen == 1 {
+					return nil, nil, false, budget.check()
+				}
+				if !ok {
+					return nil, nil, false, nil
+				}
+				return nil, item.Interface(), true, nil
+			},
+			stop: func() {},
+		}, true
+	case rv.Kind() == reflect.Func && isIteratorFunc(rv.Type()):
+		return pullIterator(rv, budget), true
+	}
+	return nil, false
+}
+
+// pullIterator runs the iterator function rv in its own goroutine, which
+// hands over one item each time next is called and waits for the next call
+// inside yield. stop makes the pending yield return false.
+func pullIterator(rv reflect.Value, budget *renderBudget) *iterSource {
+	type entry struct{ key, item any }
+	entries := make(chan entry)
+	resume := make(chan struct{})
+	stopped := make(chan struct{})
+	done := make(chan struct{})
+	var panicked any
+
+	yieldType := rv.Type().In(0)
+	last := yieldType.NumIn() - 1
+	yield := reflect.MakeFunc(yieldType, func(args []reflect.Value) []reflect.Value {
+		e := entry{item: args[last].Interface()}
+		if last == 1 {
+			e.key = args[0].Interface()
+		}
+		select {
+		case entries <- e:
+		case <-stopped:
+			return []reflect.Value{reflect.ValueOf(false)}
+		}
+		select {
+		case <-resume:
+			return []reflect.Value{reflect.ValueOf(true)}
+		case <-stopped:
+			return []reflect.Value{reflect.ValueOf(false)}
+		}
+	})
+	go func() {
+		defer close(done)
+		defer func() { panicked = recover() }()
+		select {
+		case <-resume:
+			rv.Call([]reflect.Value{yield})
+		case <-stopped:
+		}
+	}()
+
+	var once sync.Once
+	return &iterSource{
+		next: func() (any, any, bool, error) {
+			select {
+			case resume <- struct{}{}:
+			case <-done:
+				return nil, nil, false, nil
+			}
+			select {
+			case e := <-entries:
+				return e.key, e.item, true, nil
+			case <-done:
+				if panicked != nil {
+					return nil, nil, false, fmt.Errorf("iterator panicked: %v", panicked)
+				}
+				return nil, nil, false, nil
+			case <-budget.ctx.Done():
+				return nil, nil, false, budget.check()
+			}
+		},
+		stop:  func() { once.Do(func() { close(stopped) }) },
+		keyed: last == 1,
+	}
+}
+
+// mapEntries returns the keys of a mapping and their values, sorted by key
+// so that output does not depend on Go's map order. An OrderedMap keeps its
+// own order when ordered is set. ok is false when v is not a mapping.
+func mapEntries(v any, ordered bool) (keys, values []any, ok bool) {
+	switch m := v.(type) {
+	case OrderedMap:
+		names := m.Keys()
+		if !ordered {
+			names = append([]string(nil), names...)
+			sort.Strings(names)
+		}
+		keys = make([]any, 0, len(names))
+		values = make([]any, 0, len(names))
+		for _, k := range names {
+			val, _ := m.Get(k)
+			keys = append(keys, k)
+			values = append(values, val)
+		}
+		return keys, values, true
+	case map[string]any:
+		names := make([]string, 0, len(m))
+		for k := range m {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		keys = make([]any, len(names))
+		values = make([]any, len(names))
+		for i, k := range names {
+			keys[i], values[i] = k, m[k]
+		}
+		return keys, values, true
+	}
+	rv := indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Map {
+		return nil, nil, false
+	}
+	mk := rv.MapKeys()
+	sort.Slice(mk, func(i, j int) bool {
+		return compareAny(mk[i].Interface(), mk[j].Interface(), true) < 0
+	})
+	keys = make([]any, len(mk))
+	values = make([]any, len(mk))
+	for i, k := range mk {
+		keys[i], values[i] = k.Interface(), rv.MapIndex(k).Interface()
+	}
+	return keys, values, true
+}
+
+// mappingMethod returns the items, keys or values method of a mapping as a
+// func, for mappings that have no entry of that name. items() returns
+// (key, value) pairs.
+func mappingMethod(v any, name string, ordered bool) (any, bool) {
+	if name != "items" && name != "keys" && name != "values" {
+		return nil, false
+	}
+	keys, values, ok := mapEntries(v, ordered)
+	if !ok {
+		return nil, false
+	}
+	return func() []any {
+		switch name {
+		case "keys":
+			return keys
+		case "values":
+			return values
+		}
+		pairs := make([]any, len(keys))
+		for i := range keys {
+			pairs[i] = []any{keys[i], values[i]}
+		}
+		return pairs
+	}, true
+}
+
+// isIteratorFunc reports whether t has the shape of a range-over-func
+// iterator: func(yield func(V) bool) or func(yield func(K, V) bool).
+func isIteratorFunc(t reflect.Type) bool {
+	if t.NumIn() != 1 || t.NumOut() != 0 {
+		return false
+	}
+	y := t.In(0)
+	return y.Kind() == reflect.Func && (y.NumIn() == 1 || y.NumIn() == 2) &&
+		y.NumOut() == 1 && y.Out(0).Kind() == reflect.Bool
+}
+
+// reflectTruthy is truthy for values of types it does not list: empty
+// collections, zero numbers and nil pointers are false.
+func reflectTruthy(v any) bool {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if rv.IsNil() {
+			return false
+		}
+		return truthy(rv.Elem().Interface())
+	case reflect.Slice, reflect.Map, reflect.Chan:
+		return !rv.IsNil() && rv.Len() > 0
+	case reflect.Array, reflect.String:
+		return rv.Len() > 0
+	case reflect.Bool:
+		return rv.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int() != 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return rv.Uint() != 0
+	case reflect.Float32, reflect.Float64:
+		return rv.Float() != 0
+	case reflect.Func:
+		return !rv.IsNil()
+	}
+	return true
+}
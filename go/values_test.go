@@ -0,0 +1,347 @@
+package nunchucks
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCustomer struct {
+	Name  string `json:"name"`
+	Email string `json:"-"`
+}
+
+func (c testCustomer) Greeting(prefix string, times int) string {
+	return strings.Repeat(prefix, times) + " " + c.Name
+}
+
+type testItem struct {
+	Name  string
+	Price float64 `json:"price"`
+}
+
+type testOrder struct {
+	ID        int `json:"id"`
+	Customer  *testCustomer
+	CreatedAt time.Time
+	Items     []testItem
+	note      string
+}
+
+func (o *testOrder) Total() float64 {
+	total := 0.0
+	for _, it := range o.Items {
+		total += it.Price
+	}
+	return total
+}
+
+func (o testOrder) Check(ok bool) (string, error) {
+	if !ok {
+		return "", errors.New("order check failed")
+	}
+	return "checked", nil
+}
+
+func TestReflectionAccessToGoValues(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	order := testOrder{
+		ID:        7,
+		Customer:  &testCustomer{Name: "sam", Email: "sam@example.com"},
+		CreatedAt: time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC),
+		Items:     []testItem{{"pen", 2.5}, {"book", 1}},
+		note:      "hidden",
+	}
+	var noCustomer *testCustomer
+	ctx := map[string]any{"order": order, "orderPtr": &order, "nobody": noCustomer}
+
+	cases := map[string]string{
+		`{{ order.id }}/{{ order.ID }}/{{ orderPtr.id }}`:                                                  "7/7/7",
+		`{{ order.Customer.name }} {{ order.Customer.Email }}`:                                             "sam sam@example.com",
+		`{{ order.Customer.email is defined }} {{ order.note is defined }}`:                                "false false",
+		`{{ order.CreatedAt.Format("2006-01-02") }}`:                                                       "2024-03-09",
+		`{{ order.Total() }} {{ orderPtr.Total() }}`:                                                       "3.5 3.5",
+		`{{ order.Customer.Greeting("hi", 2) }}`:                                                           "hihi sam",
+		`{{ order.Check(true) }}`:                                                                          "checked",
+		`{% for it in order.Items %}{{ it.Name }}:{{ it.price }} {% endfor %}`:                             "pen:2.5 book:1 ",
+		`{{ order.Items | sort(false, false, "price") | length }}`:                                         "2",
+		`{% for it in order.Items | sort(false, false, "Price") %}{{ it.Name }}{% endfor %}`:               "bookpen",
+		`{% if order.Customer %}y{% endif %}{% if nobody %}n{% endif %}{% for x in nobody %}x{% endfor %}`: "y",
+		`{% if order.Items %}items{% endif %}`:                                                             "items",
+	}
+	for src, want := range cases {
+		out, err := env.RenderString(src, ctx)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", src, err)
+		}
+		if out != want {
+			t.Fatalf("%s: want %q, got %q", src, want, out)
+		}
+	}
+
+	_, err := env.RenderString("\n{{ order.Check(false) }}", ctx)
+	var te *TemplateError
+	if !errors.As(err, &te) || te.Line != 2 || !strings.Contains(te.Error(), "order check failed") {
+		t.Fatalf("expected method error to be located, got %v", err)
+	}
+}
+
+func TestIterationOverTypedCollections(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	ch := make(chan string, 3)
+	ch <- "a"
+	ch <- "b"
+	close(ch)
+	seq := func(yield func(int) bool) {
+		for i := 1; ; i++ {
+			if !yield(i) {
+				return
+			}
+		}
+	}
+	pairs := func(yield func(string, int) bool) {
+		_ = yield("x", 1) && yield("y", 2)
+	}
+	ctx := map[string]any{
+		"ints":  []int{1, 2, 3},
+		"arr":   [2]string{"p", "q"},
+		"ages":  map[string]int{"sam": 30},
+		"ch":    ch,
+		"pairs": pairs,
+		"seq":   seq,
+	}
+	out, err := env.RenderString(`{% for i in ints %}{{ i }}{% endfor %}|{% for s in arr %}{{ s }}{% endfor %}|{% for a in ages %}{{ a }}{% endfor %}|{% for c in ch %}{{ c }}{% endfor %}|{% for v in pairs %}{{ v }}{% endfor %}`, ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "123|pq|30|ab|12" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+
+	limited := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}, Limits: Limits{MaxLoopIterations: 100}})
+	if _, err := limited.RenderString(`{% for i in seq %}{{ i }}{% endfor %}`, ctx); !errors.Is(err, ErrLoopLimit) {
+		t.Fatalf("expected an endless iterator to hit the loop limit, got %v", err)
+	}
+}
+
+func TestIterationDrawsItemsLazily(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	stopped := make(chan struct{})
+	seq := func(yield func(int) bool) {
+		defer close(stopped)
+		for i := 1; yield(i); i++ {
+		}
+	}
+	finite := func(yield func(int) bool) {
+		_ = yield(1) && yield(2) && yield(3)
+	}
+	pairs := func(yield func(string, int) bool) {
+		_ = yield("x", 1) && yield("y", 2)
+	}
+	ctx := map[string]any{"seq": seq, "finite": finite, "pairs": pairs}
+
+	out, err := env.RenderString(`{% for i in seq %}{{ i }}{% if i == 3 %}{% break %}{% endif %}{% endfor %}`, ctx)
+	if err != nil || out != "123" {
+		t.Fatalf("expected a loop to stop an endless iterator, got %q, %v", out, err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("expected the iterator to be stopped when the loop broke")
+	}
+
+	for src, want := range map[string]string{
+		`{% for i in seq if i is even %}{{ i }}{% if loop.index == 2 %}{% break %}{% endif %}{% endfor %}`:               "24",
+		`{% for i in finite %}{{ loop.index }}/{{ loop.length }}{% if not loop.last %},{% endif %}{% endfor %}`:          "1/3,2/3,3/3",
+		`{% for i in finite %}{{ loop.nextitem }}{% endfor %}`:                                                           "23",
+		`{% for k, v in pairs %}{{ k }}={{ v }};{% endfor %}`:                                                            "x=1;y=2;",
+		`{{ finite | list | length }}{{ finite | join("-") }}{{ finite | length }}{{ finite | sum }}{{ finite | last }}`: "31-2-3363",
+		`{{ finite | map("string") | join }}{{ finite | select("odd") | join }}{{ finite | reverse | join }}`:            "12313321",
+		`{{ pairs | join(",") }}`: "1,2",
+	} {
+		out, err := env.RenderString(src, ctx)
+		if err != nil || out != want {
+			t.Fatalf("%s: want %q, got %q, %v", src, want, out, err)
+		}
+	}
+
+	ch := make(chan string, 2)
+	ch <- "a"
+	ch <- "b"
+	close(ch)
+	if out, err := env.RenderString(`{{ ch | join(",") }}`, map[string]any{"ch": ch}); err != nil || out != "a,b" {
+		t.Fatalf("expected join to read a channel, got %q, %v", out, err)
+	}
+
+	limited := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}, Limits: Limits{MaxLoopIterations: 100}})
+	endless := func(yield func(int) bool) {
+		for i := 1; yield(i); i++ {
+		}
+	}
+	if _, err := limited.RenderString(`{{ seq | list }}`, map[string]any{"seq": endless}); !errors.Is(err, ErrLoopLimit) {
+		t.Fatalf("expected reading an endless iterator to hit the loop limit, got %v", err)
+	}
+}
+
+func TestSubscriptAndSliceExpressions(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	ctx := map[string]any{
+		"items":   []any{1, 2, 3, 4, 5},
+		"names":   []string{"ann", "bob"},
+		"row":     map[string]any{"first-name": "sam"},
+		"headers": map[string]string{"Accept": "text/html"},
+		"key":     "Accept",
+		"codes":   map[int]string{404: "not found"},
+		"word":    "héllo",
+		"item":    testItem{Name: "pen", Price: 2.5},
+		"grid":    map[string]any{"rows": []any{[]any{"a", "b"}, []any{"c", "d"}}},
+		"seps":    []any{"-"},
+	}
+
+	cases := map[string]string{
+		`{{ items[0] }} {{ items[-1] }} {{ names[1] }}`:               "1 5 bob",
+		`{{ items[9] is defined }} {{ items["x"] is defined }}`:       "false false",
+		`{{ row['first-name'] }} {{ headers[key] }} {{ codes[404] }}`: "sam text/html not found",
+		`{{ item["Name"] }} {{ item["price"] }}`:                      "pen 2.5",
+		`{{ grid.rows[1][0] }}`:                                       "c",
+		`{{ items[1:3] | join(",") }}`:                                "2,3",
+		`{{ items[:2] | join(",") }}|{{ items[3:] | join(",") }}`:     "1,2|4,5",
+		`{{ items[-2:] | join(",") }}|{{ items[:-3] | join(",") }}`:   "4,5|1,2",
+		`{{ items[::2] | join(",") }}|{{ items[::-1] | join(",") }}`:  "1,3,5|5,4,3,2,1",
+		`{{ items[3:0:-1] | join(",") }}|{{ items[10:20] | length }}`: "4,3,2|0",
+		`{{ word[1] }} {{ word[1:4] }} {{ word[::-1] }}`:              "é éll olléh",
+		`{% set tail = items[1:] %}{{ tail | length }}`:               "4",
+		`{% for i in items[1:3] %}{{ i }}{% endfor %}`:                "23",
+		`{% if items[0] == 1 and row["first-name"] %}ok{% endif %}`:   "ok",
+		`{{ names | join(seps[0]) }}`:                                 "ann-bob",
+		`{{ items[1 + 1] }} {{ items[items[0]] }}`:                    "3 2",
+	}
+	for src, want := range cases {
+		out, err := env.RenderString(src, ctx)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", src, err)
+		}
+		if out != want {
+			t.Fatalf("%s: want %q, got %q", src, want, out)
+		}
+	}
+
+	for src, want := range map[string]string{
+		`{{ items[::0] }}`: "slice step cannot be zero",
+		`{{ items[] }}`:    "expected index or slice inside []",
+		`{{ items[1 }}`:    `expected "]"`,
+	} {
+		if _, err := env.RenderString(src, ctx); err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("%s: expected error containing %q, got %v", src, want, err)
+		}
+	}
+
+	strict := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}, Undefined: UndefinedStrict})
+	if _, err := strict.RenderString(`{{ row["last-name"] }}`, ctx); err == nil || !strings.Contains(err.Error(), `"row[\"last-name\"]" is undefined`) {
+		t.Fatalf("expected strict mode to name the missing key, got %v", err)
+	}
+}
+
+func TestListDictAndTupleLiterals(t *testing.T) {
+	files := map[string]string{
+		"macros.njk": `{% macro link(opts) %}<a href="{{ opts.href }}">{{ opts.label }}</a>{% endmacro %}`,
+	}
+	env := Configure(ConfigOptions{Loader: &testLoader{files: files}})
+	ctx := map[string]any{"user": map[string]any{"name": "sam"}, "key": "role"}
+
+	cases := map[string]string{
+		`{% set nav = [{"href": "/", "label": "Home"}, {"href": "/about", "label": "About"}] %}{% for l in nav %}{{ l.label }}:{{ l.href }} {% endfor %}`: "Home:/ About:/about ",
+		`{{ [1, 2, 3] | join(",") }}|{{ [] | length }}|{{ [1, 2,] | length }}`:                                                                            "1,2,3|0|2",
+		`{{ {"a": {"b": [1, {"c": "deep"}]}}.a.b[1].c }}`:                                                                                                 "deep",
+		`{% set d = {key: user.name, "n": 1 + 1} %}{{ d.role }} {{ d["n"] }} {{ {} | length }}`:                                                           "sam 2 0",
+		`{% set t = (1, "two") %}{{ t[1] }} {{ t | length }} {{ (1,) | length }} {{ () | length }} {{ (4) }}`:                                             "two 2 1 0 4",
+		`{{ "b" in ["a", "b"] }} {{ 3 in (1, 2) }} {{ "x" in {"x": 1} }}`:                                                                                 "true false true",
+		`{% import "macros.njk" as ui %}{{ ui.link({"href": "/", "label": user.name}) }}`:                                                                 `<a href="/">sam</a>`,
+		`{{ [missing, 1] | length }}`: "2",
+	}
+	for src, want := range cases {
+		out, err := env.RenderString(src, ctx)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", src, err)
+		}
+		if out != want {
+			t.Fatalf("%s: want %q, got %q", src, want, out)
+		}
+	}
+
+	for src, want := range map[string]string{
+		`{{ [1, 2 }}`:       `expected "]"`,
+		`{{ {"a" 1} }}`:     `expected ":"`,
+		`{{ {"a": 1, 2} }}`: `expected ":"`,
+		`{{ (1, 2 }}`:       `expected ")"`,
+	} {
+		if _, err := env.RenderString(src, ctx); err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("%s: expected error containing %q, got %v", src, want, err)
+		}
+	}
+}
+
+type testOrderedMap struct {
+	keys   []string
+	values map[string]any
+}
+
+func (m testOrderedMap) Keys() []string { return m.keys }
+
+func (m testOrderedMap) Get(key string) (any, bool) {
+	v, ok := m.values[key]
+	return v, ok
+}
+
+func TestKeyValueLoopsAndMapOrder(t *testing.T) {
+	env := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}})
+	ordered := testOrderedMap{keys: []string{"zeta", "alpha", "mid"}, values: map[string]any{"zeta": 1, "alpha": 2, "mid": 3}}
+	ctx := map[string]any{
+		"scores":  map[string]any{"carol": 3, "alice": 1, "bob": 2, "dave": 4, "eve": 5},
+		"codes":   map[int]string{500: "error", 200: "ok", 404: "missing"},
+		"pairs":   []any{[]any{"a", 1}, []any{"b", 2}},
+		"points":  [][2]int{{1, 2}, {3, 4}},
+		"ordered": ordered,
+		"seq": func(yield func(string, int) bool) {
+			_ = yield("x", 1) && yield("y", 2)
+		},
+	}
+
+	cases := map[string]string{
+		`{% for name, score in scores %}{{ name }}={{ score }};{% endfor %}`:                       "alice=1;bob=2;carol=3;dave=4;eve=5;",
+		`{% for score in scores %}{{ score }}{% endfor %}`:                                         "12345",
+		`{% for code, text in codes %}{{ code }}:{{ text }} {% endfor %}`:                          "200:ok 404:missing 500:error ",
+		`{% for k, v in pairs %}{{ k }}{{ v }}{% endfor %}`:                                        "a1b2",
+		`{% for x, y in points %}({{ x }},{{ y }}){% endfor %}`:                                    "(1,2)(3,4)",
+		`{% for k, v in seq %}{{ k }}{{ v }}{% endfor %}`:                                          "x1y2",
+		`{% for k, v in scores.items() %}{% if loop.first %}{{ k }}{{ v }}{% endif %}{% endfor %}`: "alice1",
+		`{{ scores.keys() | join(",") }}|{{ scores.values() | join(",") }}`:                        "alice,bob,carol,dave,eve|1,2,3,4,5",
+		`{% for k, v in {"b": 2, "a": 1}.items() %}{{ k }}{% endfor %}`:                            "ab",
+		`{{ {"keys": "own"}.keys }}`:                                                               "own",
+		`{% for k, v in ordered %}{{ k }}{% endfor %}|{{ ordered.keys() | join(",") }}`:            "alphamidzeta|alpha,mid,zeta",
+		`{{ ordered.mid }} {{ ordered["zeta"] }} {{ ordered | length }}`:                           "3 1 3",
+	}
+	for src, want := range cases {
+		out, err := env.RenderString(src, ctx)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", src, err)
+		}
+		if out != want {
+			t.Fatalf("%s: want %q, got %q", src, want, out)
+		}
+	}
+
+	preserve := Configure(ConfigOptions{Loader: &testLoader{files: map[string]string{}}, PreserveMapOrder: true})
+	out, err := preserve.RenderString(`{% for k, v in ordered %}{{ k }}{{ v }}{% endfor %}|{{ ordered.values() | join(",") }}|{% for k in scores.keys() %}{{ k }}{% endfor %}`, ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "zeta1alpha2mid3|1,2,3|alicebobcaroldaveeve" {
+		t.Fatalf("unexpected ordered output: %q", out)
+	}
+
+	if _, err := env.RenderString(`{% for a, b, c in pairs %}{% endfor %}`, ctx); err == nil || !strings.Contains(err.Error(), "cannot unpack 2 values into 3 loop variables") {
+		t.Fatalf("expected unpack error, got %v", err)
+	}
+}
@@ -0,0 +1,995 @@
+package nunchucks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// machine executes one unit of a program against a frame.
+type machine struct {
+	env     *Env
+	prog    *program
+	unit    int
+	f       *frame
+	saved   []*frame
+	stack   []any
+	loops   []*loopState
+	outs    []io.Writer
+	discard bool
+
+	// captures holds the buffers of open set and filter blocks, which outs
+	// writes to through the output limit.
+	captures []*strings.Builder
+}
+
+// loopState is a running for loop. keys is set when the loop visits a
+// mapping or a key/value iterator.
+type loopState struct {
+	keys      []any
+	items     []any
+	pos       int
+	depth     int
+	recursive bool
+	// src yields the items not read into items yet, for loops over
+	// channels and iterators and filtered loops. It is nil once it ends.
+	src    *iterSource
+	accept func(key, item any) (bool, error)
+	budget *renderBudget
+	err    error
+	// changed holds the arguments of the last loop.changed call.
+	changed    []any
+	hasChanged bool
+	// frame is the frame of the last iteration, reused for the next one
+	// unless kept is set because something may still refer to it.
+	frame *frame
+	kept  bool
+}
+
+// loopContext is the loop variable of a for loop. Its attributes read like
+// a map's; in a recursive loop it can be called with an iterable to render
+// the loop body over it one level deeper.
+type loopContext struct {
+	l       *loopState
+	idx     int
+	recurse func(v any) (any, error)
+}
+
+// newLoopState collects the items a for loop visits. Values that are not
+// collections are visited once; nil, nil pointers and undefined values not
+// at all.
+func newLoopState(v any, budget *renderBudget, ordered bool) (*loopState, error) {
+	switch vv := v.(type) {
+	case []any:
+		return &loopState{items: vv}, nil
+	case nil:
+		return &loopState{}, nil
+	default:
+		if isMissing(vv) {
+			return &loopState{}, nil
+		}
+		if src, ok := newIterSource(vv, budget); ok {
+			l := &loopState{src: src, budget: budget}
+			if src.keyed {
+				l.keys = []any{}
+			}
+			return l, nil
+		}
+		keys, items, ok, err := iterEntries(vv, budget, ordered)
+		if err != nil {
+			return nil, err
+		}
+		if !ok && indirect(reflect.ValueOf(vv)).IsValid() {
+			items = []any{vv}
+		}
+		return &loopState{keys: keys, items: items}, nil
+	}
+}
+
+// bind assigns the current item to the loop targets. With one target it
+// gets the item, or the value for a mapping. With two targets over a
+// mapping they get the key and value; otherwise the item is unpacked.
+func (l *loopState) bind(vars map[string]any, targets []string) error {
+	var key any
+	if l.keys != nil {
+		key = l.keys[l.pos]
+	}
+	return bindTargets(vars, targets, key, l.items[l.pos], l.keys != nil)
+}
+
+// bindTargets assigns an item, and its key when keyed, to the loop
+// targets as bind does.
+func bindTargets(vars map[string]any, targets []string, key, item any, keyed bool) error {
+	if len(targets) == 1 {
+		vars[targets[0]] = item
+		return nil
+	}
+	values := []any{key, item}
+	if !keyed || len(targets) != 2 {
+		var err error
+		if values, err = unpack(item, len(targets), "loop variables"); err != nil {
+			return err
+		}
+	}
+	for i, name := range targets {
+		vars[name] = values[i]
+	}
+	return nil
+}
+
+// fetch reads items from the loop's source until item n is read or the
+// source ends, keeping those the loop's filter accepts. An error ends the
+// loop's source and is returned again by later calls.
+func (l *loopState) fetch(n int) error {
+	for l.err == nil && l.src != nil && len(l.items) <= n {
+		key, item, ok, err := l.src.next()
+		if err == nil && ok && l.accept != nil {
+			ok, err = l.accept(key, item)
+			if err == nil && !ok {
+				continue
+			}
+		}
+		if err == nil && ok {
+			err = l.budget.allocate(len(l.items) + 1)
+		}
+		if err != nil {
+			l.err = err
+		}
+		if !ok || err != nil {
+			l.close()
+			break
+		}
+		if l.keys != nil {
+			l.keys = append(l.keys, key)
+		}
+		l.items = append(l.items, item)
+	}
+	return l.err
+}
+
+// close stops the loop's source, if it has not ended.
+func (l *loopState) close() {
+	if l.src != nil {
+		l.src.stop()
+		l.src = nil
+	}
+}
+
+// sliceSource yields items, and their keys when keys is not nil.
+func sliceSource(keys, items []any) *iterSource {
+	i := 0
+	return &iterSource{
+		next: func() (key, item any, ok bool, err error) {
+			if i >= len(items) {
+				return nil, nil, false, nil
+			}
+			i++
+			if keys != nil {
+				key = keys[i-1]
+			}
+			return key, items[i-1], true, nil
+		},
+		stop:  func() {},
+		keyed: keys != nil,
+	}
+}
+
+// unpack splits v into n values for as many names.
+func unpack(v any, n int, what string) ([]any, error) {
+	values := toSlice(v)
+	if values == nil {
+		return nil, fmt.Errorf("cannot unpack %T into %d %s", v, n, what)
+	}
+	if len(values) != n {
+		return nil, fmt.Errorf("cannot unpack %d values into %d %s", len(values), n, what)
+	}
+	return values, nil
+}
+
+// set assigns v as the SET instruction in says.
+func (m *machine) set(in instr, v any) error {
+	if len(in.Names) == 0 {
+		return m.assign(in.S, v)
+	}
+	values, err := unpack(v, len(in.Names), "names")
+	if err != nil {
+		return err
+	}
+	for i, target := range in.Names {
+		if err := m.assign(target, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assign stores v in target, a variable name or ns.attr for an attribute
+// of a namespace.
+func (m *machine) assign(target string, v any) error {
+	name, attr, ok := strings.Cut(target, ".")
+	if !ok {
+		m.f.vars[target] = v
+		return nil
+	}
+	found, _ := m.f.state.lookup(name, m.f.vars, m.f.ctx)
+	ns, ok := found.(*namespace)
+	if !ok {
+		return fmt.Errorf("cannot set %s: %q is not a namespace", target, name)
+	}
+	ns.attrs[attr] = v
+	return nil
+}
+
+// startLoop begins the loop of the ITER instruction in over v at depth.
+// The items its filter rejects are dropped as the loop reads them.
+func (m *machine) startLoop(in instr, v any, depth int) (*loopState, error) {
+	l, err := newLoopState(v, m.f.state.budget, m.env.preserveMapOrder)
+	if err != nil {
+		return nil, err
+	}
+	l.depth = depth
+	l.recursive = in.B&iterRecursive != 0
+	if in.B&iterFiltered == 0 {
+		return l, nil
+	}
+	if l.src == nil {
+		l.src = sliceSource(l.keys, l.items)
+		l.budget = m.f.state.budget
+		if l.keys != nil {
+			l.keys = []any{}
+		}
+		l.items = nil
+	}
+	outer, cond := m.f, m.prog.Exprs[in.A]
+	l.accept = func(key, item any) (bool, error) {
+		vars := cloneMap(outer.vars)
+		if err := bindTargets(vars, in.Names, key, item, l.keys != nil); err != nil {
+			return false, err
+		}
+		ok, err := cond.evaluate(&evalScope{env: m.env, state: outer.state, vars: vars, ctx: outer.ctx, autoescape: m.prog.Autoescape})
+		return truthy(ok), err
+	}
+	return l, nil
+}
+
+// loopContext builds the loop variable for the current item of l, whose
+// NEXT instruction is at top.
+func (m *machine) loopContext(l *loopState, top int) *loopContext {
+	lc := &loopContext{l: l, idx: l.pos}
+	if l.recursive {
+		m.keepLoopFrames()
+		f := m.f
+		lc.recurse = func(v any) (any, error) {
+			return m.recurse(top, f, v, l.depth+1)
+		}
+	}
+	return lc
+}
+
+// attr returns the loop attribute name. The attributes are worked out when
+// read, so a loop that uses few of them costs little per item.
+func (lc *loopContext) attr(name string) (any, bool) {
+	l, idx := lc.l, lc.idx
+	switch name {
+	case "revindex", "revindex0", "length":
+		l.fetch(math.MaxInt)
+	case "last", "nextitem":
+		l.fetch(idx + 1)
+	}
+	length := len(l.items)
+	switch name {
+	case "index":
+		return idx + 1, true
+	case "index0":
+		return idx, true
+	case "revindex":
+		return length - idx, true
+	case "revindex0":
+		return length - idx - 1, true
+	case "first":
+		return idx == 0, true
+	case "last":
+		return idx == length-1, true
+	case "length":
+		return length, true
+	case "depth":
+		return l.depth, true
+	case "depth0":
+		return l.depth - 1, true
+	case "previtem":
+		if idx > 0 {
+			return l.items[idx-1], true
+		}
+		return missingValue{name: "loop.previtem"}, true
+	case "nextitem":
+		if idx < length-1 {
+			return l.items[idx+1], true
+		}
+		return missingValue{name: "loop.nextitem"}, true
+	case "cycle":
+		return TemplateFunc(func(args []any, _ map[string]any, _ TemplateFunc) (any, error) {
+			if len(args) == 0 {
+				return nil, fmt.Errorf("loop.cycle needs at least one value")
+			}
+			return args[idx%len(args)], nil
+		}), true
+	case "changed":
+		return TemplateFunc(func(args []any, _ map[string]any, _ TemplateFunc) (any, error) {
+			if l.hasChanged && reflect.DeepEqual(l.changed, args) {
+				return false, nil
+			}
+			l.changed, l.hasChanged = args, true
+			return true, nil
+		}), true
+	}
+	return nil, false
+}
+
+// recurse renders the recursive loop whose NEXT is at top over the items
+// of v, in frame f, and returns the output.
+func (m *machine) recurse(top int, f *frame, v any, depth int) (any, error) {
+	budget := f.state.budget
+	if err := budget.enter(); err != nil {
+		return nil, err
+	}
+	defer budget.leave()
+	code := m.prog.Units[m.unit].Code
+	exit := code[top].A
+	end := exit + 1
+	if code[exit].A > 0 {
+		end = code[exit].A
+	}
+	var b strings.Builder
+	sub := &machine{env: m.env, prog: m.prog, unit: m.unit, f: f, outs: []io.Writer{budget.limit(&b)}}
+	l, err := sub.startLoop(code[top-1], v, depth)
+	if err != nil {
+		return nil, err
+	}
+	sub.loops = []*loopState{l}
+	if err := sub.runRange(top, end); err != nil {
+		return nil, err
+	}
+	return SafeString(b.String()), nil
+}
+
+// exec runs unit u of prog, writing its output to w.
+func (e *Env) exec(w io.Writer, prog *program, u int, f *frame) error {
+	m := &machine{env: e, prog: prog, unit: u, f: f, outs: []io.Writer{w}}
+	return m.run()
+}
+
+func (m *machine) scope() *evalScope {
+	return &evalScope{env: m.env, state: m.f.state, vars: m.f.vars, ctx: m.f.ctx, autoescape: m.prog.Autoescape}
+}
+
+func (m *machine) push(v any) {
+	m.stack = append(m.stack, v)
+}
+
+func (m *machine) pop() any {
+	v := m.stack[len(m.stack)-1]
+	m.stack = m.stack[:len(m.stack)-1]
+	return v
+}
+
+func (m *machine) popN(n int) []any {
+	out := make([]any, n)
+	copy(out, m.stack[len(m.stack)-n:])
+	m.stack = m.stack[:len(m.stack)-n]
+	return out
+}
+
+func (m *machine) pushFrame() {
+	m.saved = append(m.saved, m.f)
+	m.f = m.f.withVars(cloneMap(m.f.vars))
+}
+
+// pushLoopFrame starts the frame of one iteration of l, reusing the frame
+// of the previous iteration when nothing kept hold of it.
+func (m *machine) pushLoopFrame(l *loopState) {
+	m.saved = append(m.saved, m.f)
+	if l.frame == nil || l.kept {
+		l.frame = m.f.withVars(make(map[string]any, len(m.f.vars)+2))
+		l.kept = false
+	} else {
+		clear(l.frame.vars)
+	}
+	for k, v := range m.f.vars {
+		l.frame.vars[k] = v
+	}
+	m.f = l.frame
+}
+
+// keepLoopFrames stops the running loops from reusing the frame of the
+// current iteration, for macros and callers that refer to it later.
+func (m *machine) keepLoopFrames() {
+	for _, l := range m.loops {
+		l.kept = true
+	}
+}
+
+func (m *machine) popFrame() {
+	m.f = m.saved[len(m.saved)-1]
+	m.saved = m.saved[:len(m.saved)-1]
+}
+
+// out returns the writer for the current instruction. Once a template has
+// extended another, its top-level output goes nowhere.
+func (m *machine) out() io.Writer {
+	if m.discard && len(m.outs) == 1 {
+		return io.Discard
+	}
+	return m.outs[len(m.outs)-1]
+}
+
+func (m *machine) write(s string) error {
+	_, err := io.WriteString(m.out(), s)
+	return err
+}
+
+func (m *machine) trace(pc int, in instr) {
+	name := m.prog.Name
+	if name == "" {
+		name = "<string>"
+	}
+	if u := m.prog.Units[m.unit].Name; u != "" {
+		name += ":" + u
+	}
+	fmt.Fprintf(m.env.trace, "%s %04d %s\n", name, pc, in)
+}
+
+func (m *machine) run() error {
+	return m.runRange(0, len(m.prog.Units[m.unit].Code))
+}
+
+// runRange runs the unit's code from start until control leaves
+// [start, end).
+func (m *machine) runRange(start, end int) error {
+	defer func() {
+		for _, l := range m.loops {
+			l.close()
+		}
+	}()
+	code := m.prog.Units[m.unit].Code
+	for pc := start; pc >= start && pc < end; pc++ {
+		in := code[pc]
+		if m.env.trace != nil {
+			m.trace(pc, in)
+		}
+		switch in.Op {
+		case opText:
+			if err := m.write(in.S); err != nil {
+				return m.fail(in, err)
+			}
+		case opEval:
+			v, err := m.prog.Exprs[in.A].evaluate(m.scope())
+			if err != nil {
+				return m.fail(in, err)
+			}
+			m.push(v)
+		case opLookup:
+			v, _ := m.f.state.lookup(in.S, m.f.vars, m.f.ctx)
+			m.push(v)
+		case opFilter:
+			kwvals := m.popN(len(in.Names))
+			args := m.popN(in.A)
+			var kwargs map[string]any
+			if len(in.Names) > 0 {
+				kwargs = make(map[string]any, len(in.Names))
+				for i, name := range in.Names {
+					kwargs[name] = kwvals[i]
+				}
+			}
+			v, err := applyFilter(m.scope(), in.S, m.pop(), args, kwargs)
+			if err != nil {
+				return m.fail(in, err)
+			}
+			m.push(v)
+		case opEmit:
+			v := m.pop()
+			if isMissing(v) {
+				switch m.env.undefined {
+				case UndefinedStrict:
+					return m.fail(in, undefinedError(v))
+				case UndefinedDebug:
+					v = m.env.undefinedMarker(v)
+				}
+			}
+			if err := m.write(outputString(v, in.A)); err != nil {
+				return m.fail(in, err)
+			}
+		case opJumpIfFalse:
+			if !truthy(m.pop()) {
+				pc = in.A - 1
+			}
+		case opJump:
+			pc = in.A - 1
+		case opPushFrame:
+			m.pushFrame()
+		case opPopFrame:
+			m.popFrame()
+		case opSet:
+			if err := m.set(in, m.pop()); err != nil {
+				return m.fail(in, err)
+			}
+		case opIter:
+			l, err := m.startLoop(in, m.pop(), 1)
+			if err != nil {
+				return m.fail(in, err)
+			}
+			m.loops = append(m.loops, l)
+		case opNext:
+			l := m.loops[len(m.loops)-1]
+			if err := l.fetch(l.pos); err != nil {
+				return m.fail(in, err)
+			}
+			if l.pos >= len(l.items) {
+				pc = in.A - 1
+				continue
+			}
+			if err := m.f.state.budget.iterate(); err != nil {
+				return m.fail(in, err)
+			}
+			m.pushLoopFrame(l)
+			targets := in.Names
+			if len(targets) == 0 {
+				targets = []string{in.S}
+			}
+			if err := l.bind(m.f.vars, targets); err != nil {
+				return m.fail(in, err)
+			}
+			m.f.vars["loop"] = m.loopContext(l, pc)
+			l.pos++
+		case opIterEnd:
+			l := m.loops[len(m.loops)-1]
+			m.loops = m.loops[:len(m.loops)-1]
+			l.close()
+			if in.A > 0 && l.pos > 0 {
+				pc = in.A - 1
+			}
+		case opCall:
+			kwvals := m.popN(len(in.Names))
+			args := m.popN(in.A)
+			fn := m.pop()
+			if isMissing(fn) {
+				return m.fail(in, undefinedError(fn))
+			}
+			kwargs := make(map[string]any, len(in.Names))
+			for i, name := range in.Names {
+				kwargs[name] = kwvals[i]
+			}
+			m.keepLoopFrames()
+			called, err := invokeCallableValue(fn, args, kwargs, m.env.callerFunc(m.prog, in.B, m.f))
+			if err != nil {
+				return m.fail(in, err)
+			}
+			if err := m.write(fmt.Sprint(called)); err != nil {
+				return m.fail(in, err)
+			}
+		case opCapture:
+			captured := &strings.Builder{}
+			m.captures = append(m.captures, captured)
+			m.outs = append(m.outs, m.f.state.budget.limit(captured))
+		case opEndCapture:
+			captured := m.captures[len(m.captures)-1]
+			m.captures = m.captures[:len(m.captures)-1]
+			m.outs = m.outs[:len(m.outs)-1]
+			if in.A != 0 {
+				m.push(SafeString(captured.String()))
+			} else {
+				m.push(captured.String())
+			}
+		case opBlockCall:
+			if err := m.blockCall(in.S); err != nil {
+				return m.fail(in, err)
+			}
+		case opExtends:
+			target := m.target(in)
+			if m.f.run != nil && m.f.run.parent == nil {
+				parent, err := m.env.resolveTemplate(target)
+				if err != nil {
+					return m.fail(in, err)
+				}
+				m.f.run.parent = parent.prog
+				m.f.run.parentLine = in.Line
+				if m.unit == 0 {
+					m.discard = true
+				}
+			}
+		case opInclude:
+			ignoreMissing := in.A&includeIgnoreMissing != 0
+			withContext := in.A&includeWithContext != 0
+			if err := m.env.renderInclude(m.out(), m.target(in), ignoreMissing, withContext, m.f); err != nil {
+				return m.fail(in, err)
+			}
+		case opImport:
+			module, err := m.env.loadModule(m.target(in), m.f, in.A != 0)
+			if err != nil {
+				return m.fail(in, err)
+			}
+			m.f.vars[in.Names[0]] = module
+		case opFromImport:
+			module, err := m.env.loadModule(m.target(in), m.f, in.A != 0)
+			if err != nil {
+				return m.fail(in, err)
+			}
+			for i := 0; i+1 < len(in.Names); i += 2 {
+				if in.Names[i] == "*" {
+					for name, v := range module {
+						m.f.vars[name] = v
+					}
+					continue
+				}
+				v, ok := module[in.Names[i]]
+				if !ok {
+					return m.fail(in, fmt.Errorf("cannot import %q: the template does not define it", in.Names[i]))
+				}
+				m.f.vars[in.Names[i+1]] = v
+			}
+		case opMacro:
+			m.keepLoopFrames()
+			m.env.registerMacro(m.prog, in.A, m.f)
+		case opTag:
+			tag := &Tag{Name: in.S}
+			kwvals := m.popN(len(in.Names))
+			tag.Args = m.popN(in.A)
+			if len(in.Names) > 0 {
+				tag.Kwargs = make(map[string]any, len(in.Names))
+				for i, name := range in.Names {
+					tag.Kwargs[name] = kwvals[i]
+				}
+			}
+			if in.B != 0 {
+				tag.Body = fmt.Sprint(m.pop())
+			}
+			m.keepLoopFrames()
+			out, err := m.env.renderTag(m.scope(), m.prog, tag)
+			if err != nil {
+				return m.fail(in, err)
+			}
+			if err := m.write(out); err != nil {
+				return m.fail(in, err)
+			}
+		case opClientEvent:
+			id := fmt.Sprintf("__nc_evt_%d", len(m.f.state.events))
+			m.f.state.events = append(m.f.state.events, inlineClientEventBinding{ID: id, Expr: in.S})
+			if err := m.write(fmt.Sprintf(`data-nc-on%s="%s"`, in.Names[0], id)); err != nil {
+				return m.fail(in, err)
+			}
+		default:
+			return m.fail(in, fmt.Errorf("unsupported instruction %s", in.Op))
+		}
+	}
+	return nil
+}
+
+// undefinedMarker is what debug mode renders in place of an undefined value.
+func (e *Env) undefinedMarker(v any) string {
+	name := v.(missingValue).name
+	if name == "" {
+		name = "value"
+	}
+	return e.variableStart + " " + name + ": undefined " + e.variableEnd
+}
+
+// target returns the template target of an extends, include or import:
+// its s operand, or else the value on the stack.
+func (m *machine) target(in instr) any {
+	if in.S != "" {
+		return in.S
+	}
+	return m.pop()
+}
+
+// fail locates err at the instruction that raised it. An error raised in
+// another template keeps its location and gains this call site on its
+// stack.
+func (m *machine) fail(in instr, err error) error {
+	var te *TemplateError
+	if errors.As(err, &te) {
+		if te.Template != m.prog.Name {
+			te.Stack = append(te.Stack, TemplateFrame{Template: m.prog.Name, Line: in.Line})
+		}
+		return te
+	}
+	return &TemplateError{
+		Template: m.prog.Name,
+		Line:     in.Line,
+		Column:   in.Col,
+		Source:   sourceLine(m.prog.source, in.Line),
+		Err:      err,
+	}
+}
+
+// blockCall renders the most derived definition of a block. Blocks are
+// skipped while a child template is still collecting its overrides.
+func (m *machine) blockCall(name string) error {
+	if m.f.run == nil {
+		return m.env.renderBlock(m.out(), []blockRef{{prog: m.prog, unit: m.prog.Blocks[name]}}, 0, m.f)
+	}
+	if m.f.run.parent != nil || m.f.run.skipBlocks {
+		return nil
+	}
+	chain := m.f.run.blocks[name]
+	if len(chain) == 0 {
+		chain = []blockRef{{prog: m.prog, unit: m.prog.Blocks[name]}}
+	}
+	return m.env.renderBlock(m.out(), chain, 0, m.f)
+}
+
+// renderTemplate runs a program, following extends to its parents. Once a
+// parent is known, top-level output is discarded and only the most derived
+// block definitions are rendered by the parent.
+func (e *Env) renderTemplate(w io.Writer, prog *program, f *frame) error {
+	return e.renderTemplateBlock(w, prog, "", f)
+}
+
+// renderTemplateBlock is renderTemplate, except that a non-empty block
+// runs the templates without output and then renders only that block, the
+// way the page would.
+func (e *Env) renderTemplateBlock(w io.Writer, prog *program, block string, f *frame) error {
+	_, err := e.runTemplate(w, prog, block, f)
+	return err
+}
+
+// runTemplate is renderTemplateBlock, and also returns the variables the
+// templates set at their top level. They are set on a copy of f's
+// variables, which are left as they were.
+func (e *Env) runTemplate(w io.Writer, prog *program, block string, f *frame) (map[string]any, error) {
+	run := &templateRun{blocks: map[string][]blockRef{}, skipBlocks: block != ""}
+	out := w
+	if block != "" {
+		out = io.Discard
+	}
+	tf := *f
+	tf.run = run
+	tf.vars = cloneMap(f.vars)
+	seen := map[string]bool{prog.Name: true}
+	// extendedFrom holds the extends sites that led to prog, innermost first.
+	extendedFrom := []TemplateFrame{}
+
+	self := map[string]any{}
+	tf.vars["self"] = self
+
+	for {
+		for name, u := range prog.Blocks {
+			run.blocks[name] = append(run.blocks[name], blockRef{prog: prog, unit: u})
+			if _, ok := self[name]; !ok {
+				self[name] = e.selfBlock(run, name, &tf)
+			}
+		}
+		run.parent = nil
+
+		if err := e.exec(out, prog, 0, &tf); err != nil {
+			var te *TemplateError
+			if errors.As(err, &te) {
+				te.Stack = append(te.Stack, extendedFrom...)
+			}
+			return nil, err
+		}
+		if run.parent == nil {
+			break
+		}
+
+		site := TemplateFrame{Template: prog.Name, Line: run.parentLine}
+		if seen[run.parent.Name] {
+			return nil, newTemplateError(prog.Name, prog.source, run.parentLine, 0, fmt.Errorf("extends cycle detected"))
+		}
+		seen[run.parent.Name] = true
+		extendedFrom = append([]TemplateFrame{site}, extendedFrom...)
+		prog = run.parent
+	}
+	if block == "" {
+		return tf.vars, nil
+	}
+
+	chain := run.blocks[block]
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no block named %q", block)
+	}
+	run.skipBlocks = false
+	return tf.vars, e.renderBlock(w, chain, 0, &tf)
+}
+
+// selfBlock returns self.name(), which renders the most derived definition
+// of the block name again.
+func (e *Env) selfBlock(run *templateRun, name string, f *frame) TemplateFunc {
+	return func(_ []any, _ map[string]any, _ TemplateFunc) (any, error) {
+		if err := f.state.budget.enter(); err != nil {
+			return "", err
+		}
+		defer f.state.budget.leave()
+		var b strings.Builder
+		if err := e.renderBlock(f.state.budget.limit(&b), run.blocks[name], 0, f); err != nil {
+			return "", err
+		}
+		return SafeString(b.String()), nil
+	}
+}
+
+// renderBlock renders chain[i], exposing super() to render chain[i+1].
+func (e *Env) renderBlock(w io.Writer, chain []blockRef, i int, f *frame) error {
+	if def := chain[i].prog.Units[chain[i].unit]; def.Required {
+		return fmt.Errorf("required block %q is not overridden", def.Name)
+	}
+	vars := cloneMap(f.vars)
+	if i+1 < len(chain) {
+		vars["super"] = TemplateFunc(func(_ []any, _ map[string]any, _ TemplateFunc) (any, error) {
+			if err := f.state.budget.enter(); err != nil {
+				return "", err
+			}
+			defer f.state.budget.leave()
+			var b strings.Builder
+			if err := e.renderBlock(f.state.budget.limit(&b), chain, i+1, f); err != nil {
+				return "", err
+			}
+			return SafeString(b.String()), nil
+		})
+	}
+	return e.exec(w, chain[i].prog, chain[i].unit, f.withVars(vars))
+}
+
+// registerMacro binds the macro in unit u as a callable in the frame's
+// variables. The macro body sees the defining scope as it is at call time.
+func (e *Env) registerMacro(prog *program, u int, f *frame) {
+	def := prog.Units[u]
+	f.vars[def.Name] = TemplateFunc(func(args []any, kwargs map[string]any, caller TemplateFunc) (any, error) {
+		if err := f.state.budget.enter(); err != nil {
+			return "", err
+		}
+		defer f.state.budget.leave()
+
+		localVars := cloneMap(f.vars)
+		if err := e.bindMacroArgs(def, args, kwargs, localVars, f); err != nil {
+			return "", err
+		}
+		if caller == nil {
+			caller = func(_ []any, _ map[string]any, _ TemplateFunc) (any, error) {
+				return SafeString(""), nil
+			}
+		}
+		localVars["caller"] = caller
+		var b strings.Builder
+		if err := e.exec(f.state.budget.limit(&b), prog, u, f.withVars(localVars)); err != nil {
+			return "", err
+		}
+		if prog.Autoescape {
+			return SafeString(b.String()), nil
+		}
+		return b.String(), nil
+	})
+}
+
+// callerFunc returns caller() for the body of a call block in unit u. The
+// body renders with the variables of the call site each time it is called.
+func (e *Env) callerFunc(prog *program, u int, f *frame) TemplateFunc {
+	def := prog.Units[u]
+	return func(args []any, kwargs map[string]any, _ TemplateFunc) (any, error) {
+		vars := cloneMap(f.vars)
+		if err := e.bindMacroArgs(def, args, kwargs, vars, f); err != nil {
+			return "", err
+		}
+		var b strings.Builder
+		if err := e.exec(f.state.budget.limit(&b), prog, u, f.withVars(vars)); err != nil {
+			return "", err
+		}
+		return SafeString(b.String()), nil
+	}
+}
+
+// bindMacroArgs binds args and kwargs to the parameters of the macro or
+// caller def in vars, evaluating defaults in frame f. Arguments matching no
+// parameter are collected in varargs and kwargs when def catches them, and
+// are an error otherwise.
+func (e *Env) bindMacroArgs(def unit, args []any, kwargs map[string]any, vars map[string]any, f *frame) error {
+	if len(args) > len(def.Params) && !def.CatchVarargs {
+		return fmt.Errorf("macro %q takes at most %d arguments, got %d", def.Name, len(def.Params), len(args))
+	}
+	known := make(map[string]bool, len(def.Params))
+	for i, p := range def.Params {
+		known[p.Name] = true
+		v, named := kwargs[p.Name]
+		switch {
+		case i < len(args) && named:
+			return fmt.Errorf("macro %q got multiple values for argument %q", def.Name, p.Name)
+		case i < len(args):
+			vars[p.Name] = args[i]
+		case named:
+			vars[p.Name] = v
+		case p.HasDefault:
+			vars[p.Name] = p.defaultValue(&evalScope{env: e, state: f.state, vars: vars, ctx: f.ctx})
+		default:
+			vars[p.Name] = nil
+		}
+	}
+	extra := map[string]any{}
+	for name, v := range kwargs {
+		if known[name] {
+			continue
+		}
+		if !def.CatchKwargs {
+			return fmt.Errorf("macro %q got an unexpected keyword argument %q", def.Name, name)
+		}
+		extra[name] = v
+	}
+	if def.CatchVarargs {
+		varargs := []any{}
+		if len(args) > len(def.Params) {
+			varargs = append(varargs, args[len(def.Params):]...)
+		}
+		vars["varargs"] = varargs
+	}
+	if def.CatchKwargs {
+		vars["kwargs"] = extra
+	}
+	return nil
+}
+
+// importedModule is a template imported during a render, with the context
+// it was imported with, or nil without context. Holding on to ctx keeps
+// another context from reusing its address while the render runs.
+type importedModule struct {
+	ctx  map[string]any
+	vars map[string]any
+}
+
+// loadModule runs the top level of a template without output and returns
+// the macros and variables it defines, except those named _private. Without
+// context the module only sees its own variables. Modules are cached for
+// the rest of the render, so importing in a loop runs the template once.
+// They are not cached on the Env: their macros hold the frame of the render
+// that ran them, with its globals, limits and deadline.
+func (e *Env) loadModule(target any, f *frame, withContext bool) (map[string]any, error) {
+	tpl, err := e.resolveTemplate(target)
+	if err != nil {
+		return nil, err
+	}
+	var ctx map[string]any
+	if withContext {
+		ctx = f.ctx
+	}
+	for _, m := range f.state.modules[tpl.prog] {
+		if sameMap(m.ctx, ctx) {
+			return m.vars, nil
+		}
+	}
+
+	if err := f.state.budget.enter(); err != nil {
+		return nil, err
+	}
+	defer f.state.budget.leave()
+	if err := f.state.enterTemplate(tpl.prog.Name, "import"); err != nil {
+		return nil, err
+	}
+	defer f.state.leaveTemplate()
+	moduleCtx := ctx
+	if moduleCtx == nil {
+		moduleCtx = map[string]any{}
+	}
+	vars := map[string]any{}
+	if err := e.exec(io.Discard, tpl.prog, 0, &frame{state: f.state, ctx: moduleCtx, vars: vars}); err != nil {
+		return nil, err
+	}
+	module := make(map[string]any, len(vars))
+	for name, v := range vars {
+		if !strings.HasPrefix(name, "_") {
+			module[name] = v
+		}
+	}
+	if f.state.modules == nil {
+		f.state.modules = map[*program][]importedModule{}
+	}
+	f.state.modules[tpl.prog] = append(f.state.modules[tpl.prog], importedModule{ctx: ctx, vars: module})
+	return module, nil
+}
+
+// sameMap reports whether a and b are the same map, or both nil.
+func sameMap(a, b map[string]any) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return reflect.ValueOf(a).UnsafePointer() == reflect.ValueOf(b).UnsafePointer()
+}
@@ -4,6 +4,13 @@ export type RenderFromMapRequest = {
   context?: Record<string, any>;
 };
 
+export type RenderCompiledRequest = {
+  template: string;
+  /** Programs written by `nunchucks precompile -ir` (parsed JSON). */
+  programs: any[];
+  context?: Record<string, any>;
+};
+
 export type RenderStringRequest = {
   source: string;
   context?: Record<string, any>;
@@ -11,6 +18,7 @@ export type RenderStringRequest = {
 
 export type WasmRuntime = {
   renderFromMap(request: RenderFromMapRequest): string;
+  renderCompiled(request: RenderCompiledRequest): string;
   renderString(request: RenderStringRequest): string;
   configure(opts?: { files?: Record<string, string> }): {
     render(template: string, context?: Record<string, any>): string;
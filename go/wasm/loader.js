@@ -41,6 +41,8 @@ export async function loadNunchucksWasm({ wasmURL, goURL = "./wasm_exec.js" }) {
   const api = {
     renderFromMap: (request) =>
       parse(globalThis.NunchucksWasm.renderFromMap(JSON.stringify(request))),
+    renderCompiled: (request) =>
+      parse(globalThis.NunchucksWasm.renderCompiled(JSON.stringify(request))),
     renderString: (request) =>
       parse(globalThis.NunchucksWasm.renderString(JSON.stringify(request))),
   };